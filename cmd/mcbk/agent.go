@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Run over SSH by the mcbk of another host, for a profile with agent.ssh
+// naming this one. "mcbk agent stream" writes the world to stdout as a
+// gzipped tar stream, "mcbk agent backup" backs it up here and prints the
+// run's history record as JSON.
+func agentCommand(args []string) {
+	if len(args) == 0 || (args[0] != "stream" && args[0] != "backup") {
+		fmt.Fprintln(os.Stderr, "Usage: mcbk agent stream|backup [flags]")
+		os.Exit(2)
+	}
+	sub, args := args[0], args[1:]
+	fs := newFlagSet("agent " + sub)
+	force := fs.Bool("force", false, "Back up even if skip_idle is set and nobody has played since the last backup, or size_check would fail it")
+	var tags []string
+	fs.Func("tag", "Label the snapshot, e.g. pre-update, so pruning leaves it alone. May be repeated", func(v string) error {
+		if err := mcbk.ValidateTag(v); err != nil {
+			return err
+		}
+		tags = append(tags, v)
+		return nil
+	})
+	comment := fs.String("comment", "", "Note to record with the snapshot, shown by list")
+	reason := fs.String("reason", "", "Why the backup is taken, as for mcbk backup")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+	initLogger()
+
+	servers := mustSelectServers(fs)
+	if len(servers) != 1 {
+		fmt.Fprintln(os.Stderr, "ERROR: mcbk agent works on one server, pick it with -server")
+		os.Exit(2)
+	}
+	s := servers[0]
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch sub {
+	case "stream":
+		//stdout carries the files, so errors only go to stderr
+		if err := s.StreamWorld(ctx, os.Stdout); err != nil {
+			logger.Error("Error streaming the world", "server", s.Name(), "error", err)
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			stop()
+			os.Exit(1)
+		}
+	case "backup":
+		//The other host's mcbk notifies, so only the record is sent back
+		runner := &mcbk.Runner{Force: *force, Tags: tags, Comment: *comment, Reason: *reason, IgnoreWindow: true}
+		json.NewEncoder(os.Stdout).Encode(runner.BackupRecord(ctx, s))
+	}
+}
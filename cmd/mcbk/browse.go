@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Rows of the screen that aren't list rows: the title and column headings
+// above, two lines about the selection, the status and the keys below.
+const BROWSE_CHROME_ROWS = 6
+
+// A file or directory in the part of a snapshot being browsed.
+type browseEntry struct {
+	name  string
+	dir   bool
+	size  int64     //For a directory, of all the files under it
+	files int       //Files under a directory
+	mtime time.Time //For a directory, of the newest file under it
+}
+
+// State of "mcbk browse": the snapshot list, or the files of one snapshot.
+type browser struct {
+	ctx     context.Context
+	servers map[string]*mcbk.Server
+	snaps   []mcbk.Snapshot
+	keys    <-chan string
+
+	snap       *mcbk.Snapshot //Snapshot being browsed, nil on the snapshot list
+	snapCursor int            //Where the cursor was on the snapshot list
+	files      []mcbk.SnapshotFile
+	dir        string //Directory shown within snap, "" for the top
+	entries    []browseEntry
+
+	cursor int
+	offset int    //First row shown, once the rows don't all fit
+	status string //Outcome of the last action
+	prompt string //Question being asked, shown in place of the status
+}
+
+// Lets the snapshots of the selected servers be browsed in a terminal UI,
+// down to single files, and restored or exported from there.
+func browseCommand(args []string) {
+	fs := newFlagSet("browse")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+	initLogger()
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		if info, err := f.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			println("ERROR: browse needs a terminal; use list, restore and export in scripts")
+			os.Exit(2)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	b := &browser{ctx: ctx, servers: map[string]*mcbk.Server{}}
+	for _, s := range mustSelectServers(fs) {
+		list, err := s.Snapshots(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing snapshots for %s: %s\n", s.Name(), err.Error())
+			os.Exit(1)
+		}
+		for i := range list {
+			list[i].Server = s.Name()
+		}
+		b.servers[s.Name()] = s
+		b.snaps = append(b.snaps, list...)
+	}
+	//Newest first, as those are the ones usually wanted
+	slices.SortStableFunc(b.snaps, func(a, b mcbk.Snapshot) int { return b.Time.Compare(a.Time) })
+
+	restoreTerminal, err := rawTerminal()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up the terminal: %s\n", err.Error())
+		os.Exit(1)
+	}
+	//The alternate screen leaves the shell's scrollback as it was
+	fmt.Print("\033[?1049h\033[?25l")
+	defer func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		restoreTerminal()
+	}()
+	b.keys = readKeys()
+	b.run()
+}
+
+// Sends each key press, or escape sequence for keys like the arrows, as
+// read from the terminal.
+func readKeys() <-chan string {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		buf := make([]byte, 32)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				return
+			}
+			keys <- string(buf[:n])
+		}
+	}()
+	return keys
+}
+
+// Handles key presses until q, or until ctx is cancelled.
+func (b *browser) run() {
+	for {
+		b.draw()
+		select {
+		case <-b.ctx.Done():
+			return
+		case k, ok := <-b.keys:
+			if !ok || !b.handle(k) {
+				return
+			}
+		}
+	}
+}
+
+// Acts on a key press, returning false to quit.
+func (b *browser) handle(k string) bool {
+	b.status = ""
+	switch k {
+	case "q":
+		return false
+	case "\x1b[A", "k":
+		b.move(-1)
+	case "\x1b[B", "j":
+		b.move(1)
+	case "\x1b[5~":
+		b.move(-b.pageSize())
+	case "\x1b[6~":
+		b.move(b.pageSize())
+	case "\x1b[H", "g":
+		b.move(-b.rows())
+	case "\x1b[F", "G":
+		b.move(b.rows())
+	case "\r", "\n", "\x1b[C", "l":
+		b.open()
+	case "\x1b", "\x7f", "\b", "\x1b[D", "h":
+		b.back()
+	case "r":
+		b.restore()
+	case "e":
+		b.export()
+	}
+	return true
+}
+
+func (b *browser) rows() int {
+	if b.snap == nil {
+		return len(b.snaps)
+	}
+	return len(b.entries)
+}
+
+func (b *browser) pageSize() int {
+	_, h := terminalSize()
+	return max(h-BROWSE_CHROME_ROWS, 1)
+}
+
+func (b *browser) move(n int) {
+	b.cursor = max(min(b.cursor+n, b.rows()-1), 0)
+}
+
+// Opens the selected snapshot or directory.
+func (b *browser) open() {
+	if b.rows() == 0 {
+		return
+	}
+	if b.snap != nil {
+		if e := b.entries[b.cursor]; e.dir {
+			b.setDir(path.Join(b.dir, e.name), "")
+		}
+		return
+	}
+	snap := b.snaps[b.cursor]
+	b.status = "Listing the files in " + snap.ID + "..."
+	b.draw()
+	files, err := b.servers[snap.Server].SnapshotFiles(b.ctx, snap.ID)
+	if err != nil {
+		b.status = "Error listing files: " + err.Error()
+		return
+	}
+	b.snap, b.snapCursor, b.files = &snap, b.cursor, files
+	b.setDir("", "")
+	b.status = ""
+}
+
+// Goes up a directory, or from the top of a snapshot back to the list.
+func (b *browser) back() {
+	switch {
+	case b.snap == nil:
+	case b.dir == "":
+		b.snap, b.files, b.entries = nil, nil, nil
+		b.cursor, b.offset = b.snapCursor, 0
+	default:
+		parent := path.Dir(b.dir)
+		if parent == "." {
+			parent = ""
+		}
+		b.setDir(parent, path.Base(b.dir))
+	}
+}
+
+// Shows dir within the snapshot, with the cursor on the entry named
+// selected, if any.
+func (b *browser) setDir(dir, selected string) {
+	b.dir, b.entries = dir, entriesIn(b.files, dir)
+	b.cursor, b.offset = 0, 0
+	for i, e := range b.entries {
+		if e.name == selected {
+			b.cursor = i
+		}
+	}
+}
+
+// The files and directories directly in dir, directories first.
+func entriesIn(files []mcbk.SnapshotFile, dir string) []browseEntry {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	var entries []browseEntry
+	index := map[string]int{}
+	for _, f := range files {
+		rest, ok := strings.CutPrefix(f.Path, prefix)
+		if !ok {
+			continue
+		}
+		name, _, isDir := strings.Cut(rest, "/")
+		i, ok := index[name]
+		if !ok {
+			i = len(entries)
+			index[name] = i
+			entries = append(entries, browseEntry{name: name, dir: isDir})
+		}
+		e := &entries[i]
+		e.size += f.Size
+		e.files++
+		if f.ModTime.After(e.mtime) {
+			e.mtime = f.ModTime
+		}
+	}
+	slices.SortFunc(entries, func(a, b browseEntry) int {
+		if a.dir != b.dir {
+			if a.dir {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	return entries
+}
+
+// The server of the snapshot selected or being browsed.
+func (b *browser) selected() (*mcbk.Server, mcbk.Snapshot) {
+	if b.snap != nil {
+		return b.servers[b.snap.Server], *b.snap
+	}
+	snap := b.snaps[b.cursor]
+	return b.servers[snap.Server], snap
+}
+
+// Restores the selected file or directory in place, or a whole snapshot
+// into a directory picked at a prompt, once confirmed.
+func (b *browser) restore() {
+	if b.rows() == 0 {
+		return
+	}
+	s, snap := b.selected()
+	var paths []string
+	target := ""
+	if b.snap == nil {
+		dir := s.Config().MinecraftDir
+		var ok bool
+		target, ok = b.ask("Restore the whole snapshot into: ", dir+"-restored")
+		if !ok || target == "" {
+			return
+		}
+		if !b.confirm(fmt.Sprintf("Restore %s into %s?", snap.ID, target)) {
+			return
+		}
+	} else {
+		p := path.Join(b.dir, b.entries[b.cursor].name)
+		if !b.confirm(fmt.Sprintf("Put %s from %s back into %s, replacing the current files?", p, snap.ID, s.Config().MinecraftDir)) {
+			return
+		}
+		paths = []string{p}
+	}
+	b.status = "Restoring..."
+	b.draw()
+	if _, err := s.Restore(b.ctx, snap.ID, paths, target, false); err != nil {
+		b.status = "Error restoring: " + err.Error()
+		return
+	}
+	b.status = fmt.Sprintf("Restored %s into %s", describePaths(paths, snap.ID), cmpOr(target, s.Config().MinecraftDir))
+}
+
+// Exports the selected snapshot, file or directory to an archive named at
+// a prompt, zip unless the name ends in .tar.gz.
+func (b *browser) export() {
+	if b.rows() == 0 {
+		return
+	}
+	s, snap := b.selected()
+	var paths []string
+	if b.snap != nil {
+		paths = []string{path.Join(b.dir, b.entries[b.cursor].name)}
+	}
+	file, ok := b.ask("Export to: ", defaultExportPath(s, snap.ID, "zip"))
+	if !ok || file == "" {
+		return
+	}
+	format := "zip"
+	if strings.HasSuffix(file, ".tar.gz") {
+		format = "tar.gz"
+	}
+	b.status = "Exporting..."
+	b.draw()
+	file, err := export(b.ctx, s, snap.ID, file, mcbk.ExportOptions{Format: format, Paths: paths})
+	if err != nil {
+		b.status = "Error exporting: " + err.Error()
+		return
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	b.status = fmt.Sprintf("Exported %s to %s", describePaths(paths, snap.ID), file)
+}
+
+// The paths acted on, or the snapshot if that was all of it.
+func describePaths(paths []string, id string) string {
+	if len(paths) == 0 {
+		return id
+	}
+	return strings.Join(paths, ", ")
+}
+
+// Asks for a line of text, starting from def. ok is false if it was
+// cancelled with Escape.
+func (b *browser) ask(question, def string) (answer string, ok bool) {
+	defer func() { b.prompt = "" }()
+	answer = def
+	for {
+		b.prompt = question + answer + "_"
+		b.draw()
+		var k string
+		select {
+		case <-b.ctx.Done():
+			return "", false
+		case k, ok = <-b.keys:
+			if !ok {
+				return "", false
+			}
+		}
+		switch {
+		case k == "\r" || k == "\n":
+			return strings.TrimSpace(answer), true
+		case k == "\x1b":
+			return "", false
+		case k == "\x7f" || k == "\b":
+			if _, size := utf8.DecodeLastRuneInString(answer); size > 0 {
+				answer = answer[:len(answer)-size]
+			}
+		case !strings.ContainsFunc(k, unicode.IsControl):
+			answer += k
+		}
+	}
+}
+
+// Asks a yes or no question, taking anything but y as no.
+func (b *browser) confirm(question string) bool {
+	defer func() { b.prompt = "" }()
+	b.prompt = question + " [y/N]"
+	b.draw()
+	select {
+	case <-b.ctx.Done():
+		return false
+	case k := <-b.keys:
+		return k == "y" || k == "Y"
+	}
+}
+
+// Redraws the whole screen.
+func (b *browser) draw() {
+	w, h := terminalSize()
+	page := max(h-BROWSE_CHROME_ROWS, 1)
+	if b.cursor < b.offset {
+		b.offset = b.cursor
+	}
+	if b.cursor >= b.offset+page {
+		b.offset = b.cursor - page + 1
+	}
+
+	var title, detail1, detail2, keys string
+	var rows []string
+	if b.snap == nil {
+		title = fmt.Sprintf("mcbk browse: %d snapshots", len(b.snaps))
+		rows = table("TIME\tSERVER\tID\tSIZE\tTAGS\tCOMMENT", len(b.snaps), func(i int) string {
+			s := b.snaps[i]
+			size := "-"
+			if s.Size > 0 {
+				size = "~" + mcbk.FormatBytes(s.Size)
+			}
+			return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s", s.Time.Format("2006-01-02 15:04:05"), s.Server, s.ID, size, strings.Join(s.Tags, ","), s.Comment)
+		})
+		if len(b.snaps) > 0 {
+			s := b.snaps[b.cursor]
+			detail1 = fmt.Sprintf("%s of %s, taken %s ago", s.ID, s.Server, formatAge(time.Since(s.Time)))
+			detail2 = "Repo: " + cmpOr(s.Repo, "-") + "  Branch: " + cmpOr(s.Branch, "-") + "  Tags: " + cmpOr(strings.Join(s.Tags, ", "), "-") + "  Comment: " + cmpOr(s.Comment, "-")
+		} else {
+			detail1 = "There are no snapshots yet."
+		}
+		keys = "up/down move  enter open  r restore  e export  q quit"
+	} else {
+		title = fmt.Sprintf("mcbk browse: %s of %s: /%s", b.snap.ID, b.snap.Server, b.dir)
+		rows = table("NAME\tSIZE\tMODIFIED\tFILES", len(b.entries), func(i int) string {
+			e := b.entries[i]
+			if e.dir {
+				return fmt.Sprintf("%s/\t%s\t%s\t%d", e.name, mcbk.FormatBytes(e.size), e.mtime.Format("2006-01-02 15:04:05"), e.files)
+			}
+			return fmt.Sprintf("%s\t%s\t%s\t", e.name, mcbk.FormatBytes(e.size), e.mtime.Format("2006-01-02 15:04:05"))
+		})
+		if len(b.entries) > 0 {
+			e := b.entries[b.cursor]
+			detail1 = path.Join(b.dir, e.name)
+			if e.dir {
+				files := "files"
+				if e.files == 1 {
+					files = "file"
+				}
+				detail2 = fmt.Sprintf("Directory of %d %s, %s, last modified %s", e.files, files, mcbk.FormatBytes(e.size), e.mtime.Format("2006-01-02 15:04:05"))
+			} else {
+				detail2 = fmt.Sprintf("%s (%d bytes), modified %s", mcbk.FormatBytes(e.size), e.size, e.mtime.Format("2006-01-02 15:04:05"))
+			}
+		}
+		keys = "up/down move  enter open  left back  r restore  e export  q quit"
+	}
+
+	var out strings.Builder
+	out.WriteString("\033[H")
+	line := func(s string, style string) {
+		s = fit(s, w)
+		if style != "" {
+			s = style + s + strings.Repeat(" ", w-utf8.RuneCountInString(s)) + "\033[0m"
+		}
+		out.WriteString(s + "\033[K\r\n")
+	}
+	line(title, "\033[1m")
+	line(rows[0], "\033[4m")
+	for i := b.offset; i < b.offset+page; i++ {
+		switch {
+		case i >= len(rows)-1:
+			line("", "")
+		case i == b.cursor:
+			line(rows[i+1], "\033[7m")
+		default:
+			line(rows[i+1], "")
+		}
+	}
+	line(detail1, "")
+	line(detail2, "")
+	if b.prompt != "" {
+		line(b.prompt, "\033[1m")
+	} else {
+		line(b.status, "")
+	}
+	out.WriteString(fit(keys, w) + "\033[K\033[J")
+	fmt.Print(out.String())
+}
+
+// Lays out n rows made by row, tab-separated, under header.
+func table(header string, n int, row func(i int) string) []string {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	for i := range n {
+		fmt.Fprintln(tw, row(i))
+	}
+	tw.Flush()
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+// Cuts s to at most w cells, taking each rune as one.
+func fit(s string, w int) string {
+	if utf8.RuneCountInString(s) <= w {
+		return s
+	}
+	return string([]rune(s)[:max(w-1, 0)]) + "~"
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Runs continuously, backing up each selected server every interval and
+// serving metrics and the API, until SIGINT/SIGTERM.
+func daemonCommand(args []string) {
+	fs := newFlagSet("daemon")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+
+	initLogger()
+	notifiers, err := mcbk.NewNotifiers(config.Notify)
+	if err != nil {
+		logger.Error("Error setting up notifications", "error", err)
+		os.Exit(1)
+	}
+	//Daemon mode always covers every server unless told otherwise
+	if fs.Lookup("server").Value.String() == "" {
+		fs.Set("all", "true")
+	}
+	servers := mustSelectServers(fs)
+	for _, s := range servers {
+		s.SetDaemon()
+	}
+	metrics := mcbk.NewMetrics()
+	runner := &mcbk.Runner{Notifiers: notifiers, Metrics: metrics, MQTT: mcbk.NewMQTTPublisher(config.MQTT), Tracer: mcbk.NewTracer(config.Tracing), Slots: make(chan struct{}, config.Concurrency)}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var api *mcbk.API
+	var httpServer *http.Server
+	if config.Daemon.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", metrics)
+		if config.Daemon.APIToken != "" || config.Daemon.Dashboard.Enabled {
+			api = mcbk.NewAPI(ctx, config.Daemon.APIToken, runner, servers, logger)
+			if dash := config.Daemon.Dashboard; dash.Username != "" {
+				api.AllowBasicAuth(dash.Username, dash.Password)
+			}
+			if config.Daemon.RestoreDir != "" {
+				api.AllowRestoreDir(config.Daemon.RestoreDir)
+			}
+			api.Register(mux)
+			if config.Daemon.Dashboard.Enabled {
+				api.RegisterDashboard(mux)
+			}
+		}
+		httpServer = &http.Server{Addr: config.Daemon.Listen, Handler: mux}
+		go func() {
+			err := httpServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("HTTP server failed", "listen", config.Daemon.Listen, "error", err)
+				stop()
+			}
+		}()
+	}
+
+	logger.Info("Daemon started", "servers", len(servers), "listen", config.Daemon.Listen, "api", api != nil, "dashboard", api != nil && config.Daemon.Dashboard.Enabled)
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warn("Error notifying systemd", "error", err)
+	}
+	go sdWatchdog(ctx)
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		metrics.Register(s.Name())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			schedule(ctx, runner, s)
+		}()
+		if s.Config().Watchdog.Enabled() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runner.WatchOverdue(ctx, s)
+			}()
+		}
+		if s.Config().ChatTrigger.Enabled() {
+			trigger := mcbk.NewChatTrigger(runner, s)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				trigger.Run(ctx)
+			}()
+		}
+	}
+	if config.Daemon.Telegram.BotToken != "" {
+		bot := mcbk.NewTelegramBot(config.Daemon.Telegram, runner, servers, logger)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bot.Run(ctx)
+		}()
+	}
+	wg.Wait()
+	if api != nil {
+		api.Wait()
+	}
+	sdNotify("STOPPING=1")
+
+	if httpServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}
+	logger.Info("Daemon stopped")
+	//So a supervisor sees that shutting down cut a backup short
+	for _, s := range servers {
+		if s.Interrupted() {
+			os.Exit(1)
+		}
+	}
+}
+
+// Backs up the server now and then every interval, or as the activity
+// schedule says, until ctx is done. A run due outside backup_window waits
+// for the window to open. The next run is recorded for "mcbk status".
+func schedule(ctx context.Context, r *mcbk.Runner, s *mcbk.Server) {
+	defer s.RecordNextRun(time.Time{})
+	for {
+		if next := s.Config().BackupWindow.NextAllowed(time.Now()); time.Until(next) > 0 {
+			logger.Info("Outside the backup window, waiting", "server", s.Name(), "until", next)
+			s.RecordNextRun(next)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(next)):
+			}
+		}
+		r.Backup(ctx, s)
+		if !waitForNextRun(ctx, s) {
+			return
+		}
+	}
+}
+
+// Waits until the next backup is due, returning false if ctx is done first.
+// With an activity schedule that is idle_interval after the last one, and
+// the server is polled meanwhile; once players are seen online it is
+// brought forward to active_interval after the last one.
+func waitForNextRun(ctx context.Context, s *mcbk.Server) bool {
+	conf := s.Config()
+	last := time.Now()
+	next := last.Add(conf.Interval.Duration)
+	var poll <-chan time.Time
+	if conf.Activity.Enabled() {
+		next = last.Add(conf.Activity.IdleInterval.Duration)
+		ticker := time.NewTicker(conf.Activity.PollInterval.Duration)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	logger.Debug("Next backup scheduled", "server", s.Name(), "at", next)
+	s.RecordNextRun(next)
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case <-poll:
+			players, err := s.PlayersOnline(ctx)
+			if err != nil {
+				logger.Debug("Error checking for players online", "server", s.Name(), "error", err)
+				continue
+			}
+			if active := last.Add(conf.Activity.ActiveInterval.Duration); players > 0 && active.Before(next) {
+				next = active
+				logger.Info("Players online, backing up more often", "server", s.Name(), "players", players, "at", next)
+				s.RecordNextRun(next)
+				timer.Reset(time.Until(next))
+			}
+		}
+	}
+}
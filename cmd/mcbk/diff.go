@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Reports which files were added, removed or changed between two snapshots.
+func diffCommand(args []string) {
+	fs := newFlagSet("diff")
+	list := fs.Bool("list", false, "List every added, removed and changed file")
+	asJSON := fs.Bool("json", false, "Print the full diff as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mcbk diff [flags] <older snapshot> <newer snapshot>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	mustLoadConfig(fs)
+
+	servers := mustSelectServers(fs)
+	if len(servers) != 1 {
+		println("ERROR: diff compares snapshots of a single server, pick one with -server")
+		os.Exit(1)
+	}
+	s := servers[0]
+	diff, err := s.DiffSnapshots(context.Background(), fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error comparing snapshots: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(diff)
+		return
+	}
+	if *list {
+		for _, c := range []struct {
+			mark  string
+			files []mcbk.SnapshotFile
+		}{{"+", diff.Added}, {"-", diff.Removed}, {"M", diff.Changed}} {
+			for _, f := range c.files {
+				fmt.Printf("%s %s\n", c.mark, f.Path)
+			}
+		}
+		fmt.Println()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, c := range []struct {
+		name  string
+		files []mcbk.SnapshotFile
+	}{{"added", diff.Added}, {"removed", diff.Removed}, {"changed", diff.Changed}} {
+		var size int64
+		for _, f := range c.files {
+			size += f.Size
+		}
+		fmt.Fprintf(w, "%s\t%d files\t%s\n", c.name, len(c.files), mcbk.FormatBytes(size))
+	}
+	w.Flush()
+}
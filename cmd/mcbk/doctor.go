@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Checks the config and everything each server's backups rely on, and
+// says how to fix whatever is wrong. Exits 1 if any check failed.
+func doctorCommand(args []string) {
+	fs := newFlagSet("doctor")
+	fs.Parse(args)
+	path := fs.Lookup("config").Value.String()
+	if err := loadConfig(fs); err != nil {
+		printDiagnosis(mcbk.Diagnosis{Check: "config", Status: "fail", Detail: err.Error(), Fix: "correct the settings named above, see mcbk.example.toml for each one; run \"mcbk init\" to write a new config"})
+		os.Exit(1)
+	}
+	printDiagnosis(mcbk.Diagnosis{Check: "config", Status: "ok", Detail: path + " is valid"})
+
+	//Like status, covering every server unless told otherwise
+	if fs.Lookup("server").Value.String() == "" {
+		fs.Set("all", "true")
+	}
+	servers := mustSelectServers(fs)
+	diags := make([][]mcbk.Diagnosis, len(servers))
+	//Unreachable servers each take up to verify_timeout, so check them all at once
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Close()
+			diags[i] = s.Doctor(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	failed := false
+	for i, s := range servers {
+		fmt.Println()
+		fmt.Println(s.Name())
+		for _, d := range diags[i] {
+			printDiagnosis(d)
+			failed = failed || d.Status == "fail"
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func printDiagnosis(d mcbk.Diagnosis) {
+	fmt.Printf("  %-4s  %-18s  %s\n", strings.ToUpper(d.Status), d.Check, d.Detail)
+	if d.Fix != "" {
+		fmt.Printf("  %-4s  %-18s  Fix: %s\n", "", "", d.Fix)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Packages a snapshot into a single archive, e.g. to hand a world to
+// players or open it in singleplayer.
+func exportCommand(args []string) {
+	fs := newFlagSet("export")
+	format := fs.String("format", "zip", "Archive format, "+strings.Join(mcbk.ExportFormats, " or "))
+	output := fs.String("o", "", "File to write, default <server>-<snapshot>.<format> in the current directory; - for stdout")
+	var paths stringList
+	fs.Var(&paths, "path", "File or directory to export, relative to minecraft_dir, e.g. world (repeatable)")
+	strip := fs.Bool("strip-server-files", false, "Leave out session.lock, ops.json, the whitelist and ban lists")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mcbk export [flags] <snapshot|latest>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	mustLoadConfig(fs)
+	initLogger()
+
+	servers := mustSelectServers(fs)
+	if len(servers) != 1 {
+		println("ERROR: export works on a single server, pick one with -server")
+		os.Exit(1)
+	}
+	s := servers[0]
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	id, err := s.ResolveSnapshot(ctx, fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting: %s\n", err.Error())
+		os.Exit(1)
+	}
+	opts := mcbk.ExportOptions{Format: *format, Paths: paths, StripServerFiles: *strip}
+	path, err := export(ctx, s, id, *output, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if path != "-" {
+		fmt.Fprintf(os.Stderr, "Exported %s to %s\n", id, path)
+	}
+}
+
+// Writes the archive into a hidden file next to path and renames it into
+// place once complete, so a failed export leaves no partial archive.
+// Returns the path written, which defaults to defaultExportPath.
+func export(ctx context.Context, s *mcbk.Server, id, path string, opts mcbk.ExportOptions) (string, error) {
+	if path == "-" {
+		return path, s.ExportSnapshot(ctx, id, os.Stdout, opts)
+	}
+	if path == "" {
+		path = defaultExportPath(s, id, opts.Format)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".mcbk-export-")
+	if err != nil {
+		return path, err
+	}
+	defer os.Remove(f.Name())
+	err = s.ExportSnapshot(ctx, id, f, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return path, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return path, err
+	}
+	return path, nil
+}
+
+// <server>-<snapshot>.<format> in the current directory.
+func defaultExportPath(s *mcbk.Server, id, format string) string {
+	//Snapshot IDs may contain slashes, e.g. bup's, or end in the
+	//archive's own extension, e.g. tar's
+	name, _, _ := strings.Cut(id, ".")
+	name = strings.NewReplacer("/", "-", "\\", "-", ":", "-").Replace(s.Name() + "-" + name)
+	return name + "." + format
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Flags that override individual config file settings. Precedence, from
+// lowest to highest, is: built-in defaults, the config file, then any of
+// these flags that were given explicitly on the command line.
+var configFlags = []struct {
+	name  string
+	usage string
+	apply func(c *mcbk.Config, value string) error
+}{
+	{"root", "Path to save backups in (backup_root)", func(c *mcbk.Config, v string) error {
+		c.BackupRoot = v
+		return nil
+	}},
+	{"prefix", "Prefix for backup dir names (backup_dir_prefix)", func(c *mcbk.Config, v string) error {
+		c.BackupDirPrefix = v
+		return nil
+	}},
+	{"branch", "Branch name to use with bup (bup_branch)", func(c *mcbk.Config, v string) error {
+		c.BupBranchName = v
+		return nil
+	}},
+	{"log", "Path to mcbk's own logfile (log_path)", func(c *mcbk.Config, v string) error {
+		c.LogPath = v
+		return nil
+	}},
+	{"log-format", "Log format, text or json (log_format)", func(c *mcbk.Config, v string) error {
+		c.LogFormat = v
+		return nil
+	}},
+	{"log-output", "Where logs go: file, syslog or journald (log_output)", func(c *mcbk.Config, v string) error {
+		c.LogOutput = v
+		return nil
+	}},
+	{"concurrency", "How many servers to back up at once (concurrency)", func(c *mcbk.Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Concurrency = n
+		return err
+	}},
+	{"transport", "Command transport: screen, tmux, rcon, stdin, process, pterodactyl, docker, mark2, msm or amp (transport)", func(c *mcbk.Config, v string) error {
+		c.Transport = v
+		return nil
+	}},
+	{"session", "Screen session the server runs in (screen_session)", func(c *mcbk.Config, v string) error {
+		c.ScreenSession = v
+		return nil
+	}},
+	{"tmux-session", "Tmux session the server runs in (tmux.session)", func(c *mcbk.Config, v string) error {
+		c.Tmux.Session = v
+		return nil
+	}},
+	{"rcon-host", "RCON host (rcon.host)", func(c *mcbk.Config, v string) error {
+		c.RCON.Host = v
+		return nil
+	}},
+	{"rcon-port", "RCON port (rcon.port)", func(c *mcbk.Config, v string) error {
+		port, err := strconv.Atoi(v)
+		c.RCON.Port = port
+		return err
+	}},
+	{"stdin-pipe", "Pipe feeding the server console for the stdin transport (stdin.path)", func(c *mcbk.Config, v string) error {
+		c.Stdin.Path = v
+		return nil
+	}},
+	{"mclog", "Path to the minecraft server log (minecraft_log_path)", func(c *mcbk.Config, v string) error {
+		c.MinecraftLogPath = v
+		return nil
+	}},
+	{"mcdir", "The directory to be backed up (minecraft_dir)", func(c *mcbk.Config, v string) error {
+		c.MinecraftDir = v
+		return nil
+	}},
+	{"worlds", "Comma-separated paths under minecraft_dir to back up, or auto for every world (worlds)", func(c *mcbk.Config, v string) error {
+		c.Worlds = strings.Split(v, ",")
+		return nil
+	}},
+	{"include", "Comma-separated glob patterns for paths under minecraft_dir to back up (include)", func(c *mcbk.Config, v string) error {
+		c.Include = strings.Split(v, ",")
+		return nil
+	}},
+	{"timeout", "Command verification timeout, e.g. 30s (verify_timeout)", func(c *mcbk.Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.VerifyTimeout.Duration = d
+		return err
+	}},
+	{"lock-wait", "How long to wait for a running backup to finish, e.g. 10m (lock_wait)", func(c *mcbk.Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.LockWait.Duration = d
+		return err
+	}},
+	{"free-space-margin", "Space to leave free on the backup disk, e.g. 1GiB (free_space_margin)", func(c *mcbk.Config, v string) error {
+		b, err := mcbk.ParseByteSize(v)
+		c.FreeSpaceMargin = b
+		return err
+	}},
+}
+
+// Registers the override flags on fs. Values are only recorded here; they
+// are applied by applyConfigFlags once the config file has been read.
+func registerConfigFlags(fs *flag.FlagSet) {
+	for _, f := range configFlags {
+		fs.String(f.name, "", f.usage)
+	}
+}
+
+// Applies every override flag that was explicitly set on the command line.
+func applyConfigFlags(fs *flag.FlagSet, c *mcbk.Config) error {
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range configFlags {
+			if f.name == fl.Name && err == nil {
+				if e := f.apply(c, fl.Value.String()); e != nil {
+					err = fmt.Errorf("-%s: %w", f.name, e)
+				}
+			}
+		}
+	})
+	return err
+}
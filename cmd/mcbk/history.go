@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Prints the recorded backup runs, newest last.
+func historyCommand(args []string) {
+	fs := newFlagSet("history")
+	asJSON := fs.Bool("json", false, "Print the records as JSON")
+	limit := fs.Int("n", 20, "Show only the last n runs, 0 for all")
+	status := fs.String("status", "", "Only show runs with this status: success, failure, cancelled or skipped")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+
+	//Like list, covering every server unless told otherwise
+	if fs.Lookup("server").Value.String() == "" {
+		fs.Set("all", "true")
+	}
+	servers := mustSelectServers(fs)
+	var records []mcbk.HistoryRecord
+	for _, s := range servers {
+		list, err := s.History()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading history for %s: %s\n", s.Name(), err.Error())
+			os.Exit(1)
+		}
+		for _, r := range list {
+			if *status == "" || r.Status == *status {
+				records = append(records, r)
+			}
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Start.Before(records[j].Start)
+	})
+	if *limit > 0 && len(records) > *limit {
+		records = records[len(records)-*limit:]
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if records == nil {
+			records = []mcbk.HistoryRecord{}
+		}
+		enc.Encode(records)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tSTART\tDURATION\tSTATUS\tSNAPSHOT\tSIZE\tERROR")
+	for _, r := range records {
+		snapshot, size := "-", "-"
+		if r.Snapshot != "" {
+			snapshot = r.Snapshot
+		}
+		if r.Bytes > 0 {
+			size = mcbk.FormatBytes(r.Bytes)
+		}
+		msg := r.Error
+		if r.Phase != "" {
+			msg = r.Phase + ": " + msg
+		}
+		if r.ReplicationError != "" {
+			msg = "replicate: " + r.ReplicationError
+		}
+		if r.SourceCorrupt != "" {
+			msg = strings.TrimPrefix(msg+"; "+r.SourceCorrupt, "; ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Server, r.Start.Format("2006-01-02 15:04:05"),
+			r.End.Sub(r.Start).Round(time.Second), r.Status, snapshot, size, msg)
+	}
+	w.Flush()
+}
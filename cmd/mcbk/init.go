@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Where init looks for a server when not run from inside one.
+var serverDirCandidates = []string{"/srv/minecraft", "/opt/minecraft", "/var/lib/minecraft", "~/minecraft", "~/server"}
+
+// Asks questions on stdin, offering a default for each.
+type prompter struct {
+	in       *bufio.Reader
+	defaults bool //Take every default without asking
+}
+
+// Asks a question and returns the answer, or def if it was left blank.
+func (p *prompter) ask(question, def string) string {
+	if p.defaults {
+		fmt.Printf("%s: %s\n", question, def)
+		return def
+	}
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && line == "" {
+		//Out of input, e.g. stdin closed: use the default rather than loop
+		fmt.Println()
+		return def
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+// Asks until the answer is one of options.
+func (p *prompter) choose(question string, options []string, def string) string {
+	for {
+		answer := p.ask(fmt.Sprintf("%s (%s)", question, strings.Join(options, ", ")), def)
+		if slices.Contains(options, answer) {
+			return answer
+		}
+		fmt.Printf("Please answer one of: %s\n", strings.Join(options, ", "))
+	}
+}
+
+func (p *prompter) confirm(question string, def bool) bool {
+	d := "n"
+	if def {
+		d = "y"
+	}
+	return strings.HasPrefix(strings.ToLower(p.ask(question+" (y/n)", d)), "y")
+}
+
+// Walks a new user through writing a config file, filling in as much as
+// possible from the server's own files.
+func initCommand(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	path := fs.String("config", mcbk.DEFAULT_CONFIG_PATH, "Where to write the config file")
+	yes := fs.Bool("yes", false, "Accept every suggested answer without asking")
+	fs.Parse(args)
+	p := &prompter{in: bufio.NewReader(os.Stdin), defaults: *yes}
+
+	fmt.Println("This sets up a config file for mcbk. Press enter to accept the suggestion in brackets.")
+	fmt.Println()
+	dir := expandHome(p.ask("Minecraft server directory", findServerDir()))
+	dir, _ = filepath.Abs(dir)
+	props, err := mcbk.ReadServerProperties(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading server.properties: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if len(props) == 0 {
+		fmt.Printf("Note: no server.properties in %s, so nothing could be read from it.\n", dir)
+	} else {
+		fmt.Printf("Found a server with level-name %q.\n", cmpOr(props["level-name"], "world"))
+	}
+	flavor := p.choose("Server software", []string{"vanilla", "spigot", "paper", "fabric", "forge", mcbk.BEDROCK_FLAVOR}, mcbk.DetectFlavor(dir))
+	bedrock := flavor == mcbk.BEDROCK_FLAVOR
+
+	var b strings.Builder
+	b.WriteString("# Written by \"mcbk init\". See mcbk.example.toml for every other setting.\n\n")
+	writeSetting(&b, "minecraft_dir", dir)
+	if bedrock {
+		//Bedrock only prints to its console
+		writeSetting(&b, "minecraft_log_path", expandHome(p.ask("File the server's console output is copied to (e.g. with tee)", filepath.Join(dir, "console.log"))))
+	} else {
+		writeSetting(&b, "minecraft_log_path", filepath.Join(dir, "logs", "latest.log"))
+	}
+	writeSetting(&b, "server_flavor", flavor)
+
+	root := expandHome(p.ask("Directory to store backups in", defaultBackupRoot(dir)))
+	root, _ = filepath.Abs(root)
+	writeSetting(&b, "backup_root", root)
+	if flavor == "spigot" || flavor == "paper" {
+		if p.confirm("Back up only the worlds (world, world_nether, world_the_end, ...) rather than the whole server directory?", false) {
+			b.WriteString("worlds = [\"auto\"]\n")
+		}
+	}
+
+	backends, transports := []string{"dedup", "bup", "restic", "borg", "tar"}, []string{"rcon", "screen", "tmux", "stdin", "process", "pterodactyl", "docker", "mark2", "msm", "amp"}
+	if bedrock {
+		//mark2 and msm only run Java servers
+		backends, transports = slices.DeleteFunc(backends, func(s string) bool { return s == "restic" }), slices.DeleteFunc(transports[1:], func(s string) bool { return s == "mark2" || s == "msm" })
+	}
+	backend := p.choose("Backup engine", backends, mcbk.DEFAULT_BACKEND)
+	writeSetting(&b, "backend", backend)
+	transport := p.choose("How to send commands to the server", transports, defaultTransport(props, bedrock))
+	writeSetting(&b, "transport", transport)
+	b.WriteString("\n")
+
+	switch transport {
+	case "rcon":
+		if props["enable-rcon"] != "true" {
+			fmt.Println("Note: set enable-rcon=true, rcon.port and rcon.password in server.properties and restart the server.")
+		}
+		b.WriteString("[rcon]\n")
+		writeSetting(&b, "host", "localhost")
+		port, err := strconv.Atoi(p.ask("RCON port", cmpOr(props["rcon.port"], "25575")))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: the RCON port must be a number")
+			os.Exit(1)
+		}
+		fmt.Fprintf(&b, "port = %d\n", port)
+		if props["rcon.password"] != "" {
+			fmt.Println("Using rcon.password from server.properties.")
+			writeSetting(&b, "password", props["rcon.password"])
+		} else {
+			writeSetting(&b, "password", p.ask("RCON password", ""))
+		}
+	case "screen":
+		writeSetting(&b, "screen_session", p.ask("screen session the server runs in", "minecraft"))
+	case "tmux":
+		b.WriteString("[tmux]\n")
+		writeSetting(&b, "session", p.ask("tmux session the server runs in", "minecraft"))
+	case "stdin":
+		b.WriteString("[stdin]\n")
+		writeSetting(&b, "path", p.ask("Named pipe feeding the server console", filepath.Join(dir, "console.in")))
+	case "process":
+		b.WriteString("[process]\n")
+		start := "java -Xmx4G -jar server.jar nogui"
+		if bedrock {
+			start = "./bedrock_server"
+		}
+		command := strings.Fields(p.ask("Command that starts the server, run by \"mcbk run\"", start))
+		quoted := make([]string, len(command))
+		for i, arg := range command {
+			quoted[i] = strconv.Quote(arg)
+		}
+		fmt.Fprintf(&b, "command = [%s]\n", strings.Join(quoted, ", "))
+	case "pterodactyl":
+		b.WriteString("[pterodactyl]\n")
+		writeSetting(&b, "url", p.ask("Panel address", "https://panel.example.com"))
+		writeSetting(&b, "api_key", p.ask("Client API key (ptlc_..., from Account > API Credentials)", ""))
+		writeSetting(&b, "server", p.ask("Server identifier, as in its panel URL", ""))
+	case "docker":
+		b.WriteString("[docker]\n")
+		writeSetting(&b, "container", p.ask("Container the server runs in", "mc"))
+		if bedrock {
+			//Bedrock images have no rcon-cli
+			writeSetting(&b, "mode", "attach")
+		} else {
+			writeSetting(&b, "mode", p.choose("Send commands with rcon-cli in the container (exec) or write to its console (attach)", []string{"exec", "attach"}, "exec"))
+		}
+	case "mark2":
+		b.WriteString("[mark2]\n")
+		writeSetting(&b, "name", p.ask("Server name given to mark2 start (empty if it runs only one)", ""))
+	case "msm":
+		b.WriteString("[msm]\n")
+		writeSetting(&b, "server", p.ask("Name of the server in msm", filepath.Base(dir)))
+	case "amp":
+		b.WriteString("[amp]\n")
+		writeSetting(&b, "url", p.ask("AMP address", "http://localhost:8080"))
+		writeSetting(&b, "instance", p.ask("Instance ID or name, if that is the ADS controller (empty for the instance itself)", ""))
+		writeSetting(&b, "username", p.ask("AMP user", "admin"))
+		writeSetting(&b, "password", p.ask("AMP password (shown as you type)", ""))
+	}
+
+	switch backend {
+	case "restic":
+		b.WriteString("\n[restic]\n")
+		writeSetting(&b, "repository", p.ask("restic repository", filepath.Join(root, "restic")))
+		writeSetting(&b, "password", p.ask("restic repository password (shown as you type)", ""))
+	case "borg":
+		b.WriteString("\n[borg]\n")
+		writeSetting(&b, "repository", p.ask("borg repository", filepath.Join(root, "borg")))
+		writeSetting(&b, "passphrase", p.ask("borg passphrase (shown as you type)", ""))
+	}
+
+	*path = expandHome(p.ask("Where to save this config", *path))
+	if _, err := os.Stat(*path); err == nil && !p.confirm(*path+" already exists. Overwrite it?", false) {
+		fmt.Println("Nothing written.")
+		os.Exit(1)
+	}
+	//The config may hold passwords
+	if err := os.WriteFile(*path, []byte(b.String()), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing config: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("Wrote", *path)
+
+	c, err := mcbk.LoadConfig(*path, true, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "The config doesn't load yet, please fix it by hand: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(root, 0770); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating %s: %s\n", root, err.Error())
+		os.Exit(1)
+	}
+	//mcbk only appends to its log, so it must exist
+	if f, err := os.OpenFile(c.LogPath, os.O_CREATE|os.O_WRONLY, 0600); err == nil {
+		f.Close()
+	}
+	fmt.Println()
+	fmt.Printf("All set. Run \"mcbk -config %s\" to take a first backup, then schedule it with cron\n", *path)
+	fmt.Printf("or \"mcbk install-systemd -config %s\".\n", *path)
+}
+
+// Writes a key = "value" line.
+func writeSetting(b *strings.Builder, key, value string) {
+	fmt.Fprintf(b, "%s = %s\n", key, strconv.Quote(value))
+}
+
+// The current directory if it holds a server, or else the first of the
+// usual places that does.
+func findServerDir() string {
+	cwd, _ := os.Getwd()
+	for _, dir := range append([]string{cwd}, serverDirCandidates...) {
+		dir = expandHome(dir)
+		if _, err := os.Stat(filepath.Join(dir, "server.properties")); err == nil {
+			return dir
+		}
+	}
+	return cwd
+}
+
+// Next to the server directory, so backups don't end up inside it.
+func defaultBackupRoot(serverDir string) string {
+	return filepath.Join(filepath.Dir(serverDir), filepath.Base(serverDir)+"-backups")
+}
+
+// RCON if the server has it turned on, otherwise a terminal multiplexer
+// that is installed. Bedrock servers have no RCON.
+func defaultTransport(props map[string]string, bedrock bool) string {
+	if !bedrock && (props["enable-rcon"] == "true" || runtime.GOOS == "windows") {
+		return "rcon"
+	}
+	for _, t := range []string{"screen", "tmux"} {
+		if _, err := exec.LookPath(t); err == nil {
+			return t
+		}
+	}
+	if bedrock {
+		return "stdin"
+	}
+	return "rcon"
+}
+
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~"); ok && (rest == "" || rest[0] == '/' || rest[0] == filepath.Separator) {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+func cmpOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
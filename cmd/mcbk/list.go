@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Prints every snapshot the backend knows about.
+func listCommand(args []string) {
+	fs := newFlagSet("list")
+	asJSON := fs.Bool("json", false, "Print snapshots as JSON")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+
+	servers := mustSelectServers(fs)
+	var snaps []mcbk.Snapshot
+	for _, s := range servers {
+		list, err := s.Snapshots(context.Background())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing snapshots for %s: %s\n", s.Name(), err.Error())
+			os.Exit(1)
+		}
+		for i := range list {
+			list[i].Server = s.Name()
+		}
+		snaps = append(snaps, list...)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if snaps == nil {
+			snaps = []mcbk.Snapshot{}
+		}
+		enc.Encode(snaps)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tTIME\tID\tBRANCH\tSIZE\tREPO\tTAGS\tCOMMENT")
+	for _, s := range snaps {
+		size := "-"
+		if s.Size > 0 {
+			size = "~" + mcbk.FormatBytes(s.Size)
+		}
+		branch := s.Branch
+		if branch == "" {
+			branch = "-"
+		}
+		tags := strings.Join(s.Tags, ",")
+		if tags == "" {
+			tags = "-"
+		}
+		if s.PinnedUntil != nil && time.Now().Before(*s.PinnedUntil) {
+			tags += " (pinned until " + s.PinnedUntil.Format("2006-01-02") + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Server, s.Time.Format("2006-01-02 15:04:05"), s.ID, branch, size, s.Repo, tags, s.Comment)
+	}
+	w.Flush()
+}
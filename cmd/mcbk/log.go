@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Logs go to stderr until initLogger switches them to the log file.
+var logger = slog.New(mcbk.NewLogHandler(os.Stderr, "text"))
+
+// Switches logging to log_output: mcbk's log file, created with its
+// directory on first run and rotated as configured, syslog or the journal.
+// Servers set up afterwards log there too. If the destination can't be
+// opened, logs stay on stderr so the run isn't lost.
+func initLogger() {
+	var handler slog.Handler
+	var err error
+	switch config.LogOutput {
+	case "syslog":
+		handler, err = mcbk.NewSyslogHandler(config.LogFormat)
+	case "journald":
+		handler, err = mcbk.NewJournalHandler(config.LogFormat)
+	default:
+		var f *mcbk.LogFile
+		if err = config.CheckLogMount(); err == nil {
+			f, err = mcbk.OpenLogFile(config.LogPath, config.LogRotate)
+		}
+		if err == nil {
+			handler = mcbk.NewLogHandler(f, config.LogFormat)
+		}
+	}
+	if err != nil {
+		logger = slog.New(mcbk.NewLogHandler(os.Stderr, config.LogFormat))
+		logger.Warn("Error opening the log, logging to stderr instead", "log_output", config.LogOutput, "log_path", config.LogPath, "error", err)
+		return
+	}
+	logger = slog.New(handler)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Loaded by mustLoadConfig at the start of each command.
+var config mcbk.Config
+
+// Subcommands, run as "mcbk <command> [flags]". Without a command mcbk runs
+// a backup, so existing cron entries keep working.
+var commands = map[string]func(args []string){
+	"agent":           agentCommand,
+	"backup":          backupCommand,
+	"browse":          browseCommand,
+	"daemon":          daemonCommand,
+	"diff":            diffCommand,
+	"doctor":          doctorCommand,
+	"export":          exportCommand,
+	"history":         historyCommand,
+	"init":            initCommand,
+	"install-systemd": installSystemdCommand,
+	"list":            listCommand,
+	"mount":           mountCommand,
+	"network":         networkCommand,
+	"prune":           pruneCommand,
+	"restore":         restoreCommand,
+	"run":             runServerCommand,
+	"stats":           statsCommand,
+	"status":          statusCommand,
+	"verify":          verifyCommand,
+	"watchdog":        watchdogCommand,
+}
+
+func main() {
+	args := os.Args[1:]
+	name := "backup"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q. Available commands:\n", name)
+		for _, n := range slices.Sorted(maps.Keys(commands)) {
+			fmt.Fprintln(os.Stderr, "  "+n)
+		}
+		os.Exit(2)
+	}
+	cmd(args)
+}
+
+// Creates the flag set for a subcommand, with -config and the config
+// override flags already registered.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.String("config", mcbk.DEFAULT_CONFIG_PATH, "Path to the config file")
+	fs.String("server", "", "Comma-separated names of the server profiles to act on")
+	fs.Bool("all", false, "Act on every server profile")
+	registerConfigFlags(fs)
+	return fs
+}
+
+// Loads the global config using the -config and override flags of an
+// already parsed flag set, exiting if it is invalid.
+func mustLoadConfig(fs *flag.FlagSet) {
+	if err := loadConfig(fs); err != nil {
+		println("ERROR LOADING CONFIG:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Like mustLoadConfig, returning the error instead.
+func loadConfig(fs *flag.FlagSet) error {
+	configGiven := false
+	fs.Visit(func(f *flag.Flag) {
+		configGiven = configGiven || f.Name == "config"
+	})
+
+	var err error
+	config, err = mcbk.LoadConfig(fs.Lookup("config").Value.String(), configGiven, func(c *mcbk.Config) error {
+		return applyConfigFlags(fs, c)
+	})
+	return err
+}
+
+// Picks the servers a command should act on from its -server and -all
+// flags and sets them up, exiting if the selection is invalid. With a
+// single server configured, neither flag is needed; its backup sets are
+// only picked by name or with -all.
+func mustSelectServers(fs *flag.FlagSet) []*mcbk.Server {
+	names := fs.Lookup("server").Value.String()
+	all := fs.Lookup("all").Value.String() == "true"
+
+	primary := slices.DeleteFunc(slices.Clone(config.Servers), func(s mcbk.ServerConfig) bool { return s.Set != "" })
+	var selected []mcbk.ServerConfig
+	switch {
+	case all:
+		selected = config.Servers
+	case names != "":
+		for _, name := range strings.Split(names, ",") {
+			i := slices.IndexFunc(config.Servers, func(s mcbk.ServerConfig) bool { return s.Name == name })
+			if i < 0 {
+				println("ERROR: no server named", name)
+				os.Exit(1)
+			}
+			selected = append(selected, config.Servers[i])
+		}
+	case len(primary) == 1:
+		selected = primary
+	default:
+		println("ERROR: the config defines several servers, pick one with -server or use -all")
+		os.Exit(1)
+	}
+
+	servers := make([]*mcbk.Server, 0, len(selected))
+	for _, c := range selected {
+		s, err := mcbk.NewServer(c, logger)
+		if err != nil {
+			println("ERROR SETTING UP SERVER "+c.Name+":", err.Error())
+			os.Exit(1)
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// Runs fn for each server, at most limit at a time, and returns how many
+// failed. A limit below 1 means one at a time.
+func forEachServer(ctx context.Context, servers []*mcbk.Server, limit int, fn func(*mcbk.Server, context.Context) error) int {
+	if limit < 1 {
+		limit = 1
+	}
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	sem := make(chan struct{}, limit)
+	for _, s := range servers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if fn(s, ctx) != nil {
+				failed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	return int(failed.Load())
+}
+
+// Takes a backup of the world, the original and default mode.
+func backupCommand(args []string) {
+	fs := newFlagSet("backup")
+	force := fs.Bool("force", false, "Back up even if skip_idle is set and nobody has played since the last backup, or size_check would fail it")
+	ignoreWindow := fs.Bool("ignore-window", false, "Back up even outside backup_window")
+	dryRun := fs.Bool("dry-run", false, "Check the server is up and log what the backup would do, without changing anything")
+	var tags []string
+	fs.Func("tag", "Label the snapshot, e.g. pre-update, so pruning leaves it alone. May be repeated", func(v string) error {
+		if err := mcbk.ValidateTag(v); err != nil {
+			return err
+		}
+		tags = append(tags, v)
+		return nil
+	})
+	comment := fs.String("comment", "", "Note to record with the snapshot, shown by list")
+	reason := fs.String("reason", "", "Why the backup is taken: \"upgrade\" forces a snapshot tagged pre-upgrade, with upgrade.paths too, and pins it for upgrade.pin")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+	for _, err := range []error{mcbk.ValidateComment(*comment), mcbk.ValidateReason(*reason)} {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if *dryRun {
+		//Logged to stderr, so nothing is written
+		servers := mustSelectServers(fs)
+		runner := &mcbk.Runner{Force: *force, IgnoreWindow: *ignoreWindow, Tags: tags, Comment: *comment, Reason: *reason}
+		failed := forEachServer(context.Background(), servers, 1, func(s *mcbk.Server, ctx context.Context) error {
+			return runner.DryRun(ctx, s)
+		})
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	initLogger()
+
+	notifiers, err := mcbk.NewNotifiers(config.Notify)
+	if err != nil {
+		logger.Error("Error setting up notifications", "error", err)
+		os.Exit(1)
+	}
+
+	servers := mustSelectServers(fs)
+
+	//The first SIGINT/SIGTERM cancels ctx; each backup still re-enables saving
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runner := &mcbk.Runner{Notifiers: notifiers, MQTT: mcbk.NewMQTTPublisher(config.MQTT), Tracer: mcbk.NewTracer(config.Tracing), Force: *force, IgnoreWindow: *ignoreWindow, Slots: make(chan struct{}, config.Concurrency), Tags: tags, Comment: *comment, Reason: *reason}
+	if bar := newProgressBar(); bar != nil {
+		runner.Progress = bar.update
+	}
+	failed := forEachServer(ctx, servers, config.Concurrency, func(s *mcbk.Server, ctx context.Context) error {
+		//Skipping is what was asked for, not a failure
+		if err := runner.Backup(ctx, s); !errors.Is(err, mcbk.ErrServerIdle) && !errors.Is(err, mcbk.ErrOutsideWindow) {
+			return err
+		}
+		return nil
+	})
+	if failed > 0 {
+		stop()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Mounts the snapshots of a server read-only, so single files can be
+// copied out of them with the usual tools, until interrupted.
+func mountCommand(args []string) {
+	fs := newFlagSet("mount")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mcbk mount [flags] <dir>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	mustLoadConfig(fs)
+	initLogger()
+
+	servers := mustSelectServers(fs)
+	if len(servers) != 1 {
+		println("ERROR: mount works on a single server, pick one with -server")
+		os.Exit(1)
+	}
+	s := servers[0]
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	dir := fs.Arg(0)
+	fmt.Fprintf(os.Stderr, "Mounting the snapshots of %s at %s, press Ctrl-C to unmount\n", s.Name(), dir)
+	if err := s.MountSnapshots(ctx, dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error mounting: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Backs up the servers behind a proxy one after another, announcing it
+// network-wide, and prints a report of the whole run.
+func networkCommand(args []string) {
+	fs := newFlagSet("network")
+	force := fs.Bool("force", false, "Back up even servers with skip_idle that nobody has played on, or that size_check would fail")
+	ignoreWindow := fs.Bool("ignore-window", false, "Back up even outside backup_window")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+	initLogger()
+
+	//network.servers picks the servers and their order, unless -server does
+	if fs.Lookup("server").Value.String() == "" {
+		if len(config.Network.Servers) > 0 {
+			fs.Set("server", strings.Join(config.Network.Servers, ","))
+		} else {
+			fs.Set("all", "true")
+		}
+	}
+	notifiers, err := mcbk.NewNotifiers(config.Notify)
+	if err != nil {
+		logger.Error("Error setting up notifications", "error", err)
+		os.Exit(1)
+	}
+	network, err := mcbk.NewNetwork(config.Network, mustSelectServers(fs), logger)
+	if err != nil {
+		logger.Error("Error setting up the network", "error", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	runner := &mcbk.Runner{Notifiers: notifiers, MQTT: mcbk.NewMQTTPublisher(config.MQTT), Tracer: mcbk.NewTracer(config.Tracing), Force: *force, IgnoreWindow: *ignoreWindow}
+	report := runner.BackupNetwork(ctx, network)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVER\tSTATUS\tDURATION\tSIZE\tSNAPSHOT\tERROR")
+		for _, r := range report.Servers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Server, r.Status, r.End.Sub(r.Start).Round(time.Second), statsBytes(r.Bytes), r.Snapshot, r.Error)
+		}
+		w.Flush()
+		fmt.Printf("Network %s: %d servers, %d failed, in %s\n", report.Network, len(report.Servers), report.Failed(), report.End.Sub(report.Start).Round(time.Second))
+	}
+	if report.Failed() > 0 || ctx.Err() != nil {
+		stop()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+const PROGRESS_BAR_WIDTH = 20 //Cells in each server's bar
+
+// Draws how far each running backup has got on one line of stderr.
+type progressBar struct {
+	mu      sync.Mutex
+	servers map[string]mcbk.Progress
+	order   []string //Servers in the order they started, so they don't swap places
+}
+
+// Returns a progress bar if stderr is a terminal, so it is only drawn when
+// run interactively, otherwise nil.
+func newProgressBar() *progressBar {
+	info, err := os.Stderr.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &progressBar{servers: map[string]mcbk.Progress{}}
+}
+
+// Redraws the line with the latest progress of a server, or without it
+// once its backup is done. For Runner.Progress.
+func (b *progressBar) update(p mcbk.Progress) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p.Done {
+		delete(b.servers, p.Server)
+		b.order = slices.DeleteFunc(b.order, func(name string) bool { return name == p.Server })
+	} else {
+		if _, ok := b.servers[p.Server]; !ok {
+			b.order = append(b.order, p.Server)
+		}
+		b.servers[p.Server] = p
+	}
+
+	parts := make([]string, len(b.order))
+	for i, name := range b.order {
+		p := b.servers[name]
+		if p.Total == 0 {
+			parts[i] = fmt.Sprintf("%s %s", name, mcbk.FormatBytes(p.Bytes))
+			continue
+		}
+		filled := int(p.Percent / 100 * PROGRESS_BAR_WIDTH)
+		bar := strings.Repeat("#", filled) + strings.Repeat("-", PROGRESS_BAR_WIDTH-filled)
+		parts[i] = fmt.Sprintf("%s [%s] %3.0f%% %s/%s", name, bar, p.Percent, mcbk.FormatBytes(p.Bytes), mcbk.FormatBytes(p.Total))
+	}
+	//Back to the start of the line, clearing what was drawn before
+	fmt.Fprintf(os.Stderr, "\r\033[K%s", strings.Join(parts, "  "))
+}
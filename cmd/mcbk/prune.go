@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Applies retention without taking a backup, e.g. to preview a new policy.
+func pruneCommand(args []string) {
+	fs := newFlagSet("prune")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be removed")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+
+	if !*dryRun {
+		initLogger()
+	}
+	servers := mustSelectServers(fs)
+	runner := &mcbk.Runner{MQTT: mcbk.NewMQTTPublisher(config.MQTT), Tracer: mcbk.NewTracer(config.Tracing)}
+	failed := 0
+	for _, s := range servers {
+		if !*dryRun {
+			if prune(runner, s) != nil {
+				failed++
+			}
+			continue
+		}
+		if len(servers) > 1 {
+			fmt.Printf("== %s ==\n", s.Name())
+		}
+		if err := previewRetention(s); err != nil {
+			logger.Error("Error pruning old backups", "server", s.Name(), "phase", "prune", "error", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// Prunes a server while holding its lock, so it can't race a backup.
+func prune(r *mcbk.Runner, s *mcbk.Server) error {
+	unlock, err := s.Lock(context.Background())
+	if err != nil {
+		logger.Error("Error pruning old backups", "server", s.Name(), "phase", "lock", "error", err)
+		return err
+	}
+	defer unlock()
+	_, err = r.Prune(context.Background(), s)
+	return err
+}
+
+// Prints what pruning would keep and remove on stdout.
+func previewRetention(s *mcbk.Server) error {
+	decisions, err := s.PreviewRetention(context.Background())
+	if err != nil {
+		return err
+	}
+	if decisions == nil {
+		fmt.Println("No retention policy configured, the backend's built-in pruning would run")
+		return nil
+	}
+	removed := 0
+	for _, d := range decisions {
+		if d.Keep {
+			fmt.Printf("keep    %s  %s (%s)\n", d.Snapshot.Time.Format("2006-01-02 15:04:05"), d.Snapshot.ID, strings.Join(d.Reasons, ", "))
+			continue
+		}
+		fmt.Printf("remove  %s  %s\n", d.Snapshot.Time.Format("2006-01-02 15:04:05"), d.Snapshot.ID)
+		removed++
+	}
+	fmt.Printf("%d of %d snapshots would be removed\n", removed, len(decisions))
+	return nil
+}
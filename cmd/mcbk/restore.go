@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// A flag that can be given several times, collecting every value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// Restores individual files, such as a corrupted region file or a player's
+// data, or a whole snapshot, in place or into a staging directory.
+func restoreCommand(args []string) {
+	fs := newFlagSet("restore")
+	var paths, players stringList
+	fs.Var(&paths, "path", "File or directory to restore, relative to minecraft_dir, e.g. world/region/r.0.0.mca (repeatable)")
+	fs.Var(&players, "player", "UUID of a player whose playerdata to restore (repeatable)")
+	target := fs.String("target", "", "Directory to restore into instead of putting the files back in minecraft_dir")
+	restart := fs.Bool("restart", false, "Stop the server first and start it again afterwards, as [control] says")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mcbk restore [flags] <snapshot|latest>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	mustLoadConfig(fs)
+	if len(paths) == 0 && len(players) == 0 && *target == "" {
+		println("ERROR: restoring a whole snapshot in place would replace all of minecraft_dir; give -path, -player or -target")
+		os.Exit(2)
+	}
+	if *restart && *target != "" {
+		println("ERROR: -restart is for restoring in place; the server can keep running while restoring into -target")
+		os.Exit(2)
+	}
+	initLogger()
+
+	servers := mustSelectServers(fs)
+	if len(servers) != 1 {
+		println("ERROR: restore works on a single server, pick one with -server")
+		os.Exit(1)
+	}
+	s := servers[0]
+	if *restart {
+		if err := s.CanRestart(); err != nil {
+			println("ERROR:", err.Error())
+			os.Exit(1)
+		}
+	}
+	for _, uuid := range players {
+		p, err := s.PlayerDataPath(uuid)
+		if err != nil {
+			println("ERROR:", err.Error())
+			os.Exit(2)
+		}
+		paths = append(paths, p)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	id, err := s.Restore(ctx, fs.Arg(0), paths, *target, *restart)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error restoring: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Restored %s into %s\n", id, cmpOr(*target, s.Config().MinecraftDir))
+}
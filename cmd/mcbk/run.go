@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Runs the server in the foreground as a child process, passing its console
+// through and taking commands for the process transport, until it exits.
+func runServerCommand(args []string) {
+	fs := newFlagSet("run")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mcbk run [flags] [-- COMMAND [ARGS...]]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	mustLoadConfig(fs)
+
+	initLogger()
+	servers := mustSelectServers(fs)
+	if len(servers) != 1 {
+		fmt.Fprintln(os.Stderr, "mcbk run runs a single server, pick one with -server")
+		os.Exit(2)
+	}
+	c := servers[0].Config()
+	if fs.NArg() > 0 {
+		c.Process.Command = fs.Args()
+	}
+	if len(c.Process.Command) == 0 {
+		fmt.Fprintln(os.Stderr, "Set process.command, or give the command after --")
+		os.Exit(2)
+	}
+	if c.Transport != "process" {
+		logger.Warn("transport isn't \"process\", so backups won't send commands through mcbk run", "server", c.Name, "transport", c.Transport)
+	}
+
+	//The first SIGINT/SIGTERM stops the server cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := mcbk.NewSupervisor(c, logger).Run(ctx, os.Stdin, os.Stdout)
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		os.Exit(exit.ExitCode())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running the server: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Summarizes world growth, storage use and deduplication from the history,
+// or with -runs lists the statistics of each run.
+func statsCommand(args []string) {
+	fs := newFlagSet("stats")
+	asJSON := fs.Bool("json", false, "Print the statistics as JSON")
+	since := fs.Duration("since", 30*24*time.Hour, "Cover the runs started within this long, 0 for all")
+	runs := fs.Bool("runs", false, "List the statistics of each successful run instead of a summary")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+
+	//Like history, covering every server unless told otherwise
+	if fs.Lookup("server").Value.String() == "" {
+		fs.Set("all", "true")
+	}
+	servers := mustSelectServers(fs)
+	var from time.Time
+	if *since > 0 {
+		from = time.Now().Add(-*since)
+	}
+
+	if *runs {
+		var records []mcbk.HistoryRecord
+		for _, s := range servers {
+			list, err := s.History()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading history for %s: %s\n", s.Name(), err.Error())
+				os.Exit(1)
+			}
+			for _, r := range list {
+				if r.Status == "success" && !r.Start.Before(from) {
+					records = append(records, r)
+				}
+			}
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if records == nil {
+				records = []mcbk.HistoryRecord{}
+			}
+			enc.Encode(records)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVER\tSTART\tDURATION\tWORLD\tBACKUPS\tGROWTH\tDEDUP")
+		for _, r := range records {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Server, r.Start.Format("2006-01-02 15:04:05"), r.End.Sub(r.Start).Round(time.Second),
+				statsBytes(r.SourceBytes), statsBytes(r.RepoBytes), statsBytes(r.RepoGrowth), statsRatio(r.DedupRatio))
+		}
+		w.Flush()
+		return
+	}
+
+	var stats []mcbk.Stats
+	for _, s := range servers {
+		st, err := s.Stats(from)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading history for %s: %s\n", s.Name(), err.Error())
+			os.Exit(1)
+		}
+		stats = append(stats, st)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(stats)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tRUNS\tOK\tWORLD\tWORLD GROWTH\tBACKUPS\tBACKUP GROWTH\tDEDUP\tAVG TIME\tMAX TIME")
+	for _, st := range stats {
+		growth := "-"
+		if st.SourceBytes > 0 {
+			growth = "+" + mcbk.FormatBytes(st.SourceGrowth)
+			if st.SourceGrowth < 0 {
+				growth = "-" + mcbk.FormatBytes(-st.SourceGrowth)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", st.Server, st.Runs, st.Successes,
+			statsBytes(st.SourceBytes), growth, statsBytes(st.RepoBytes), statsBytes(st.RepoGrowth), statsRatio(st.DedupRatio),
+			time.Duration(st.AvgDuration*float64(time.Second)).Round(time.Second), time.Duration(st.MaxDuration*float64(time.Second)).Round(time.Second))
+	}
+	w.Flush()
+}
+
+// Formats a size, which is negative if the backups shrank, or "-" if it
+// isn't known.
+func statsBytes(n int64) string {
+	switch {
+	case n == 0:
+		return "-"
+	case n < 0:
+		return "-" + mcbk.FormatBytes(-n)
+	}
+	return mcbk.FormatBytes(n)
+}
+
+func statsRatio(r float64) string {
+	if r == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fx", r)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Prints whether each server is reachable and how its backups stand.
+func statusCommand(args []string) {
+	fs := newFlagSet("status")
+	asJSON := fs.Bool("json", false, "Print the status as JSON")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+
+	//Like list, covering every server unless told otherwise
+	if fs.Lookup("server").Value.String() == "" {
+		fs.Set("all", "true")
+	}
+	servers := mustSelectServers(fs)
+	statuses := make([]mcbk.Status, len(servers))
+	errs := make([]error, len(servers))
+	//Unreachable servers each take up to verify_timeout, so ask them all at once
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Close()
+			statuses[i], errs[i] = s.Status(context.Background())
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading status for %s: %s\n", servers[i].Name(), err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(statuses)
+		return
+	}
+
+	now := time.Now()
+	for i, st := range statuses {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(st.Server)
+		fmt.Printf("  Reachable:       %s\n", yesNo(st.Reachable))
+		running := yesNo(st.InProgress)
+		if h := st.LockHolder; h != nil && h.PID != 0 {
+			running += fmt.Sprintf(" (pid %d on %s, for %s)", h.PID, h.Host, formatAge(now.Sub(h.Started)))
+		}
+		fmt.Printf("  Backup running:  %s\n", running)
+		if st.LastSuccess == nil {
+			fmt.Println("  Last backup:     never")
+		} else {
+			last := fmt.Sprintf("%s (%s ago)", st.LastSuccess.Format("2006-01-02 15:04:05"), formatAge(now.Sub(*st.LastSuccess)))
+			if st.LastSize > 0 {
+				last += ", " + mcbk.FormatBytes(st.LastSize)
+			}
+			fmt.Printf("  Last backup:     %s\n", last)
+		}
+		if st.LastFailure != nil {
+			fmt.Printf("  Last failure:    %s: %s\n", st.LastFailure.Format("2006-01-02 15:04:05"), st.LastError)
+		}
+		switch {
+		case st.NextRun == nil:
+			fmt.Println("  Next backup:     not scheduled")
+		case st.NextRun.After(now):
+			fmt.Printf("  Next backup:     %s (in %s)\n", st.NextRun.Format("2006-01-02 15:04:05"), formatAge(st.NextRun.Sub(now)))
+		default:
+			fmt.Printf("  Next backup:     %s (due)\n", st.NextRun.Format("2006-01-02 15:04:05"))
+		}
+		if st.DiskUsage == nil {
+			fmt.Println("  Backups on disk: - (remote)")
+		} else {
+			fmt.Printf("  Backups on disk: %s\n", mcbk.FormatBytes(*st.DiskUsage))
+		}
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// Rounds a duration for display, e.g. "12m", "3h12m" or "2d4h".
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return d.Round(time.Second).String()
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+}
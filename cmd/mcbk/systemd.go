@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+const DEFAULT_UNIT_DIR = "/etc/systemd/system"
+const DAEMON_WATCHDOG_SEC = 60 //WatchdogSec for the daemon's service; it pings twice as often
+
+// Sends a state change such as "READY=1" to systemd, if it started us as a
+// Type=notify service. Does nothing otherwise.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	//Linux abstract sockets are given with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Pings systemd's watchdog at half the interval it asked for, until ctx is
+// done. Returns straight away if the watchdog isn't enabled for us.
+func sdWatchdog(ctx context.Context) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				logger.Warn("Error pinging the systemd watchdog", "error", err)
+			}
+		}
+	}
+}
+
+// A systemd unit file to be written.
+type unit struct {
+	name     string
+	contents string
+}
+
+// Writes systemd units that run mcbk on the configured schedule: a backup
+// service and timer for each selected server, or with -daemon a single
+// service running "mcbk daemon" under systemd's watchdog.
+func installSystemdCommand(args []string) {
+	fs := newFlagSet("install-systemd")
+	dir := fs.String("unit-dir", DEFAULT_UNIT_DIR, "Directory to write the unit files to")
+	prefix := fs.String("name", "mcbk", "Name of the units, suffixed with the server name when there are several servers")
+	user := fs.String("user", "", "User to run mcbk as, default root")
+	daemon := fs.Bool("daemon", false, "Install one long-running daemon service instead of a timer per server")
+	enable := fs.Bool("enable", false, "Reload systemd and enable and start the new units")
+	printOnly := fs.Bool("print", false, "Print the units instead of writing them")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+
+	//Like daemon mode, cover every server unless told otherwise
+	names := fs.Lookup("server").Value.String()
+	if names == "" {
+		fs.Set("all", "true")
+	}
+	servers := mustSelectServers(fs)
+
+	binary, err := os.Executable()
+	if err == nil {
+		binary, err = filepath.EvalSymlinks(binary)
+	}
+	if err != nil {
+		println("ERROR FINDING THE MCBK BINARY:", err.Error())
+		os.Exit(1)
+	}
+	configPath, err := filepath.Abs(fs.Lookup("config").Value.String())
+	if err != nil {
+		println("ERROR:", err.Error())
+		os.Exit(1)
+	}
+	//Overrides given here are passed on, so the units run what was tested
+	cmdArgs := []string{"-config", configPath}
+	fs.Visit(func(f *flag.Flag) {
+		if isConfigFlag(f.Name) {
+			cmdArgs = append(cmdArgs, "-"+f.Name, f.Value.String())
+		}
+	})
+
+	var units []unit
+	var start []string
+	if *daemon {
+		if names != "" {
+			cmdArgs = append(cmdArgs, "-server", names)
+		}
+		name := *prefix + ".service"
+		units = append(units, unit{name, daemonServiceUnit(binary, cmdArgs, *user)})
+		start = append(start, name)
+	} else {
+		for _, s := range servers {
+			base := *prefix
+			if len(config.Servers) > 1 {
+				base += "-" + s.Name()
+			}
+			args := append(cmdArgs[:len(cmdArgs):len(cmdArgs)], "-server", s.Name())
+			units = append(units,
+				unit{base + ".service", backupServiceUnit(s, binary, args, *user)},
+				unit{base + ".timer", backupTimerUnit(s)})
+			start = append(start, base+".timer")
+		}
+	}
+
+	if *printOnly {
+		for _, u := range units {
+			fmt.Printf("# %s\n%s\n", u.name, u.contents)
+		}
+		return
+	}
+	for _, u := range units {
+		path := filepath.Join(*dir, u.name)
+		if err := os.WriteFile(path, []byte(u.contents), 0644); err != nil {
+			println("ERROR WRITING UNIT:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Wrote", path)
+	}
+	if !*enable {
+		fmt.Printf("Run \"systemctl daemon-reload && systemctl enable --now %s\" to start them.\n", strings.Join(start, " "))
+		return
+	}
+	for _, cmd := range [][]string{{"daemon-reload"}, append([]string{"enable", "--now"}, start...)} {
+		out, err := exec.Command("systemctl", cmd...).CombinedOutput()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: systemctl %s: %v\n%s", strings.Join(cmd, " "), err, out)
+			os.Exit(1)
+		}
+	}
+	fmt.Println("Enabled", strings.Join(start, " "))
+}
+
+func isConfigFlag(name string) bool {
+	for _, f := range configFlags {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// A oneshot service taking a single backup of s.
+func backupServiceUnit(s *mcbk.Server, binary string, args []string, user string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=Minecraft backup of %s (mcbk)\n", s.Name())
+	b.WriteString("Wants=network-online.target\nAfter=network-online.target\n\n")
+	b.WriteString("[Service]\nType=oneshot\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", execLine(binary, append([]string{"backup"}, args...)))
+	if user != "" {
+		fmt.Fprintf(&b, "User=%s\n", user)
+	}
+	return b.String()
+}
+
+// A timer starting s's backup service every interval. systemd doesn't
+// start it again while a backup is still running.
+func backupTimerUnit(s *mcbk.Server) string {
+	interval := systemdTimespan(s.Config().Interval.Duration)
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=Minecraft backup of %s every %s (mcbk)\n\n", s.Name(), interval)
+	fmt.Fprintf(&b, "[Timer]\nOnBootSec=%s\nOnUnitActiveSec=%s\n\n", interval, interval)
+	b.WriteString("[Install]\nWantedBy=timers.target\n")
+	return b.String()
+}
+
+// A service running the daemon, which tells systemd when it is ready and
+// keeps pinging its watchdog.
+func daemonServiceUnit(binary string, args []string, user string) string {
+	var b strings.Builder
+	b.WriteString("[Unit]\nDescription=Minecraft backup daemon (mcbk)\n")
+	b.WriteString("Wants=network-online.target\nAfter=network-online.target\n\n")
+	b.WriteString("[Service]\nType=notify\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", execLine(binary, append([]string{"daemon"}, args...)))
+	fmt.Fprintf(&b, "WatchdogSec=%d\nRestart=on-failure\n", DAEMON_WATCHDOG_SEC)
+	if user != "" {
+		fmt.Fprintf(&b, "User=%s\n", user)
+	}
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// Quotes a command line for ExecStart, which expands % specifiers and
+// $ variables unless they are doubled.
+func execLine(binary string, args []string) string {
+	words := make([]string, 0, len(args)+1)
+	for _, w := range append([]string{binary}, args...) {
+		w = strings.NewReplacer("%", "%%", "$", "$$").Replace(w)
+		if strings.ContainsAny(w, " \t\"'\\;") || w == "" {
+			w = strconv.Quote(w)
+		}
+		words = append(words, w)
+	}
+	return strings.Join(words, " ")
+}
+
+// Formats d the way systemd writes time spans, e.g. "1h 30min".
+func systemdTimespan(d time.Duration) string {
+	var parts []string
+	for _, u := range []struct {
+		unit string
+		size time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"min", time.Minute}, {"s", time.Second}} {
+		if n := d / u.size; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", n, u.unit))
+			d -= n * u.size
+		}
+	}
+	if len(parts) == 0 {
+		return "0"
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Has the terminal on stdin pass on each key as it is pressed, without
+// echoing it, and returns a function that puts it back as it was. stty is
+// used as the terminal ioctls differ between Unixes.
+func rawTerminal() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+	return func() { stty(strings.TrimSpace(saved)) }, nil
+}
+
+// The terminal's width and height in cells, or 80x24 if unknown.
+func terminalSize() (int, int) {
+	out, err := stty("size")
+	var rows, cols int
+	if err != nil {
+		return 80, 24
+	}
+	if _, err := fmt.Sscan(out, &rows, &cols); err != nil || rows == 0 || cols == 0 {
+		return 80, 24
+	}
+	return cols, rows
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procSetConsoleMode             = kernel32.NewProc("SetConsoleMode")
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+)
+
+// Console mode flags, from the Windows SDK.
+const (
+	ENABLE_ECHO_INPUT                  = 0x0004
+	ENABLE_LINE_INPUT                  = 0x0002
+	ENABLE_VIRTUAL_TERMINAL_INPUT      = 0x0200
+	ENABLE_VIRTUAL_TERMINAL_PROCESSING = 0x0004
+)
+
+func setConsoleMode(h syscall.Handle, mode uint32) error {
+	if r, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode)); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// Has the console pass on each key as it is pressed, without echoing it,
+// with arrow keys and output as the same escape sequences as on Unix, and
+// returns a function that puts it back as it was.
+func rawTerminal() (func(), error) {
+	in, out := syscall.Handle(os.Stdin.Fd()), syscall.Handle(os.Stdout.Fd())
+	var inMode, outMode uint32
+	if err := syscall.GetConsoleMode(in, &inMode); err != nil {
+		return nil, err
+	}
+	if err := syscall.GetConsoleMode(out, &outMode); err != nil {
+		return nil, err
+	}
+	if err := setConsoleMode(in, inMode&^(ENABLE_ECHO_INPUT|ENABLE_LINE_INPUT)|ENABLE_VIRTUAL_TERMINAL_INPUT); err != nil {
+		return nil, err
+	}
+	if err := setConsoleMode(out, outMode|ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+		setConsoleMode(in, inMode)
+		return nil, err
+	}
+	return func() {
+		setConsoleMode(in, inMode)
+		setConsoleMode(out, outMode)
+	}, nil
+}
+
+// The console's width and height in cells, or 80x24 if unknown.
+func terminalSize() (int, int) {
+	var info struct {
+		size, cursor             [2]int16
+		attributes               uint16
+		left, top, right, bottom int16
+		maxSize                  [2]int16
+	}
+	if r, _, _ := procGetConsoleScreenBufferInfo.Call(os.Stdout.Fd(), uintptr(unsafe.Pointer(&info))); r == 0 {
+		return 80, 24
+	}
+	return int(info.right-info.left) + 1, int(info.bottom-info.top) + 1
+}
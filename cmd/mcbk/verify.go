@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Checks that a snapshot is intact, and with -deep that it restores into a
+// working world, reporting a pass or fail for each server.
+func verifyCommand(args []string) {
+	fs := newFlagSet("verify")
+	deep := fs.Bool("deep", false, "Restore the snapshot into a temporary directory and check every file and world in it")
+	dir := fs.String("dir", "", "Directory to restore into for -deep, instead of the system's temporary directory")
+	asJSON := fs.Bool("json", false, "Print the reports as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mcbk verify [flags] [snapshot|latest]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	id := "latest"
+	if fs.NArg() == 1 {
+		id = fs.Arg(0)
+	}
+	mustLoadConfig(fs)
+	initLogger()
+
+	servers := mustSelectServers(fs)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var reports []mcbk.VerifyReport
+	failed := false
+	for _, s := range servers {
+		report, err := verify(ctx, s, id, *deep, *dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error verifying %s: %s\n", s.Name(), err.Error())
+			failed = true
+			continue
+		}
+		failed = failed || !report.Passed()
+		reports = append(reports, report)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if reports == nil {
+			reports = []mcbk.VerifyReport{}
+		}
+		enc.Encode(reports)
+	} else {
+		for i, r := range reports {
+			if i > 0 {
+				fmt.Println()
+			}
+			printVerifyReport(r)
+		}
+	}
+	if failed {
+		stop()
+		os.Exit(1)
+	}
+}
+
+// Verifies under the server's lock, so pruning can't remove the snapshot
+// halfway through.
+func verify(ctx context.Context, s *mcbk.Server, id string, deep bool, dir string) (mcbk.VerifyReport, error) {
+	unlock, err := s.Lock(ctx)
+	if err != nil {
+		return mcbk.VerifyReport{}, err
+	}
+	defer unlock()
+	return s.VerifySnapshot(ctx, id, deep, dir)
+}
+
+func printVerifyReport(r mcbk.VerifyReport) {
+	fmt.Printf("%s: %s\n", r.Server, r.Snapshot)
+	if r.Checked {
+		fmt.Println("  Integrity check: run")
+	} else {
+		fmt.Println("  Integrity check: not supported by the backend")
+	}
+	if r.Deep {
+		fmt.Printf("  Restored:        %d files, %s\n", r.Files, mcbk.FormatBytes(r.Size))
+	}
+	//Without -deep, the manifest is compared with what the backend stores
+	against := "the stored files"
+	if r.Deep && r.Stored {
+		against = "the manifest"
+	} else if r.Deep {
+		against = "the backend's listing"
+	}
+	switch {
+	case !r.Manifest && r.Deep:
+		fmt.Println("  File listing:    not compared")
+	case !r.Manifest:
+	case r.Hashed > 0:
+		fmt.Printf("  File listing:    compared with %s, %d files by SHA-256\n", against, r.Hashed)
+	default:
+		fmt.Printf("  File listing:    compared with %s by size\n", against)
+	}
+	if r.Deep {
+		fmt.Printf("  level.dat:       %d parsed\n", r.LevelDats)
+		fmt.Printf("  Region files:    %d parsed, %d chunks\n", r.RegionFiles, r.Chunks)
+	}
+	for _, p := range r.Problems {
+		fmt.Printf("  Problem:         %s\n", p)
+	}
+	if more := r.Failed - len(r.Problems); more > 0 {
+		fmt.Printf("  ...and %d more problems\n", more)
+	}
+	if r.Passed() {
+		fmt.Println("  Result:          PASS")
+	} else {
+		fmt.Println("  Result:          FAIL")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Xenograph/mcbk/pkg/mcbk"
+)
+
+// Checks once whether each server's last successful backup is older than
+// its watchdog.max_age, notifying about those that are, for a cron entry
+// that keeps an eye on backups scheduled some other way. Exits non-zero if
+// any is overdue.
+func watchdogCommand(args []string) {
+	fs := newFlagSet("watchdog")
+	maxAge := fs.Duration("max-age", 0, "Age of the last successful backup to alert at, instead of watchdog.max_age")
+	fs.Parse(args)
+	mustLoadConfig(fs)
+
+	initLogger()
+	notifiers, err := mcbk.NewNotifiers(config.Notify)
+	if err != nil {
+		logger.Error("Error setting up notifications", "error", err)
+		os.Exit(1)
+	}
+	//Like daemon, covering every server unless told otherwise
+	if fs.Lookup("server").Value.String() == "" {
+		fs.Set("all", "true")
+	}
+	servers := mustSelectServers(fs)
+	runner := &mcbk.Runner{Notifiers: notifiers}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	checked, failed := 0, false
+	for _, s := range servers {
+		limit := s.Config().Watchdog.MaxAge.Duration
+		if *maxAge > 0 {
+			limit = *maxAge
+		}
+		if limit <= 0 {
+			continue
+		}
+		checked++
+		overdue, err := runner.Watchdog(ctx, s, limit)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Error checking %s: %s\n", s.Name(), err.Error())
+			failed = true
+		case overdue:
+			fmt.Printf("%s: OVERDUE, no successful backup in the last %s\n", s.Name(), limit)
+			failed = true
+		default:
+			fmt.Printf("%s: ok\n", s.Name())
+		}
+		s.Close()
+	}
+	if checked == 0 {
+		println("ERROR: no server sets watchdog.max_age, set it or pass -max-age")
+		os.Exit(1)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/Xenograph/mcbk
+
+go 1.23
@@ -0,0 +1,58 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// The player count in a response to "list": vanilla's "There are 2 of a
+// max of 20 players online", Bukkit's "There are 2 out of maximum 20" and
+// Bedrock's "There are 2/10 players online".
+var playerCountRegexp = regexp.MustCompile(`(?i)there are (\d+)`)
+
+// Settings for daemon mode backing up more often while players are online
+// and less often while the server is idle, found by polling "list".
+type ActivityConfig struct {
+	ActiveInterval Duration `json:"active_interval"` //How often to back up once players have been online since the last backup, e.g. "1h"
+	IdleInterval   Duration `json:"idle_interval"`   //How often to back up while nobody has been, e.g. "6h"
+	PollInterval   Duration `json:"poll_interval"`   //How often to check who is online, default 5m
+}
+
+// Whether the schedule adapts to players. Either interval left unset is
+// the server's interval.
+func (c ActivityConfig) Enabled() bool {
+	return c.ActiveInterval.Duration != 0 || c.IdleInterval.Duration != 0
+}
+
+func (c ActivityConfig) validate() []error {
+	var errs []error
+	if c.ActiveInterval.Duration < time.Minute {
+		errs = append(errs, errors.New("activity.active_interval must be at least 1m"))
+	}
+	if c.IdleInterval.Duration < time.Minute {
+		errs = append(errs, errors.New("activity.idle_interval must be at least 1m"))
+	}
+	if c.PollInterval.Duration < 10*time.Second {
+		errs = append(errs, errors.New("activity.poll_interval must be at least 10s"))
+	}
+	return errs
+}
+
+// Asks the server how many players are online, with a single attempt at
+// "list". Fails if the server doesn't answer or the count can't be found
+// in its response.
+func (s *Server) PlayersOnline(ctx context.Context) (int, error) {
+	resp, err := s.queryCommand(ctx, "list")
+	if err != nil {
+		return 0, err
+	}
+	m := playerCountRegexp.FindStringSubmatch(resp)
+	if m == nil {
+		return 0, fmt.Errorf("no player count in the response to list: %q", resp)
+	}
+	return strconv.Atoi(m[1])
+}
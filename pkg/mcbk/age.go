@@ -0,0 +1,120 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const AGE_SUFFIX = ".age" //Added to the names of encrypted files
+
+// Settings for encrypting files with age (https://age-encryption.org),
+// which must be installed. Encryption is on once any of them is set.
+type AgeConfig struct {
+	Recipients     []string `json:"recipients"`      //Public keys to encrypt to, age1... or SSH keys
+	RecipientsFile string   `json:"recipients_file"` //Or a file listing them, one per line
+	Identity       string   `json:"identity"`        //File with a private key, needed to read the files back. Without recipients, files are encrypted to it
+}
+
+func (c AgeConfig) Enabled() bool {
+	return len(c.Recipients) > 0 || c.RecipientsFile != "" || c.Identity != ""
+}
+
+func (c AgeConfig) validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	for _, path := range []string{c.RecipientsFile, c.Identity} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c AgeConfig) encryptArgs() []string {
+	var args []string
+	for _, r := range c.Recipients {
+		args = append(args, "-r", r)
+	}
+	if c.RecipientsFile != "" {
+		args = append(args, "-R", c.RecipientsFile)
+	}
+	if len(args) == 0 {
+		args = append(args, "-i", c.Identity)
+	}
+	return append([]string{"-e"}, args...)
+}
+
+// Runs age, with stderr kept for the error.
+func runAge(ctx context.Context, args []string, setup func(cmd *exec.Cmd) error, run func() error) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "age", args...)
+	cmd.Stderr = &stderr
+	if err := setup(cmd); err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting age: %w", err)
+	}
+	err := run()
+	werr := cmd.Wait()
+	msg := strings.TrimSpace(stderr.String())
+	//age explains its own failures, which likely made run fail too. Without
+	//a message it was stopped, e.g. by run giving up on its output
+	switch {
+	case werr != nil && msg != "":
+		return fmt.Errorf("age: %w: %s", werr, msg)
+	case werr != nil && err == nil:
+		return fmt.Errorf("age: %w", werr)
+	}
+	return err
+}
+
+// Runs write with a writer whose contents end up encrypted in w.
+func (c AgeConfig) encrypt(ctx context.Context, w io.Writer, write func(io.Writer) error) error {
+	var in io.WriteCloser
+	return runAge(ctx, c.encryptArgs(), func(cmd *exec.Cmd) (err error) {
+		cmd.Stdout = w
+		in, err = cmd.StdinPipe()
+		return err
+	}, func() error {
+		err := write(in)
+		//Ends age's input; on failure the caller throws the output away
+		if cerr := in.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+}
+
+// Runs read with the decrypted contents of r. age checks the data as it
+// goes, so a tampered file fails read or, at the very end, decrypt.
+func (c AgeConfig) decrypt(ctx context.Context, r io.Reader, read func(io.Reader) error) error {
+	if c.Identity == "" {
+		return errors.New("reading an encrypted archive needs an age identity file")
+	}
+	var out io.ReadCloser
+	return runAge(ctx, []string{"-d", "-i", c.Identity}, func(cmd *exec.Cmd) (err error) {
+		cmd.Stdin = r
+		out, err = cmd.StdoutPipe()
+		return err
+	}, func() error {
+		err := read(out)
+		if err == nil {
+			//read may not need everything, but age only checks the end once it gets there
+			_, err = io.Copy(io.Discard, out)
+		}
+		//Stops age early if read failed
+		out.Close()
+		return err
+	})
+}
@@ -0,0 +1,278 @@
+package mcbk
+
+import (
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	AGENT_MODE_STREAM = "stream" //Copy the world from the host and back it up here
+	AGENT_MODE_REMOTE = "remote" //Have the host back it up with its own backend
+)
+
+// Settings for a server on another host, backed up through the mcbk
+// installed there, which runs the in-game commands with its own transport.
+type AgentConfig struct {
+	SSH     SSHConfig `json:"ssh"`     //The host running the server. Empty for a server on this machine
+	Mode    string    `json:"mode"`    //"stream" (default) copies the world into minecraft_dir here and backs it up with this profile's backend, "remote" has the host back it up with its own
+	Command string    `json:"command"` //mcbk on the host, default "mcbk"
+	Config  string    `json:"config"`  //Config file on the host, default its default path
+	Server  string    `json:"server"`  //Profile on the host, if its config has several
+}
+
+// Whether the server is backed up through another host.
+func (c AgentConfig) Enabled() bool {
+	return c.SSH.Enabled()
+}
+
+// Whether the host keeps the backups, rather than this machine.
+func (c AgentConfig) remote() bool {
+	return c.Enabled() && c.Mode == AGENT_MODE_REMOTE
+}
+
+func (c *AgentConfig) setDefaults() {
+	if c.Mode == "" {
+		c.Mode = AGENT_MODE_STREAM
+	}
+	if c.Command == "" {
+		c.Command = "mcbk"
+	}
+}
+
+// Checks the agent settings, and that the profile doesn't also ask for
+// anything only the host's own config can do.
+func (c *ServerConfig) validateAgent() []error {
+	a := c.Agent
+	errs := a.SSH.validate("agent.ssh")
+	if a.Mode != AGENT_MODE_STREAM && a.Mode != AGENT_MODE_REMOTE {
+		errs = append(errs, fmt.Errorf("unknown agent.mode %q, expected \"stream\" or \"remote\"", a.Mode))
+	}
+	var hostOnly []string
+	for _, s := range []struct {
+		key string
+		set bool
+	}{
+		{"countdown", len(c.Countdown.Steps) > 0},
+		{"chat_trigger", c.ChatTrigger.Enabled()},
+		{"activity", c.Activity.Enabled()},
+		{"skip_idle", c.SkipIdle},
+		{"require_online", c.RequireOnline},
+		{"worlds", len(c.Worlds) > 0},
+		{"include", len(c.Include) > 0},
+		{c.snapshotStaging(), c.snapshotStaging() != ""},
+	} {
+		if s.set {
+			hostOnly = append(hostOnly, s.key)
+		}
+	}
+	if len(hostOnly) > 0 {
+		errs = append(errs, fmt.Errorf("%s must be set in the host's config, not in a profile with agent.ssh", strings.Join(hostOnly, ", ")))
+	}
+	return errs
+}
+
+// The command that runs "mcbk agent <command>" on the host, with extra
+// arguments, quoted for its shell.
+func (c AgentConfig) command(sub string, args ...string) string {
+	words := []string{shellQuote(c.Command), "agent", sub}
+	if c.Config != "" {
+		words = append(words, "-config", shellQuote(c.Config))
+	}
+	if c.Server != "" {
+		words = append(words, "-server", shellQuote(c.Server))
+	}
+	for _, a := range args {
+		words = append(words, shellQuote(a))
+	}
+	return strings.Join(words, " ")
+}
+
+// Stands in for the transport of a profile with agent.ssh, whose commands
+// only the host can send.
+type agentTransport struct {
+	host string
+}
+
+func (t agentTransport) Send(ctx context.Context, command string) error {
+	return fmt.Errorf("the server is on %s, whose mcbk sends its commands", t.host)
+}
+
+func (t agentTransport) Close() error {
+	return nil
+}
+
+// Has the mcbk on the host turn saving off, save the world and stream the
+// files to back up, then replaces minecraft_dir with them. The files are
+// unpacked next to it first, so a copy cut short leaves the last one intact.
+// The stream isn't trusted: extractTarGz refuses anything that would lead
+// out of the copy, so a compromised host can't write elsewhere through it.
+func (s *Server) pullWorld(ctx context.Context) error {
+	a := s.conf.Agent
+	tmp := s.conf.MinecraftDir + ".partial"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0770); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	var out io.ReadCloser
+	err := a.SSH.run(ctx, a.command("stream"), func(cmd *exec.Cmd) (err error) {
+		out, err = cmd.StdoutPipe()
+		return err
+	}, func() error {
+		err := extractTarGz(ctx, out, tmp, nil)
+		//Stops the transfer if unpacking failed
+		out.Close()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("copying the world from %s: %w", a.SSH.Host, err)
+	}
+	if err := os.RemoveAll(s.conf.MinecraftDir); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.conf.MinecraftDir)
+}
+
+// Has the mcbk on the host take the backup with its own backend, and
+// returns the snapshot from the run it recorded.
+func (s *Server) remoteBackup(ctx context.Context, force bool, tags []string, comment, reason string) (Snapshot, error) {
+	a := s.conf.Agent
+	var args []string
+	if force {
+		args = append(args, "-force")
+	}
+	for _, t := range tags {
+		args = append(args, "-tag", t)
+	}
+	if comment != "" {
+		args = append(args, "-comment", comment)
+	}
+	if reason != "" {
+		args = append(args, "-reason", reason)
+	}
+	out, err := a.SSH.output(ctx, a.command("backup", args...))
+	if err != nil {
+		return Snapshot{}, &phaseError{"agent", fmt.Errorf("backing up on %s: %w", a.SSH.Host, err)}
+	}
+	var rec HistoryRecord
+	if err := json.Unmarshal(out, &rec); err != nil {
+		return Snapshot{}, &phaseError{"agent", fmt.Errorf("reading the result from %s: %w", a.SSH.Host, err)}
+	}
+	if rec.Status != "success" {
+		return Snapshot{}, &phaseError{cmp.Or(rec.Phase, "agent"), fmt.Errorf("%s on %s: %s", rec.Status, a.SSH.Host, rec.Error)}
+	}
+	return Snapshot{ID: rec.Snapshot, Time: rec.End, Repo: a.SSH.Host, Size: rec.Bytes}, nil
+}
+
+// Writes the backed up files as a gzipped tar stream, for a central mcbk to
+// back up with its own backend.
+type streamBackend struct {
+	w        io.Writer
+	excludes []excludePattern
+}
+
+var errStreamOnly = errors.New("the backup is streamed to another host")
+
+func (b *streamBackend) Init(ctx context.Context) error {
+	return nil
+}
+
+func (b *streamBackend) Save(ctx context.Context, dir string, paths []string) (Snapshot, error) {
+	counter := &countingWriter{w: b.w}
+	if err := writeTarGz(ctx, counter, dir, paths, gzip.BestSpeed, b.excludes); err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{ID: "stream", Time: time.Now(), Size: counter.n}, nil
+}
+
+func (b *streamBackend) List(ctx context.Context) ([]Snapshot, error) {
+	return nil, errStreamOnly
+}
+
+func (b *streamBackend) Restore(ctx context.Context, id, target string) error {
+	return errStreamOnly
+}
+
+func (b *streamBackend) Prune(ctx context.Context) error {
+	return errStreamOnly
+}
+
+func (b *streamBackend) Delete(ctx context.Context, snaps []Snapshot) error {
+	return errStreamOnly
+}
+
+// Stands in for the backend of a profile with agent.mode "remote", whose
+// backups only the host's mcbk can reach.
+type hostBackend struct {
+	host string
+}
+
+func (b *hostBackend) err() error {
+	return fmt.Errorf("the backups are kept on %s, run mcbk there", b.host)
+}
+
+func (b *hostBackend) Init(ctx context.Context) error {
+	return b.err()
+}
+
+func (b *hostBackend) Save(ctx context.Context, dir string, paths []string) (Snapshot, error) {
+	return Snapshot{}, b.err()
+}
+
+func (b *hostBackend) List(ctx context.Context) ([]Snapshot, error) {
+	return nil, b.err()
+}
+
+func (b *hostBackend) Restore(ctx context.Context, id, target string) error {
+	return b.err()
+}
+
+func (b *hostBackend) Prune(ctx context.Context) error {
+	return b.err()
+}
+
+func (b *hostBackend) Delete(ctx context.Context, snaps []Snapshot) error {
+	return b.err()
+}
+
+// Runs the in-game part of a backup as usual, but writes the files to w as
+// a gzipped tar stream instead of to the backend, for "mcbk agent stream".
+// Nothing is recorded in the history, as the central mcbk records the run.
+func (s *Server) StreamWorld(ctx context.Context, w io.Writer) error {
+	unlock, err := s.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer s.Close()
+	excludes, err := parseExcludes(s.conf.Exclude)
+	if err != nil {
+		return err
+	}
+	streamer := &Server{conf: s.conf, backend: &streamBackend{w: w, excludes: excludes}, transport: s.transport, patterns: s.patterns, logger: s.logger}
+	p, err := streamer.Plan(ctx)
+	if err != nil {
+		return err
+	}
+	_, _, err = streamer.runBackup(ctx, p)
+	return err
+}
+
+// Backs up the server as Backup does, returning the history record of the
+// run, for "mcbk agent backup".
+func (r *Runner) BackupRecord(ctx context.Context, s *Server) HistoryRecord {
+	start := time.Now()
+	err := r.Backup(ctx, s)
+	return s.lastRun(start, err)
+}
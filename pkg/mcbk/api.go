@@ -0,0 +1,576 @@
+package mcbk
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const API_KEEPALIVE_INTERVAL = 15 * time.Second //How often a quiet event stream gets a comment, so proxies keep it open
+
+// A local HTTP API for hosting panels and dashboards to inspect and trigger
+// backups. Every request needs the configured token, as a bearer token or a
+// token query parameter, or the basic auth credentials if there are any.
+// Endpoints take an optional comma-separated server query parameter and
+// default to every server:
+//
+//	GET  /backups       snapshots, oldest first
+//	GET  /backups/{id}  one snapshot
+//	GET  /status        the state of each server's backups
+//	GET  /history       the recorded runs, oldest first
+//	GET  /storage       the space taken by each server's backups
+//	POST /trigger       start a backup, streaming progress as server-sent
+//	                    events if the client accepts text/event-stream
+//	POST /prune         apply the retention policy
+//	POST /cancel        stop the running backup cleanly
+//	POST /restore       restore a snapshot of one server
+type API struct {
+	ctx        context.Context
+	token      string
+	user       string //Basic auth credentials, if allowed
+	password   string
+	restoreDir string //Where restores may go instead of in place, if anywhere
+	runner     *Runner
+	servers    []*Server
+	logger     *slog.Logger
+	running    sync.Map //Names of servers with a triggered backup in progress
+	wg         sync.WaitGroup
+	mux        *http.ServeMux
+}
+
+// Sets up the API for the given servers. Backups it triggers are run by
+// runner under ctx, so they are cancelled along with it, and runner's
+// Metrics answer /status.
+func NewAPI(ctx context.Context, token string, runner *Runner, servers []*Server, logger *slog.Logger) *API {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	a := &API{ctx: ctx, token: token, runner: runner, servers: servers, logger: logger.With("phase", "api"), mux: http.NewServeMux()}
+	a.mux.HandleFunc("GET /backups", a.listBackups)
+	a.mux.HandleFunc("GET /backups/{id}", a.getBackup)
+	a.mux.HandleFunc("GET /status", a.status)
+	a.mux.HandleFunc("POST /trigger", a.trigger)
+	a.mux.HandleFunc("POST /prune", a.prune)
+	a.mux.HandleFunc("POST /cancel", a.cancel)
+	a.mux.HandleFunc("GET /history", a.history)
+	a.mux.HandleFunc("GET /storage", a.storage)
+	a.mux.HandleFunc("POST /restore", a.restore)
+	return a
+}
+
+// Also accepts requests with the given HTTP basic auth credentials, which
+// browsers ask for and then send by themselves, for the dashboard.
+func (a *API) AllowBasicAuth(user, password string) {
+	a.user, a.password = user, password
+}
+
+// Lets restores go into a target directory under dir, each server's in a
+// subdirectory named after it, rather than only in place.
+func (a *API) AllowRestoreDir(dir string) {
+	a.restoreDir = dir
+}
+
+// Registers the API's endpoints on mux.
+func (a *API) Register(mux *http.ServeMux) {
+	for _, pattern := range []string{"/backups", "/backups/", "/status", "/history", "/storage", "/trigger", "/prune", "/cancel", "/restore"} {
+		mux.Handle(pattern, a)
+	}
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ok, basic := a.authenticate(r)
+	if !ok {
+		a.unauthorized(w)
+		return
+	}
+	//A browser sends basic auth credentials along with requests other
+	//sites make it send, so changes must come with a header those can't set
+	if basic && r.Method != http.MethodGet && r.Header.Get(DASHBOARD_HEADER) == "" {
+		writeAPIError(w, http.StatusForbidden, fmt.Errorf("requests authenticated with basic auth must set the %s header", DASHBOARD_HEADER))
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// Checks the request's token or basic auth credentials, and tells which
+// it was authenticated with.
+func (a *API) authenticate(r *http.Request) (ok, basic bool) {
+	if user, password, found := r.BasicAuth(); found && a.user != "" {
+		ok := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) & subtle.ConstantTimeCompare([]byte(password), []byte(a.password))
+		return ok == 1, true
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		//EventSource in browsers can't set headers
+		token = r.URL.Query().Get("token")
+	}
+	return a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1, false
+}
+
+func (a *API) unauthorized(w http.ResponseWriter) {
+	if a.user != "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mcbk", charset="UTF-8"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	writeAPIError(w, http.StatusUnauthorized, errors.New("missing or wrong credentials"))
+}
+
+// Waits for triggered backups and restores to finish, e.g. after ctx was
+// cancelled, so none is left with world saving turned off or the server
+// stopped.
+func (a *API) Wait() {
+	a.wg.Wait()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// The servers named in the request's server parameter, or all of them.
+func (a *API) pick(r *http.Request) ([]*Server, error) {
+	names := r.URL.Query().Get("server")
+	if names == "" {
+		return a.servers, nil
+	}
+	var picked []*Server
+	for _, name := range strings.Split(names, ",") {
+		i := slices.IndexFunc(a.servers, func(s *Server) bool { return s.Name() == name })
+		if i < 0 {
+			return nil, fmt.Errorf("no server named %q", name)
+		}
+		picked = append(picked, a.servers[i])
+	}
+	return picked, nil
+}
+
+// Snapshots of every picked server, oldest first within each server.
+func (a *API) snapshots(r *http.Request) ([]Snapshot, int, error) {
+	servers, err := a.pick(r)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	all := []Snapshot{}
+	for _, s := range servers {
+		snaps, err := s.Snapshots(r.Context())
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("listing snapshots for %s: %w", s.Name(), err)
+		}
+		for _, snap := range snaps {
+			snap.Server = s.Name()
+			all = append(all, snap)
+		}
+	}
+	return all, http.StatusOK, nil
+}
+
+func (a *API) listBackups(w http.ResponseWriter, r *http.Request) {
+	snaps, status, err := a.snapshots(r)
+	if err != nil {
+		writeAPIError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snaps)
+}
+
+func (a *API) getBackup(w http.ResponseWriter, r *http.Request) {
+	snaps, status, err := a.snapshots(r)
+	if err != nil {
+		writeAPIError(w, status, err)
+		return
+	}
+	id := r.PathValue("id")
+	i := slices.IndexFunc(snaps, func(s Snapshot) bool { return s.ID == id })
+	if i < 0 {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no snapshot %q", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, snaps[i])
+}
+
+// The state of one server's backups since the daemon started.
+type apiStatus struct {
+	Server       string     `json:"server"`
+	InProgress   bool       `json:"in_progress"`
+	LastBackup   *time.Time `json:"last_backup"`  //Start of the last attempt
+	LastSuccess  *time.Time `json:"last_success"` //End of the last successful backup
+	LastDuration float64    `json:"last_duration_seconds"`
+	LastSize     int64      `json:"last_size"`
+	LastError    string     `json:"last_error,omitempty"`
+	Successes    int64      `json:"successes"`
+	Failures     int64      `json:"failures"`
+	Progress     *Progress  `json:"progress,omitempty"` //How far the running backup has got, once it has started saving
+}
+
+func (a *API) status(w http.ResponseWriter, r *http.Request) {
+	servers, err := a.pick(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	statuses := []apiStatus{}
+	for _, s := range servers {
+		sm, _ := a.runner.Metrics.status(s.Name())
+		st := apiStatus{
+			Server:       s.Name(),
+			InProgress:   sm.inProgress,
+			LastDuration: sm.lastDuration.Seconds(),
+			LastSize:     sm.lastSize,
+			Successes:    sm.successes,
+			Failures:     sm.failures,
+		}
+		if !sm.lastBackup.IsZero() {
+			st.LastBackup = &sm.lastBackup
+		}
+		if !sm.lastSuccess.IsZero() {
+			st.LastSuccess = &sm.lastSuccess
+		}
+		if sm.lastErr != nil {
+			st.LastError = sm.lastErr.Error()
+		}
+		if sm.inProgress && sm.progress.Server != "" {
+			st.Progress = &sm.progress
+		}
+		statuses = append(statuses, st)
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// Something that happened to a triggered backup, as sent to the client.
+type apiEvent struct {
+	Kind     string    `json:"event"` //"start", "progress", "success", "failure", "replication_failure", "size_anomaly", "source_corrupt", or "done" once the run is over
+	Server   string    `json:"server"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds,omitempty"`
+	Snapshot string    `json:"snapshot,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`   //For progress, bytes read so far
+	Total    int64     `json:"total,omitempty"`   //For progress, bytes to read in all if known
+	Percent  float64   `json:"percent,omitempty"` //For progress, how far the backup has got if the total is known
+}
+
+// Passes the events of a triggered backup on to the client streaming them.
+type chanNotifier chan<- apiEvent
+
+func (c chanNotifier) Notify(ev Event) error {
+	e := apiEvent{Kind: string(ev.Kind), Server: ev.Server, Time: ev.Time, Duration: ev.Duration.Seconds(), Snapshot: ev.Snapshot.ID, Size: ev.Snapshot.Size, Remote: ev.Remote}
+	if ev.Err != nil {
+		e.Error = ev.Err.Error()
+	}
+	//Never hold up the backup for a slow client
+	select {
+	case c <- e:
+	default:
+	}
+	return nil
+}
+
+// Passes the progress of a triggered backup on the same way.
+func (c chanNotifier) progress(p Progress) {
+	if p.Done {
+		return
+	}
+	select {
+	case c <- apiEvent{Kind: "progress", Server: p.Server, Time: time.Now(), Bytes: p.Bytes, Total: p.Total, Percent: p.Percent}:
+	default:
+	}
+}
+
+// Starts a backup of each picked server in the background, skip_idle or
+// not. With Accept: text/event-stream, its events are streamed until every
+// backup is done; otherwise the response returns straight away.
+func (a *API) trigger(w http.ResponseWriter, r *http.Request) {
+	servers, err := a.pick(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	var started []*Server
+	for _, s := range servers {
+		if _, busy := a.running.LoadOrStore(s.Name(), true); !busy {
+			started = append(started, s)
+		}
+	}
+	if len(started) == 0 {
+		writeAPIError(w, http.StatusConflict, errors.New("a triggered backup is already running"))
+		return
+	}
+
+	events := make(chan apiEvent, 64)
+	forced := *a.runner
+	forced.Force = true
+	forced.Notifiers = append(slices.Clip(forced.Notifiers), chanNotifier(events))
+	forced.Progress = func(p Progress) {
+		if a.runner.Progress != nil {
+			a.runner.Progress(p)
+		}
+		chanNotifier(events).progress(p)
+	}
+	var done sync.WaitGroup
+	for _, s := range started {
+		a.wg.Add(1)
+		done.Add(1)
+		go func() {
+			defer a.wg.Done()
+			defer done.Done()
+			defer a.running.Delete(s.Name())
+			a.logger.Info("Backup triggered through the API", "server", s.Name())
+			ev := apiEvent{Kind: "done", Server: s.Name()}
+			if err := forced.Backup(a.ctx, s); err != nil {
+				ev.Error = err.Error()
+			}
+			ev.Time = time.Now()
+			events <- ev
+		}()
+	}
+	names := make([]string, len(started))
+	for i, s := range started {
+		names[i] = s.Name()
+	}
+	go func() {
+		done.Wait()
+		close(events)
+	}()
+	//Without a client streaming the events, they must still be taken off
+	//the channel so the backups don't block
+	drain := func() {
+		go func() {
+			for range events {
+			}
+		}()
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		drain()
+		writeJSON(w, http.StatusAccepted, map[string]any{"started": names})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(API_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, data)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			//The backups carry on without the client
+			drain()
+			return
+		}
+	}
+}
+
+// The outcome of pruning one server.
+type apiPruneResult struct {
+	Server  string `json:"server"`
+	Removed int    `json:"removed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Prunes each picked server under its lock, like "mcbk prune".
+func (a *API) prune(w http.ResponseWriter, r *http.Request) {
+	servers, err := a.pick(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	results := []apiPruneResult{}
+	status := http.StatusOK
+	for _, s := range servers {
+		res := apiPruneResult{Server: s.Name()}
+		//Not cut short if the client goes away
+		unlock, err := s.Lock(a.ctx)
+		if err == nil {
+			res.Removed, err = a.runner.Prune(a.ctx, s)
+			unlock()
+		}
+		if err != nil {
+			res.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+		results = append(results, res)
+	}
+	writeJSON(w, status, results)
+}
+
+// Cancels the backup of each picked server that is running in the daemon,
+// whatever started it. Answers once the backups have been told to stop;
+// they finish cleaning up, e.g. turning saving back on, in the background.
+func (a *API) cancel(w http.ResponseWriter, r *http.Request) {
+	servers, err := a.pick(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	cancelled := []string{}
+	for _, s := range servers {
+		if s.CancelBackup() {
+			a.logger.Info("Backup cancelled through the API", "server", s.Name())
+			cancelled = append(cancelled, s.Name())
+		}
+	}
+	if len(cancelled) == 0 {
+		writeAPIError(w, http.StatusConflict, errors.New("no backup is running"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"cancelled": cancelled})
+}
+
+// Recorded runs of every picked server, oldest first: the last limit of
+// them, 100 by default, or all of them with limit=0.
+func (a *API) history(w http.ResponseWriter, r *http.Request) {
+	servers, err := a.pick(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+	}
+	records := []HistoryRecord{}
+	for _, s := range servers {
+		list, err := s.History()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("reading history for %s: %w", s.Name(), err))
+			return
+		}
+		records = append(records, list...)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Start.Before(records[j].Start)
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// The space one server's backups take up, and what is left on the disk
+// holding them, if they are stored on this machine.
+type apiStorage struct {
+	Server    string `json:"server"`
+	Dir       string `json:"dir,omitempty"`        //Where the backups are stored
+	Used      *int64 `json:"used"`                 //Bytes the backups take up
+	DiskFree  int64  `json:"disk_free,omitempty"`  //Bytes free on their disk, if known
+	DiskTotal int64  `json:"disk_total,omitempty"` //Size of their disk, if known
+}
+
+func (a *API) storage(w http.ResponseWriter, r *http.Request) {
+	servers, err := a.pick(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	storage := []apiStorage{}
+	for _, s := range servers {
+		st := apiStorage{Server: s.Name()}
+		used, ok, err := s.diskUsage(r.Context())
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("measuring the backups of %s: %w", s.Name(), err))
+			return
+		}
+		if ok {
+			st.Dir, st.Used = s.storageDir(), &used
+			//Unknown on platforms that can't tell
+			st.DiskFree, _ = freeSpace(existingParent(st.Dir))
+			st.DiskTotal, _ = diskSize(existingParent(st.Dir))
+		}
+		storage = append(storage, st)
+	}
+	writeJSON(w, http.StatusOK, storage)
+}
+
+// Restores a snapshot of the one picked server, like "mcbk restore": the
+// id parameter names it, or "latest". Each path parameter is put back in
+// place in minecraft_dir, or with target everything, or those paths, is
+// restored into that directory instead. target is relative to the server's
+// subdirectory of the restore directory, and refused without one, so
+// callers can't have the daemon replace arbitrary directories. With
+// restart=true the server is stopped first and started again afterwards.
+// Answers once it is done.
+func (a *API) restore(w http.ResponseWriter, r *http.Request) {
+	servers, err := a.pick(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	if len(servers) != 1 {
+		writeAPIError(w, http.StatusBadRequest, errors.New("restore works on a single server, pick one with server"))
+		return
+	}
+	s, q := servers[0], r.URL.Query()
+	id, paths, target, restart := q.Get("id"), q["path"], q.Get("target"), q.Get("restart") == "true"
+	switch {
+	case id == "":
+		err = errors.New("missing id, the snapshot to restore or \"latest\"")
+	case len(paths) == 0 && target == "":
+		err = errors.New("restoring a whole snapshot in place would replace all of minecraft_dir; give path or target")
+	case restart && target != "":
+		err = errors.New("restart is for restoring in place; the server can keep running while restoring into target")
+	case target != "" && a.restoreDir == "":
+		err = errors.New("restoring into target is disabled, set daemon.restore_dir to allow it")
+	case target != "" && !filepath.IsLocal(filepath.FromSlash(target)):
+		err = fmt.Errorf("target must be a relative path within daemon.restore_dir, not %q", target)
+	case target != "":
+		//No symlink on the way may lead the restore elsewhere
+		target, err = extractPath(filepath.Join(a.restoreDir, s.Name()), filepath.FromSlash(target))
+	case restart:
+		err = s.CanRestart()
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.logger.Info("Restore requested through the API", "server", s.Name(), "snapshot", id, "paths", paths, "target", target, "restart", restart)
+	//Not cut short if the client goes away, which could leave the server
+	//down, and waited for as the daemon stops
+	a.wg.Add(1)
+	id, err = s.Restore(a.ctx, id, paths, target, restart)
+	a.wg.Done()
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrWorldInUse) {
+			status = http.StatusConflict
+		}
+		writeAPIError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"server": s.Name(), "snapshot": id, "target": cmp.Or(target, s.conf.MinecraftDir)})
+}
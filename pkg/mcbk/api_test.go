@@ -0,0 +1,155 @@
+package mcbk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const TEST_API_TOKEN = "test-token"
+
+// A server with the tar backend, keeping its archives in a temporary
+// directory, and a world holding level.dat. extra is added to its config
+// before any table.
+func newTestServer(t *testing.T, extra string) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	mc := filepath.Join(dir, "mc")
+	if err := os.MkdirAll(filepath.Join(mc, "world"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mc, "world", "level.dat"), []byte("level"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "mcbk.toml")
+	config := fmt.Sprintf("name = \"survival\"\nbackend = \"tar\"\nbackup_root = %q\nminecraft_dir = %q\nminecraft_log_path = %q\nworlds = [\"world\"]\n%s\n[rcon]\npassword = \"x\"\n", filepath.Join(dir, "backups"), mc, filepath.Join(mc, "logs", "latest.log"), extra)
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(c.Servers[0], slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.backend.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// An API for a test server with one snapshot of its world, whose ID is
+// returned along with it.
+func newTestAPI(t *testing.T) (*API, string) {
+	t.Helper()
+	s := newTestServer(t, "")
+	snap, err := s.backend.Save(context.Background(), s.conf.MinecraftDir, []string{"world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAPI(context.Background(), TEST_API_TOKEN, &Runner{}, []*Server{s}, s.logger), snap.ID
+}
+
+// Sends a request to the API with the token, returning what it answered.
+func serveTestAPI(a *API, method, path string, query url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path+"?"+query.Encode(), nil)
+	req.Header.Set("Authorization", "Bearer "+TEST_API_TOKEN)
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	a, _ := newTestAPI(t)
+	a.AllowBasicAuth("admin", "secret")
+	for _, tt := range []struct {
+		name string
+		set  func(*http.Request)
+		want int
+	}{
+		{"no credentials", func(*http.Request) {}, http.StatusUnauthorized},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+TEST_API_TOKEN) }, http.StatusOK},
+		{"token parameter", func(r *http.Request) { r.URL.RawQuery = "token=" + TEST_API_TOKEN }, http.StatusOK},
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("admin", "guess") }, http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/backups", nil)
+			tt.set(req)
+			rec := httptest.NewRecorder()
+			a.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	//A page on another site can make a browser send basic auth, but not the header
+	req := httptest.NewRequest(http.MethodPost, "/prune", nil)
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("a change with basic auth and no %s header got status %d, want %d", DASHBOARD_HEADER, rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestAPIListBackups(t *testing.T) {
+	a, id := newTestAPI(t)
+	rec := serveTestAPI(a, http.MethodGet, "/backups", nil)
+	var snaps []Snapshot
+	if err := json.NewDecoder(rec.Body).Decode(&snaps); err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 || snaps[0].ID != id {
+		t.Errorf("got snapshots %+v, want only %s", snaps, id)
+	}
+	if rec := serveTestAPI(a, http.MethodGet, "/backups", url.Values{"server": {"creative"}}); rec.Code != http.StatusNotFound {
+		t.Errorf("an unknown server got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAPIRestoreTarget(t *testing.T) {
+	a, id := newTestAPI(t)
+	outside := t.TempDir()
+	if rec := serveTestAPI(a, http.MethodPost, "/restore", url.Values{"id": {id}, "target": {"check"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("a target without a restore directory got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	restoreDir := t.TempDir()
+	a.AllowRestoreDir(restoreDir)
+	if err := os.MkdirAll(filepath.Join(restoreDir, "survival"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(restoreDir, "survival", "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{outside, "../escape", "link/check"} {
+		if rec := serveTestAPI(a, http.MethodPost, "/restore", url.Values{"id": {id}, "target": {target}}); rec.Code != http.StatusBadRequest {
+			t.Errorf("target %q got status %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) > 0 {
+		t.Errorf("restored outside of the restore directory: %v", entries)
+	}
+
+	rec := serveTestAPI(a, http.MethodPost, "/restore", url.Values{"id": {"latest"}, "target": {"check"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	data, err := os.ReadFile(filepath.Join(restoreDir, "survival", "check", "world", "level.dat"))
+	if err != nil || string(data) != "level" {
+		t.Errorf("the restored level.dat holds %q, %v", data, err)
+	}
+}
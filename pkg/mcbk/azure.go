@@ -0,0 +1,201 @@
+package mcbk
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const AZURE_MAX_PUT_SIZE = 5000 << 20  //Largest blob a single Put Blob may upload
+const AZURE_API_VERSION = "2021-08-06" //Blob service REST API version requested
+
+// Settings for mirroring backups into an Azure Blob Storage container after
+// each successful backup, authorized by a shared access signature.
+type AzureConfig struct {
+	Account    string `json:"account"`                 //Storage account name
+	Container  string `json:"container"`               //Container to upload into. Empty disables uploads
+	SASToken   string `json:"sas_token" secret:"true"` //Shared access signature with read, add, create, write, delete and list permissions on the container. Defaults to $AZURE_STORAGE_SAS_TOKEN
+	Endpoint   string `json:"endpoint"`                //Blob service URL, default https://<account>.blob.core.windows.net. For Azurite or other clouds
+	Prefix     string `json:"prefix"`                  //Name prefix for every uploaded blob
+	AccessTier string `json:"access_tier"`             //"Hot", "Cool", "Cold" or "Archive", the account's default if empty
+	Retries    int    `json:"retries"`                 //Attempts per request before giving up
+}
+
+// Whether uploads are configured.
+func (c AzureConfig) Enabled() bool {
+	return c.Container != ""
+}
+
+// The container's URL, without the SAS token.
+func (c AzureConfig) containerURL() string {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + c.Account + ".blob.core.windows.net"
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/" + c.Container
+}
+
+func (c AzureConfig) validate() []error {
+	var errs []error
+	if c.Account == "" && c.Endpoint == "" {
+		errs = append(errs, errors.New("azure.account must be set"))
+	}
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid azure.endpoint %q, expected a URL such as https://account.blob.core.windows.net", c.Endpoint))
+		}
+	}
+	switch c.AccessTier {
+	case "", "Hot", "Cool", "Cold", "Archive":
+	default:
+		errs = append(errs, fmt.Errorf("unknown azure.access_tier %q, expected \"Hot\", \"Cool\", \"Cold\" or \"Archive\"", c.AccessTier))
+	}
+	if c.Retries < 1 {
+		errs = append(errs, errors.New("azure.retries must be at least 1"))
+	}
+	return errs
+}
+
+// A minimal client for the Blob service REST API, covering the calls a
+// one-way sync needs.
+type azureClient struct {
+	conf      AzureConfig
+	container string //URL of the container
+	sas       string //Query string of the shared access signature
+	http      *http.Client
+	log       *slog.Logger
+}
+
+func newAzureClient(c AzureConfig, log *slog.Logger) (*azureClient, error) {
+	sas := c.SASToken
+	if sas == "" {
+		sas = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	//As copied from the portal, with or without the question mark
+	sas = strings.TrimPrefix(sas, "?")
+	if sas == "" {
+		return nil, errors.New("no Azure credentials, set azure.sas_token or AZURE_STORAGE_SAS_TOKEN")
+	}
+	return &azureClient{conf: c, container: c.containerURL(), sas: sas, http: newUploadHTTPClient(), log: log}, nil
+}
+
+// Sends a request for the container, or a blob in it if key isn't empty,
+// retrying as sendWithRetries does. body is called once per attempt and
+// may be nil. The caller must close the returned response's body.
+func (c *azureClient) do(ctx context.Context, method, key string, query url.Values, header http.Header, body func() (io.ReadCloser, int64, error)) (*http.Response, error) {
+	u := c.container
+	if key != "" {
+		u += "/" + (&url.URL{Path: key}).EscapedPath()
+	}
+	//Errors show the URL without the signature
+	what := method + " " + u
+	u += "?" + c.sas
+	if len(query) > 0 {
+		u += "&" + query.Encode()
+	}
+	return sendWithRetries(ctx, c.log, "Azure", c.conf.Retries, what, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			req.Header = header.Clone()
+		}
+		req.Header.Set("X-Ms-Version", AZURE_API_VERSION)
+		client := c.http
+		if body != nil {
+			rc, size, err := body()
+			if err != nil {
+				return nil, err
+			}
+			req.Body, req.ContentLength = rc, size
+			client = uploadClient(c.http, size)
+		}
+		resp, err := client.Do(req)
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			//Its message includes the signed URL
+			err = urlErr.Err
+		}
+		return resp, err
+	}, xmlResponseError)
+}
+
+func (c *azureClient) list(ctx context.Context, prefix string) ([]remoteObject, error) {
+	var objects []remoteObject
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Blobs []struct {
+				Name       string
+				Properties struct {
+					LastModified  string `xml:"Last-Modified"`
+					ContentLength int64  `xml:"Content-Length"`
+				}
+			} `xml:"Blobs>Blob"`
+			NextMarker string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing container listing: %w", err)
+		}
+		for _, b := range result.Blobs {
+			modified, err := time.Parse(time.RFC1123, b.Properties.LastModified)
+			if err != nil {
+				return nil, fmt.Errorf("parsing container listing: %w", err)
+			}
+			objects = append(objects, remoteObject{Key: b.Name, Size: b.Properties.ContentLength, LastModified: modified})
+		}
+		if result.NextMarker == "" {
+			return objects, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (c *azureClient) put(ctx context.Context, key, path string, size int64) error {
+	if size > AZURE_MAX_PUT_SIZE {
+		return fmt.Errorf("%s is larger than the 5000 MiB Azure allows in one upload", path)
+	}
+	header := http.Header{}
+	header.Set("X-Ms-Blob-Type", "BlockBlob")
+	header.Set("Content-Type", "application/octet-stream")
+	if c.conf.AccessTier != "" {
+		header.Set("X-Ms-Access-Tier", c.conf.AccessTier)
+	}
+	resp, err := c.do(ctx, http.MethodPut, key, nil, header, func() (io.ReadCloser, int64, error) {
+		body, err := openUploadBody(path, size)
+		return body, size, err
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *azureClient) delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,204 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A single saved copy of the world, as reported by a backend.
+type Snapshot struct {
+	ID     string    `json:"id"`               //Backend-specific identifier, accepted by Restore
+	Time   time.Time `json:"time"`             //When the snapshot was taken
+	Branch string    `json:"branch,omitempty"` //Branch or tag the snapshot was saved under, if the backend has one
+	Repo   string    `json:"repo"`             //Repository or directory the snapshot lives in
+	Size   int64     `json:"size"`             //Approximate size in bytes, 0 if unknown
+	Server string    `json:"server,omitempty"` //Name of the server profile, filled in by callers that list several
+
+	Tags    []string `json:"tags,omitempty"`    //Labels given with "mcbk backup -tag", from the history file
+	Comment string   `json:"comment,omitempty"` //Note given with "mcbk backup -comment", from the history file
+
+	PinnedUntil *time.Time `json:"pinned_until,omitempty"` //Until when pruning leaves the snapshot alone, from the history file
+}
+
+// A backup engine. The core flow only talks to this interface, so other
+// engines can be swapped in for bup. Cancelling the context passed to any
+// method stops the work in progress.
+type Backend interface {
+	// Prepares the backup destination, creating it if needed.
+	Init(ctx context.Context) error
+	// Snapshots the given directory. If paths isn't empty, only those
+	// files and directories in it, given relative to dir, are included;
+	// the snapshot still restores them to the same places under dir.
+	Save(ctx context.Context, dir string, paths []string) (Snapshot, error)
+	// Returns all existing snapshots, oldest first.
+	List(ctx context.Context) ([]Snapshot, error)
+	// Restores the snapshot with the given ID into the target directory.
+	Restore(ctx context.Context, id, target string) error
+	// Removes backups that have aged out under the backend's built-in policy,
+	// used when no retention policy is configured.
+	Prune(ctx context.Context) error
+	// Removes the given snapshots, as chosen by the retention policy.
+	Delete(ctx context.Context, snaps []Snapshot) error
+}
+
+// Implemented by backends that keep their backups as plain files under one
+// directory, so they can be mirrored elsewhere.
+type fileStore interface {
+	//Returns the directory and a filepath.Match pattern for the entries in
+	//it that belong to this backend
+	Files() (dir, pattern string)
+}
+
+type runStartKey struct{}
+
+// Returns ctx carrying the time a backup run started, so backends that pick
+// their destination by date, like bup's monthly repos, pick the same one at
+// every step of the run, even if it straddles midnight on the 1st.
+func withRunStart(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, runStartKey{}, t)
+}
+
+// The start of the run ctx belongs to, or the current time outside of one.
+func runStart(ctx context.Context) time.Time {
+	if t, ok := ctx.Value(runStartKey{}).(time.Time); ok {
+		return t
+	}
+	return time.Now()
+}
+
+// Joins paths, relative to dir, onto it. Without any paths that is just dir.
+func absPaths(dir string, paths []string) []string {
+	if len(paths) == 0 {
+		return []string{dir}
+	}
+	abs := make([]string, len(paths))
+	for i, p := range paths {
+		abs[i] = filepath.Join(dir, p)
+	}
+	return abs
+}
+
+// Walks each of paths within dir, or all of dir if there are none.
+func walkPaths(dir string, paths []string, fn fs.WalkDirFunc) error {
+	for _, root := range absPaths(dir, paths) {
+		if err := filepath.WalkDir(root, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const COMMAND_CANCEL_GRACE = 10 * time.Second //How long a cancelled external command gets to exit
+
+// Creates the backend selected for a server.
+func NewBackend(c ServerConfig) (Backend, error) {
+	excludes, err := parseExcludes(c.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Backend {
+	case "bup":
+		return &bupBackend{root: c.BackupRoot, prefix: c.BackupDirPrefix, branch: c.BupBranchName, dir: c.MinecraftDir, excludes: excludes, gc: c.GC, single: c.BupLayout == "single", conf: c.Bup}, nil
+	case "restic":
+		return &resticBackend{conf: c.Restic, dir: c.MinecraftDir, tag: resticTag(c.Name), excludes: excludes, gc: c.GC}, nil
+	case "tar":
+		return newTarBackend(c.Tar, excludes), nil
+	case "dedup":
+		return newDedupBackend(c.Dedup, excludes, c.GC), nil
+	case "borg":
+		return &borgBackend{conf: c.Borg, prefix: c.BackupDirPrefix, excludes: excludes, gc: c.GC}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", c.Backend)
+}
+
+// Runs an external command and returns its stdout. On failure the error
+// includes whatever the command wrote to stderr. If ctx is cancelled the
+// command gets an interrupt so it can clean up, and is killed if it hasn't
+// exited within COMMAND_CANCEL_GRACE.
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return runCommandEnv(ctx, nil, name, args...)
+}
+
+// Like runCommand, with extra environment variables in "KEY=value" form
+// added to the inherited environment.
+func runCommandEnv(ctx context.Context, env []string, name string, args ...string) ([]byte, error) {
+	return runCommandDir(ctx, "", env, name, args...)
+}
+
+// Like runCommandEnv, running the command in dir instead of the current
+// directory when dir isn't empty.
+func runCommandDir(ctx context.Context, dir string, env []string, name string, args ...string) ([]byte, error) {
+	return runCommandStream(ctx, dir, env, nil, nil, name, args...)
+}
+
+// Like runCommandDir, passing each line of stdout to onStdout and of stderr
+// to onStderr as the command writes it, so progress can be followed while
+// it runs. Lines end at "\n" or "\r", as tools redraw their progress with
+// the latter. A callback returns true to leave its line out of the output
+// kept. Either may be nil.
+func runCommandStream(ctx context.Context, dir string, env []string, onStdout, onStderr func(line string) bool, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = COMMAND_CANCEL_GRACE
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	outLines := &lineWriter{out: &stdout, onLine: onStdout}
+	errLines := &lineWriter{out: &stderr, onLine: onStderr}
+	cmd.Stdout, cmd.Stderr = outLines, errLines
+	err := cmd.Run()
+	outLines.flush()
+	errLines.flush()
+	if err != nil {
+		cmdline := name + " " + strings.Join(args, " ")
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return stdout.Bytes(), fmt.Errorf("%s: %w: %s", cmdline, err, msg)
+		}
+		return stdout.Bytes(), fmt.Errorf("%s: %w", cmdline, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// Passes what is written to it on to out a line at a time, leaving out the
+// lines onLine handles. Without onLine, writes go straight through.
+type lineWriter struct {
+	out     *bytes.Buffer
+	onLine  func(line string) bool
+	partial []byte //The start of a line still being written
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	if w.onLine == nil {
+		return w.out.Write(p)
+	}
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexAny(w.partial, "\r\n")
+		if i < 0 {
+			return len(p), nil
+		}
+		if !w.onLine(string(w.partial[:i])) {
+			w.out.Write(w.partial[:i+1])
+		}
+		w.partial = w.partial[i+1:]
+	}
+}
+
+// Passes on the last line, if it wasn't ended.
+func (w *lineWriter) flush() {
+	if len(w.partial) > 0 && !w.onLine(string(w.partial)) {
+		w.out.Write(w.partial)
+	}
+	w.partial = nil
+}
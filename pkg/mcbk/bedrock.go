@@ -0,0 +1,191 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const BEDROCK_FLAVOR = "bedrock"
+const BEDROCK_WORLDS_DIR = "worlds"                   //Where Bedrock Dedicated Server keeps its worlds, relative to its directory
+const BEDROCK_QUERY_INTERVAL = 500 * time.Millisecond //How long to wait for "save query" to report the files ready before asking again
+
+// Bedrock has no save-off or save-all. "save hold" prepares a consistent
+// copy, "save query" says when it is ready and "save resume" lets the
+// server carry on writing.
+var bedrockPatterns = VerifyConfig{
+	List:    `players online`,
+	SaveOff: `Saving\.\.\.|already being processed`,
+	SaveAll: `Data saved\. Files are now ready to be copied`,
+	SaveOn:  `Changes to the level are resumed`,
+}
+
+var bedrockCommands = map[string]string{
+	"save-off": "save hold",
+	"save-all": "save query",
+	"save-on":  "save resume",
+}
+
+// A prefix the server or a wrapper may put in front of console output,
+// e.g. "[2024-03-01 12:00:00:123 INFO] ".
+var bedrockLinePrefix = regexp.MustCompile(`^\[[^\]]*\]\s*`)
+
+// A file listed by "save query", with the length to copy. The server keeps
+// appending to some files while held, and anything past the length isn't
+// part of the consistent copy.
+type bedrockFile struct {
+	Path   string //Relative to the worlds directory
+	Length int64
+}
+
+// Parses the file list "save query" prints once the files are ready, e.g.
+// "Bedrock level/db/000005.ldb:12345, Bedrock level/level.dat:2345".
+func parseBedrockManifest(line string) ([]bedrockFile, error) {
+	line = strings.TrimSpace(bedrockLinePrefix.ReplaceAllString(line, ""))
+	var files []bedrockFile
+	for _, entry := range strings.Split(line, ", ") {
+		i := strings.LastIndexByte(entry, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("unexpected entry %q in the save query file list", entry)
+		}
+		n, err := strconv.ParseInt(entry[i+1:], 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("unexpected length in save query entry %q", entry)
+		}
+		path := filepath.Clean(filepath.FromSlash(entry[:i]))
+		if !filepath.IsLocal(path) {
+			return nil, fmt.Errorf("save query listed a file outside the worlds directory: %q", entry[:i])
+		}
+		files = append(files, bedrockFile{Path: path, Length: n})
+	}
+	return files, nil
+}
+
+// Asks "save query" until the server reports the held files are ready,
+// within the save-all timeout, and returns the files it lists.
+func (s *Server) bedrockQuery(ctx context.Context) ([]bedrockFile, error) {
+	timeout := s.conf.CommandTimeouts.get("save-all", s.conf.VerifyTimeout.Duration)
+	queryCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	follower, err := s.followConsole(queryCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer follower.Close()
+
+	//The file list is the line after the one saying the files are ready
+	ready := s.patterns["save-all"]
+	found := false
+	var manifest string
+	match := func(line string) bool {
+		if found {
+			manifest = line
+			return strings.TrimSpace(line) != ""
+		}
+		found = ready.MatchString(line)
+		return false
+	}
+	for {
+		if !found {
+			if err := s.sendCommand(queryCtx, bedrockCommands["save-all"]); err != nil {
+				return nil, err
+			}
+		}
+		waitCtx, cancelWait := context.WithTimeout(queryCtx, BEDROCK_QUERY_INTERVAL)
+		err := follower.waitFor(waitCtx, match)
+		cancelWait()
+		if err == nil {
+			return parseBedrockManifest(manifest)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		if queryCtx.Err() != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, errors.New("the server didn't report the world files ready in time")
+		}
+		if !found {
+			s.log().Debug("World files not ready yet, asking again", "phase", "save-all")
+		}
+	}
+}
+
+// Copies the files a held Bedrock server listed into a staging directory
+// under backup_root, cut to their listed lengths, so the server can resume
+// while the backup is taken from the copy. Returns the staging directory,
+// laid out like minecraft_dir, and a function that removes it again.
+func (s *Server) bedrockStage(ctx context.Context) (string, func(), error) {
+	files, err := s.bedrockQuery(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := os.MkdirAll(s.conf.BackupRoot, 0770); err != nil {
+		return "", nil, err
+	}
+	//Hidden, so nothing mistakes it for a backup
+	dir, err := os.MkdirTemp(s.conf.BackupRoot, "."+s.conf.BackupDirPrefix+"-bedrock-")
+	if err != nil {
+		return "", nil, err
+	}
+	release := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			s.log().Error("Error removing the Bedrock staging directory", "phase", "snapshot", "dir", dir, "error", err)
+		}
+	}
+	var total int64
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			release()
+			return "", nil, err
+		}
+		src := filepath.Join(s.conf.MinecraftDir, BEDROCK_WORLDS_DIR, f.Path)
+		dst := filepath.Join(dir, BEDROCK_WORLDS_DIR, f.Path)
+		if err := copyPrefix(src, dst, f.Length); err != nil {
+			release()
+			return "", nil, err
+		}
+		total += f.Length
+	}
+	s.log().Debug("Copied held world files", "phase", "snapshot", "files", len(files), "size", total, "dir", dir)
+	return dir, release, nil
+}
+
+// Copies the first n bytes of src to dst, keeping its modification time.
+func copyPrefix(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0770); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(out, in, n)
+	if errors.Is(err, io.EOF) {
+		err = fmt.Errorf("%s is shorter than the %d bytes the server listed", src, n)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,333 @@
+package mcbk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const BORG_TIME_FORMAT = "2006-01-02T15:04:05"             //Timestamp in archive names, and in borg's JSON without fractions
+const BORG_ARCHIVE_GLOB = "????-??-??T??:??:??"            //Matches the BORG_TIME_FORMAT part of archive names
+const BORG_JSON_TIME_FORMAT = "2006-01-02T15:04:05.999999" //Local time as borg reports it
+
+// Settings for the borg backend.
+type BorgConfig struct {
+	Repository     string `json:"repository"`               //Anything borg accepts as a repository, e.g. /srv/borg or ssh://host/./repo
+	Passphrase     string `json:"passphrase" secret:"true"` //Repository passphrase, defaults to $BORG_PASSPHRASE
+	PassphraseFile string `json:"passphrase_file"`          //Or a file containing it
+	Encryption     string `json:"encryption"`               //Mode used when creating the repository, e.g. "repokey-blake2" or "none"
+	Compression    string `json:"compression"`              //Passed to borg create --compression, e.g. "lz4" or "zstd,6"
+	KeepWithin     string `json:"keep_within"`              //Passed to borg prune --keep-within without a retention policy
+}
+
+// Stores backups as archives in a borg repository. Archives are named
+// <prefix>-YYYY-MM-DDTHH:MM:SS so several servers can share a repository.
+type borgBackend struct {
+	conf     BorgConfig
+	prefix   string
+	excludes []excludePattern
+	gc       GCConfig
+}
+
+// Runs borg with the repository and passphrase passed through the
+// environment, keeping the passphrase off the command line.
+func (b *borgBackend) borg(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	return b.borgStream(ctx, dir, nil, args...)
+}
+
+// Like borg, passing each line borg writes to stderr to onStderr as it does.
+func (b *borgBackend) borgStream(ctx context.Context, dir string, onStderr func(line string) bool, args ...string) ([]byte, error) {
+	env, err := b.env()
+	if err != nil {
+		return nil, err
+	}
+	return runCommandStream(ctx, dir, env, nil, onStderr, "borg", args...)
+}
+
+// The environment giving borg the repository and its passphrase.
+func (b *borgBackend) env() ([]string, error) {
+	env := []string{"BORG_REPO=" + b.conf.Repository}
+	switch {
+	case b.conf.PassphraseFile != "":
+		data, err := os.ReadFile(b.conf.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, "BORG_PASSPHRASE="+strings.TrimRight(string(data), "\r\n"))
+	case b.conf.Passphrase != "":
+		env = append(env, "BORG_PASSPHRASE="+b.conf.Passphrase)
+	}
+	return env, nil
+}
+
+// Creates the repository if it doesn't exist yet.
+func (b *borgBackend) Init(ctx context.Context) error {
+	if _, err := b.borg(ctx, "", "info", "--json"); err == nil {
+		return nil
+	}
+	_, err := b.borg(ctx, "", "init", "--encryption", b.conf.Encryption)
+	return err
+}
+
+// Archives dir with paths relative to it, so it can be restored anywhere.
+func (b *borgBackend) Save(ctx context.Context, dir string, paths []string) (Snapshot, error) {
+	now := time.Now()
+	name := b.prefix + "-" + now.Format(BORG_TIME_FORMAT)
+	args := append([]string{"create", "--json", "--progress", "--log-json", "--compression", b.conf.Compression}, borgExcludeArgs(b.excludes)...)
+	args = append(args, "::"+name)
+	if len(paths) == 0 {
+		args = append(args, ".")
+	}
+	//borg doesn't know the total, so that is measured
+	out, err := b.borgStream(ctx, dir, func(line string) bool {
+		var msg struct {
+			Type         string `json:"type"`
+			OriginalSize int64  `json:"original_size"`
+		}
+		if json.Unmarshal([]byte(line), &msg) != nil || msg.Type != "archive_progress" {
+			return false
+		}
+		if msg.OriginalSize > 0 {
+			reportProgress(ctx, msg.OriginalSize, 0)
+		}
+		return true
+	}, append(args, paths...)...)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var result struct {
+		Archive struct {
+			Name  string `json:"name"`
+			Stats struct {
+				DeduplicatedSize int64 `json:"deduplicated_size"`
+			} `json:"stats"`
+		} `json:"archive"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return Snapshot{}, fmt.Errorf("parsing borg create output: %w", err)
+	}
+	return Snapshot{ID: result.Archive.Name, Time: now, Repo: b.conf.Repository, Size: result.Archive.Stats.DeduplicatedSize}, nil
+}
+
+func (b *borgBackend) List(ctx context.Context) ([]Snapshot, error) {
+	out, err := b.borg(ctx, "", "list", "--json", "--glob-archives", b.prefix+"-"+BORG_ARCHIVE_GLOB)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Archives []struct {
+			Name  string `json:"name"`
+			Start string `json:"start"`
+		} `json:"archives"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("parsing borg list output: %w", err)
+	}
+	snaps := make([]Snapshot, 0, len(result.Archives))
+	for _, a := range result.Archives {
+		t, err := time.ParseInLocation(BORG_JSON_TIME_FORMAT, a.Start, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("archive %s: %w", a.Name, err)
+		}
+		snaps = append(snaps, Snapshot{ID: a.Name, Time: t, Repo: b.conf.Repository})
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Time.Before(snaps[j].Time)
+	})
+	return snaps, nil
+}
+
+func (b *borgBackend) spaceTarget(ctx context.Context) (string, time.Time, error) {
+	return repoSpaceTarget(ctx, localRepoPath(b.conf.Repository), b)
+}
+
+// Extracts an archive into target, which is created if needed.
+func (b *borgBackend) Restore(ctx context.Context, id, target string) error {
+	if err := os.MkdirAll(target, 0770); err != nil {
+		return err
+	}
+	_, err := b.borg(ctx, target, "extract", "::"+id)
+	return err
+}
+
+// Extracts only the given paths, which borg matches as prefixes.
+func (b *borgBackend) RestorePaths(ctx context.Context, id, target string, paths []string) error {
+	if err := os.MkdirAll(target, 0770); err != nil {
+		return err
+	}
+	args := []string{"extract", "::" + id}
+	for _, p := range paths {
+		args = append(args, filepath.ToSlash(p))
+	}
+	_, err := b.borg(ctx, target, args...)
+	return err
+}
+
+// Lists the files in an archive with borg list.
+func (b *borgBackend) ListFiles(ctx context.Context, id string) ([]SnapshotFile, error) {
+	return b.listFiles(ctx, id, false)
+}
+
+// Lists the regular files in an archive with the SHA-256 hashes of their
+// contents, which borg computes by reading back all of their chunks.
+func (b *borgBackend) HashFiles(ctx context.Context, id string) ([]SnapshotFile, error) {
+	return b.listFiles(ctx, id, true)
+}
+
+func (b *borgBackend) listFiles(ctx context.Context, id string, hash bool) ([]SnapshotFile, error) {
+	args := []string{"list", "--json-lines"}
+	if hash {
+		//With --json-lines the keys named in --format are added to each line
+		args = append(args, "--format", "{sha256}")
+	}
+	out, err := b.borg(ctx, "", append(args, "::"+id)...)
+	if err != nil {
+		return nil, err
+	}
+	var files []SnapshotFile
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		var item struct {
+			Type   string `json:"type"`
+			Path   string `json:"path"`
+			Size   int64  `json:"size"`
+			MTime  string `json:"mtime"`
+			SHA256 string `json:"sha256"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			return nil, fmt.Errorf("parsing borg list output: %w", err)
+		}
+		if item.Type == "d" || item.Path == "." || hash && item.Type != "-" {
+			continue
+		}
+		t, err := time.ParseInLocation(BORG_JSON_TIME_FORMAT, item.MTime, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", item.Path, err)
+		}
+		files = append(files, SnapshotFile{Path: strings.TrimPrefix(item.Path, "./"), Size: item.Size, ModTime: t.Truncate(time.Second), SHA256: item.SHA256})
+	}
+	return files, scanner.Err()
+}
+
+// Prunes archives older than keep_within and frees their space.
+func (b *borgBackend) Prune(ctx context.Context) error {
+	return b.prune(ctx, "--keep-within", b.conf.KeepWithin)
+}
+
+// Deletes archives older than keep_within like Prune, except the spared
+// ones. borg prune can't be told to keep particular archives, so keep_within
+// is applied here the way borg does, relative to now.
+func (b *borgBackend) PruneSparing(ctx context.Context, spared []Snapshot) error {
+	within, err := parseBorgInterval(b.conf.KeepWithin)
+	if err != nil {
+		return err
+	}
+	snaps, err := b.List(ctx)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-within)
+	var remove []Snapshot
+	for _, s := range snaps {
+		if s.Time.Before(cutoff) && !containsSnapshot(spared, s.ID) {
+			remove = append(remove, s)
+		}
+	}
+	return b.Delete(ctx, remove)
+}
+
+// Parses an interval as borg prune --keep-within takes it, a number of
+// hours, days, weeks, months or years such as "12H" or "2m". Like borg,
+// a month is 31 days and a year 365.
+func parseBorgInterval(text string) (time.Duration, error) {
+	units := map[byte]time.Duration{'H': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour, 'm': 31 * 24 * time.Hour, 'y': 365 * 24 * time.Hour}
+	if text == "" {
+		return 0, errors.New("borg.keep_within is empty")
+	}
+	unit, ok := units[text[len(text)-1]]
+	n, err := strconv.Atoi(text[:len(text)-1])
+	if !ok || err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid borg.keep_within %q, expected a number followed by H, d, w, m or y", text)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// Applies a retention policy with borg prune itself, which uses the same
+// grandfather-father-son rules as mcbk's engine. Returns how many archives
+// were removed.
+func (b *borgBackend) PruneRetention(ctx context.Context, r RetentionConfig) (int, error) {
+	before, err := b.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var args []string
+	for _, rule := range []struct {
+		flag  string
+		count int
+	}{
+		{"--keep-last", r.KeepLast},
+		{"--keep-hourly", r.KeepHourly},
+		{"--keep-daily", r.KeepDaily},
+		{"--keep-weekly", r.KeepWeekly},
+		{"--keep-monthly", r.KeepMonthly},
+	} {
+		if rule.count > 0 {
+			args = append(args, rule.flag, strconv.Itoa(rule.count))
+		}
+	}
+	if err := b.prune(ctx, args...); err != nil {
+		return 0, err
+	}
+	after, err := b.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(before) - len(after), nil
+}
+
+// Runs borg prune on this backend's archives with the given keep flags,
+// then compacts the repository so the space is actually freed.
+func (b *borgBackend) prune(ctx context.Context, keep ...string) error {
+	args := append([]string{"prune", "--glob-archives", b.prefix + "-" + BORG_ARCHIVE_GLOB}, keep...)
+	if _, err := b.borg(ctx, "", args...); err != nil {
+		return err
+	}
+	return b.compact(ctx)
+}
+
+// Deletes the given archives and frees their space.
+func (b *borgBackend) Delete(ctx context.Context, snaps []Snapshot) error {
+	if len(snaps) == 0 {
+		return nil
+	}
+	for _, s := range snaps {
+		if _, err := b.borg(ctx, "", "delete", "::"+s.ID); err != nil {
+			return err
+		}
+	}
+	return b.compact(ctx)
+}
+
+// Frees the space of deleted archives, unless gc.skip is set.
+func (b *borgBackend) compact(ctx context.Context) error {
+	if b.gc.Skip {
+		return nil
+	}
+	_, err := b.borg(ctx, "", append([]string{"compact"}, b.gc.thresholdArgs("--threshold", "")...)...)
+	return err
+}
+
+// Checks the repository and the new archive's metadata.
+func (b *borgBackend) Check(ctx context.Context, snap Snapshot) error {
+	_, err := b.borg(ctx, "", "check", "--glob-archives", snap.ID, "--last", "1")
+	return err
+}
@@ -0,0 +1,47 @@
+package mcbk
+
+import (
+	"context"
+	"path/filepath"
+)
+
+// Settings for staging backups through a btrfs snapshot.
+type BtrfsConfig struct {
+	Subvolume   string `json:"subvolume"`    //Subvolume holding minecraft_dir, e.g. "/srv/minecraft". Empty disables btrfs staging
+	SnapshotDir string `json:"snapshot_dir"` //Directory on the same filesystem to create snapshots in, default the subvolume's parent
+}
+
+func (c BtrfsConfig) Enabled() bool {
+	return c.Subvolume != ""
+}
+
+// Takes a read-only snapshot of the server's subvolume, which is instant,
+// so world saving can be turned back on while the backup is copied from
+// the snapshot. Returns where minecraft_dir appears in the snapshot, and a
+// function that deletes it again.
+func (s *Server) btrfsSnapshot(ctx context.Context) (string, func(), error) {
+	subvolume := s.conf.Btrfs.Subvolume
+	rel, err := s.dirWithin(subvolume, "subvolume "+subvolume)
+	if err != nil {
+		return "", nil, err
+	}
+	dir := s.conf.Btrfs.SnapshotDir
+	if dir == "" {
+		//Not inside the subvolume, where it would show up in later snapshots
+		dir = filepath.Dir(subvolume)
+	}
+
+	snapshot := filepath.Join(dir, s.stagingSnapshotName())
+	if _, err := runCommand(ctx, "btrfs", "subvolume", "snapshot", "-r", subvolume, snapshot); err != nil {
+		return "", nil, err
+	}
+	s.log().Debug("Took btrfs snapshot", "phase", "snapshot", "snapshot", snapshot)
+	release := func() {
+		//Also after a cancelled backup, or snapshots would pile up
+		_, err := runCommand(context.WithoutCancel(ctx), "btrfs", "subvolume", "delete", snapshot)
+		if err != nil {
+			s.log().Error("Error deleting btrfs snapshot", "phase", "snapshot", "snapshot", snapshot, "error", err)
+		}
+	}
+	return filepath.Join(snapshot, rel), release, nil
+}
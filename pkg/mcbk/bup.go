@@ -0,0 +1,512 @@
+package mcbk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const BUP_SAVE_TIME_FORMAT = "2006-01-02-150405" //How bup names saves within a branch
+const BUP_REPO_TIME_FORMAT = "2006-01"           //Month in repo names, e.g. minecraft-2024-03
+const BUP_SINGLE_REPO_SUFFIX = "repo"            //Name of the repo with bup_layout = "single", after the prefix, e.g. minecraft-repo
+
+// Month-year suffix of repos named before zero-padding, e.g. minecraft-3-2024.
+var legacyRepoSuffix = regexp.MustCompile(`^(\d{1,2})-(\d{4})$`)
+
+// The progress bup save draws on a terminal, e.g.
+// "Saving: 42.10% (1234/2931k, 10/25 files) 0m12s 100k/s".
+var bupSavingRegexp = regexp.MustCompile(`^Saving: [\d.]+% \((\d+)/(\d+)k,`)
+
+// The bup subcommands mcbk runs that bup.flags can add arguments to.
+var bupFlagCommands = []string{"init", "index", "save", "restore", "rm", "gc", "fsck", "fuse"}
+
+// Tuning for the bup backend.
+type BupConfig struct {
+	NoCheckDevice     bool                `json:"no_check_device"`     //Pass --no-check-device to bup index, for filesystems whose device numbers change between runs, like snapshots and network mounts
+	SplitBits         int                 `json:"split_bits"`          //Average chunk size as a power of two, from 13 (8KiB, bup's default) to 21, set as bup.split.files in each repo. Needs bup 0.33
+	Compression       *int                `json:"compression"`         //Level for bup save --compress, 0 (none) to 9, default bup's own 1
+	Flags             map[string][]string `json:"flags"`               //Extra arguments per subcommand, e.g. { save = ["--bwlimit=10M"] }
+	IncrementalIndex  bool                `json:"incremental_index"`   //Skip the region files that haven't changed since the last run when running bup index
+	FullIndexInterval Duration            `json:"full_index_interval"` //With incremental_index, how often to index everything anyway, default a week
+}
+
+func (c BupConfig) validate() []error {
+	var errs []error
+	if c.SplitBits != 0 && (c.SplitBits < 13 || c.SplitBits > 21) {
+		errs = append(errs, errors.New("bup.split_bits must be between 13 and 21"))
+	}
+	if c.FullIndexInterval.Duration < 0 {
+		errs = append(errs, errors.New("bup.full_index_interval can't be negative"))
+	}
+	if c.Compression != nil && (*c.Compression < 0 || *c.Compression > 9) {
+		errs = append(errs, errors.New("bup.compression must be between 0 and 9"))
+	}
+	for _, cmd := range slices.Sorted(maps.Keys(c.Flags)) {
+		if !slices.Contains(bupFlagCommands, cmd) {
+			errs = append(errs, fmt.Errorf("bup.flags: unknown subcommand %q, expected one of %s", cmd, strings.Join(bupFlagCommands, ", ")))
+		}
+	}
+	return errs
+}
+
+// Stores backups in one bup repository per month under the backup root,
+// or with single set, in one repository kept for good so every save
+// deduplicates against all earlier ones.
+type bupBackend struct {
+	root     string
+	prefix   string
+	branch   string
+	dir      string //Directory being backed up, needed to locate it within a save
+	excludes []excludePattern
+	gc       GCConfig
+	single   bool
+	conf     BupConfig
+}
+
+// Runs a bup subcommand on repo, with the extra arguments bup.flags has
+// for it ahead of args.
+func (b *bupBackend) run(ctx context.Context, repo, command string, args ...string) ([]byte, error) {
+	return runCommand(ctx, "bup", slices.Concat([]string{"-d", repo, command}, b.conf.Flags[command], args)...)
+}
+
+// Like run, reporting the progress bup draws as it goes. bup only draws it
+// on a terminal, so it is told stderr is one.
+func (b *bupBackend) runWithProgress(ctx context.Context, repo, command string, args ...string) ([]byte, error) {
+	args = slices.Concat([]string{"-d", repo, command}, b.conf.Flags[command], args)
+	return runCommandStream(ctx, "", []string{"BUP_FORCE_TTY=2"}, nil, func(line string) bool {
+		m := bupSavingRegexp.FindStringSubmatch(line)
+		if m == nil {
+			//Other progress lines are of no use in an error either
+			return strings.HasPrefix(line, "Reading index:")
+		}
+		done, _ := strconv.ParseInt(m[1], 10, 64)
+		total, _ := strconv.ParseInt(m[2], 10, 64)
+		reportProgress(ctx, done*1024, total*1024)
+		return true
+	}, "bup", args...)
+}
+
+// Every monthly repo under the backup root.
+func (b *bupBackend) Files() (string, string) {
+	return b.root, b.prefix + "-*"
+}
+
+// Creates and initializes the current month's bup repo directory, in the
+// case that it does not exist. Repos with old-style names are renamed first.
+func (b *bupBackend) Init(ctx context.Context) error {
+	if err := b.migrateRepos(); err != nil {
+		return fmt.Errorf("renaming old repos: %w", err)
+	}
+	bupPath := b.currentRepoPath(ctx)
+	dirExists, err := exists(bupPath)
+	if err != nil {
+		return err
+	}
+
+	if !dirExists {
+		os.MkdirAll(bupPath, 0770)
+		_, err = b.run(ctx, bupPath, "init")
+		if err != nil {
+			return err
+		}
+	}
+	if b.conf.SplitBits != 0 {
+		//Only data saved from now on is split the new way
+		_, err = runCommand(ctx, "git", "config", "--file", filepath.Join(bupPath, "config"), "bup.split.files", fmt.Sprintf("legacy:%d", b.conf.SplitBits))
+		if err != nil {
+			return fmt.Errorf("setting bup.split.files: %w", err)
+		}
+	}
+	return nil
+}
+
+// Does the actual backup portion
+func (b *bupBackend) Save(ctx context.Context, dir string, paths []string) (Snapshot, error) {
+	bupPath := b.currentRepoPath(ctx)
+	sources := absPaths(dir, paths)
+	args := bupExcludeArgs(b.excludes, dir)
+	if b.conf.NoCheckDevice {
+		args = append(args, "--no-check-device")
+	}
+	err := traced(ctx, "index", func(ctx context.Context) error {
+		return b.index(ctx, bupPath, dir, paths, args)
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	//Saves keep absolute paths, so Restore finds dir either way. A copy,
+	//such as a filesystem snapshot, is stored as if it were the real directory
+	args = []string{"-n", b.branch}
+	if dir != b.dir {
+		args = append(args, "--graft", dir+"="+b.dir)
+	}
+	if b.conf.Compression != nil {
+		args = append(args, fmt.Sprintf("--compress=%d", *b.conf.Compression))
+	}
+	_, err = b.runWithProgress(ctx, bupPath, "save", append(args, sources...)...)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	//bup names the save after its timestamp, so the newest one is ours
+	snaps, err := b.listRepo(ctx, bupPath)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if len(snaps) == 0 {
+		return Snapshot{}, fmt.Errorf("bup save succeeded but %s has no saves", bupPath)
+	}
+	return snaps[len(snaps)-1], nil
+}
+
+// Lists the saves in every repo, monthly or single.
+func (b *bupBackend) List(ctx context.Context) ([]Snapshot, error) {
+	repos, err := b.repos()
+	if err != nil {
+		return nil, err
+	}
+	var all []Snapshot
+	for _, repo := range repos {
+		snaps, err := b.listRepo(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, snaps...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Time.Before(all[j].Time)
+	})
+	return all, nil
+}
+
+// Each month starts a new monthly repo, so its first save is a full copy,
+// as is the first save into the single repo.
+func (b *bupBackend) spaceTarget(ctx context.Context) (string, time.Time, error) {
+	repo := b.currentRepoPath(ctx)
+	if ok, err := exists(repo); err != nil || !ok {
+		return b.root, time.Time{}, err
+	}
+	snaps, err := b.listRepo(ctx, repo)
+	return b.root, lastSnapshotTime(snaps), err
+}
+
+// Lists the saves on our branch in a single repo, oldest first.
+func (b *bupBackend) listRepo(ctx context.Context, repo string) ([]Snapshot, error) {
+	out, err := runCommand(ctx, "bup", "-d", repo, "ls", b.branch)
+	if err != nil {
+		//A freshly initialized repo has no branch yet
+		if strings.Contains(err.Error(), "No such file or directory") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snaps []Snapshot
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		t, err := time.ParseInLocation(BUP_SAVE_TIME_FORMAT, name, time.Local)
+		if err != nil {
+			continue //"latest" and anything else that isn't a save
+		}
+		snaps = append(snaps, Snapshot{
+			ID:     filepath.Base(repo) + ":" + name,
+			Time:   t,
+			Branch: b.branch,
+			Repo:   repo,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Time.Before(snaps[j].Time)
+	})
+	return snaps, estimateBupSaveSizes(repo, snaps)
+}
+
+// bup doesn't track how much each save added, but every save writes its new
+// data into fresh pack files. Attributing each pack to the newest save that
+// started before the pack was written gives a decent approximation.
+func estimateBupSaveSizes(repo string, snaps []Snapshot) error {
+	packs, err := filepath.Glob(filepath.Join(repo, "objects", "pack", "*.pack"))
+	if err != nil || len(snaps) == 0 {
+		return err
+	}
+	for _, p := range packs {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		i := sort.Search(len(snaps), func(i int) bool {
+			return snaps[i].Time.After(info.ModTime())
+		})
+		if i > 0 {
+			snaps[i-1].Size += info.Size()
+		}
+	}
+	return nil
+}
+
+// Restores a save, given as "<repo>:<save>", into target. bup stores the
+// absolute path of the saved directory, so only its contents are restored.
+func (b *bupBackend) Restore(ctx context.Context, id, target string) error {
+	repo, save, ok := strings.Cut(id, ":")
+	if !ok {
+		return fmt.Errorf("invalid bup snapshot id %q, expected <repo>:<save>", id)
+	}
+	source := "/" + b.branch + "/" + save + filepath.ToSlash(b.dir) + "/."
+	_, err := b.run(ctx, b.resolveRepo(repo), "restore", "-C", target, source)
+	return err
+}
+
+// Restores each path on its own, as bup puts what it restores directly
+// into the -C directory.
+func (b *bupBackend) RestorePaths(ctx context.Context, id, target string, paths []string) error {
+	repo, save, ok := strings.Cut(id, ":")
+	if !ok {
+		return fmt.Errorf("invalid bup snapshot id %q, expected <repo>:<save>", id)
+	}
+	for _, p := range paths {
+		dir := filepath.Join(target, filepath.Dir(p))
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			return err
+		}
+		source := "/" + b.branch + "/" + save + filepath.ToSlash(filepath.Join(b.dir, p))
+		if _, err := b.run(ctx, b.resolveRepo(repo), "restore", "-C", dir, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prunes any old backups, if they exist.
+func (b *bupBackend) Prune(ctx context.Context) error {
+	return b.PruneSparing(ctx, nil)
+}
+
+// Prunes like Prune, but keeps a whole month's repo if it holds any of the
+// spared snapshots.
+func (b *bupBackend) PruneSparing(ctx context.Context, spared []Snapshot) error {
+	repos, err := b.repos()
+	if err != nil {
+		return err
+	}
+	//The repo that is two months old, under either naming scheme
+	prune := b.repoPath(monthsBefore(runStart(ctx), 2))
+	for _, repo := range repos {
+		month, _, _ := b.repoMonth(filepath.Base(repo))
+		if b.repoPath(month) == prune {
+			if slices.ContainsFunc(spared, func(s Snapshot) bool { return s.Repo == repo }) {
+				continue
+			}
+			if err := os.RemoveAll(repo); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the full path to the bup repo for the month the run in ctx
+// started in, so a run never indexes into one repo and saves into the next,
+// or to the single repo.
+func (b *bupBackend) currentRepoPath(ctx context.Context) string {
+	if b.single {
+		return b.singleRepoPath()
+	}
+	return b.repoPath(runStart(ctx))
+}
+
+func (b *bupBackend) singleRepoPath() string {
+	return filepath.Join(b.root, b.prefix+"-"+BUP_SINGLE_REPO_SUFFIX)
+}
+
+// Returns the first of the month n months before t's. Unlike t.AddDate,
+// this doesn't overflow into the following month from e.g. the 31st.
+func monthsBefore(t time.Time, n int) time.Time {
+	return time.Date(t.Year(), t.Month()-time.Month(n), 1, 0, 0, 0, 0, t.Location())
+}
+
+// Returns the full path to the repo for the month containing t.
+func (b *bupBackend) repoPath(t time.Time) string {
+	return filepath.Join(b.root, b.prefix+"-"+t.Format(BUP_REPO_TIME_FORMAT))
+}
+
+// Returns the month a repo holds, parsed from its directory name. legacy is
+// set for the old month-year naming, and ok is false for names that aren't
+// one of our repos at all, such as another profile's "<prefix>-survival-*".
+func (b *bupBackend) repoMonth(name string) (month time.Time, legacy bool, ok bool) {
+	suffix, found := strings.CutPrefix(name, b.prefix+"-")
+	if !found {
+		return month, false, false
+	}
+	if t, err := time.ParseInLocation(BUP_REPO_TIME_FORMAT, suffix, time.Local); err == nil {
+		return t, false, true
+	}
+	m := legacyRepoSuffix.FindStringSubmatch(suffix)
+	if m == nil {
+		return month, false, false
+	}
+	monthNum, _ := strconv.Atoi(m[1])
+	year, _ := strconv.Atoi(m[2])
+	if monthNum < 1 || monthNum > 12 {
+		return month, false, false
+	}
+	return time.Date(year, time.Month(monthNum), 1, 0, 0, 0, 0, time.Local), true, true
+}
+
+// Returns the paths of every monthly repo under the backup root, in either
+// naming scheme, and the single repo if there is one. Monthly repos from
+// before switching to the single layout are kept until retention empties
+// them.
+func (b *bupBackend) repos() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(b.root, b.prefix+"-*"))
+	if err != nil {
+		return nil, err
+	}
+	var repos []string
+	for _, p := range paths {
+		if _, _, ok := b.repoMonth(filepath.Base(p)); ok || p == b.singleRepoPath() {
+			repos = append(repos, p)
+		}
+	}
+	return repos, nil
+}
+
+// Renames repos from the old "<prefix>-3-2024" naming, which doesn't sort,
+// to "<prefix>-2024-03". A repo whose new name is already taken is left as
+// it is; it is still listed and pruned under its old name.
+func (b *bupBackend) migrateRepos() error {
+	repos, err := b.repos()
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		month, legacy, _ := b.repoMonth(filepath.Base(repo))
+		if !legacy {
+			continue
+		}
+		target := b.repoPath(month)
+		taken, err := exists(target)
+		if err != nil {
+			return err
+		}
+		if taken {
+			continue
+		}
+		if err := os.Rename(repo, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the path of the repo named in a snapshot ID. IDs listed before
+// a repo was renamed still find it under its new name.
+func (b *bupBackend) resolveRepo(name string) string {
+	path := filepath.Join(b.root, name)
+	if month, legacy, ok := b.repoMonth(name); ok && legacy {
+		if found, _ := exists(path); !found {
+			return b.repoPath(month)
+		}
+	}
+	return path
+}
+
+// Removes individual saves with bup rm. A repo left without saves is deleted
+// outright, which frees its space immediately; otherwise bup gc rewrites
+// the packs that are mostly garbage, unless gc.skip is set.
+func (b *bupBackend) Delete(ctx context.Context, snaps []Snapshot) error {
+	byRepo := map[string][]string{}
+	for _, s := range snaps {
+		repo, save, ok := strings.Cut(s.ID, ":")
+		if !ok {
+			return fmt.Errorf("invalid bup snapshot id %q, expected <repo>:<save>", s.ID)
+		}
+		byRepo[repo] = append(byRepo[repo], "/"+b.branch+"/"+save)
+	}
+	for repo, saves := range byRepo {
+		repoPath := b.resolveRepo(repo)
+		remaining, err := b.listRepo(ctx, repoPath)
+		if err != nil {
+			return err
+		}
+		if len(remaining) == len(saves) {
+			if err := os.RemoveAll(repoPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := b.run(ctx, repoPath, "rm", append([]string{"--unsafe"}, saves...)...); err != nil {
+			return err
+		}
+		if !b.gc.Skip {
+			args := append([]string{"--unsafe"}, b.gc.thresholdArgs("--threshold", "")...)
+			if _, err := b.run(ctx, repoPath, "gc", args...); err != nil {
+				return fmt.Errorf("reclaiming space in %s: %w", repoPath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Verifies every pack file in the repo the save went into. Earlier months'
+// repos aren't written to anymore, so were checked when they were current.
+func (b *bupBackend) Check(ctx context.Context, snap Snapshot) error {
+	_, err := b.run(ctx, snap.Repo, "fsck")
+	return err
+}
+
+func exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Logs how much space the single repo saves over keeping each of its saves
+// as a full copy, taking the files just backed up as the size of a copy.
+func (s *Server) logDedupSavings(ctx context.Context) {
+	b, ok := s.backend.(*bupBackend)
+	if !ok || !b.single {
+		return
+	}
+	repo := b.singleRepoPath()
+	snaps, err := b.listRepo(ctx, repo)
+	if err == nil && len(snaps) == 0 {
+		return
+	}
+	var stored, world int64
+	if err == nil {
+		stored, err = changedSize(ctx, repo, nil, nil, time.Time{})
+	}
+	if err == nil {
+		world, err = s.sourceSize(ctx)
+	}
+	if err != nil {
+		s.log().Warn("Error measuring deduplication", "phase", "backup", "error", err)
+		return
+	}
+	full := world * int64(len(snaps))
+	if stored == 0 || full == 0 {
+		return
+	}
+	s.log().Info("Deduplication", "phase", "backup", "saves", len(snaps), "stored", FormatBytes(stored),
+		"full_copies", FormatBytes(full), "saved", fmt.Sprintf("%.1f%%", 100*(1-float64(stored)/float64(full))))
+}
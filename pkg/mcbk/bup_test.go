@@ -0,0 +1,202 @@
+package mcbk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day, hour, min, sec int) time.Time {
+	return time.Date(year, month, day, hour, min, sec, 0, time.Local)
+}
+
+func TestCurrentRepoPathUsesRunStart(t *testing.T) {
+	b := &bupBackend{root: "/backups", prefix: "minecraft"}
+	for _, tt := range []struct {
+		start time.Time
+		want  string
+	}{
+		{date(2024, time.January, 31, 23, 59, 59), "minecraft-2024-01"},
+		{date(2024, time.February, 1, 0, 0, 0), "minecraft-2024-02"},
+		{date(2023, time.December, 31, 23, 59, 59), "minecraft-2023-12"},
+		{date(2024, time.January, 1, 0, 0, 0), "minecraft-2024-01"},
+		{date(2024, time.February, 29, 12, 0, 0), "minecraft-2024-02"},
+	} {
+		ctx := withRunStart(context.Background(), tt.start)
+		if got := b.currentRepoPath(ctx); got != filepath.Join("/backups", tt.want) {
+			t.Errorf("run started %s: got %s, want %s", tt.start, got, tt.want)
+		}
+	}
+}
+
+func TestRunStartOutsideRun(t *testing.T) {
+	before := time.Now()
+	got := runStart(context.Background())
+	if got.Before(before) || got.After(time.Now()) {
+		t.Errorf("runStart without a run = %s, want the current time", got)
+	}
+}
+
+func TestMonthsBefore(t *testing.T) {
+	for _, tt := range []struct {
+		t    time.Time
+		n    int
+		want time.Time
+	}{
+		{date(2024, time.March, 15, 10, 0, 0), 2, date(2024, time.January, 1, 0, 0, 0)},
+		//AddDate(0, -2, 0) would give March 1st and 2nd here
+		{date(2024, time.April, 30, 10, 0, 0), 2, date(2024, time.February, 1, 0, 0, 0)},
+		{date(2024, time.April, 30, 10, 0, 0), 1, date(2024, time.March, 1, 0, 0, 0)},
+		{date(2024, time.May, 31, 23, 59, 59), 3, date(2024, time.February, 1, 0, 0, 0)},
+		{date(2024, time.January, 31, 0, 0, 0), 2, date(2023, time.November, 1, 0, 0, 0)},
+		{date(2024, time.February, 29, 0, 0, 0), 2, date(2023, time.December, 1, 0, 0, 0)},
+		{date(2024, time.January, 1, 0, 0, 0), 12, date(2023, time.January, 1, 0, 0, 0)},
+	} {
+		if got := monthsBefore(tt.t, tt.n); !got.Equal(tt.want) {
+			t.Errorf("monthsBefore(%s, %d) = %s, want %s", tt.t, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestRepoMonth(t *testing.T) {
+	b := &bupBackend{prefix: "minecraft"}
+	for _, tt := range []struct {
+		name   string
+		month  time.Time
+		legacy bool
+		ok     bool
+	}{
+		{"minecraft-2024-01", date(2024, time.January, 1, 0, 0, 0), false, true},
+		{"minecraft-2023-12", date(2023, time.December, 1, 0, 0, 0), false, true},
+		{"minecraft-12-2023", date(2023, time.December, 1, 0, 0, 0), true, true},
+		{"minecraft-1-2024", date(2024, time.January, 1, 0, 0, 0), true, true},
+		{"minecraft-13-2023", time.Time{}, false, false},
+		{"minecraft-survival-2024-01", time.Time{}, false, false},
+	} {
+		month, legacy, ok := b.repoMonth(tt.name)
+		if ok != tt.ok || legacy != tt.legacy || !month.Equal(tt.month) {
+			t.Errorf("repoMonth(%q) = %s, %v, %v, want %s, %v, %v", tt.name, month, legacy, ok, tt.month, tt.legacy, tt.ok)
+		}
+	}
+}
+
+func TestPruneAcrossYearBoundary(t *testing.T) {
+	for _, tt := range []struct {
+		start time.Time
+		repos []string
+		want  []string
+	}{
+		{
+			start: date(2024, time.January, 31, 23, 59, 59),
+			repos: []string{"minecraft-11-2023", "minecraft-2023-10", "minecraft-2023-11", "minecraft-2023-12", "minecraft-2024-01"},
+			want:  []string{"minecraft-2023-10", "minecraft-2023-12", "minecraft-2024-01"},
+		},
+		{
+			start: date(2024, time.February, 1, 0, 0, 0),
+			repos: []string{"minecraft-2023-11", "minecraft-2023-12", "minecraft-2024-01"},
+			want:  []string{"minecraft-2023-11", "minecraft-2024-01"},
+		},
+		{
+			start: date(2024, time.April, 30, 12, 0, 0),
+			repos: []string{"minecraft-2024-02", "minecraft-2024-03", "minecraft-2024-04", "minecraft-survival-2024-02"},
+			want:  []string{"minecraft-2024-03", "minecraft-2024-04", "minecraft-survival-2024-02"},
+		},
+	} {
+		root := t.TempDir()
+		for _, repo := range tt.repos {
+			if err := os.Mkdir(filepath.Join(root, repo), 0770); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b := &bupBackend{root: root, prefix: "minecraft"}
+		if err := b.Prune(withRunStart(context.Background(), tt.start)); err != nil {
+			t.Fatalf("pruning at %s: %v", tt.start, err)
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var left []string
+		for _, e := range entries {
+			left = append(left, e.Name())
+		}
+		if !slices.Equal(left, tt.want) {
+			t.Errorf("pruning at %s left %v, want %v", tt.start, left, tt.want)
+		}
+	}
+}
+
+func TestSingleRepoLayout(t *testing.T) {
+	root := t.TempDir()
+	for _, repo := range []string{"minecraft-2024-01", "minecraft-repo", "minecraft-survival-repo", "minecraft_history.jsonl"} {
+		if err := os.Mkdir(filepath.Join(root, repo), 0770); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := &bupBackend{root: root, prefix: "minecraft", single: true}
+	for _, start := range []time.Time{date(2024, time.January, 31, 23, 59, 59), date(2025, time.June, 1, 0, 0, 0)} {
+		if got := b.currentRepoPath(withRunStart(context.Background(), start)); got != filepath.Join(root, "minecraft-repo") {
+			t.Errorf("run started %s: got %s, want the single repo", start, got)
+		}
+	}
+	repos, err := b.repos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "minecraft-2024-01"), filepath.Join(root, "minecraft-repo")}
+	if !slices.Equal(repos, want) {
+		t.Errorf("repos() = %v, want %v", repos, want)
+	}
+}
+
+func TestIncrementalIndexChanges(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"server.properties", "world/level.dat", "world/playerdata/p.dat", "world/region/r.0.0.mca",
+		"world/region/r.0.1.mca", "world/DIM-1/region/r.0.0.mca", "world/entities/r.0.0.mca"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0770); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(f), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludes, err := parseExcludes([]string{"entities/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := scanRegions(context.Background(), dir, nil, excludes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := first.state(dir, nil, time.Now())
+	if got := first.changed(prev); !slices.Equal(got, []string{"server.properties", "world/level.dat", "world/playerdata"}) {
+		t.Errorf("with nothing changed, got %v", got)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, "world/region/r.0.1.mca"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "world/DIM-1/region/r.0.1.mca"), nil, 0660); err != nil {
+		t.Fatal(err)
+	}
+	second, err := scanRegions(context.Background(), dir, nil, excludes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"server.properties", "world/DIM-1/region", "world/level.dat", "world/playerdata", "world/region/r.0.1.mca"}
+	if got := second.changed(prev); !slices.Equal(got, want) {
+		t.Errorf("changed() = %v, want %v", got, want)
+	}
+
+	only, err := scanRegions(context.Background(), dir, []string{"world"}, excludes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := only.changed(only.state(dir, nil, time.Now())); !slices.Equal(got, []string{"world/level.dat", "world/playerdata"}) {
+		t.Errorf("backing up only world, got %v", got)
+	}
+}
@@ -0,0 +1,204 @@
+package mcbk
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const BUP_FULL_INDEX_INTERVAL = 7 * 24 * time.Hour //How often incremental_index indexes everything, unless bup.full_index_interval says otherwise
+const BUP_INDEX_STATE_FILE = "mcbk-regions.json"   //In each repo, what incremental_index knows about its index
+
+// Directories of the Anvil format that hold nothing but region files.
+var regionDirNames = []string{"region", "entities", "poi"}
+
+// Whether rel, a slash-separated path, is a region file.
+func isRegionFile(rel string) bool {
+	return slices.Contains(regionDirNames, path.Base(path.Dir(rel))) && (strings.HasSuffix(rel, ".mca") || strings.HasSuffix(rel, ".mcr"))
+}
+
+// How a file looked when it was indexed. Minecraft rewrites a region file
+// in place whenever a chunk in it is saved, which changes its mtime.
+type fileStamp struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"` //Nanoseconds since the epoch
+}
+
+// What the last run told bup index, kept in the repo so a new one, e.g.
+// each month's, starts with a full index.
+type bupIndexState struct {
+	Dir       string               `json:"dir"`        //The directory indexed, which differs for a filesystem snapshot
+	Args      []string             `json:"args"`       //Arguments and sources of bup index; changing them means a full index
+	FullIndex time.Time            `json:"full_index"` //When everything was last indexed
+	Regions   map[string]fileStamp `json:"regions"`    //Region files, by slash-separated path relative to dir
+	Dirs      map[string][]string  `json:"dirs"`       //Entries of the directories holding region files, so additions and removals are noticed
+}
+
+// Reads the state left by the last run, or returns nil if there is none
+// to rely on.
+func readBupIndexState(file string) *bupIndexState {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var st bupIndexState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil
+	}
+	return &st
+}
+
+// The files about to be backed up, as far as incremental_index cares.
+type regionScan struct {
+	roots   []string             //The sources, relative to the backed up directory
+	regions map[string]fileStamp //Every region file
+	dirs    map[string][]string  //Entries of every directory, sorted
+	holders map[string]bool      //Directories with region files somewhere below them
+}
+
+// Walks the files to back up, skipping excluded ones as bup index would,
+// and notes every region file and directory entry.
+func scanRegions(ctx context.Context, dir string, paths []string, excludes []excludePattern) (*regionScan, error) {
+	s := &regionScan{regions: map[string]fileStamp{}, dirs: map[string][]string{}, holders: map[string]bool{}}
+	for _, p := range absPaths(dir, paths) {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return nil, err
+		}
+		s.roots = append(s.roots, filepath.ToSlash(rel))
+	}
+	err := walkPaths(dir, paths, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && excluded(excludes, rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !slices.Contains(s.roots, rel) {
+			parent := path.Dir(rel)
+			s.dirs[parent] = append(s.dirs[parent], path.Base(rel))
+		}
+		if d.IsDir() {
+			s.dirs[rel] = []string{}
+			return nil
+		}
+		if !d.Type().IsRegular() || !isRegionFile(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		s.regions[rel] = fileStamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+		for parent := path.Dir(rel); !s.holders[parent]; parent = path.Dir(parent) {
+			s.holders[parent] = true
+			if parent == "." || slices.Contains(s.roots, parent) {
+				break
+			}
+		}
+		return nil
+	})
+	return s, err
+}
+
+// The state to leave for the next run.
+func (s *regionScan) state(dir string, args []string, fullIndex time.Time) *bupIndexState {
+	st := &bupIndexState{Dir: dir, Args: args, FullIndex: fullIndex, Regions: s.regions, Dirs: map[string][]string{}}
+	for d := range s.holders {
+		st.Dirs[d] = s.dirs[d]
+	}
+	return st
+}
+
+// The paths bup index needs to be given for the files that changed since
+// prev: region files whose size or mtime differ, and whole directories
+// where anything may have changed, such as everything that isn't a region
+// and region directories that gained or lost files.
+func (s *regionScan) changed(prev *bupIndexState) []string {
+	var out []string
+	var cover func(rel string)
+	cover = func(rel string) {
+		if stamp, ok := s.regions[rel]; ok {
+			if prev.Regions[rel] != stamp {
+				out = append(out, rel)
+			}
+			return
+		}
+		entries := s.dirs[rel]
+		if !s.holders[rel] || !slices.Equal(entries, prev.Dirs[rel]) {
+			out = append(out, rel)
+			return
+		}
+		for _, e := range entries {
+			cover(path.Join(rel, e))
+		}
+	}
+	for _, root := range s.roots {
+		cover(root)
+	}
+	return out
+}
+
+// Runs bup index on the files to back up. With bup.incremental_index, only
+// what changed since the last run is given to it, so the unchanged region
+// files that make up most of a big world aren't walked every time.
+// Everything is indexed when the repo has no state from an earlier run,
+// the arguments change, or full_index_interval has passed.
+func (b *bupBackend) index(ctx context.Context, repo, dir string, paths []string, args []string) error {
+	sources := absPaths(dir, paths)
+	if !b.conf.IncrementalIndex {
+		_, err := b.run(ctx, repo, "index", append(args, sources...)...)
+		return err
+	}
+	stateFile := filepath.Join(repo, BUP_INDEX_STATE_FILE)
+	prev := readBupIndexState(stateFile)
+	scan, err := scanRegions(ctx, dir, paths, b.excludes)
+	if err != nil {
+		return err
+	}
+	key := slices.Concat(b.conf.Flags["index"], args, sources)
+	interval := cmp.Or(b.conf.FullIndexInterval.Duration, BUP_FULL_INDEX_INTERVAL)
+	next := scan.state(dir, key, time.Now())
+	targets := sources
+	if prev != nil && prev.Dir == dir && slices.Equal(prev.Args, key) && time.Since(prev.FullIndex) < interval {
+		next.FullIndex = prev.FullIndex
+		targets = nil
+		for _, rel := range scan.changed(prev) {
+			targets = append(targets, filepath.Join(dir, filepath.FromSlash(rel)))
+		}
+	}
+
+	//An index cut short leaves bup's view unknown until the next full one
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	//Given no paths, bup would index the working directory
+	if len(targets) > 0 {
+		if _, err := b.run(ctx, repo, "index", append(args, targets...)...); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(stateFile, data, 0660)
+}
@@ -0,0 +1,53 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+)
+
+// The cause of a backup stopped with CancelBackup, as opposed to one
+// stopped because the whole process is shutting down.
+var ErrBackupCancelled = errors.New("backup cancelled on request")
+
+// Returns ctx, which CancelBackup cancels for as long as the run lasts, and
+// a function to call once the run is over.
+func (s *Server) cancellable(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	s.runMu.Lock()
+	s.cancelRun = cancel
+	s.runMu.Unlock()
+	return ctx, func() {
+		s.runMu.Lock()
+		s.cancelRun = nil
+		s.runMu.Unlock()
+		cancel(nil)
+	}
+}
+
+// Stops the backup of the server running in this process, if there is one,
+// as a signal would: the backend is stopped, saving is turned back on, the
+// locks are released and the run is recorded as cancelled. Returns whether
+// a backup was running.
+func (s *Server) CancelBackup() bool {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	if s.cancelRun == nil {
+		return false
+	}
+	s.cancelRun(ErrBackupCancelled)
+	return true
+}
+
+// Whether a backup of the server was cut short by its context being
+// cancelled, e.g. on SIGTERM, rather than by CancelBackup.
+func (s *Server) Interrupted() bool {
+	return s.interrupted.Load()
+}
+
+// Why a cancelled run stopped, for the log, notifications and history.
+func cancelReason(ctx context.Context) error {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrBackupCancelled) {
+		return cause
+	}
+	return errors.New("backup cancelled by signal")
+}
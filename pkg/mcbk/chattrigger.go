@@ -0,0 +1,186 @@
+package mcbk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Settings for starting a backup by typing a phrase in the game's chat,
+// watched for by "mcbk daemon" in the server's console output.
+type ChatTriggerConfig struct {
+	Phrase  string   `json:"phrase"`  //Chat message that starts a backup, e.g. "!backup". Empty disables the trigger
+	Players []string `json:"players"` //Names or UUIDs of the players allowed to use it
+}
+
+func (c ChatTriggerConfig) Enabled() bool {
+	return c.Phrase != ""
+}
+
+func (c ChatTriggerConfig) validate() []error {
+	var errs []error
+	if strings.TrimSpace(c.Phrase) != c.Phrase {
+		errs = append(errs, errors.New("chat_trigger.phrase must not start or end with spaces"))
+	}
+	if len(c.Players) == 0 {
+		errs = append(errs, errors.New("chat_trigger needs players, or nobody could use it"))
+	}
+	return errs
+}
+
+// A chat message in the server log, e.g. "[12:00:00] [Server thread/INFO]:
+// <Steve> !backup". Servers that can't verify a message's signature mark it
+// "[Not Secure]".
+var chatRegexp = regexp.MustCompile(`]: (?:\[Not Secure\] )?<([^>\s]+)> (.*)$`)
+
+// Logged by the server as each player logs in, before they join.
+var uuidRegexp = regexp.MustCompile(`: UUID of player (\S+) is ([0-9a-fA-F-]{36})\s*$`)
+
+// Watches a server's console output for an allowed player typing the chat
+// trigger phrase, and backs the server up when they do, telling the players
+// in-game when the backup starts and how it went.
+type ChatTrigger struct {
+	runner  Runner
+	server  *Server
+	logger  *slog.Logger
+	uuids   map[string]string //Lowercased player names to the UUIDs logged as they logged in
+	running atomic.Bool       //Whether a backup started from chat is in progress
+}
+
+// Sets up the trigger for s, whose config must have chat_trigger enabled.
+// Backups it starts are run by a copy of runner that overrides skip_idle.
+func NewChatTrigger(runner *Runner, s *Server) *ChatTrigger {
+	forced := *runner
+	forced.Force = true
+	return &ChatTrigger{
+		runner: forced,
+		server: s,
+		logger: s.log().With("phase", "chat-trigger"),
+		uuids:  map[string]string{},
+	}
+}
+
+// Follows the server's console output until ctx is done. Backups started from chat keep
+// ctx, so they are cancelled along with the trigger.
+func (t *ChatTrigger) Run(ctx context.Context) {
+	t.logger.Info("Watching chat for the backup trigger", "phrase", t.server.conf.ChatTrigger.Phrase)
+	for {
+		err := t.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		t.logger.Warn("Error reading the server's console output, retrying", "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// Handles console lines until ctx is done or reading them fails.
+func (t *ChatTrigger) watch(ctx context.Context) error {
+	follower, err := t.server.followConsole(ctx)
+	if err != nil {
+		return err
+	}
+	defer follower.Close()
+	return follower.waitFor(ctx, func(line string) bool {
+		t.handle(ctx, line)
+		return false
+	})
+}
+
+// Acts on one line of the server log.
+func (t *ChatTrigger) handle(ctx context.Context, line string) {
+	if m := uuidRegexp.FindStringSubmatch(line); m != nil {
+		t.uuids[strings.ToLower(m[1])] = strings.ToLower(m[2])
+		return
+	}
+	m := chatRegexp.FindStringSubmatch(line)
+	if m == nil || strings.TrimSpace(m[2]) != t.server.conf.ChatTrigger.Phrase {
+		return
+	}
+	player := m[1]
+	if !t.allowed(player) {
+		t.logger.Warn("Ignoring the backup trigger from a player who isn't allowed", "player", player)
+		t.server.sendCommand(ctx, t.server.tellCommand(player, t.server.message(t.server.conf.Messages.TriggerDenied, messageData{Player: player})))
+		return
+	}
+	t.logger.Info("Backup requested in-game", "player", player)
+	if !t.running.CompareAndSwap(false, true) {
+		t.server.sendCommand(ctx, t.server.tellCommand(player, t.server.message(t.server.conf.Messages.TriggerRunning, messageData{Player: player})))
+		return
+	}
+	t.server.broadcast(ctx, t.server.message(t.server.conf.Messages.TriggerStart, messageData{Player: player}))
+	go func() {
+		defer t.running.Store(false)
+		//A backup that gets going announces itself and its completion
+		err := t.runner.Backup(ctx, t.server)
+		switch {
+		case errors.Is(err, ErrBackupInProgress):
+			t.server.broadcast(context.WithoutCancel(ctx), t.server.message(t.server.conf.Messages.TriggerBusy, messageData{Player: player}))
+		case errors.Is(err, ErrOutsideWindow):
+			t.server.broadcast(context.WithoutCancel(ctx), t.server.message(t.server.conf.Messages.TriggerSkipped, messageData{Player: player, Error: err.Error()}))
+		case err != nil:
+			t.server.broadcast(context.WithoutCancel(ctx), t.server.message(t.server.conf.Messages.TriggerFailed, messageData{Player: player}))
+		default:
+			return
+		}
+		//The backup already closed the transport when it finished
+		t.server.Close()
+	}()
+}
+
+// Whether player is in chat_trigger.players, by name or by the UUID they
+// logged in with. Players who logged in before mcbk started watching are
+// looked up in the server's usercache.json instead.
+func (t *ChatTrigger) allowed(player string) bool {
+	uuid, ok := t.uuids[strings.ToLower(player)]
+	if !ok {
+		uuid = cachedUUID(filepath.Join(t.server.conf.MinecraftDir, "usercache.json"), player)
+	}
+	return slices.ContainsFunc(t.server.conf.ChatTrigger.Players, func(p string) bool {
+		return strings.EqualFold(p, player) || uuid != "" && strings.EqualFold(p, uuid)
+	})
+}
+
+// The UUID the server last saw player with according to its user cache, or
+// "" if it isn't known.
+func cachedUUID(path, player string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var users []struct {
+		Name string `json:"name"`
+		UUID string `json:"uuid"`
+	}
+	if json.Unmarshal(data, &users) != nil {
+		return ""
+	}
+	for _, u := range users {
+		if strings.EqualFold(u.Name, player) {
+			return strings.ToLower(u.UUID)
+		}
+	}
+	return ""
+}
+
+// The command that sends msg to just player.
+func (s *Server) tellCommand(player, msg string) string {
+	if s.conf.Broadcast == "tellraw" {
+		text, _ := json.Marshal(map[string]string{"text": msg, "color": "yellow"})
+		return fmt.Sprintf("tellraw %s %s", player, text)
+	}
+	return fmt.Sprintf("tell %s %s", player, msg)
+}
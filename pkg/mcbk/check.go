@@ -0,0 +1,59 @@
+package mcbk
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Settings for verifying backups after they are taken.
+type CheckConfig struct {
+	Enabled  bool     `json:"enabled"`  //Check the backend's repository after backups; a failed check fails the backup
+	Interval Duration `json:"interval"` //Check at most this often, e.g. "24h". 0 checks after every backup
+}
+
+// Implemented by backends that can verify their stored data.
+type checker interface {
+	//Verifies the repository holding snap, or snap itself
+	Check(ctx context.Context, snap Snapshot) error
+}
+
+// Whether the next backup should be followed by a check: when checks are
+// on and the last passed check is at least check.interval ago.
+func (s *Server) checkDue() bool {
+	if !s.conf.Check.Enabled {
+		return false
+	}
+	if s.conf.Check.Interval.Duration == 0 {
+		return true
+	}
+	history, err := s.History()
+	if err != nil {
+		//Better to check once too often
+		return true
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Checked {
+			return time.Since(history[i].End) >= s.conf.Check.Interval.Duration
+		}
+	}
+	return true
+}
+
+// Verifies the repository or archive a new snapshot was written to.
+func (s *Server) checkSnapshot(ctx context.Context, snap Snapshot) error {
+	c, ok := s.backend.(checker)
+	if !ok {
+		return fmt.Errorf("the %s backend can't check its backups", s.conf.Backend)
+	}
+	s.log().Info("Checking backup integrity...", "phase", "check", "snapshot", snap.ID)
+	start := time.Now()
+	err := withPhaseTimeout(ctx, s.conf.PhaseTimeouts.Check.Duration, func(ctx context.Context) error {
+		return c.Check(ctx, snap)
+	})
+	if err != nil {
+		return &phaseError{"check", fmt.Errorf("integrity check failed: %w", err)}
+	}
+	s.log().Info("Integrity check passed", "phase", "check", "duration", time.Since(start))
+	return nil
+}
@@ -0,0 +1,970 @@
+package mcbk
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Runtime configuration, loaded from a TOML file.
+type Config struct {
+	//Settings for a single server can be given at the top level. When
+	//[[server]] profiles are defined, they are defaults for every profile.
+	ServerConfig
+
+	LogPath     string          `json:"log_path"`    //Path to logfile for this script
+	LogFormat   string          `json:"log_format"`  //"text" for key=value lines or "json" for one JSON object per line
+	LogOutput   string          `json:"log_output"`  //Where logs go: "file" for log_path, "syslog" or "journald"
+	LogRotate   LogRotateConfig `json:"log_rotate"`  //When to rotate log_path and how many old logs to keep
+	Concurrency int             `json:"concurrency"` //How many servers may be backed up at once, default 1
+	Notify      []NotifyConfig  `json:"notify"`      //Where to send backup notifications
+	MQTT        MQTTConfig      `json:"mqtt"`        //Broker to publish backup lifecycle events to
+	Tracing     TracingConfig   `json:"tracing"`     //Where to export OpenTelemetry traces of backup runs
+	Daemon      DaemonConfig    `json:"daemon"`      //Settings for "mcbk daemon"
+	Network     NetworkConfig   `json:"network"`     //Backend servers and proxy for "mcbk network"
+	Servers     []ServerConfig  `json:"server"`      //Server profiles, or just the top-level server if none are defined
+}
+
+// Settings for one minecraft server and where its backups go.
+type ServerConfig struct {
+	Name             string                `json:"name"`                          //Profile name, used with -server
+	BackupRoot       string                `json:"backup_root"`                   //Path to save backups in
+	BackupDirPrefix  string                `json:"backup_dir_prefix"`             //Prefix for backup dir names. Suffix is year-month
+	Backend          string                `json:"backend"`                       //Backup engine to use: "dedup", "bup", "restic", "borg" or "tar"
+	BupBranchName    string                `json:"bup_branch"`                    //Branch name to use with bup
+	BupLayout        string                `json:"bup_layout"`                    //"monthly" for a new bup repo each month, or "single" for one repo pruned by the retention policy
+	Bup              BupConfig             `json:"bup"`                           //Tuning and extra arguments for the bup backend
+	Transport        string                `json:"transport"`                     //How commands reach the server: "screen", "tmux", "rcon", "stdin", "process", "pterodactyl", "docker", "mark2", "msm" or "amp"
+	ScreenSession    string                `json:"screen_session"`                //Session where your minecraft server is running
+	Tmux             TmuxConfig            `json:"tmux"`                          //Target pane for the tmux transport
+	RCON             RCONConfig            `json:"rcon"`                          //Connection settings for the rcon transport
+	Stdin            StdinConfig           `json:"stdin"`                         //Pipe for the stdin transport
+	Process          ProcessConfig         `json:"process"`                       //Server command run by "mcbk run", for the process transport
+	Pterodactyl      PterodactylConfig     `json:"pterodactyl"`                   //Panel and server for the pterodactyl transport
+	Control          ControlConfig         `json:"control"`                       //How "mcbk restore -restart" stops and starts the server
+	Docker           DockerConfig          `json:"docker"`                        //Container for the docker transport
+	Mark2            Mark2Config           `json:"mark2"`                         //Server for the mark2 transport
+	MSM              MSMConfig             `json:"msm"`                           //Server for the msm transport
+	AMP              AMPConfig             `json:"amp"`                           //Instance and login for the amp transport
+	Restic           ResticConfig          `json:"restic"`                        //Repository settings for the restic backend
+	Borg             BorgConfig            `json:"borg"`                          //Repository settings for the borg backend
+	Tar              TarConfig             `json:"tar"`                           //Archive settings for the tar backend
+	Dedup            DedupConfig           `json:"dedup"`                         //Repository settings for the dedup backend
+	S3               S3Config              `json:"s3"`                            //Bucket to mirror backups into after each backup
+	GCS              GCSConfig             `json:"gcs"`                           //Google Cloud Storage bucket to mirror backups into after each backup
+	Azure            AzureConfig           `json:"azure"`                         //Azure Blob Storage container to mirror backups into after each backup
+	Rclone           []RcloneConfig        `json:"rclone"`                        //rclone remotes to sync backups to after each backup
+	ZFS              ZFSConfig             `json:"zfs"`                           //Dataset to snapshot so world saving is only off for a moment
+	Btrfs            BtrfsConfig           `json:"btrfs"`                         //Subvolume to snapshot, like zfs
+	LVM              LVMConfig             `json:"lvm"`                           //Logical volume to snapshot, like zfs
+	Check            CheckConfig           `json:"check"`                         //Integrity checks of the backend's data after backups
+	SizeCheck        SizeCheckConfig       `json:"size_check"`                    //Warn about or fail backups far smaller than usual
+	SourceCheck      SourceCheckConfig     `json:"source_check"`                  //Flag backups of world files that look damaged
+	Retention        RetentionConfig       `json:"retention"`                     //Which snapshots to keep when pruning
+	Quota            QuotaConfig           `json:"quota"`                         //Space the backups may take up, enforced by removing the oldest snapshots
+	Hooks            HooksConfig           `json:"hooks"`                         //Commands to run around each backup
+	Agent            AgentConfig           `json:"agent"`                         //Back up a server on another host through the mcbk there, over SSH
+	Upgrade          UpgradeConfig         `json:"upgrade"`                       //What "mcbk backup -reason upgrade" backs up besides the worlds, and how long it is kept
+	Sets             []BackupSetConfig     `json:"sets"`                          //Files backed up apart from the worlds, e.g. configs, each as a profile of its own
+	Databases        DatabasesConfig       `json:"databases"`                     //Plugin databases dumped into minecraft_dir before each backup
+	Set              string                `json:"-"`                             //For the profile of a backup set, its name; its files are copied without in-game commands
+	MinecraftLogPath string                `json:"minecraft_log_path"`            //Path to minecraft server log
+	MinecraftDir     string                `json:"minecraft_dir"`                 //The directory to be backed up
+	Worlds           []string              `json:"worlds"`                        //Paths under minecraft_dir to back up instead of all of it; "auto" finds every world
+	Include          []string              `json:"include"`                       //Glob patterns for more paths under minecraft_dir to back up, e.g. "world/playerdata"
+	Exclude          []string              `json:"exclude"`                       //Glob patterns for paths under minecraft_dir to leave out, default ["session.lock"]
+	VerifyTimeout    Duration              `json:"verify_timeout"`                //May need to be adjusted for saving large worlds
+	CommandTimeouts  CommandTimeoutsConfig `json:"command_timeouts"`              //Per-command verify timeouts, defaulting to verify_timeout
+	PhaseTimeouts    PhaseTimeoutsConfig   `json:"phase_timeouts"`                //Limits on backing up, checking and pruning
+	GC               GCConfig              `json:"gc"`                            //Reclaiming the space of pruned snapshots
+	CommandRetries   *int                  `json:"command_retries"`               //Extra attempts for a command that fails or isn't confirmed in time, default 2
+	CommandRetryWait Duration              `json:"command_retry_delay"`           //Wait before the first retry, doubled for each further one
+	ServerFlavor     string                `json:"server_flavor"`                 //Server software, picks the built-in verification patterns: "vanilla", "spigot", "paper", "fabric", "forge" or "bedrock"
+	Verify           VerifyConfig          `json:"verify"`                        //Patterns that confirm each command, overriding the flavor's
+	SaveAllCommand   string                `json:"save_all_command"`              //Command sent to save the world, default "save-all flush" for paper and spigot, otherwise "save-all"
+	Broadcast        string                `json:"broadcast"`                     //How in-game messages are sent: "say" or "tellraw"
+	Countdown        CountdownConfig       `json:"countdown"`                     //Warnings broadcast before the backup starts
+	Messages         MessagesConfig        `json:"messages"`                      //What is said in-game, and in which language
+	ChatTrigger      ChatTriggerConfig     `json:"chat_trigger"`                  //Chat phrase that makes "mcbk daemon" back up the server
+	RequireOnline    bool                  `json:"require_online"`                //Skip the backup instead of taking a cold one when the server isn't running
+	SkipIdle         bool                  `json:"skip_idle"`                     //Skip the backup if no player has been online since the last successful one
+	MaxIdleSkip      Duration              `json:"max_idle_skip"`                 //With skip_idle, back up anyway once the last backup is this old, default 24h
+	Interval         Duration              `json:"interval"`                      //How often daemon mode backs up this server
+	Activity         ActivityConfig        `json:"activity"`                      //Intervals for daemon mode that follow whether players are online
+	BackupWindow     BackupWindowConfig    `json:"backup_window"`                 //Times of day and week when backups may run
+	LockWait         Duration              `json:"lock_wait"`                     //How long to wait for a running backup of this server to finish before giving up
+	LockMaxRuntime   Duration              `json:"lock_max_runtime"`              //How long a run may hold the lock before it is considered hung and stopped, default 24h
+	GlobalLock       string                `json:"global_lock"`                   //Lock file every backup also takes, so runs from any process back up one server at a time
+	HistoryPath      string                `json:"history_path"`                  //File recording every backup run, default <backup_root>/<backup_dir_prefix>_history.jsonl
+	HealthcheckURL   string                `json:"healthcheck_url" secret:"true"` //healthchecks.io style URL pinged on backup start, success and failure
+	Watchdog         WatchdogConfig        `json:"watchdog"`                      //Alert when no backup has succeeded for too long
+	FreeSpaceMargin  ByteSize              `json:"free_space_margin"`             //Space to leave free on the backup disk on top of the estimated backup size, e.g. "1GiB"
+	MinFreeInodes    int64                 `json:"min_free_inodes"`               //Inodes to leave free on the backup disk, default 1000
+	SkipSpaceCheck   bool                  `json:"skip_space_check"`              //Don't check for free space or inodes before backing up
+	SkipManifest     bool                  `json:"skip_manifest"`                 //Don't write a manifest of each snapshot's files with their SHA-256 to <backup_root>/<backup_dir_prefix>_manifests
+	MountCheck       string                `json:"mount_check"`                   //Mount point backup_root must be on, e.g. "/mnt/backups", so backups fail rather than fill the root disk if it isn't mounted
+}
+
+const DEFAULT_SERVER_NAME = "default" //Name of the implicit server when no profiles are defined
+
+// Settings for the rcon transport, matching enable-rcon, rcon.port and
+// rcon.password in server.properties.
+type RCONConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Password string `json:"password" secret:"true"`
+}
+
+// A time.Duration that can be written as "10s" or "2m" in the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\", got %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// A byte count that can be written as "500MB" or "2GiB" in the config file,
+// or as a plain number of bytes.
+type ByteSize int64
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"tib": 1 << 40,
+}
+
+// Parses a size such as "512MiB", "1.5GB" or "1048576".
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	var n float64
+	_, err := fmt.Sscanf(s[:i], "%g", &n)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. \"500MB\" or \"2GiB\"", s)
+	}
+	return ByteSize(n * float64(unit)), nil
+}
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil || n < 0 {
+			return fmt.Errorf("size must be a string like \"2GiB\" or a number of bytes, got %s", data)
+		}
+		*b = ByteSize(n)
+		return nil
+	}
+	v, err := ParseByteSize(s)
+	*b = v
+	return err
+}
+
+func (b ByteSize) MarshalJSON() ([]byte, error) {
+	return json.Marshal(FormatBytes(int64(b)))
+}
+
+// Limits on the slow phases of a backup, so a hung backend command can't
+// hold the lock forever. Commands sent to the server, including the alive
+// check and save-all, are limited by command_timeouts instead.
+type PhaseTimeoutsConfig struct {
+	Backup Duration `json:"backup"` //The backend writing the snapshot, default 6h
+	Check  Duration `json:"check"`  //The integrity check, default 6h
+	Prune  Duration `json:"prune"`  //Applying the retention policy, default 1h
+}
+
+func (t *PhaseTimeoutsConfig) setDefaults() {
+	if t.Backup.Duration == 0 {
+		t.Backup.Duration = 6 * time.Hour
+	}
+	if t.Check.Duration == 0 {
+		t.Check.Duration = 6 * time.Hour
+	}
+	if t.Prune.Duration == 0 {
+		t.Prune.Duration = time.Hour
+	}
+}
+
+// Runs fn with ctx limited to d. A timeout is reported as one, since the
+// error of an interrupted command rarely says why it stopped.
+func withPhaseTimeout(ctx context.Context, d time.Duration, fn func(ctx context.Context) error) error {
+	phaseCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	err := fn(phaseCtx)
+	if err != nil && errors.Is(phaseCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("timed out after %s: %w", d, err)
+	}
+	return err
+}
+
+// Settings for "mcbk daemon".
+type DaemonConfig struct {
+	Listen     string            `json:"listen"`                  //Address for the HTTP endpoint serving /metrics, e.g. "127.0.0.1:9150". Empty disables it.
+	APIToken   string            `json:"api_token" secret:"true"` //Token required by the REST API served on listen. Empty disables the API
+	Telegram   TelegramBotConfig `json:"telegram"`                //Bot accepting /backupnow, /status and /lastbackup
+	Dashboard  DashboardConfig   `json:"dashboard"`               //Web UI served on listen
+	RestoreDir string            `json:"restore_dir"`             //Directory restores through the API and dashboard may go into, each server's in a subdirectory named after it. Empty only allows restoring in place
+}
+
+// Reads the config file at path, applies the command-line overrides, then
+// fills in defaults and validates the result. A missing file is only an
+// error when required is set, so one-off runs can be configured entirely
+// through flags. Overrides are applied to the top level and to every
+// server profile, so they win over both.
+func LoadConfig(path string, required bool, overrides func(*Config) error) (Config, error) {
+	var c Config
+	var profiles []any
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		tree, err := parseTOML(data)
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := resolveSecrets(tree, reflect.TypeOf(c), ""); err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+		//Profiles are decoded separately, on top of the top-level settings
+		if p, ok := tree["server"].([]any); ok {
+			profiles = p
+			delete(tree, "server")
+		}
+		if err := decodeTOMLTree(tree, &c); err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	case required || !errors.Is(err, fs.ErrNotExist):
+		return c, err
+	}
+	if overrides != nil {
+		if err := overrides(&c); err != nil {
+			return c, err
+		}
+	}
+
+	for i, p := range profiles {
+		s := c.ServerConfig.clone()
+		s.Name = ""
+		if err := decodeTOMLTree(p, &s); err != nil {
+			return c, fmt.Errorf("%s: server[%d]: %w", path, i, err)
+		}
+		if overrides != nil {
+			tmp := Config{ServerConfig: s}
+			if err := overrides(&tmp); err != nil {
+				return c, err
+			}
+			s = tmp.ServerConfig
+		}
+		s.setDefaults(s.Name)
+		c.Servers = append(c.Servers, s)
+	}
+
+	c.setDefaults()
+	if len(profiles) == 0 {
+		s := c.ServerConfig
+		if s.Name == "" {
+			s.Name = DEFAULT_SERVER_NAME
+		}
+		c.Servers = []ServerConfig{s}
+	}
+	c.Servers = withSetProfiles(c.Servers)
+	for i := range c.Servers {
+		if err := c.Servers[i].resolveDockerPaths(); err != nil {
+			if len(c.Servers) > 1 {
+				err = fmt.Errorf("server %q: %w", c.Servers[i].Name, err)
+			}
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := c.validate(); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Returns a copy that shares no pointers with the original, so decoding a
+// profile over it can't change the top-level settings.
+func (s ServerConfig) clone() ServerConfig {
+	if l := s.Tar.CompressionLevel; l != nil {
+		v := *l
+		s.Tar.CompressionLevel = &v
+	}
+	if r := s.CommandRetries; r != nil {
+		v := *r
+		s.CommandRetries = &v
+	}
+	if t := s.GC.Threshold; t != nil {
+		v := *t
+		s.GC.Threshold = &v
+	}
+	if l := s.Bup.Compression; l != nil {
+		v := *l
+		s.Bup.Compression = &v
+	}
+	s.Bup.Flags = maps.Clone(s.Bup.Flags)
+	s.Countdown.Steps = slices.Clone(s.Countdown.Steps)
+	s.Retention.KeepFirst = slices.Clone(s.Retention.KeepFirst)
+	s.Process.Command = slices.Clone(s.Process.Command)
+	s.Docker.Exec = slices.Clone(s.Docker.Exec)
+	s.ChatTrigger.Players = slices.Clone(s.ChatTrigger.Players)
+	s.BackupWindow.Allow = slices.Clone(s.BackupWindow.Allow)
+	s.BackupWindow.Blackout = slices.Clone(s.BackupWindow.Blackout)
+	s.Worlds = slices.Clone(s.Worlds)
+	s.Include = slices.Clone(s.Include)
+	s.Upgrade.Paths = slices.Clone(s.Upgrade.Paths)
+	s.Sets = slices.Clone(s.Sets)
+	for i := range s.Sets {
+		s.Sets[i].Include = slices.Clone(s.Sets[i].Include)
+		s.Sets[i].Exclude = slices.Clone(s.Sets[i].Exclude)
+		s.Sets[i].Retention.KeepFirst = slices.Clone(s.Sets[i].Retention.KeepFirst)
+	}
+	s.Databases.Dump = slices.Clone(s.Databases.Dump)
+	for i := range s.Databases.Dump {
+		s.Databases.Dump[i].Flags = slices.Clone(s.Databases.Dump[i].Flags)
+	}
+	s.Exclude = slices.Clone(s.Exclude)
+	s.Rclone = slices.Clone(s.Rclone)
+	for i := range s.Rclone {
+		s.Rclone[i].Flags = slices.Clone(s.Rclone[i].Flags)
+	}
+	s.Tar.Age.Recipients = slices.Clone(s.Tar.Age.Recipients)
+	return s
+}
+
+// Fills in optional global settings that were left blank.
+func (c *Config) setDefaults() {
+	c.ServerConfig.setDefaults("")
+	if c.Concurrency == 0 {
+		c.Concurrency = 1
+	}
+	if c.LogOutput == "" {
+		c.LogOutput = "file"
+	}
+	if c.LogPath == "" && c.BackupRoot != "" {
+		c.LogPath = filepath.Join(c.BackupRoot, c.BackupDirPrefix+"_backup.log")
+	}
+	c.LogRotate.setDefaults()
+	c.Network.setDefaults()
+	c.MQTT.setDefaults()
+	c.Tracing.setDefaults()
+	ownLog := c.LogPath
+	if c.LogOutput != "file" {
+		//Email can't include the end of a log mcbk doesn't write
+		ownLog = ""
+	}
+	for i := range c.Notify {
+		c.Notify[i].SMTP.setDefaults(ownLog)
+		c.Notify[i].Webhook.setDefaults()
+		c.Notify[i].Push.setDefaults(c.Notify[i].Type)
+	}
+}
+
+// Fills in optional server settings that were left blank. Named profiles
+// default their repo prefix and archive name to the profile name, so
+// several servers can share one backup_root.
+func (c *ServerConfig) setDefaults(profile string) {
+	if c.BackupDirPrefix == "" {
+		c.BackupDirPrefix = "minecraft"
+		if profile != "" {
+			c.BackupDirPrefix = profile
+		}
+	}
+	if c.BupBranchName == "" {
+		c.BupBranchName = "minecraft_server"
+	}
+	if c.BupLayout == "" {
+		c.BupLayout = "monthly"
+	}
+	if c.Transport == "" {
+		c.Transport = DEFAULT_TRANSPORT
+	}
+	if c.Restic.KeepWithin == "" {
+		c.Restic.KeepWithin = "2m"
+	}
+	if c.Borg.Encryption == "" {
+		c.Borg.Encryption = "repokey-blake2"
+	}
+	if c.Borg.Compression == "" {
+		c.Borg.Compression = "lz4"
+	}
+	if c.Borg.KeepWithin == "" {
+		c.Borg.KeepWithin = "2m"
+	}
+	if c.Tar.Name == "" {
+		c.Tar.Name = "world"
+		if profile != "" {
+			c.Tar.Name = profile
+		}
+	}
+	if c.Tar.Keep == 0 {
+		c.Tar.Keep = 14
+	}
+	if c.Dedup.Keep == 0 {
+		c.Dedup.Keep = 14
+	}
+	if c.Tmux.Session == "" {
+		c.Tmux.Session = "minecraft"
+	}
+	c.Docker.setDefaults()
+	c.Agent.setDefaults()
+	c.Upgrade.setDefaults()
+	c.Databases.setDefaults()
+	c.Watchdog.setDefaults()
+	c.Control.setDefaults(c.Transport)
+	if c.MinFreeInodes == 0 {
+		c.MinFreeInodes = DEFAULT_MIN_FREE_INODES
+	}
+	if c.Process.StopTimeout.Duration == 0 {
+		c.Process.StopTimeout.Duration = 2 * time.Minute
+	}
+	if c.RCON.Host == "" {
+		c.RCON.Host = "localhost"
+	}
+	if c.RCON.Port == 0 {
+		c.RCON.Port = 25575
+	}
+	if c.ScreenSession == "" {
+		c.ScreenSession = "minecraft"
+	}
+	if c.VerifyTimeout.Duration == 0 {
+		c.VerifyTimeout.Duration = 10 * time.Second
+	}
+	c.CommandTimeouts.setDefaults(c.VerifyTimeout)
+	c.PhaseTimeouts.setDefaults()
+	if c.CommandRetries == nil {
+		retries := 2
+		c.CommandRetries = &retries
+	}
+	if c.CommandRetryWait.Duration == 0 {
+		c.CommandRetryWait.Duration = 2 * time.Second
+	}
+	if c.Broadcast == "" {
+		c.Broadcast = "say"
+	}
+	c.setMessageDefaults()
+	if c.ServerFlavor == "" {
+		c.ServerFlavor = DEFAULT_SERVER_FLAVOR
+	}
+	c.Verify.setDefaults(c.ServerFlavor)
+	if c.SaveAllCommand == "" {
+		c.SaveAllCommand = cmp.Or(flavorSaveAllCommands[c.ServerFlavor], "save-all")
+	}
+	//session.lock only matters to a running server, and a restored copy
+	//can stop it from opening the world
+	if c.Exclude == nil {
+		c.Exclude = []string{"session.lock"}
+	}
+	if c.Interval.Duration == 0 {
+		c.Interval.Duration = time.Hour
+	}
+	if c.Activity.Enabled() {
+		if c.Activity.ActiveInterval.Duration == 0 {
+			c.Activity.ActiveInterval = c.Interval
+		}
+		if c.Activity.IdleInterval.Duration == 0 {
+			c.Activity.IdleInterval = c.Interval
+		}
+	}
+	if c.Activity.PollInterval.Duration == 0 {
+		c.Activity.PollInterval.Duration = 5 * time.Minute
+	}
+	if c.MaxIdleSkip.Duration == 0 {
+		c.MaxIdleSkip.Duration = 24 * time.Hour
+	}
+	if c.LockMaxRuntime.Duration == 0 {
+		c.LockMaxRuntime.Duration = 24 * time.Hour
+	}
+	c.SizeCheck.setDefaults()
+	if c.S3.Region == "" {
+		c.S3.Region = "us-east-1"
+	}
+	if c.S3.Retries == 0 {
+		c.S3.Retries = 5
+	}
+	if c.GCS.Retries == 0 {
+		c.GCS.Retries = 5
+	}
+	if c.Azure.Retries == 0 {
+		c.Azure.Retries = 5
+	}
+	if c.Hooks.Timeout.Duration == 0 {
+		c.Hooks.Timeout.Duration = 5 * time.Minute
+	}
+	if c.LVM.Size == "" {
+		c.LVM.Size = "1G"
+	}
+	c.BackupRoot = cleanPath(c.BackupRoot)
+	c.MinecraftDir = cleanPath(c.MinecraftDir)
+	c.GlobalLock = cleanPath(c.GlobalLock)
+	c.MountCheck = cleanPath(c.MountCheck)
+	c.Btrfs.Subvolume = cleanPath(c.Btrfs.Subvolume)
+	if c.Tar.Dir == "" {
+		c.Tar.Dir = c.BackupRoot
+	}
+	if c.Dedup.Dir == "" && c.BackupRoot != "" {
+		c.Dedup.Dir = filepath.Join(c.BackupRoot, c.BackupDirPrefix+"-dedup")
+	}
+	c.Dedup.Dir = cleanPath(c.Dedup.Dir)
+	//Last, as it looks for existing backups where the settings above put them
+	if c.Backend == "" {
+		c.Backend = c.defaultBackend()
+	}
+}
+
+// Checks the global settings and every server, reporting all problems at once.
+func (c *Config) validate() error {
+	var errs []error
+	switch c.LogOutput {
+	case "file":
+		if c.LogPath == "" {
+			errs = append(errs, errors.New("missing required setting \"log_path\" (or a top-level \"backup_root\" to default it from)"))
+		}
+	case "syslog", "journald":
+		if c.LogRotate.Enabled() {
+			errs = append(errs, fmt.Errorf("log_rotate only applies to log_output = \"file\", %s does its own", c.LogOutput))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown log_output %q, expected \"file\", \"syslog\" or \"journald\"", c.LogOutput))
+	}
+	errs = append(errs, c.LogRotate.validate()...)
+	for i, n := range c.Notify {
+		switch n.Type {
+		case "discord":
+			if n.URL == "" {
+				errs = append(errs, fmt.Errorf("notify[%d]: missing url", i))
+			}
+		case "slack":
+			for _, err := range n.Slack.validate(n.URL) {
+				errs = append(errs, fmt.Errorf("notify[%d]: %w", i, err))
+			}
+		case "telegram":
+			if n.BotToken == "" || n.ChatID == 0 {
+				errs = append(errs, fmt.Errorf("notify[%d]: telegram needs bot_token and chat_id", i))
+			}
+		case "email":
+			for _, err := range n.SMTP.validate() {
+				errs = append(errs, fmt.Errorf("notify[%d]: %w", i, err))
+			}
+		case "webhook":
+			for _, err := range n.Webhook.validate(n.URL) {
+				errs = append(errs, fmt.Errorf("notify[%d]: %w", i, err))
+			}
+		case "ntfy", "pushover":
+			for _, err := range n.Push.validate(n.Type, n.URL) {
+				errs = append(errs, fmt.Errorf("notify[%d]: %w", i, err))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("notify[%d]: unknown type %q", i, n.Type))
+		}
+		for _, e := range n.Events {
+			if e != EventStart && e != EventSuccess && e != EventFailure && e != EventReplicationFailure && e != EventSizeAnomaly && e != EventSourceCorrupt && e != EventNetworkReport && e != EventOverdue {
+				errs = append(errs, fmt.Errorf("notify[%d]: unknown event %q", i, e))
+			}
+		}
+	}
+	if c.Daemon.APIToken != "" && c.Daemon.Listen == "" {
+		errs = append(errs, errors.New("daemon.api_token needs daemon.listen to serve the API on"))
+	}
+	if c.Daemon.Telegram.BotToken != "" && len(c.Daemon.Telegram.AllowedChats) == 0 {
+		errs = append(errs, errors.New("daemon.telegram needs allowed_chats, or nobody could use the bot"))
+	}
+	if c.Daemon.RestoreDir != "" && !filepath.IsAbs(c.Daemon.RestoreDir) {
+		errs = append(errs, fmt.Errorf("daemon.restore_dir must be an absolute path, not %q", c.Daemon.RestoreDir))
+	}
+	errs = append(errs, c.Daemon.validateDashboard()...)
+	errs = append(errs, c.Network.validate(c.Servers)...)
+	if c.MQTT.Enabled() {
+		errs = append(errs, c.MQTT.validate()...)
+	}
+	if c.Tracing.Enabled() {
+		errs = append(errs, c.Tracing.validate()...)
+	}
+	if c.Concurrency < 1 {
+		errs = append(errs, fmt.Errorf("concurrency must be at least 1, got %d", c.Concurrency))
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("unknown log_format %q, expected \"text\" or \"json\"", c.LogFormat))
+	}
+
+	seen := map[string]bool{}
+	storage := map[string]string{}
+	pings := map[string]string{}
+	for i, s := range c.Servers {
+		if s.Name == "" {
+			errs = append(errs, fmt.Errorf("server[%d]: missing required setting \"name\"", i))
+		} else if seen[s.Name] {
+			errs = append(errs, fmt.Errorf("server[%d]: duplicate name %q", i, s.Name))
+		}
+		seen[s.Name] = true
+		if other, ok := storage[s.storageKey()]; ok {
+			errs = append(errs, fmt.Errorf("servers %q and %q would store backups in the same place, give them different backup_dir_prefix, tar.name or dedup.dir settings", other, s.Name))
+		}
+		storage[s.storageKey()] = s.Name
+		if other, ok := pings[s.HealthcheckURL]; ok && s.HealthcheckURL != "" {
+			errs = append(errs, fmt.Errorf("servers %q and %q share a healthcheck_url, so one could hide the other's missed backups", other, s.Name))
+		}
+		pings[s.HealthcheckURL] = s.Name
+		if err := s.validate(); err != nil {
+			if len(c.Servers) > 1 {
+				err = fmt.Errorf("server %q: %w", s.Name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Identifies where a server's backups are stored, to catch two profiles
+// writing into the same repo.
+func (c *ServerConfig) storageKey() string {
+	switch c.Backend {
+	case "tar":
+		if c.Tar.SSH.Enabled() {
+			return "tar:" + c.Tar.SSH.location() + "/" + c.Tar.Name
+		}
+		return "tar:" + filepath.Join(c.Tar.Dir, c.Tar.Name)
+	case "dedup":
+		return "dedup:" + c.Dedup.Dir
+	case "restic":
+		return "restic:" + c.Restic.Repository + "#" + c.Name
+	case "borg":
+		return "borg:" + c.Borg.Repository + "#" + c.BackupDirPrefix
+	}
+	return c.Backend + ":" + filepath.Join(c.BackupRoot, c.BackupDirPrefix)
+}
+
+// Checks that required server settings are present.
+func (c *ServerConfig) validate() error {
+	var errs []error
+	type setting struct {
+		key, value string
+	}
+	required := []setting{
+		{"backup_root", c.BackupRoot},
+	}
+	//With agent.mode = "remote" the world is only on the host
+	if !c.Agent.remote() {
+		required = append(required, setting{"minecraft_dir", c.MinecraftDir})
+	}
+	switch c.Backend {
+	case "bup":
+		switch {
+		case c.BupLayout != "monthly" && c.BupLayout != "single":
+			errs = append(errs, fmt.Errorf("unknown bup_layout %q, expected \"monthly\" or \"single\"", c.BupLayout))
+		case c.BupLayout == "single" && !c.Retention.Enabled() && !c.Quota.Enabled():
+			//Built-in pruning drops whole monthly repos, which would never free anything
+			errs = append(errs, errors.New("bup_layout = \"single\" needs a [retention] policy or a [quota] to prune old saves"))
+		}
+		errs = append(errs, c.Bup.validate()...)
+	case "restic":
+		required = append(required, setting{"restic.repository", c.Restic.Repository})
+		if c.Restic.Password == "" && c.Restic.PasswordFile == "" {
+			errs = append(errs, errors.New("restic backend needs restic.password or restic.password_file"))
+		}
+	case "borg":
+		required = append(required, setting{"borg.repository", c.Borg.Repository})
+	case "tar":
+		if l := c.Tar.CompressionLevel; l != nil && (*l < 0 || *l > 9) {
+			errs = append(errs, fmt.Errorf("tar.compression_level %d must be between 0 and 9", *l))
+		}
+		if c.Tar.Keep < 1 {
+			errs = append(errs, errors.New("tar.keep must be at least 1"))
+		}
+		if err := c.Tar.Age.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("tar.age: %w", err))
+		}
+		if c.Tar.SSH.Enabled() {
+			errs = append(errs, c.Tar.SSH.validate("tar.ssh")...)
+			if c.Tar.SSH.Path == "" {
+				errs = append(errs, errors.New("tar.ssh needs path"))
+			}
+			//Each of these reads or writes the archive directory directly
+			switch {
+			case len(c.uploadTargets()) > 0:
+				errs = append(errs, fmt.Errorf("%s uploads need local archives, not tar.ssh", c.uploadTargets()[0].name))
+			case len(c.Rclone) > 0:
+				errs = append(errs, errors.New("rclone replication needs local archives, not tar.ssh"))
+			case c.Quota.Enabled():
+				errs = append(errs, errors.New("quota needs local archives, not tar.ssh"))
+			}
+		}
+	case "dedup":
+		if c.Dedup.Keep < 1 {
+			errs = append(errs, errors.New("dedup.keep must be at least 1"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown backend %q, expected \"dedup\", \"bup\", \"restic\", \"borg\" or \"tar\"", c.Backend))
+	}
+	if c.Agent.Enabled() {
+		//The host's mcbk talks to the server, with its own settings
+		errs = append(errs, c.validateAgent()...)
+	} else {
+		switch c.Transport {
+		case "screen", "tmux":
+			//Without a direct response channel, commands are confirmed via the log
+			required = append(required, setting{"minecraft_log_path", c.MinecraftLogPath})
+		case "stdin":
+			required = append(required, setting{"stdin.path", c.Stdin.Path}, setting{"minecraft_log_path", c.MinecraftLogPath})
+		case "process":
+			//Commands are confirmed from the output "mcbk run" passes on
+		case "pterodactyl":
+			required = append(required, setting{"minecraft_log_path", c.MinecraftLogPath})
+			if err := c.Pterodactyl.validate(); err != nil {
+				errs = append(errs, err)
+			}
+		case "docker":
+			required = append(required, setting{"docker.container", c.Docker.Container})
+			if c.Docker.Mode == "attach" {
+				//Only exec reads responses back
+				required = append(required, setting{"minecraft_log_path", c.MinecraftLogPath})
+			}
+			errs = append(errs, c.Docker.validate()...)
+		case "mark2":
+			required = append(required, setting{"minecraft_log_path", c.MinecraftLogPath})
+		case "msm":
+			required = append(required, setting{"msm.server", c.MSM.Server}, setting{"minecraft_log_path", c.MinecraftLogPath})
+		case "amp":
+			required = append(required, setting{"minecraft_log_path", c.MinecraftLogPath})
+			if err := c.AMP.validate(); err != nil {
+				errs = append(errs, err)
+			}
+		case "rcon":
+			required = append(required, setting{"rcon.password", c.RCON.Password})
+			if c.RCON.Port < 1 || c.RCON.Port > 65535 {
+				errs = append(errs, fmt.Errorf("rcon.port %d is out of range", c.RCON.Port))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unknown transport %q, expected \"screen\", \"tmux\", \"rcon\", \"stdin\", \"process\", \"pterodactyl\", \"docker\", \"mark2\", \"msm\" or \"amp\"", c.Transport))
+		}
+	}
+	if runtime.GOOS == "windows" {
+		switch c.Backend {
+		case "bup", "borg":
+			errs = append(errs, fmt.Errorf("the %s backend isn't supported on Windows, use dedup, tar or restic", c.Backend))
+		}
+		switch c.Transport {
+		case "screen", "tmux", "mark2", "msm":
+			if !c.Agent.Enabled() {
+				errs = append(errs, fmt.Errorf("the %s transport isn't supported on Windows, use rcon or stdin", c.Transport))
+			}
+		}
+	}
+	for _, r := range required {
+		if r.value == "" {
+			errs = append(errs, fmt.Errorf("missing required setting %q", r.key))
+		}
+	}
+	errs = append(errs, c.Retention.validate()...)
+	if c.VerifyTimeout.Duration < 0 {
+		errs = append(errs, errors.New("verify_timeout must not be negative"))
+	}
+	errs = append(errs, validateWorlds(c.Worlds)...)
+	errs = append(errs, validateIncludes(c.Include)...)
+	errs = append(errs, c.Upgrade.validate()...)
+	errs = append(errs, c.validateSets()...)
+	errs = append(errs, c.Databases.validate()...)
+	errs = append(errs, c.Watchdog.validate()...)
+	errs = append(errs, c.validateControl()...)
+	errs = append(errs, c.validateMountCheck()...)
+	if len(c.Databases.Dump) > 0 && c.Agent.Enabled() {
+		errs = append(errs, errors.New("databases aren't supported with agent, define them on the host"))
+	}
+	if len(c.Databases.Dump) > 0 && c.ServerFlavor == BEDROCK_FLAVOR {
+		errs = append(errs, errors.New("databases aren't supported with server_flavor bedrock, whose backups hold only the world files"))
+	}
+	if _, err := parseExcludes(c.Exclude); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.CommandTimeouts.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if t := c.PhaseTimeouts; min(t.Backup.Duration, t.Check.Duration, t.Prune.Duration) < 0 {
+		errs = append(errs, errors.New("phase_timeouts must not be negative"))
+	}
+	if err := c.GC.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, c.Quota.validate()...)
+	if c.Quota.Enabled() {
+		switch {
+		case c.Backend == "restic" && localRepoPath(c.Restic.Repository) == "" || c.Backend == "borg" && localRepoPath(c.Borg.Repository) == "":
+			errs = append(errs, fmt.Errorf("quota needs a local %s repository to measure", c.Backend))
+		case c.GC.Skip && c.Backend != "tar":
+			errs = append(errs, errors.New("quota needs gc, or removing snapshots wouldn't free any space"))
+		}
+	}
+	if *c.CommandRetries < 0 {
+		errs = append(errs, errors.New("command_retries must not be negative"))
+	}
+	if c.CommandRetryWait.Duration < 0 {
+		errs = append(errs, errors.New("command_retry_delay must not be negative"))
+	}
+	if c.LockWait.Duration < 0 {
+		errs = append(errs, errors.New("lock_wait must not be negative"))
+	}
+	if c.LockMaxRuntime.Duration < 0 {
+		errs = append(errs, errors.New("lock_max_runtime must not be negative"))
+	}
+	if c.GlobalLock != "" && c.GlobalLock == filepath.Join(c.BackupRoot, c.BackupDirPrefix+".lock") {
+		errs = append(errs, errors.New("global_lock must not be the server's own lock file"))
+	}
+	if c.MaxIdleSkip.Duration < 0 {
+		errs = append(errs, errors.New("max_idle_skip must not be negative"))
+	}
+	errs = append(errs, c.SizeCheck.validate()...)
+	errs = append(errs, c.SourceCheck.validate()...)
+	if c.Check.Interval.Duration < 0 {
+		errs = append(errs, errors.New("check.interval must not be negative"))
+	}
+	staging := c.snapshotStaging()
+	enabled := 0
+	for _, on := range []bool{c.ZFS.Enabled(), c.Btrfs.Enabled(), c.LVM.Enabled()} {
+		if on {
+			enabled++
+		}
+	}
+	if enabled > 1 {
+		errs = append(errs, errors.New("set only one of zfs, btrfs and lvm"))
+	}
+	if staging != "" && c.Backend == "restic" {
+		errs = append(errs, fmt.Errorf("%s staging isn't supported with the restic backend, which would record the snapshot's paths", staging))
+	}
+	if c.LVM.Enabled() {
+		if err := c.LVM.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.ServerFlavor == BEDROCK_FLAVOR {
+		switch {
+		case c.Transport == "rcon":
+			errs = append(errs, errors.New("bedrock servers have no rcon, use the screen, tmux or stdin transport"))
+		case c.Transport == "docker" && c.Docker.Mode == "exec":
+			errs = append(errs, errors.New("bedrock servers have no rcon, set docker.mode = \"attach\""))
+		case c.Backend == "restic":
+			errs = append(errs, errors.New("bedrock isn't supported with the restic backend, which would record the staging directory's paths"))
+		case staging != "":
+			errs = append(errs, fmt.Errorf("%s staging isn't used with bedrock, which copies the held world files instead", staging))
+		}
+	}
+	for _, t := range c.uploadTargets() {
+		if c.Backend != "bup" && c.Backend != "tar" && c.Backend != "dedup" {
+			errs = append(errs, fmt.Errorf("%s uploads aren't supported with the %s backend, only dedup, bup and tar", t.name, c.Backend))
+		}
+	}
+	for i, r := range c.Rclone {
+		if err := r.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rclone[%d]: %w", i, err))
+		}
+	}
+	if len(c.Rclone) > 0 && (c.Backend == "restic" && localRepoPath(c.Restic.Repository) == "" || c.Backend == "borg" && localRepoPath(c.Borg.Repository) == "") {
+		errs = append(errs, fmt.Errorf("rclone replication needs a local %s repository", c.Backend))
+	}
+	if c.S3.Retries < 1 {
+		errs = append(errs, errors.New("s3.retries must be at least 1"))
+	}
+	if c.GCS.Enabled() {
+		errs = append(errs, c.GCS.validate()...)
+	}
+	if c.Azure.Enabled() {
+		errs = append(errs, c.Azure.validate()...)
+	}
+	if _, ok := flavorPatterns[c.ServerFlavor]; !ok {
+		errs = append(errs, fmt.Errorf("unknown server_flavor %q, expected one of %s", c.ServerFlavor, strings.Join(slices.Sorted(maps.Keys(flavorPatterns)), ", ")))
+	} else if _, err := c.Verify.compile(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.HealthcheckURL != "" {
+		if err := validateHealthcheckURL(c.HealthcheckURL); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if strings.ContainsAny(c.SaveAllCommand, "\r\n") {
+		errs = append(errs, errors.New("save_all_command must be a single line"))
+	}
+	if c.Broadcast != "say" && c.Broadcast != "tellraw" {
+		errs = append(errs, fmt.Errorf("unknown broadcast %q, expected \"say\" or \"tellraw\"", c.Broadcast))
+	}
+	for _, d := range c.Countdown.Steps {
+		if d.Duration <= 0 {
+			errs = append(errs, errors.New("countdown.steps must be positive"))
+			break
+		}
+	}
+	if err := checkMessage(c.Countdown.Message); err != nil {
+		errs = append(errs, fmt.Errorf("countdown.message: %w", err))
+	}
+	errs = append(errs, c.Messages.validate()...)
+	if c.ChatTrigger.Enabled() {
+		errs = append(errs, c.ChatTrigger.validate()...)
+		switch {
+		case c.ServerFlavor == BEDROCK_FLAVOR:
+			errs = append(errs, errors.New("chat_trigger isn't supported on bedrock, whose log doesn't show chat"))
+		case c.MinecraftLogPath == "" && c.Transport != "process":
+			errs = append(errs, errors.New("chat_trigger needs minecraft_log_path to watch chat"))
+		}
+	}
+	if c.Process.StopTimeout.Duration < 0 {
+		errs = append(errs, errors.New("process.stop_timeout must not be negative"))
+	}
+	if c.Hooks.Timeout.Duration < 0 {
+		errs = append(errs, errors.New("hooks.timeout must not be negative"))
+	}
+	if c.Interval.Duration < time.Minute {
+		errs = append(errs, errors.New("interval must be at least 1m"))
+	}
+	if c.Activity.Enabled() {
+		errs = append(errs, c.Activity.validate()...)
+	}
+	errs = append(errs, c.BackupWindow.validate()...)
+	if strings.ContainsAny(c.BackupDirPrefix+c.Name, `/\`) {
+		errs = append(errs, errors.New("name and backup_dir_prefix must not contain path separators"))
+	}
+	return errors.Join(errs...)
+}
+
+// Removes trailing slashes so paths can be concatenated safely.
+func cleanPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	return filepath.Clean(p)
+}
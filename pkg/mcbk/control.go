@@ -0,0 +1,220 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CONTROL_POLL = time.Second //How often stopping and starting the server is checked on
+
+// What servers log once the world is saved on shutdown: Java Edition's
+// final save since 1.14, and Bedrock's last words.
+const DEFAULT_STOPPED_LOG = `All dimensions are saved|Quit correctly`
+
+// How "mcbk restore -restart" stops the server before putting the files
+// back and starts it again afterwards.
+type ControlConfig struct {
+	Method       string   `json:"method"`        //"command" to send "stop" and run start, "systemd", "docker" or "pterodactyl". Default "docker" or "pterodactyl" with those transports, otherwise "command"
+	Start        string   `json:"start"`         //command: shell command that starts the server again, e.g. "systemctl start minecraft" or a tmux new-session
+	Unit         string   `json:"unit"`          //systemd: the server's unit, e.g. "minecraft.service"
+	StoppedLog   string   `json:"stopped_log"`   //Pattern in the console output confirming the server saved and shut down, for command
+	StopTimeout  Duration `json:"stop_timeout"`  //How long the server may take to shut down, default 2m
+	StartTimeout Duration `json:"start_timeout"` //How long it may take to answer "list" after starting, default 5m
+}
+
+func (c *ControlConfig) setDefaults(transport string) {
+	if c.Method == "" {
+		switch transport {
+		case "docker", "pterodactyl":
+			c.Method = transport
+		default:
+			c.Method = "command"
+		}
+	}
+	if c.StoppedLog == "" {
+		c.StoppedLog = DEFAULT_STOPPED_LOG
+	}
+	if c.StopTimeout.Duration == 0 {
+		c.StopTimeout.Duration = 2 * time.Minute
+	}
+	if c.StartTimeout.Duration == 0 {
+		c.StartTimeout.Duration = 5 * time.Minute
+	}
+}
+
+func (c ServerConfig) validateControl() []error {
+	var errs []error
+	switch c.Control.Method {
+	case "command":
+	case "systemd":
+		if c.Control.Unit == "" {
+			errs = append(errs, errors.New("control.method systemd needs control.unit"))
+		}
+	case "docker":
+		if c.Docker.Container == "" {
+			errs = append(errs, errors.New("control.method docker needs docker.container"))
+		}
+	case "pterodactyl":
+		if c.Transport != "pterodactyl" {
+			errs = append(errs, errors.New("control.method pterodactyl needs the pterodactyl transport"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown control.method %q, expected \"command\", \"systemd\", \"docker\" or \"pterodactyl\"", c.Control.Method))
+	}
+	if _, err := regexp.Compile(c.Control.StoppedLog); err != nil {
+		errs = append(errs, fmt.Errorf("control.stopped_log: %w", err))
+	}
+	if c.Control.StopTimeout.Duration < 0 || c.Control.StartTimeout.Duration < 0 {
+		errs = append(errs, errors.New("control timeouts must not be negative"))
+	}
+	return errs
+}
+
+// Returns why the server can't be stopped and started again, or nil.
+func (s *Server) CanRestart() error {
+	if s.conf.Control.Method == "command" && s.conf.Control.Start == "" {
+		return errors.New("set control.start to the command that starts the server, or another control.method")
+	}
+	return nil
+}
+
+// Stops the server and waits for it to shut down cleanly: for the world to
+// be saved and closed, and with the command method for the server to log
+// that it has saved.
+func (s *Server) StopServer(ctx context.Context) error {
+	conf := s.conf.Control
+	ctx, cancel := context.WithTimeout(ctx, conf.StopTimeout.Duration)
+	defer cancel()
+	s.log().Info("Stopping the server...", "phase", "stop", "method", conf.Method)
+	var err error
+	switch conf.Method {
+	case "command":
+		err = s.stopWithCommand(ctx)
+	case "systemd":
+		_, err = runCommand(ctx, "systemctl", "stop", conf.Unit)
+	case "docker":
+		secs := strconv.Itoa(int(conf.StopTimeout.Duration.Seconds()))
+		_, err = runCommand(ctx, "docker", s.conf.Docker.cliArgs("stop", "-t", secs, s.conf.Docker.Container)...)
+	case "pterodactyl":
+		err = s.pterodactylPower(ctx, "stop")
+	}
+	if err == nil {
+		err = s.waitWorldClosed(ctx)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("the server didn't shut down within control.stop_timeout (%s)", conf.StopTimeout.Duration)
+	}
+	if err != nil {
+		return fmt.Errorf("stopping the server: %w", err)
+	}
+	s.log().Info("Server stopped", "phase", "stop")
+	return nil
+}
+
+// Sends "stop" and waits for the server to log that it saved the world.
+// Without a console to follow, only the world lock tells it has stopped.
+func (s *Server) stopWithCommand(ctx context.Context) error {
+	stopped := regexp.MustCompile(s.conf.Control.StoppedLog)
+	follower, err := s.followConsole(ctx)
+	if err != nil {
+		s.log().Debug("Can't follow the console, waiting for the world to be closed instead", "phase", "stop", "error", err)
+		return s.sendCommand(ctx, s.commandText("stop"))
+	}
+	defer follower.Close()
+	if err := s.sendCommand(ctx, s.commandText("stop")); err != nil {
+		return err
+	}
+	return follower.waitFor(ctx, stopped.MatchString)
+}
+
+// Waits until the server no longer holds the lock on its worlds.
+func (s *Server) waitWorldClosed(ctx context.Context) error {
+	for {
+		inUse, err := worldInUse(s.conf.MinecraftDir)
+		if err != nil {
+			return err
+		}
+		if !inUse {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(CONTROL_POLL):
+		}
+	}
+}
+
+// Starts the server again and waits for it to answer "list".
+func (s *Server) StartServer(ctx context.Context) error {
+	conf := s.conf.Control
+	ctx, cancel := context.WithTimeout(ctx, conf.StartTimeout.Duration)
+	defer cancel()
+	s.log().Info("Starting the server...", "phase", "start", "method", conf.Method)
+	var err error
+	switch conf.Method {
+	case "command":
+		if err = s.CanRestart(); err == nil {
+			_, err = runCommand(ctx, hookShell[0], append(hookShell[1:], conf.Start)...)
+		}
+	case "systemd":
+		_, err = runCommand(ctx, "systemctl", "start", conf.Unit)
+	case "docker":
+		_, err = runCommand(ctx, "docker", s.conf.Docker.cliArgs("start", s.conf.Docker.Container)...)
+	case "pterodactyl":
+		err = s.pterodactylPower(ctx, "start")
+	}
+	for err == nil && s.verifyCommand(ctx, "list") != nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(CONTROL_POLL):
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("the server didn't answer within control.start_timeout (%s)", conf.StartTimeout.Duration)
+	}
+	if err != nil {
+		return fmt.Errorf("starting the server: %w", err)
+	}
+	s.log().Info("Server started", "phase", "start")
+	return nil
+}
+
+// Sends a power signal, "start" or "stop", to the server through the
+// Pterodactyl panel.
+func (s *Server) pterodactylPower(ctx context.Context, signal string) error {
+	conf := s.conf.Pterodactyl
+	body, err := json.Marshal(map[string]string{"signal": signal})
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimSuffix(conf.URL, "/") + "/api/client/servers/" + url.PathEscape(conf.Server) + "/power"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("pterodactyl returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package mcbk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Warnings broadcast in-game before world saving is paused, so players
+// aren't surprised by it.
+type CountdownConfig struct {
+	Steps   []Duration `json:"steps"`   //How long before the backup to warn, e.g. ["60s", "30s", "10s"]. Empty disables the countdown
+	Message string     `json:"message"` //Template for each warning, see messageData. Defaults to messages.language's
+}
+
+// The countdown steps, longest first, with the warning for each.
+func (s *Server) countdownMessages() ([]time.Duration, []string, error) {
+	c := s.conf.Countdown
+	tmpl, err := template.New("countdown").Parse(c.Message)
+	if err != nil {
+		return nil, nil, err
+	}
+	steps := make([]time.Duration, len(c.Steps))
+	for i, d := range c.Steps {
+		steps[i] = d.Duration
+	}
+	slices.Sort(steps)
+	slices.Reverse(steps)
+
+	msgs := make([]string, len(steps))
+	for i, remaining := range steps {
+		var msg strings.Builder
+		err := tmpl.Execute(&msg, messageData{
+			Server:    s.conf.Name,
+			Remaining: formatRemaining(remaining),
+			Seconds:   int(remaining.Seconds()),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		msgs[i] = msg.String()
+	}
+	return steps, msgs, nil
+}
+
+// Broadcasts a warning at each countdown step and returns once the last
+// step has run out, or early if ctx is cancelled.
+func (s *Server) countdown(ctx context.Context) error {
+	if len(s.conf.Countdown.Steps) == 0 {
+		return nil
+	}
+	steps, msgs, err := s.countdownMessages()
+	if err != nil {
+		return err
+	}
+
+	s.log().Info("Counting down to backup", "phase", "countdown", "duration", steps[0])
+	for i, remaining := range steps {
+		s.broadcast(ctx, msgs[i])
+
+		wait := remaining
+		if i+1 < len(steps) {
+			wait -= steps[i+1]
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}
+
+// Formats a countdown step without trailing zero units, e.g. "1m" rather
+// than "1m0s".
+func formatRemaining(d time.Duration) string {
+	text := d.Round(time.Second).String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
+	}
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return text
+}
+
+// Sends a message to every player, with "say" or as plain tellraw text
+// depending on the broadcast setting. Delivery isn't verified.
+func (s *Server) broadcast(ctx context.Context, msg string) {
+	s.sendCommand(ctx, s.broadcastCommand(msg))
+}
+
+// The command that sends msg to every player.
+func (s *Server) broadcastCommand(msg string) string {
+	if s.conf.Broadcast == "tellraw" {
+		text, _ := json.Marshal(map[string]string{"text": msg, "color": "yellow"})
+		return fmt.Sprintf("tellraw @a %s", text)
+	}
+	return "say " + msg
+}
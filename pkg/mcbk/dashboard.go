@@ -0,0 +1,65 @@
+package mcbk
+
+import (
+	_ "embed"
+	"errors"
+	"net/http"
+)
+
+const DASHBOARD_HEADER = "X-Mcbk-Dashboard" //Header the dashboard sends with its changes, which other sites can't make a browser send
+
+// The dashboard page, with its script and styles inline so the binary
+// serves it as is.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// Settings for the web dashboard "mcbk daemon" serves on listen.
+type DashboardConfig struct {
+	Enabled  bool   `json:"enabled"`                //Serve the dashboard at / on daemon.listen
+	Username string `json:"username"`               //Basic auth user for the dashboard and the API. Without one the dashboard asks for daemon.api_token
+	Password string `json:"password" secret:"true"` //That user's password
+}
+
+func (c DaemonConfig) validateDashboard() []error {
+	var errs []error
+	d := c.Dashboard
+	if (d.Username == "") != (d.Password == "") {
+		errs = append(errs, errors.New("daemon.dashboard needs both username and password, or neither"))
+	}
+	if !d.Enabled {
+		return errs
+	}
+	if c.Listen == "" {
+		errs = append(errs, errors.New("daemon.dashboard needs daemon.listen to serve it on"))
+	}
+	if c.APIToken == "" && d.Username == "" {
+		errs = append(errs, errors.New("daemon.dashboard needs daemon.api_token or a username and password, or anyone could use it"))
+	}
+	return errs
+}
+
+// Registers the dashboard at / on mux, next to the API it uses, which must
+// be registered too. The page itself holds nothing secret, so it asks for
+// credentials only when basic auth is set; otherwise its script asks for
+// the token.
+func (a *API) RegisterDashboard(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", a.dashboard)
+}
+
+func (a *API) dashboard(w http.ResponseWriter, r *http.Request) {
+	if a.user != "" {
+		if ok, _ := a.authenticate(r); !ok {
+			a.unauthorized(w)
+			return
+		}
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'; img-src 'self' data:; frame-ancestors 'none'")
+	w.Write(dashboardHTML)
+}
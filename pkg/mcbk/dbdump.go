@@ -0,0 +1,198 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DUMPS_DIR = "mcbk-dumps"        //Where database dumps are written under minecraft_dir, unless databases.dir says otherwise
+const DUMP_TIMEOUT = 30 * time.Minute //How long all dumps of a backup may take, unless databases.timeout says otherwise
+
+// Databases that plugins such as LuckPerms and CoreProtect keep their data
+// in, dumped into minecraft_dir right after the world is saved, so the
+// backup holds a consistent copy of them next to the world. Copying a
+// database file while it is written isn't safe.
+type DatabasesConfig struct {
+	Dir     string           `json:"dir"`     //Directory under minecraft_dir the dumps are written to, default "mcbk-dumps"
+	Timeout Duration         `json:"timeout"` //How long all dumps together may take, default 30m
+	Dump    []DatabaseConfig `json:"dump"`    //The databases to dump
+}
+
+// A database to dump, and how to reach it.
+type DatabaseConfig struct {
+	Name     string   `json:"name"`                   //File name of the dump in dir, without extension, e.g. "coreprotect"
+	Type     string   `json:"type"`                   //"sqlite" or "mysql"
+	Path     string   `json:"path"`                   //sqlite: the database file, relative to minecraft_dir, e.g. "plugins/CoreProtect/database.db"
+	Host     string   `json:"host"`                   //mysql: server to connect to, default "localhost"
+	Port     int      `json:"port"`                   //mysql: default 3306
+	User     string   `json:"user"`                   //mysql: user with SELECT, LOCK TABLES and SHOW VIEW on the database
+	Password string   `json:"password" secret:"true"` //mysql: the user's password
+	Database string   `json:"database"`               //mysql: the database to dump
+	Command  string   `json:"command"`                //Program to run, default "sqlite3" or "mysqldump", e.g. "mariadb-dump"
+	Flags    []string `json:"flags"`                  //Extra arguments for mysqldump, e.g. ["--ignore-table=cp.co_block"]
+}
+
+func (c *DatabasesConfig) setDefaults() {
+	if c.Dir == "" {
+		c.Dir = DUMPS_DIR
+	}
+	if c.Timeout.Duration == 0 {
+		c.Timeout.Duration = DUMP_TIMEOUT
+	}
+	for i := range c.Dump {
+		d := &c.Dump[i]
+		switch d.Type {
+		case "sqlite":
+			if d.Command == "" {
+				d.Command = "sqlite3"
+			}
+		case "mysql":
+			if d.Command == "" {
+				d.Command = "mysqldump"
+			}
+			if d.Host == "" {
+				d.Host = "localhost"
+			}
+			if d.Port == 0 {
+				d.Port = 3306
+			}
+		}
+	}
+}
+
+func (c DatabasesConfig) validate() []error {
+	var errs []error
+	if len(c.Dump) == 0 {
+		return nil
+	}
+	if filepath.IsAbs(c.Dir) || !filepath.IsLocal(filepath.FromSlash(c.Dir)) {
+		errs = append(errs, fmt.Errorf("databases.dir must be a relative path under minecraft_dir, got %q", c.Dir))
+	}
+	if c.Timeout.Duration < 0 {
+		errs = append(errs, errors.New("databases.timeout must not be negative"))
+	}
+	seen := map[string]bool{}
+	for i, d := range c.Dump {
+		prefix := fmt.Sprintf("databases.dump[%d]", i)
+		switch {
+		case d.Name == "":
+			errs = append(errs, fmt.Errorf("%s: missing required setting \"name\"", prefix))
+		case seen[d.Name]:
+			errs = append(errs, fmt.Errorf("%s: duplicate name %q", prefix, d.Name))
+		case strings.ContainsAny(d.Name, `/\`):
+			errs = append(errs, fmt.Errorf("%s: name %q must not contain path separators", prefix, d.Name))
+		}
+		seen[d.Name] = true
+		switch d.Type {
+		case "sqlite":
+			if d.Path == "" {
+				errs = append(errs, fmt.Errorf("%s: missing required setting \"path\" for type sqlite", prefix))
+			}
+		case "mysql":
+			if d.Database == "" {
+				errs = append(errs, fmt.Errorf("%s: missing required setting \"database\" for type mysql", prefix))
+			}
+			if d.Port < 1 || d.Port > 65535 {
+				errs = append(errs, fmt.Errorf("%s: port must be between 1 and 65535, got %d", prefix, d.Port))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown type %q, expected \"sqlite\" or \"mysql\"", prefix, d.Type))
+		}
+	}
+	return errs
+}
+
+// The include patterns the dumps are backed up with, if there are any.
+func (c DatabasesConfig) include() []string {
+	if len(c.Dump) == 0 {
+		return nil
+	}
+	return []string{filepath.ToSlash(c.Dir)}
+}
+
+// The file a database is dumped to.
+func (c ServerConfig) dumpPath(d DatabaseConfig) string {
+	ext := ".sql"
+	if d.Type == "sqlite" {
+		ext = ".db"
+	}
+	return filepath.Join(c.MinecraftDir, filepath.FromSlash(c.Databases.Dir), d.Name+ext)
+}
+
+// Dumps every configured database into databases.dir. Each dump is written
+// next to its file and renamed over it once complete, so a failed dump
+// never leaves a partial one behind to be backed up.
+func (s *Server) dumpDatabases(ctx context.Context) error {
+	if len(s.conf.Databases.Dump) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.conf.Databases.Timeout.Duration)
+	defer cancel()
+
+	dir := filepath.Join(s.conf.MinecraftDir, filepath.FromSlash(s.conf.Databases.Dir))
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	for _, d := range s.conf.Databases.Dump {
+		s.log().Info("Dumping database...", "phase", "dump", "database", d.Name, "type", d.Type)
+		start := time.Now()
+		path := s.conf.dumpPath(d)
+		tmp := path + ".tmp"
+		var err error
+		switch d.Type {
+		case "sqlite":
+			err = s.dumpSQLite(ctx, d, tmp)
+		case "mysql":
+			err = dumpMySQL(ctx, d, tmp)
+		}
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("dumping database %q: %w", d.Name, err)
+		}
+		s.log().Debug("Database dumped", "phase", "dump", "database", d.Name, "path", path, "duration", time.Since(start))
+	}
+	return nil
+}
+
+// Copies a SQLite database with its online backup API, which gives a
+// consistent copy even while the plugin writes to it.
+func (s *Server) dumpSQLite(ctx context.Context, d DatabaseConfig, to string) error {
+	src := d.Path
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(s.conf.MinecraftDir, filepath.FromSlash(src))
+	}
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	os.Remove(to) //.backup won't write over a file that isn't a database
+	_, err := runCommand(ctx, d.Command, "-bail", "-cmd", ".timeout 10000", src, ".backup '"+strings.ReplaceAll(to, "'", "''")+"'")
+	return err
+}
+
+// Dumps a MySQL or MariaDB database as SQL in a single transaction, so
+// InnoDB tables are dumped as they were at one moment without locking
+// them. The password is passed in the environment rather than on the
+// command line, where other users could see it.
+func dumpMySQL(ctx context.Context, d DatabaseConfig, to string) error {
+	args := []string{"--single-transaction", "--quick", "--routines", "--triggers", "--host=" + d.Host, "--port=" + strconv.Itoa(d.Port), "--result-file=" + to}
+	if d.User != "" {
+		args = append(args, "--user="+d.User)
+	}
+	args = append(args, d.Flags...)
+	args = append(args, d.Database)
+	var env []string
+	if d.Password != "" {
+		env = append(env, "MYSQL_PWD="+d.Password)
+	}
+	_, err := runCommandEnv(ctx, env, d.Command, args...)
+	return err
+}
@@ -0,0 +1,710 @@
+package mcbk
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DEDUP_TIME_FORMAT = "20060102-150405" //Name of each snapshot's manifest, before .json.gz
+	DEDUP_MIN_CHUNK   = 16 << 10          //Smallest chunk a file is split into, apart from its last
+	DEDUP_MAX_CHUNK   = 256 << 10         //Largest chunk, cut even if the content has no boundary
+	DEDUP_CHUNK_BITS  = 16                //Past the minimum, a boundary is found every 2^DEDUP_CHUNK_BITS bytes on average
+)
+
+// How a chunk is stored, given by its file's first byte.
+const (
+	dedupRaw   = 0
+	dedupFlate = 1
+)
+
+// Settings for the dedup backend.
+type DedupConfig struct {
+	Dir  string `json:"dir"`  //Where the repository is kept, default <backup_root>/<backup_dir_prefix>-dedup
+	Keep int    `json:"keep"` //Number of snapshots kept when pruning
+}
+
+// Keeps backups in a repository of its own, using only the standard
+// library. Files are split into chunks at boundaries picked by their
+// content, so data that shifts within a file still deduplicates, and each
+// chunk is stored once, under its SHA-256 and compressed if that helps. A
+// snapshot is a manifest listing every file with the chunks it is made of.
+// Files whose size and mtime haven't changed since the last snapshot reuse
+// its chunks without being read at all.
+type dedupBackend struct {
+	dir      string
+	keep     int
+	excludes []excludePattern
+	gc       GCConfig
+}
+
+// The first line of a snapshot's manifest, followed by a dedupEntry on each
+// line after it.
+type dedupHeader struct {
+	Time  time.Time `json:"time"`
+	Added int64     `json:"added"` //Bytes of new chunks the snapshot stored
+}
+
+// A file, directory or symlink in a snapshot.
+type dedupEntry struct {
+	Path    string      `json:"path"` //Relative to the backed up directory, slash-separated
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size,omitempty"`
+	Link    string      `json:"link,omitempty"`   //Target of a symlink
+	Chunks  []string    `json:"chunks,omitempty"` //SHA-256 of each chunk of a regular file, in order
+}
+
+// Multipliers for the rolling gear hash that finds chunk boundaries. They
+// come from a fixed seed, as changing them would move every boundary and
+// stop new saves from deduplicating against old ones.
+var dedupGear = func() (t [256]uint64) {
+	x := uint64(0x6d63626b) //"mcbk"
+	for i := range t {
+		//splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+func newDedupBackend(c DedupConfig, excludes []excludePattern, gc GCConfig) *dedupBackend {
+	return &dedupBackend{dir: c.Dir, keep: c.Keep, excludes: excludes, gc: gc}
+}
+
+// The backend of a server that doesn't choose one: dedup, unless the
+// server already has backups made with the backend that was the default
+// before, which is then kept so upgrading doesn't start over beside them.
+func (c *ServerConfig) defaultBackend() string {
+	if c.BackupRoot == "" {
+		return DEFAULT_BACKEND
+	}
+	var found []string
+	switch LEGACY_DEFAULT_BACKEND {
+	case "bup":
+		found, _ = (&bupBackend{root: c.BackupRoot, prefix: c.BackupDirPrefix}).repos()
+	case "tar":
+		found, _ = filepath.Glob(filepath.Join(c.Tar.Dir, c.Tar.Name+"-*.tar.gz*"))
+	}
+	if len(found) > 0 {
+		return LEGACY_DEFAULT_BACKEND
+	}
+	return DEFAULT_BACKEND
+}
+
+// The whole repository.
+func (b *dedupBackend) Files() (string, string) {
+	return filepath.Dir(b.dir), filepath.Base(b.dir)
+}
+
+func (b *dedupBackend) Init(ctx context.Context) error {
+	for _, sub := range []string{"chunks", "snapshots"} {
+		if err := os.MkdirAll(filepath.Join(b.dir, sub), 0770); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *dedupBackend) chunkPath(id string) string {
+	return filepath.Join(b.dir, "chunks", id[:2], id)
+}
+
+func (b *dedupBackend) manifestPath(id string) string {
+	return filepath.Join(b.dir, "snapshots", id+".json.gz")
+}
+
+// Whether id names a snapshot, which can't point outside the repository.
+func validDedupID(id string) bool {
+	_, err := time.ParseInLocation(DEDUP_TIME_FORMAT, id, time.Local)
+	return err == nil
+}
+
+// Whether id is a chunk's SHA-256 in hex, as a manifest read back from disk
+// could hold anything.
+func validChunkID(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Saves everything under dir, or under paths within it, that isn't
+// excluded, then writes the manifest. It is written under a temporary name
+// and renamed once complete, so a failed run leaves no snapshot behind,
+// only chunks the next gc removes. Stops between chunks if ctx is
+// cancelled, and reports progress after each file.
+func (b *dedupBackend) Save(ctx context.Context, dir string, paths []string) (Snapshot, error) {
+	now := time.Now()
+	id := now.Format(DEDUP_TIME_FORMAT)
+	if ok, err := exists(b.manifestPath(id)); err != nil {
+		return Snapshot{}, err
+	} else if ok {
+		return Snapshot{}, fmt.Errorf("snapshot %s already exists", id)
+	}
+	previous, err := b.lastFiles(ctx)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("reading the last snapshot: %w", err)
+	}
+
+	w := &dedupWriter{backend: b, buf: make([]byte, DEDUP_MAX_CHUNK)}
+	var entries []dedupEntry
+	var done int64
+	err = walkPaths(dir, paths, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if excluded(b.excludes, filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := dedupEntry{Path: filepath.ToSlash(rel), Mode: info.Mode(), ModTime: info.ModTime()}
+		switch {
+		case info.IsDir():
+		case info.Mode()&fs.ModeSymlink != 0:
+			if e.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if p, ok := previous[e.Path]; ok && p.Mode.IsRegular() && p.Size == info.Size() && p.ModTime.Equal(e.ModTime) {
+				e.Size, e.Chunks = p.Size, p.Chunks
+			} else if e.Size, e.Chunks, err = w.writeFile(ctx, path); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+			done += e.Size
+			reportProgress(ctx, done, 0)
+		default:
+			return nil //Sockets, pipes such as the stdin transport's, and devices
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := b.writeManifest(id, dedupHeader{Time: now, Added: w.added}, entries); err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{ID: id, Time: now, Repo: b.dir, Size: w.added}, nil
+}
+
+// Splits files into chunks and stores the ones the repository doesn't have
+// yet, reusing its buffers from one chunk to the next.
+type dedupWriter struct {
+	backend *dedupBackend
+	buf     []byte
+	packed  bytes.Buffer
+	flate   *flate.Writer
+	added   int64 //Bytes of new chunks stored so far
+}
+
+// Stores the file at path, returning its size and the IDs of its chunks.
+func (w *dedupWriter) writeFile(ctx context.Context, path string) (int64, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	var size int64
+	var chunks []string
+	filled := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, nil, err
+		}
+		n, err := io.ReadFull(f, w.buf[filled:])
+		filled += n
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, nil, err
+		}
+		if filled == 0 {
+			return size, chunks, nil
+		}
+		cut := dedupCut(w.buf[:filled])
+		id, err := w.writeChunk(w.buf[:cut])
+		if err != nil {
+			return 0, nil, err
+		}
+		chunks = append(chunks, id)
+		size += int64(cut)
+		filled = copy(w.buf, w.buf[cut:filled])
+	}
+}
+
+// Returns where the chunk at the start of data ends: the first point past
+// DEDUP_MIN_CHUNK where the gear hash of the bytes before it has its top
+// DEDUP_CHUNK_BITS bits clear, or DEDUP_MAX_CHUNK if there is none. The
+// hash only depends on the last 64 bytes, so the same content gives the
+// same boundaries wherever it is in a file.
+func dedupCut(data []byte) int {
+	if len(data) <= DEDUP_MIN_CHUNK {
+		return len(data)
+	}
+	end := min(len(data), DEDUP_MAX_CHUNK)
+	var h uint64
+	for i := DEDUP_MIN_CHUNK; i < end; i++ {
+		h = h<<1 + dedupGear[data[i]]
+		if h>>(64-DEDUP_CHUNK_BITS) == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+// Stores a chunk unless the repository already has it, and returns its ID.
+// It is compressed unless that doesn't make it any smaller, as with the
+// already compressed chunks of region files.
+func (w *dedupWriter) writeChunk(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+	path := w.backend.chunkPath(id)
+	if ok, err := exists(path); err != nil || ok {
+		return id, err
+	}
+	w.packed.Reset()
+	w.packed.WriteByte(dedupFlate)
+	if w.flate == nil {
+		w.flate, _ = flate.NewWriter(&w.packed, flate.DefaultCompression)
+	} else {
+		w.flate.Reset(&w.packed)
+	}
+	w.flate.Write(data)
+	if err := w.flate.Close(); err != nil {
+		return "", err
+	}
+	if w.packed.Len() > len(data) {
+		w.packed.Reset()
+		w.packed.WriteByte(dedupRaw)
+		w.packed.Write(data)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+id+"-*.partial")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(w.packed.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	w.added += int64(w.packed.Len())
+	return id, nil
+}
+
+// Reads a chunk back, checking it against its ID.
+func (b *dedupBackend) readChunk(id string) ([]byte, error) {
+	if !validChunkID(id) {
+		return nil, fmt.Errorf("invalid chunk id %q", id)
+	}
+	data, err := os.ReadFile(b.chunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("chunk %s is empty", id)
+	}
+	switch data[0] {
+	case dedupRaw:
+		data = data[1:]
+	case dedupFlate:
+		if data, err = io.ReadAll(flate.NewReader(bytes.NewReader(data[1:]))); err != nil {
+			return nil, fmt.Errorf("chunk %s: %w", id, err)
+		}
+	default:
+		return nil, fmt.Errorf("chunk %s is stored in unknown format %d", id, data[0])
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("chunk %s is corrupt, its contents don't match its hash", id)
+	}
+	return data, nil
+}
+
+// Reads a file's contents back from its chunks.
+type dedupReader struct {
+	backend *dedupBackend
+	chunks  []string
+	buf     []byte
+}
+
+func (r *dedupReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := r.backend.readChunk(r.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		r.buf, r.chunks = data, r.chunks[1:]
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Writes a snapshot's manifest as gzipped JSON lines, only making it
+// visible under its name once complete.
+func (b *dedupBackend) writeManifest(id string, header dedupHeader, entries []dedupEntry) error {
+	path := b.manifestPath(id)
+	tmp := filepath.Join(filepath.Dir(path), "."+id+".partial")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+	err = enc.Encode(header)
+	for i := 0; i < len(entries) && err == nil; i++ {
+		err = enc.Encode(entries[i])
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Reads the manifest of a snapshot, passing each of its entries to fn, if
+// it isn't nil, and returns its header.
+func (b *dedupBackend) readManifest(ctx context.Context, id string, fn func(e dedupEntry) error) (dedupHeader, error) {
+	var header dedupHeader
+	if !validDedupID(id) {
+		return header, fmt.Errorf("invalid dedup snapshot id %q", id)
+	}
+	f, err := os.Open(b.manifestPath(id))
+	if err != nil {
+		return header, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return header, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+	defer gz.Close()
+	dec := json.NewDecoder(gz)
+	if err := dec.Decode(&header); err != nil {
+		return header, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+	for fn != nil {
+		if err := ctx.Err(); err != nil {
+			return header, err
+		}
+		var e dedupEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return header, fmt.Errorf("snapshot %s: %w", id, err)
+		}
+		if err := fn(e); err != nil {
+			return header, err
+		}
+	}
+	return header, nil
+}
+
+// The files of the newest snapshot, keyed by path, for Save to skip the
+// unchanged ones.
+func (b *dedupBackend) lastFiles(ctx context.Context) (map[string]dedupEntry, error) {
+	snaps, err := b.List(ctx)
+	if err != nil || len(snaps) == 0 {
+		return nil, err
+	}
+	files := map[string]dedupEntry{}
+	_, err = b.readManifest(ctx, snaps[len(snaps)-1].ID, func(e dedupEntry) error {
+		files[e.Path] = e
+		return nil
+	})
+	return files, err
+}
+
+// Every save deduplicates against the whole repository, most closely the
+// newest snapshot, whose unchanged files take no space at all.
+func (b *dedupBackend) spaceTarget(ctx context.Context) (string, time.Time, error) {
+	snaps, err := b.List(ctx)
+	return b.dir, lastSnapshotTime(snaps), err
+}
+
+// Lists the snapshots from their manifests' names, reading only the header
+// of each for its size.
+func (b *dedupBackend) List(ctx context.Context) ([]Snapshot, error) {
+	paths, err := filepath.Glob(filepath.Join(b.dir, "snapshots", "*.json.gz"))
+	if err != nil {
+		return nil, err
+	}
+	var snaps []Snapshot
+	for _, p := range paths {
+		id := strings.TrimSuffix(filepath.Base(p), ".json.gz")
+		t, err := time.ParseInLocation(DEDUP_TIME_FORMAT, id, time.Local)
+		if err != nil {
+			continue
+		}
+		header, err := b.readManifest(ctx, id, nil)
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, Snapshot{ID: id, Time: t, Repo: b.dir, Size: header.Added})
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Time.Before(snaps[j].Time)
+	})
+	return snaps, nil
+}
+
+func (b *dedupBackend) Restore(ctx context.Context, id, target string) error {
+	return b.RestorePaths(ctx, id, target, nil)
+}
+
+// Restores only the given paths, or everything if there are none, refusing
+// entries that would escape target, as extractTarGz does. Every chunk is
+// checked against its hash as it is read.
+func (b *dedupBackend) RestorePaths(ctx context.Context, id, target string, paths []string) error {
+	links := &pendingSymlinks{target: target}
+	_, err := b.readManifest(ctx, id, func(e dedupEntry) error {
+		rel := filepath.FromSlash(e.Path)
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("refusing to restore %q outside of target", e.Path)
+		}
+		if len(paths) > 0 && !underAny(rel, paths) {
+			return nil
+		}
+		path, err := extractPath(target, rel)
+		if err != nil {
+			return err
+		}
+		switch {
+		case e.Mode.IsDir():
+			err = os.MkdirAll(path, e.Mode.Perm()|0700)
+		case e.Mode.IsRegular():
+			err = writeFileFrom(path, &dedupReader{backend: b, chunks: e.Chunks}, e.Mode.Perm())
+		case e.Mode&fs.ModeSymlink != 0:
+			links.add(rel, path, e.Link)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.Path, err)
+		}
+		os.Chtimes(path, e.ModTime, e.ModTime)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return links.create()
+}
+
+// Lists the files in a snapshot from its manifest.
+func (b *dedupBackend) ListFiles(ctx context.Context, id string) ([]SnapshotFile, error) {
+	return b.listFiles(ctx, id, false)
+}
+
+// Lists the regular files in a snapshot with the SHA-256 hashes of their
+// contents, reading back every chunk.
+func (b *dedupBackend) HashFiles(ctx context.Context, id string) ([]SnapshotFile, error) {
+	return b.listFiles(ctx, id, true)
+}
+
+func (b *dedupBackend) listFiles(ctx context.Context, id string, hash bool) ([]SnapshotFile, error) {
+	var files []SnapshotFile
+	_, err := b.readManifest(ctx, id, func(e dedupEntry) error {
+		if e.Mode.IsDir() || hash && !e.Mode.IsRegular() {
+			return nil
+		}
+		f := SnapshotFile{Path: e.Path, Size: e.Size, ModTime: e.ModTime.Truncate(time.Second)}
+		if hash {
+			h := sha256.New()
+			if _, err := io.Copy(h, &dedupReader{backend: b, chunks: e.Chunks}); err != nil {
+				return fmt.Errorf("%s: %w", e.Path, err)
+			}
+			f.SHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Lists a snapshot's manifest for a mount.
+func (b *dedupBackend) mountEntries(ctx context.Context, id string) ([]mountEntry, error) {
+	var entries []mountEntry
+	_, err := b.readManifest(ctx, id, func(e dedupEntry) error {
+		entries = append(entries, mountEntry{path: e.Path, mode: e.Mode, size: e.Size, mtime: e.ModTime, link: e.Link, chunks: e.Chunks})
+		return nil
+	})
+	return entries, err
+}
+
+// Reads a mounted file back from its chunks, checking each against its
+// hash.
+func (b *dedupBackend) extract(ctx context.Context, n *mountNode, f *os.File) error {
+	_, err := io.Copy(f, &dedupReader{backend: b, chunks: n.chunks})
+	return err
+}
+
+// Serves the snapshots as a read-only filesystem at dir, one directory
+// per snapshot, named by its ID.
+func (b *dedupBackend) Mount(ctx context.Context, dir string) error {
+	snaps, err := b.List(ctx)
+	if err != nil {
+		return err
+	}
+	m, err := newSnapshotMount(ctx, b, snaps, func(snap Snapshot) string { return snap.ID })
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return serveFUSE(ctx, dir, m)
+}
+
+// Reads back every chunk the snapshot uses, checking each against its
+// hash, so a chunk that went missing or was damaged on disk is found.
+func (b *dedupBackend) Check(ctx context.Context, snap Snapshot) error {
+	checked := map[string]bool{}
+	_, err := b.readManifest(ctx, snap.ID, func(e dedupEntry) error {
+		for _, id := range e.Chunks {
+			if checked[id] {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if _, err := b.readChunk(id); err != nil {
+				return fmt.Errorf("%s: %w", e.Path, err)
+			}
+			checked[id] = true
+		}
+		return nil
+	})
+	return err
+}
+
+// Deletes all but the newest keep snapshots.
+func (b *dedupBackend) Prune(ctx context.Context) error {
+	return b.PruneSparing(ctx, nil)
+}
+
+// Prunes like Prune, leaving the spared snapshots alone and not counting
+// them towards keep.
+func (b *dedupBackend) PruneSparing(ctx context.Context, spared []Snapshot) error {
+	all, err := b.List(ctx)
+	if err != nil {
+		return err
+	}
+	var snaps []Snapshot
+	for _, s := range all {
+		if !containsSnapshot(spared, s.ID) {
+			snaps = append(snaps, s)
+		}
+	}
+	if len(snaps) <= b.keep {
+		return nil
+	}
+	return b.Delete(ctx, snaps[:len(snaps)-b.keep])
+}
+
+// Removes the snapshots' manifests, then the chunks no longer used by any
+// other snapshot, unless gc.skip is set.
+func (b *dedupBackend) Delete(ctx context.Context, snaps []Snapshot) error {
+	for _, s := range snaps {
+		if !validDedupID(s.ID) {
+			return fmt.Errorf("invalid dedup snapshot id %q", s.ID)
+		}
+		if err := os.Remove(b.manifestPath(s.ID)); err != nil {
+			return err
+		}
+	}
+	if b.gc.Skip {
+		return nil
+	}
+	return b.collect(ctx)
+}
+
+// Removes every chunk no snapshot uses, including those left behind by
+// saves that failed or were deleted with gc.skip set. Any manifest that
+// can't be read stops it, rather than risk removing chunks it uses.
+func (b *dedupBackend) collect(ctx context.Context) error {
+	snaps, err := b.List(ctx)
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, s := range snaps {
+		_, err := b.readManifest(ctx, s.ID, func(e dedupEntry) error {
+			for _, id := range e.Chunks {
+				used[id] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = filepath.WalkDir(filepath.Join(b.dir, "chunks"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || used[d.Name()] {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,247 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Random bytes that are the same on every run.
+func dedupTestData(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// Splits data into chunks as Save does, keyed by content.
+func dedupChunks(data []byte) map[string]bool {
+	chunks := map[string]bool{}
+	for len(data) > 0 {
+		cut := dedupCut(data)
+		chunks[string(data[:cut])] = true
+		data = data[cut:]
+	}
+	return chunks
+}
+
+func newTestDedupBackend(t *testing.T) *dedupBackend {
+	t.Helper()
+	b := newDedupBackend(DedupConfig{Dir: filepath.Join(t.TempDir(), "repo"), Keep: 14}, nil, GCConfig{})
+	if err := b.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDedupCutBounds(t *testing.T) {
+	data := dedupTestData(4<<20, 1)
+	for len(data) > 0 {
+		cut := dedupCut(data)
+		if cut > DEDUP_MAX_CHUNK || cut < min(len(data), DEDUP_MIN_CHUNK) {
+			t.Fatalf("cut a chunk of %d bytes with %d left", cut, len(data))
+		}
+		data = data[cut:]
+	}
+}
+
+func TestDedupCutStableAfterInsert(t *testing.T) {
+	data := dedupTestData(4<<20, 2)
+	before := dedupChunks(data)
+	for _, at := range []int{0, 1000, 1 << 20} {
+		inserted := append(append(append([]byte{}, data[:at]...), bytes.Repeat([]byte("inserted"), 100)...), data[at:]...)
+		after := dedupChunks(inserted)
+		changed := 0
+		for chunk := range before {
+			if !after[chunk] {
+				changed++
+			}
+		}
+		//Only the chunk the bytes went into, and at most the one after it
+		if changed > 2 {
+			t.Errorf("inserting at %d changed %d of %d chunks", at, changed, len(before))
+		}
+	}
+}
+
+func TestDedupRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	b := newTestDedupBackend(t)
+	src := t.TempDir()
+	level := dedupTestData(1<<20, 3)
+	files := map[string][]byte{
+		"world/level.dat":         level,
+		"world/empty":             {},
+		"world/region/r.0.0.mca":  bytes.Repeat([]byte("region"), 50000),
+		"world/region/copy.mca":   level,
+		"server.properties":       []byte("motd=test\n"),
+		"world/playerdata/a.json": []byte("{}"),
+	}
+	for name, data := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("level.dat", filepath.Join(src, "world", "latest")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "world", "datapacks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := b.Save(ctx, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Check(ctx, snap); err != nil {
+		t.Errorf("checking the new snapshot: %v", err)
+	}
+
+	target := t.TempDir()
+	if err := b.RestorePaths(ctx, snap.ID, target, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(target, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: restored %d bytes that differ from the %d saved", name, len(got), len(want))
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(target, "world", "latest")); err != nil || link != "level.dat" {
+		t.Errorf("world/latest: got link %q, %v, want level.dat", link, err)
+	}
+	if info, err := os.Stat(filepath.Join(target, "world", "datapacks")); err != nil || !info.IsDir() {
+		t.Errorf("world/datapacks wasn't restored as a directory: %v", err)
+	}
+
+	//Only the paths asked for
+	partial := t.TempDir()
+	if err := b.RestorePaths(ctx, snap.ID, partial, []string{filepath.Join("world", "region")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(partial, "world", "region", "r.0.0.mca")); err != nil {
+		t.Errorf("world/region wasn't restored: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(partial, "server.properties")); err == nil {
+		t.Error("server.properties was restored along with world/region")
+	}
+}
+
+func TestDedupRestoreRefusesSymlinkEscapes(t *testing.T) {
+	self := dedupEntry{Path: "self", Mode: fs.ModeSymlink | 0777, Link: "."}
+	up := dedupEntry{Path: "up", Mode: fs.ModeSymlink | 0777, Link: "self/.."}
+	for _, tt := range []struct {
+		name    string
+		entries []dedupEntry
+	}{
+		{"through an earlier symlink", []dedupEntry{self, up}},
+		{"through a later symlink", []dedupEntry{up, self}},
+		{"out of target", []dedupEntry{{Path: "world/link", Mode: fs.ModeSymlink | 0777, Link: "../../evil"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestDedupBackend(t)
+			id := "20240101-000000"
+			if err := b.writeManifest(id, dedupHeader{Time: time.Now()}, tt.entries); err != nil {
+				t.Fatal(err)
+			}
+			target := filepath.Join(t.TempDir(), "target")
+			err := b.RestorePaths(context.Background(), id, target, nil)
+			if err == nil || !strings.Contains(err.Error(), "refusing") {
+				t.Errorf("restoring got error %v, want a refusal", err)
+			}
+			for _, e := range tt.entries {
+				if _, err := os.Lstat(filepath.Join(target, filepath.FromSlash(e.Path))); err == nil {
+					t.Errorf("%s was created despite the refusal", e.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestDedupReadChunkDetectsCorruption(t *testing.T) {
+	b := newTestDedupBackend(t)
+	w := &dedupWriter{backend: b}
+	//Random, so it is stored as is and the damage can't hide in compression
+	id, err := w.writeChunk(dedupTestData(DEDUP_MIN_CHUNK, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.readChunk(id); err != nil {
+		t.Fatalf("reading the intact chunk: %v", err)
+	}
+	path := b.chunkPath(id)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.readChunk(id); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("reading the damaged chunk: got error %v, want it reported as corrupt", err)
+	}
+}
+
+func TestDedupCollect(t *testing.T) {
+	ctx := context.Background()
+	b := newTestDedupBackend(t)
+	w := &dedupWriter{backend: b}
+	var ids []string
+	for i := range 3 {
+		id, err := w.writeChunk(dedupTestData(1000, int64(10+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	//The first chunk is shared, the second only in the older snapshot and
+	//the third in none, as after a failed save
+	older, newer := "20240101-000000", "20240102-000000"
+	for _, m := range []struct {
+		id     string
+		chunks []string
+	}{
+		{older, []string{ids[0], ids[1]}},
+		{newer, []string{ids[0]}},
+	} {
+		entries := []dedupEntry{{Path: "world/level.dat", Mode: 0644, ModTime: time.Now(), Size: 2000, Chunks: m.chunks}}
+		if err := b.writeManifest(m.id, dedupHeader{Time: time.Now()}, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func() []bool {
+		var found []bool
+		for _, id := range ids {
+			ok, err := exists(b.chunkPath(id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			found = append(found, ok)
+		}
+		return found
+	}
+
+	if err := b.collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored(); !got[0] || !got[1] || got[2] {
+		t.Errorf("after collecting, chunks stored = %v, want [true true false]", got)
+	}
+	if err := b.Delete(ctx, []Snapshot{{ID: older}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored(); !got[0] || got[1] || got[2] {
+		t.Errorf("after deleting the older snapshot, chunks stored = %v, want [true false false]", got)
+	}
+}
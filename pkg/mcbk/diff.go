@@ -0,0 +1,143 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A file inside a snapshot, with its path relative to the backed up
+// directory in slash-separated form.
+type SnapshotFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"` //Hex hash of the contents, only filled in by fileHasher and manifests
+}
+
+// Implemented by backends that can list a snapshot's files without
+// restoring it. Directories are left out.
+type fileLister interface {
+	ListFiles(ctx context.Context, id string) ([]SnapshotFile, error)
+}
+
+// Implemented by backends that can also hash the contents of a snapshot's
+// regular files without restoring it, to check a restore against.
+type fileHasher interface {
+	HashFiles(ctx context.Context, id string) ([]SnapshotFile, error)
+}
+
+// The files that differ between two snapshots. A file counts as changed if
+// its size or contents differ, going by SHA-256 when both versions have a
+// hash and otherwise by modification time; Changed holds the newer version.
+type SnapshotDiff struct {
+	Added   []SnapshotFile `json:"added"`
+	Removed []SnapshotFile `json:"removed"`
+	Changed []SnapshotFile `json:"changed"`
+}
+
+// Compares the files in two snapshots, given by ID as listed by the
+// backend, using their manifests where mcbk wrote them. Backends that can't
+// list a snapshot's files have the others restored into temporary
+// directories, which needs room for two copies of the world.
+func (s *Server) DiffSnapshots(ctx context.Context, from, to string) (SnapshotDiff, error) {
+	var diff SnapshotDiff
+	old, err := s.snapshotFiles(ctx, from)
+	if err != nil {
+		return diff, err
+	}
+	cur, err := s.snapshotFiles(ctx, to)
+	if err != nil {
+		return diff, err
+	}
+
+	before := map[string]SnapshotFile{}
+	for _, f := range old {
+		before[f.Path] = f
+	}
+	for _, f := range cur {
+		o, ok := before[f.Path]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, f)
+		case o.Size != f.Size || !sameContents(o, f):
+			diff.Changed = append(diff.Changed, f)
+		}
+		delete(before, f.Path)
+	}
+	for _, f := range before {
+		diff.Removed = append(diff.Removed, f)
+	}
+	for _, list := range [][]SnapshotFile{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	return diff, nil
+}
+
+// Whether two versions of a file hold the same contents, by their hashes
+// if both have one, or else by modification time to the second, which is
+// all some backends keep.
+func sameContents(a, b SnapshotFile) bool {
+	if a.SHA256 != "" && b.SHA256 != "" {
+		return a.SHA256 == b.SHA256
+	}
+	return a.ModTime.Truncate(time.Second).Equal(b.ModTime.Truncate(time.Second))
+}
+
+// Lists the files in a snapshot, sorted by path, e.g. to browse it.
+// Backends that can't list a snapshot's files have it restored into a
+// temporary directory, unless mcbk wrote a manifest of it.
+func (s *Server) SnapshotFiles(ctx context.Context, id string) ([]SnapshotFile, error) {
+	files, err := s.snapshotFiles(ctx, id)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, err
+}
+
+// Lists a snapshot's files from its manifest, through the backend, or by
+// restoring it.
+func (s *Server) snapshotFiles(ctx context.Context, id string) ([]SnapshotFile, error) {
+	m, err := s.readManifest(id)
+	if err == nil {
+		return m.Files, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		s.log().Warn("Error reading the snapshot's manifest, listing its files from the backend", "snapshot", id, "error", err)
+	}
+	if l, ok := s.backend.(fileLister); ok {
+		return l.ListFiles(ctx, id)
+	}
+	dir, err := os.MkdirTemp("", "mcbk-diff-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := s.backend.Restore(ctx, id, dir); err != nil {
+		return nil, err
+	}
+	return walkFiles(dir)
+}
+
+// Lists the files under dir. Modification times are truncated to the
+// second, which is all some backends restore.
+func walkFiles(dir string) ([]SnapshotFile, error) {
+	var files []SnapshotFile
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, SnapshotFile{Path: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime().Truncate(time.Second)})
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,111 @@
+package mcbk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Embed colours for each event
+const (
+	DISCORD_COLOR_START   = 0x3498db
+	DISCORD_COLOR_SUCCESS = 0x2ecc71
+	DISCORD_COLOR_FAILURE = 0xe74c3c
+	DISCORD_COLOR_WARNING = 0xf39c12
+)
+
+// Posts events to a Discord channel through an incoming webhook.
+type discordNotifier struct {
+	url string
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbed struct {
+	Title     string         `json:"title"`
+	Color     int            `json:"color"`
+	Timestamp string         `json:"timestamp"`
+	Fields    []discordField `json:"fields,omitempty"`
+}
+
+func (d *discordNotifier) Notify(ev Event) error {
+	embed := discordEmbed{Timestamp: ev.Time.Format("2006-01-02T15:04:05Z07:00")}
+	if ev.Server != DEFAULT_SERVER_NAME {
+		embed.Fields = append(embed.Fields, discordField{Name: sourceLabel(ev), Value: ev.Server, Inline: true})
+	}
+	switch ev.Kind {
+	case EventStart:
+		embed.Title = "Minecraft backup started"
+		embed.Color = DISCORD_COLOR_START
+	case EventSuccess:
+		embed.Title = "Minecraft backup complete"
+		embed.Color = DISCORD_COLOR_SUCCESS
+		embed.Fields = append(embed.Fields, discordField{Name: "Duration", Value: ev.Duration.Round(time.Second).String(), Inline: true})
+		if ev.Snapshot.Size > 0 {
+			embed.Fields = append(embed.Fields, discordField{Name: "Size", Value: FormatBytes(ev.Snapshot.Size), Inline: true})
+		}
+		if ev.Snapshot.ID != "" {
+			embed.Fields = append(embed.Fields, discordField{Name: "Snapshot", Value: ev.Snapshot.ID})
+		}
+	case EventFailure:
+		embed.Title = "Minecraft backup FAILED"
+		embed.Color = DISCORD_COLOR_FAILURE
+		embed.Fields = append(embed.Fields, discordField{Name: "Error", Value: truncate(ev.Err.Error(), 1024)})
+	case EventReplicationFailure:
+		embed.Title = "Minecraft backup replication FAILED"
+		embed.Color = DISCORD_COLOR_FAILURE
+		embed.Fields = append(embed.Fields, discordField{Name: "Remote", Value: ev.Remote, Inline: true})
+		embed.Fields = append(embed.Fields, discordField{Name: "Error", Value: truncate(ev.Err.Error(), 1024)})
+	case EventSizeAnomaly:
+		embed.Title = "Minecraft backup much smaller than usual"
+		embed.Color = DISCORD_COLOR_WARNING
+		embed.Fields = append(embed.Fields, discordField{Name: "Warning", Value: truncate(ev.Err.Error(), 1024)})
+	case EventSourceCorrupt:
+		embed.Title = "Minecraft backup taken from a world that may be corrupt"
+		embed.Color = DISCORD_COLOR_WARNING
+		embed.Fields = append(embed.Fields, discordField{Name: "Snapshot", Value: ev.Snapshot.ID})
+		embed.Fields = append(embed.Fields, discordField{Name: "Warning", Value: truncate(ev.Err.Error(), 1024)})
+	case EventOverdue:
+		embed.Title = "Minecraft backup OVERDUE"
+		embed.Color = DISCORD_COLOR_FAILURE
+		embed.Fields = append(embed.Fields, discordField{Name: "Error", Value: truncate(ev.Err.Error(), 1024)})
+	case EventNetworkReport:
+		embed.Title = "Minecraft network backup complete"
+		embed.Color = DISCORD_COLOR_SUCCESS
+		if ev.Err != nil {
+			embed.Title = "Minecraft network backup FAILED"
+			embed.Color = DISCORD_COLOR_FAILURE
+		}
+		embed.Fields = append(embed.Fields, discordField{Name: "Duration", Value: ev.Duration.Round(time.Second).String(), Inline: true})
+		embed.Fields = append(embed.Fields, discordField{Name: "Servers", Value: truncate(ev.Report, 1024)})
+	}
+
+	body, err := json.Marshal(map[string]any{"embeds": []discordEmbed{embed}})
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(d.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("discord returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// Shortens s to at most n bytes, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
@@ -0,0 +1,173 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Implemented by backends that write their backups to a local directory, so
+// the free space there can be checked before a backup starts.
+type spaceChecker interface {
+	//Returns the directory the next Save writes to, or "" if it isn't on
+	//this machine, and when the snapshot it deduplicates against was taken.
+	//The zero time means the save stores a full copy of the world.
+	spaceTarget(ctx context.Context) (dir string, base time.Time, err error)
+}
+
+var errFreeSpaceUnsupported = errors.New("free space can't be checked on this platform")
+
+// Makes sure the backup destination has room for the next backup plus
+// free_space_margin, so a full disk stops the run before the server is
+// touched rather than half way through writing the backup. The size is
+// estimated from the world files that would be stored: all of them for
+// full copies, otherwise the ones modified since the last snapshot.
+func (s *Server) checkFreeSpace(ctx context.Context) error {
+	sc, ok := s.backend.(spaceChecker)
+	if !ok || s.conf.SkipSpaceCheck {
+		return nil
+	}
+	dir, base, err := sc.spaceTarget(ctx)
+	if err != nil {
+		return fmt.Errorf("finding the last snapshot: %w", err)
+	}
+	if dir == "" {
+		return nil
+	}
+	free, err := freeSpace(existingParent(dir))
+	if errors.Is(err, errFreeSpaceUnsupported) {
+		s.log().Debug("Skipping free space check", "phase", "preflight", "error", err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("checking free space in %s: %w", dir, err)
+	}
+	if err := s.checkFreeInodes(dir); err != nil {
+		return err
+	}
+	excludes, err := parseExcludes(s.conf.Exclude)
+	if err != nil {
+		return err
+	}
+	paths, err := s.backupPaths()
+	if err != nil {
+		return err
+	}
+	estimate, err := changedSize(ctx, s.conf.MinecraftDir, paths, excludes, base)
+	if err != nil {
+		return fmt.Errorf("estimating backup size: %w", err)
+	}
+	need := estimate + int64(s.conf.FreeSpaceMargin)
+	s.log().Debug("Checked free space", "phase", "preflight", "dir", dir, "free", free, "estimate", estimate, "margin", int64(s.conf.FreeSpaceMargin))
+	if free < need {
+		return fmt.Errorf("not enough free space in %s: the backup needs about %s plus a free_space_margin of %s, but only %s is free",
+			dir, FormatBytes(estimate), FormatBytes(int64(s.conf.FreeSpaceMargin)), FormatBytes(free))
+	}
+	return nil
+}
+
+// Totals the size of the files under dir, or paths within it, that would
+// be backed up and were modified after since.
+func changedSize(ctx context.Context, dir string, paths []string, excludes []excludePattern, since time.Time) (int64, error) {
+	var total int64
+	err := walkPaths(dir, paths, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && excluded(excludes, filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(since) {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// The space target of a deduplicating repository at the local path dir,
+// which is "" for remote ones.
+func repoSpaceTarget(ctx context.Context, dir string, b Backend) (string, time.Time, error) {
+	if dir == "" {
+		return "", time.Time{}, nil
+	}
+	if ok, err := exists(dir); err != nil || !ok {
+		return dir, time.Time{}, err
+	}
+	snaps, err := b.List(ctx)
+	return dir, lastSnapshotTime(snaps), err
+}
+
+// When the newest of snaps, sorted oldest first, was taken.
+func lastSnapshotTime(snaps []Snapshot) time.Time {
+	if len(snaps) == 0 {
+		return time.Time{}
+	}
+	return snaps[len(snaps)-1].Time
+}
+
+// Returns dir, or its closest ancestor that exists when it hasn't been
+// created yet.
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// Returns the local path of the server's restic or borg repository, or ""
+// if it's remote or the backend has none.
+func (s *Server) localRepo() string {
+	switch s.conf.Backend {
+	case "restic":
+		return localRepoPath(s.conf.Restic.Repository)
+	case "borg":
+		return localRepoPath(s.conf.Borg.Repository)
+	}
+	return ""
+}
+
+// Returns the local path of a restic or borg repository, or "" if it's
+// reached over the network, e.g. "s3:..." or "ssh://...".
+func localRepoPath(repo string) string {
+	repo = strings.TrimPrefix(repo, "local:")
+	repo = strings.TrimPrefix(repo, "file://")
+	if repo == "" || strings.Contains(repo, "://") {
+		return ""
+	}
+	if filepath.VolumeName(repo) != "" {
+		return repo
+	}
+	//"sftp:host:/path", "user@host:path" and the like
+	if i := strings.IndexByte(repo, ':'); i >= 0 && !strings.Contains(repo[:i], "/") {
+		return ""
+	}
+	return repo
+}
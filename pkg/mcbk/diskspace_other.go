@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package mcbk
+
+func freeSpace(path string) (int64, error) {
+	return 0, errFreeSpaceUnsupported
+}
+
+func diskSize(path string) (int64, error) {
+	return 0, errFreeSpaceUnsupported
+}
+
+func freeInodes(path string) (free, total int64, err error) {
+	return 0, 0, errFreeSpaceUnsupported
+}
+
+func deviceID(path string) (uint64, error) {
+	return 0, errMountCheckUnsupported
+}
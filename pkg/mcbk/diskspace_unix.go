@@ -0,0 +1,42 @@
+//go:build linux || darwin || freebsd
+
+package mcbk
+
+import "syscall"
+
+// Bytes available to unprivileged users on the filesystem holding path.
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// Total size of the filesystem holding path.
+func diskSize(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Blocks) * int64(st.Bsize), nil
+}
+
+// Free and total inodes of the filesystem holding path. Filesystems that
+// allocate inodes as needed, like btrfs, report a total of 0.
+func freeInodes(path string) (free, total int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Ffree), int64(st.Files), nil
+}
+
+// The device of the filesystem holding path.
+func deviceID(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
@@ -0,0 +1,47 @@
+package mcbk
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceExW = kernel32.NewProc("GetDiskFreeSpaceExW")
+
+// Bytes available to the current user on the volume holding path, taking
+// quotas into account.
+func freeSpace(path string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var avail uint64
+	r, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	return int64(avail), nil
+}
+
+// Total size of the volume holding path, as far as the current user's
+// quota allows.
+func diskSize(path string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var total uint64
+	r, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(p)), 0, uintptr(unsafe.Pointer(&total)), 0)
+	if r == 0 {
+		return 0, err
+	}
+	return int64(total), nil
+}
+
+// NTFS has no fixed number of inodes to run out of.
+func freeInodes(path string) (free, total int64, err error) {
+	return 0, 0, nil
+}
+
+func deviceID(path string) (uint64, error) {
+	return 0, errMountCheckUnsupported
+}
@@ -0,0 +1,243 @@
+package mcbk
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DOCKER_DEFAULT_HOST = "unix:///var/run/docker.sock"
+const DOCKER_INSPECT_TIMEOUT = 30 * time.Second //How long to wait for docker inspect when resolving minecraft_dir
+
+// Settings for the docker transport, for servers running in a container
+// such as itzg/minecraft-server.
+type DockerConfig struct {
+	Container string   `json:"container"`    //Name or id of the server's container
+	Mode      string   `json:"mode"`         //"exec" to run exec_command in the container and read its output, or "attach" to write to the server console
+	Exec      []string `json:"exec_command"` //Command run in the container with the console command as its last argument, default ["rcon-cli"]
+	Host      string   `json:"host"`         //Docker daemon, "unix://..." or "tcp://host:port". Defaults to $DOCKER_HOST, then the local socket
+	DataDir   string   `json:"data_dir"`     //Where the server directory is mounted in the container, default "/data"
+}
+
+func (c *DockerConfig) setDefaults() {
+	if c.Mode == "" {
+		c.Mode = "exec"
+	}
+	if c.Exec == nil {
+		c.Exec = []string{"rcon-cli"}
+	}
+	if c.DataDir == "" {
+		c.DataDir = "/data"
+	}
+}
+
+func (c DockerConfig) validate() []error {
+	var errs []error
+	switch c.Mode {
+	case "exec":
+		if len(c.Exec) == 0 || c.Exec[0] == "" {
+			errs = append(errs, errors.New("docker.exec_command must not be empty"))
+		}
+	case "attach":
+		if _, _, err := dockerDialAddr(c.host()); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown docker.mode %q, expected \"exec\" or \"attach\"", c.Mode))
+	}
+	if !path.IsAbs(c.DataDir) {
+		errs = append(errs, fmt.Errorf("docker.data_dir must be an absolute path in the container, got %q", c.DataDir))
+	}
+	return errs
+}
+
+func (c DockerConfig) host() string {
+	return cmp.Or(c.Host, os.Getenv("DOCKER_HOST"), DOCKER_DEFAULT_HOST)
+}
+
+// Arguments selecting the daemon for the docker CLI, which otherwise
+// follows $DOCKER_HOST by itself.
+func (c DockerConfig) cliArgs(args ...string) []string {
+	if c.Host != "" {
+		return append([]string{"-H", c.Host}, args...)
+	}
+	return args
+}
+
+// Splits a Docker host URL into a network and address to dial.
+func dockerDialAddr(host string) (string, string, error) {
+	u, err := url.Parse(host)
+	if err == nil {
+		switch u.Scheme {
+		case "unix":
+			return "unix", u.Path, nil
+		case "tcp":
+			return "tcp", u.Host, nil
+		}
+	}
+	return "", "", fmt.Errorf("docker host %q isn't supported for attaching, expected unix:// or tcp://", host)
+}
+
+// Finds where the container's data_dir is mounted on the host, so
+// minecraft_dir can be left out when mcbk runs beside the container.
+func (c DockerConfig) resolveDataDir(ctx context.Context) (string, error) {
+	out, err := runCommand(ctx, "docker", c.cliArgs("inspect", "--format", "{{json .Mounts}}", c.Container)...)
+	if err != nil {
+		return "", err
+	}
+	var mounts []struct {
+		Type        string
+		Source      string
+		Destination string
+	}
+	if err := json.Unmarshal(out, &mounts); err != nil {
+		return "", fmt.Errorf("reading the mounts of container %s: %w", c.Container, err)
+	}
+	for _, m := range mounts {
+		if path.Clean(m.Destination) == path.Clean(c.DataDir) {
+			if m.Type != "bind" && m.Type != "volume" {
+				return "", fmt.Errorf("%s in container %s is a %s mount, which can't be backed up from outside", c.DataDir, c.Container, m.Type)
+			}
+			return filepath.FromSlash(m.Source), nil
+		}
+	}
+	return "", fmt.Errorf("container %s has no mount at %s, set minecraft_dir or docker.data_dir", c.Container, c.DataDir)
+}
+
+// Fills in minecraft_dir from the container's mount of docker.data_dir
+// when it is left out, and minecraft_log_path from that for Java servers.
+func (c *ServerConfig) resolveDockerPaths() error {
+	if c.Transport != "docker" || c.MinecraftDir != "" || c.Docker.Container == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DOCKER_INSPECT_TIMEOUT)
+	defer cancel()
+	dir, err := c.Docker.resolveDataDir(ctx)
+	if err != nil {
+		return err
+	}
+	c.MinecraftDir = cleanPath(dir)
+	if c.MinecraftLogPath == "" && c.ServerFlavor != BEDROCK_FLAVOR {
+		c.MinecraftLogPath = filepath.Join(c.MinecraftDir, "logs", "latest.log")
+	}
+	return nil
+}
+
+// Runs console commands through a command in the container, by default
+// itzg/minecraft-server's rcon-cli, and reads their responses from its
+// output.
+type dockerExecTransport struct {
+	conf DockerConfig
+}
+
+func (t *dockerExecTransport) Send(ctx context.Context, command string) error {
+	_, err := t.Query(ctx, command)
+	return err
+}
+
+func (t *dockerExecTransport) Query(ctx context.Context, command string) (string, error) {
+	args := append([]string{"exec", t.conf.Container}, t.conf.Exec...)
+	out, err := runCommand(ctx, "docker", t.conf.cliArgs(append(args, command)...)...)
+	return strings.TrimSpace(string(out)), err
+}
+
+func (t *dockerExecTransport) Close() error {
+	return nil
+}
+
+// Writes console commands to the container's standard input through the
+// Docker API, which unlike docker attach works without a terminal. The
+// container must be started with stdin open (-i or stdin_open: true), and
+// commands are confirmed through the server log. The connection is kept
+// for the run.
+type dockerAttachTransport struct {
+	conf DockerConfig
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (t *dockerAttachTransport) Send(ctx context.Context, command string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		conn, err := t.attach(ctx)
+		if err != nil {
+			return err
+		}
+		t.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		t.conn.SetWriteDeadline(deadline)
+	}
+	_, err := t.conn.Write([]byte(command + "\n"))
+	if err != nil {
+		//The container may have restarted, reattach on the next command
+		t.conn.Close()
+		t.conn = nil
+	}
+	return err
+}
+
+// Attaches to the container's standard input, upgrading the API request to
+// a raw stream.
+func (t *dockerAttachTransport) attach(ctx context.Context) (net.Conn, error) {
+	network, addr, err := dockerDialAddr(t.conf.host())
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to docker: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://docker/containers/"+url.PathEscape(t.conf.Container)+"/attach?stream=1&stdin=1", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("attaching to container %s: %w", t.conf.Container, err)
+	}
+	//Older daemons answer 200 and switch to the raw stream anyway
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("attaching to container %s: docker returned %s", t.conf.Container, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (t *dockerAttachTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
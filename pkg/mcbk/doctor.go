@@ -0,0 +1,261 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DOCTOR_CLOCK_SKEW = 5 * time.Minute //How far in the future a history record may start before the clock is taken to have gone back
+
+// The oldest version of each backup tool mcbk works with.
+var minToolVersions = map[string]string{
+	"bup":    "0.29",
+	"restic": "0.9.5", //The first with backup --json
+	"borg":   "1.1",   //The first with --json and --glob-archives
+}
+
+// A version number in a tool's --version output.
+var versionRegexp = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// The outcome of one of the checks Doctor runs.
+type Diagnosis struct {
+	Check  string //What was checked, e.g. "backup_root"
+	Status string //"ok", "warn" for something that may cause trouble, or "fail"
+	Detail string //What was found
+	Fix    string //What to do about it, unless Status is "ok"
+}
+
+// Checks that everything a backup of the server relies on is in place: the
+// backup root can be written, the tools needed are installed and recent
+// enough, the server answers, its log can be read, there is room for the
+// next backup and the clock is right. Nothing is changed, apart from a file
+// briefly written to the backup root.
+func (s *Server) Doctor(ctx context.Context) []Diagnosis {
+	diags := []Diagnosis{s.diagnoseBackupRoot()}
+	diags = append(diags, s.diagnoseTools(ctx)...)
+	diags = append(diags, s.diagnoseServer(ctx))
+	if s.conf.MinecraftLogPath != "" {
+		diags = append(diags, s.diagnoseLog())
+	}
+	diags = append(diags, s.diagnoseSpace(ctx), s.diagnoseClock(ctx))
+	return diags
+}
+
+func diagOK(check, detail string) Diagnosis {
+	return Diagnosis{Check: check, Status: "ok", Detail: detail}
+}
+
+// Writes and removes a file in the backup root, which also holds the lock,
+// history and, for local backends, the backups themselves. With mount_check
+// set, nothing is written unless the backup disk is mounted.
+func (s *Server) diagnoseBackupRoot() Diagnosis {
+	root := s.conf.BackupRoot
+	if err := s.checkMount(); err != nil {
+		return Diagnosis{Check: "mount_check", Status: "fail", Detail: err.Error(), Fix: fmt.Sprintf("mount the backup disk at %s, e.g. with mount -a, and check why it went missing", s.conf.MountCheck)}
+	}
+	fix := fmt.Sprintf("create %s and give the user mcbk runs as write access to it, or set backup_root to a directory it can write", root)
+	if err := os.MkdirAll(root, 0770); err != nil {
+		return Diagnosis{Check: "backup_root", Status: "fail", Detail: err.Error(), Fix: fix}
+	}
+	f, err := os.CreateTemp(root, ".mcbk-doctor-")
+	if err != nil {
+		return Diagnosis{Check: "backup_root", Status: "fail", Detail: err.Error(), Fix: fix}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return diagOK("backup_root", root+" is writable")
+}
+
+// Checks that the backend's tool is installed and recent enough, and that
+// every other tool the config calls for is installed.
+func (s *Server) diagnoseTools(ctx context.Context) []Diagnosis {
+	var diags []Diagnosis
+	if minVersion, ok := minToolVersions[s.conf.Backend]; ok {
+		if s.conf.Backend == "bup" && s.conf.Bup.SplitBits != 0 {
+			minVersion = "0.33"
+		}
+		diags = append(diags, diagnoseToolVersion(ctx, s.conf.Backend, minVersion))
+	}
+
+	var tools []string
+	switch {
+	case s.conf.ZFS.Enabled():
+		tools = append(tools, "zfs")
+	case s.conf.Btrfs.Enabled():
+		tools = append(tools, "btrfs")
+	case s.conf.LVM.Enabled():
+		tools = append(tools, "lvcreate", "lvremove", "findmnt", "mount", "umount")
+	}
+	if s.conf.Backend == "tar" && s.conf.Tar.Age.Enabled() {
+		tools = append(tools, "age")
+	}
+	if s.conf.Backend == "tar" && s.conf.Tar.SSH.Enabled() {
+		tools = append(tools, "ssh")
+	}
+	if len(s.conf.Rclone) > 0 {
+		tools = append(tools, "rclone")
+	}
+	for _, d := range s.conf.Databases.Dump {
+		if !slices.Contains(tools, d.Command) {
+			tools = append(tools, d.Command)
+		}
+	}
+	switch s.conf.Transport {
+	case "screen", "tmux", "mark2", "msm":
+		tools = append(tools, s.conf.Transport)
+	}
+	for _, tool := range tools {
+		if path, err := exec.LookPath(tool); err != nil {
+			diags = append(diags, Diagnosis{Check: tool, Status: "fail", Detail: tool + " isn't installed or isn't in PATH", Fix: "install " + tool + " with your package manager, or add its directory to PATH"})
+		} else {
+			diags = append(diags, diagOK(tool, "found at "+path))
+		}
+	}
+	return diags
+}
+
+// Checks that tool is installed and at least minVersion.
+func diagnoseToolVersion(ctx context.Context, tool, minVersion string) Diagnosis {
+	installFix := fmt.Sprintf("install %s %s or later with your package manager, or add its directory to PATH", tool, minVersion)
+	if _, err := exec.LookPath(tool); err != nil {
+		return Diagnosis{Check: tool, Status: "fail", Detail: tool + " isn't installed or isn't in PATH", Fix: installFix}
+	}
+	args := []string{"--version"}
+	if tool != "borg" {
+		args = []string{"version"}
+	}
+	out, err := runCommand(ctx, tool, args...)
+	if err != nil {
+		return Diagnosis{Check: tool, Status: "fail", Detail: err.Error(), Fix: "check that " + tool + " runs for the user mcbk runs as"}
+	}
+	version := versionRegexp.FindString(string(out))
+	if version == "" {
+		return Diagnosis{Check: tool, Status: "warn", Detail: fmt.Sprintf("couldn't tell the version from %q", strings.TrimSpace(string(out))), Fix: fmt.Sprintf("make sure it is %s %s or later", tool, minVersion)}
+	}
+	if compareVersions(version, minVersion) < 0 {
+		return Diagnosis{Check: tool, Status: "fail", Detail: fmt.Sprintf("%s %s is older than the %s mcbk needs", tool, version, minVersion), Fix: fmt.Sprintf("upgrade %s, e.g. from its releases page if your distribution's package is too old", tool)}
+	}
+	return diagOK(tool, tool+" "+version)
+}
+
+// Compares dotted version numbers, returning -1, 0 or 1.
+func compareVersions(a, b string) int {
+	parse := func(v string) []int {
+		var nums []int
+		for _, part := range strings.Split(v, ".") {
+			n, _ := strconv.Atoi(part)
+			nums = append(nums, n)
+		}
+		return nums
+	}
+	va, vb := parse(a), parse(b)
+	for len(va) < len(vb) {
+		va = append(va, 0)
+	}
+	for len(vb) < len(va) {
+		vb = append(vb, 0)
+	}
+	return slices.Compare(va, vb)
+}
+
+// Checks that the server answers a command over its transport, and if not,
+// what is likely wrong.
+func (s *Server) diagnoseServer(ctx context.Context) Diagnosis {
+	err := s.verifyCommand(ctx, "list")
+	if err == nil {
+		return diagOK("server", fmt.Sprintf("answered %q over %s", "list", s.conf.Transport))
+	}
+	d := Diagnosis{Check: "server", Status: "fail", Detail: err.Error()}
+	const stopped = "; if the server is meant to be stopped, backups are taken cold and this can be ignored"
+	switch s.conf.Transport {
+	case "rcon":
+		if errors.Is(err, errRCONAuth) {
+			d.Fix = "set password under [rcon] to the rcon.password in server.properties"
+		} else {
+			d.Fix = fmt.Sprintf("check that the server is running with enable-rcon=true and rcon.port=%d in server.properties, and that %s:%d can be reached from here", s.conf.RCON.Port, s.conf.RCON.Host, s.conf.RCON.Port) + stopped
+		}
+	case "screen":
+		if _, err := runCommand(ctx, "screen", "-S", s.conf.ScreenSession, "-Q", "select", "."); err != nil {
+			d.Fix = fmt.Sprintf("start the server in a screen session named %s (screen -dmS %s ...), or set screen_session to the one it runs in; screen sessions are per user, so run mcbk as the same user", s.conf.ScreenSession, s.conf.ScreenSession) + stopped
+		} else {
+			d.Fix = "the session exists but the response wasn't seen in minecraft_log_path; check that it is the server's log, or set verify patterns for its output"
+		}
+	case "tmux":
+		if _, err := runCommand(ctx, "tmux", "has-session", "-t", s.conf.Tmux.Session); err != nil {
+			d.Fix = fmt.Sprintf("start the server in a tmux session named %s, or set tmux.session to the one it runs in; tmux sessions are per user, so run mcbk as the same user", s.conf.Tmux.Session) + stopped
+		} else {
+			d.Fix = "the session exists but the response wasn't seen in minecraft_log_path; check that it is the server's log and that tmux.window and tmux.pane point at the server console"
+		}
+	default:
+		d.Fix = fmt.Sprintf("check that the server is running and the %s settings", s.conf.Transport) + stopped
+	}
+	return d
+}
+
+// Checks that the server log can be read, for confirming commands, skip_idle
+// and chat_trigger.
+func (s *Server) diagnoseLog() Diagnosis {
+	path := s.conf.MinecraftLogPath
+	f, err := os.Open(path)
+	if err == nil {
+		_, err = f.Read(make([]byte, 1))
+		f.Close()
+		if err == nil || err == io.EOF {
+			return diagOK("minecraft_log_path", path+" is readable")
+		}
+	}
+	d := Diagnosis{Check: "minecraft_log_path", Status: "fail", Detail: err.Error()}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		d.Fix = "set minecraft_log_path to the server's log, usually logs/latest.log under its directory; it is created once the server has started"
+	case errors.Is(err, fs.ErrPermission):
+		d.Fix = "give the user mcbk runs as read access to the log, e.g. by adding it to the server's group"
+	default:
+		d.Fix = "check that minecraft_log_path is a readable file"
+	}
+	return d
+}
+
+// Runs the free space and inode check a backup starts with.
+func (s *Server) diagnoseSpace(ctx context.Context) Diagnosis {
+	if s.conf.SkipSpaceCheck {
+		return Diagnosis{Check: "free_space", Status: "warn", Detail: "skip_space_check is set", Fix: "make sure the backup destination is watched some other way"}
+	}
+	if err := s.checkFreeSpace(ctx); err != nil {
+		return Diagnosis{Check: "free_space", Status: "fail", Detail: err.Error(), Fix: "free up space, prune old backups with \"mcbk prune\" or keep fewer with the retention settings, or move backup_root to a bigger disk"}
+	}
+	return diagOK("free_space", "enough for the next backup")
+}
+
+// Checks that the clock looks right, as snapshots are named and pruned by
+// their time.
+func (s *Server) diagnoseClock(ctx context.Context) Diagnosis {
+	now := time.Now()
+	const ntpFix = "set the time and keep it synchronized with NTP, e.g. with timedatectl set-ntp true"
+	if now.Year() < 2024 {
+		return Diagnosis{Check: "clock", Status: "fail", Detail: "the clock reads " + now.Format(time.RFC3339) + ", so it has never been set", Fix: ntpFix}
+	}
+	if history, err := s.History(); err == nil && len(history) > 0 {
+		if last := history[len(history)-1].Start; last.After(now.Add(DOCTOR_CLOCK_SKEW)) {
+			return Diagnosis{Check: "clock", Status: "fail", Detail: fmt.Sprintf("the last backup started at %s, after the current time of %s, so the clock has gone back", last.Format(time.RFC3339), now.Format(time.RFC3339)), Fix: ntpFix}
+		}
+	}
+	if runtime.GOOS == "linux" {
+		//Only known on systemd hosts
+		if out, err := runCommand(ctx, "timedatectl", "show", "-p", "NTPSynchronized", "--value"); err == nil && strings.TrimSpace(string(out)) == "no" {
+			return Diagnosis{Check: "clock", Status: "warn", Detail: "the clock isn't synchronized with NTP", Fix: ntpFix}
+		}
+	}
+	return diagOK("clock", now.Format(time.RFC3339))
+}
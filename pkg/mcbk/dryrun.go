@@ -0,0 +1,211 @@
+package mcbk
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Goes through a backup of the server without changing anything, e.g. to
+// validate a new config. The alive check runs as usual; every later step
+// is logged with what it would do, down to the exact commands. Only "list"
+// is sent to the server, and no lock is taken, nothing is written and
+// nothing is notified or recorded in the history.
+func (r *Runner) DryRun(ctx context.Context, s *Server) error {
+	defer s.Close()
+	log := s.log().With("dry_run", true)
+	if err := s.checkWindow(time.Now()); err != nil && !r.ignoreWindow() {
+		log.Info("Would skip the backup", "phase", "window", "error", err)
+		return nil
+	}
+	if s.conf.SkipIdle && !r.force() {
+		if last, reason := s.idleSince(); reason == "" {
+			log.Info("Would skip the backup, no players since the last one", "phase", "idle-check", "last_backup", last)
+			return nil
+		}
+	}
+	p, err := s.Plan(ctx)
+	if err != nil {
+		log.Error("Would skip the backup", "phase", "alive-check", "error", err)
+		return err
+	}
+	p = r.adjust(p)
+
+	send := func(phase, command string) {
+		log.Info("Would send", "phase", phase, "command", command)
+	}
+	hook := func(phase, command string) {
+		if command != "" {
+			log.Info("Would run hook", "phase", phase, "command", command)
+		}
+	}
+	hook("pre-save", s.conf.Hooks.PreSave)
+	savingOff := false
+	if !p.Cold {
+		if p.Countdown {
+			steps, msgs, err := s.countdownMessages()
+			if err != nil {
+				return &phaseError{"countdown", err}
+			}
+			for i, msg := range msgs {
+				log.Info("Would send", "phase", "countdown", "command", s.broadcastCommand(msg), "before_backup", steps[i])
+			}
+		}
+		send("save-off", s.broadcastCommand(s.message(s.conf.Messages.BackupStart, messageData{})))
+		send("save-off", s.commandText("save-off"))
+		savingOff = true
+		send("save-all", s.commandText("save-all"))
+		s.describeDumps(log)
+		switch {
+		case s.conf.ServerFlavor == BEDROCK_FLAVOR:
+			log.Info("Would copy the held world files to a staging directory", "phase", "snapshot", "dir", s.conf.BackupRoot)
+		case s.conf.ZFS.Enabled():
+			log.Info("Would take a ZFS snapshot and back up from it", "phase", "snapshot", "dataset", s.conf.ZFS.Dataset)
+		case s.conf.Btrfs.Enabled():
+			log.Info("Would take a btrfs snapshot and back up from it", "phase", "snapshot", "subvolume", s.conf.Btrfs.Subvolume)
+		case s.conf.LVM.Enabled():
+			log.Info("Would take an LVM snapshot and back up from it", "phase", "snapshot", "volume", s.conf.LVM.Volume, "size", s.conf.LVM.Size)
+		}
+		if s.conf.ServerFlavor == BEDROCK_FLAVOR || s.conf.snapshotStaging() != "" {
+			send("save-on", s.commandText("save-on"))
+			savingOff = false
+		}
+	}
+
+	if p.Cold && !s.conf.Agent.Enabled() {
+		s.describeDumps(log)
+	}
+	if s.conf.SourceCheck.Enabled {
+		log.Info("Would check the world files for corruption", "phase", "source-check", "sample", s.conf.SourceCheck.Sample)
+	}
+	if err := s.describeSave(ctx, log, p.Include); err != nil {
+		return &phaseError{"backup", err}
+	}
+	if !s.conf.SkipManifest && !s.conf.Agent.remote() {
+		log.Info("Would write a manifest of the files with their SHA-256", "phase", "manifest", "dir", s.manifestDir())
+	}
+	hook("post-save", s.conf.Hooks.PostSave)
+	next := Snapshot{ID: "(new)", Time: time.Now(), Tags: r.tags(), PinnedUntil: r.pinnedUntil(s, time.Now())}
+	if len(next.Tags) > 0 || r.Comment != "" {
+		log.Info("Would label the snapshot", "phase", "backup", "tags", next.Tags, "comment", r.Comment)
+	}
+	if next.PinnedUntil != nil {
+		log.Info("Would pin the snapshot", "phase", "backup", "until", *next.PinnedUntil)
+	}
+	if savingOff {
+		send("save-on", s.commandText("save-on"))
+	}
+	if !p.Cold {
+		send("backup", s.broadcastCommand(s.message(s.conf.Messages.BackupComplete, messageData{})))
+	}
+	if p.Check {
+		log.Info("Would check the new snapshot", "phase", "check")
+	}
+	hook("post-backup", s.conf.Hooks.PostBackup)
+
+	if p.Prune {
+		if err := s.describePrune(ctx, log, next); err != nil {
+			return &phaseError{"prune", err}
+		}
+		hook("post-prune", s.conf.Hooks.PostPrune)
+	}
+	for _, t := range s.conf.uploadTargets() {
+		log.Info("Would upload the backups to "+t.label, "phase", "upload", "location", t.location, "prefix", t.prefix)
+	}
+	if p.Replicate {
+		for _, rc := range s.conf.Rclone {
+			log.Info("Would sync the backups with rclone", "phase", "replicate", "remote", rc.Remote)
+		}
+	}
+	return nil
+}
+
+// Logs the database dumps that would be taken.
+func (s *Server) describeDumps(log *slog.Logger) {
+	for _, d := range s.conf.Databases.Dump {
+		args := []any{"phase", "dump", "database", d.Name, "command", d.Command, "path", s.conf.dumpPath(d)}
+		if d.Type == "mysql" {
+			args = append(args, "host", d.Host, "port", d.Port, "name", d.Database)
+		} else {
+			args = append(args, "source", d.Path)
+		}
+		log.Info("Would dump database", args...)
+	}
+}
+
+// Logs where the backup would be written and what would go into it, with
+// the extra include patterns of the plan.
+func (s *Server) describeSave(ctx context.Context, log *slog.Logger, extra []string) error {
+	var repo string
+	switch b := s.backend.(type) {
+	case *bupBackend:
+		repo = b.currentRepoPath(ctx)
+	case *dedupBackend:
+		repo = b.dir
+	case fileStore:
+		repo, _ = b.Files()
+	case *tarBackend:
+		repo = b.store.location()
+	default:
+		switch s.conf.Backend {
+		case "restic":
+			repo = s.conf.Restic.Repository
+		case "borg":
+			repo = s.conf.Borg.Repository
+		}
+	}
+	paths, err := s.backupPaths(extra...)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	size, err := s.sourceSize(ctx)
+	if err != nil {
+		return err
+	}
+	log.Info("Would back up", "phase", "backup", "backend", s.conf.Backend, "repo", repo,
+		"source", s.conf.MinecraftDir, "paths", paths, "exclude", s.conf.Exclude, "size", size)
+	return nil
+}
+
+// Logs which snapshots pruning would remove, counting next, the backup
+// that would have just been taken, as the newest.
+func (s *Server) describePrune(ctx context.Context, log *slog.Logger, next Snapshot) error {
+	if !s.conf.Retention.Enabled() {
+		log.Info("Would run the backend's built-in pruning", "phase", "prune", "backend", s.conf.Backend)
+	} else {
+		snaps, err := s.Snapshots(ctx)
+		if err != nil {
+			return err
+		}
+		snaps = append(snaps, next)
+		removed := 0
+		for _, d := range ApplyRetention(snaps, s.conf.Retention) {
+			if !d.Keep {
+				log.Info("Would remove snapshot", "phase", "prune", "snapshot", d.Snapshot.ID, "time", d.Snapshot.Time)
+				removed++
+			}
+		}
+		log.Info("Would apply the retention policy", "phase", "prune", "remove", removed, "keep", len(snaps)-removed)
+	}
+	if s.conf.Quota.Enabled() {
+		limit, err := s.quotaLimit()
+		if err != nil {
+			return err
+		}
+		used, _, err := s.diskUsage(ctx)
+		if err != nil {
+			return err
+		}
+		//The new backup is added on top, and what each removal frees is only
+		//known once it is done, so this is as far as the preview can go
+		msg := "Backups are within the quota before the backup"
+		if used > limit {
+			msg = "Would remove the oldest snapshots until the backups fit the quota"
+		}
+		log.Info(msg, "phase", "prune", "used", used, "quota", limit)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package mcbk
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const SMTP_TIMEOUT = 30 * time.Second //Limit on delivering one message, including connecting
+const LOG_TAIL_MAX_BYTES = 64 * 1024  //How much of the end of the log is read for log_tail
+
+const DEFAULT_EMAIL_SUBJECT = "[mcbk] {{.Server}} backup {{.Status}}"
+const DEFAULT_EMAIL_BODY = `Backup of {{.Server}} {{.Status}} at {{.Time.Format "2006-01-02 15:04:05"}}.
+{{if .Duration}}
+Duration: {{.Duration}}{{end}}{{if .Snapshot}}
+Snapshot: {{.Snapshot}}{{if .Size}} ({{.Size}}){{end}}{{end}}{{if .Error}}
+Error: {{.Error}}{{end}}{{if .Report}}
+
+{{.Report}}{{end}}{{if .LogTail}}
+
+Last lines of the log:
+
+{{.LogTail}}{{end}}
+`
+
+// Settings for an email notification destination.
+type SMTPConfig struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`     //Defaults to 587 for starttls, 465 for tls and 25 for none
+	Security string   `json:"security"` //"starttls" (default), "tls" for implicit TLS, or "none"
+	Username string   `json:"username"` //Leave empty to send without authenticating
+	Password string   `json:"password" secret:"true"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Subject  string   `json:"subject"`  //Template for the subject line, see emailData
+	Body     string   `json:"body"`     //Template for the plain text body, see emailData
+	LogPath  string   `json:"log_path"` //Log whose last lines are included on failure, defaults to mcbk's own
+	LogTail  int      `json:"log_tail"` //How many lines of it to include, default 20
+}
+
+// What email subject and body templates can refer to.
+type emailData struct {
+	Server   string //The server, or the network for network_report
+	Status   string //"started", "complete", "FAILED", "replication to <remote> FAILED", "much smaller than usual" or "taken from a world that may be corrupt"
+	Time     time.Time
+	Duration string //Empty for start events
+	Snapshot string //ID of the new snapshot, on success and source_corrupt
+	Size     string //Size of the new snapshot, e.g. "1.5 GiB", if known
+	Error    string //What went wrong, on failure
+	Report   string //The outcome for each server, one per line, for network_report
+	LogTail  string //The end of the log, on failure
+}
+
+func (c *SMTPConfig) setDefaults(logPath string) {
+	if c.Security == "" {
+		c.Security = "starttls"
+	}
+	if c.Port == 0 {
+		switch c.Security {
+		case "tls":
+			c.Port = 465
+		case "none":
+			c.Port = 25
+		default:
+			c.Port = 587
+		}
+	}
+	if c.Subject == "" {
+		c.Subject = DEFAULT_EMAIL_SUBJECT
+	}
+	if c.Body == "" {
+		c.Body = DEFAULT_EMAIL_BODY
+	}
+	if c.LogPath == "" {
+		c.LogPath = logPath
+	}
+	if c.LogTail == 0 {
+		c.LogTail = 20
+	}
+}
+
+func (c *SMTPConfig) validate() []error {
+	var errs []error
+	if c.Host == "" || c.From == "" || len(c.To) == 0 {
+		errs = append(errs, errors.New("email needs smtp.host, smtp.from and smtp.to"))
+	}
+	if c.Security != "starttls" && c.Security != "tls" && c.Security != "none" {
+		errs = append(errs, fmt.Errorf("unknown smtp.security %q, expected \"starttls\", \"tls\" or \"none\"", c.Security))
+	}
+	if _, _, err := parseEmailTemplates(c); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Parses the subject and body templates, checking that they only refer to
+// fields emailData has.
+func parseEmailTemplates(c *SMTPConfig) (subject, body *template.Template, err error) {
+	subject, err = template.New("subject").Parse(c.Subject)
+	if err == nil {
+		err = subject.Execute(io.Discard, emailData{})
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("smtp.subject: %w", err)
+	}
+	body, err = template.New("body").Parse(c.Body)
+	if err == nil {
+		err = body.Execute(io.Discard, emailData{})
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("smtp.body: %w", err)
+	}
+	return subject, body, nil
+}
+
+// Sends events as plain text emails over SMTP.
+type emailNotifier struct {
+	conf SMTPConfig
+}
+
+func (n *emailNotifier) Notify(ev Event) error {
+	data := emailData{Server: ev.Server, Time: ev.Time}
+	switch ev.Kind {
+	case EventStart:
+		data.Status = "started"
+	case EventSuccess:
+		data.Status = "complete"
+		data.Snapshot = ev.Snapshot.ID
+		if ev.Snapshot.Size > 0 {
+			data.Size = FormatBytes(ev.Snapshot.Size)
+		}
+	case EventFailure, EventReplicationFailure, EventSizeAnomaly, EventSourceCorrupt, EventOverdue:
+		data.Status = "FAILED"
+		switch ev.Kind {
+		case EventReplicationFailure:
+			data.Status = "replication to " + ev.Remote + " FAILED"
+		case EventSizeAnomaly:
+			data.Status = "much smaller than usual"
+		case EventSourceCorrupt:
+			data.Status = "taken from a world that may be corrupt"
+			data.Snapshot = ev.Snapshot.ID
+		case EventOverdue:
+			data.Status = "OVERDUE"
+		}
+		data.Error = ev.Err.Error()
+		data.LogTail = n.logTail()
+	case EventNetworkReport:
+		data.Status, data.Report = "complete", ev.Report
+		if ev.Err != nil {
+			data.Status, data.Error = "FAILED", ev.Err.Error()
+			data.LogTail = n.logTail()
+		}
+	}
+	if ev.Kind != EventStart {
+		data.Duration = ev.Duration.Round(time.Second).String()
+	}
+
+	subjectTmpl, bodyTmpl, err := parseEmailTemplates(&n.conf)
+	if err != nil {
+		return err
+	}
+	var subject, body strings.Builder
+	if err := subjectTmpl.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := bodyTmpl.Execute(&body, data); err != nil {
+		return err
+	}
+	return n.send(strings.TrimSpace(subject.String()), body.String())
+}
+
+// The end of the log, for failure emails, or nothing if log_path isn't set.
+func (n *emailNotifier) logTail() string {
+	if n.conf.LogPath == "" {
+		return ""
+	}
+	tail, err := tailFile(n.conf.LogPath, n.conf.LogTail)
+	if err != nil {
+		return "(error reading " + n.conf.LogPath + ": " + err.Error() + ")"
+	}
+	return tail
+}
+
+// Builds the message and delivers it to every recipient.
+func (n *emailNotifier) send(subject, body string) error {
+	c := n.conf
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	var conn net.Conn
+	var err error
+	if c.Security == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: SMTP_TIMEOUT}, "tcp", addr, &tls.Config{ServerName: c.Host})
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, SMTP_TIMEOUT)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if c.Security == "starttls" {
+		if err := client.StartTLS(&tls.Config{ServerName: c.Host}); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		//PlainAuth refuses to send the password unencrypted, except to localhost
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Returns the last n lines of a file, reading at most LOG_TAIL_MAX_BYTES
+// from its end.
+func tailFile(path string, n int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	start := max(info.Size()-LOG_TAIL_MAX_BYTES, 0)
+	buf := make([]byte, info.Size()-start)
+	if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+	if start > 0 && len(lines) > 1 {
+		lines = lines[1:] //Most likely cut off part way through
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n"), nil
+}
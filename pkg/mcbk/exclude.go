@@ -0,0 +1,130 @@
+package mcbk
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Glob patterns for paths left out of backups. A pattern without a slash
+// matches a file or directory name at any depth, like "session.lock"; one
+// with a slash matches from minecraft_dir down, like "dynmap/web/tiles". A
+// trailing slash makes a pattern match directories only. Excluding a
+// directory excludes everything in it.
+type excludePattern struct {
+	glob    string //Without the trailing slash
+	dirOnly bool
+	nested  bool //Contains a slash, so it is matched against the whole relative path
+}
+
+func parseExcludes(patterns []string) ([]excludePattern, error) {
+	var parsed []excludePattern
+	for _, p := range patterns {
+		e := excludePattern{glob: strings.TrimSuffix(p, "/"), dirOnly: strings.HasSuffix(p, "/")}
+		e.nested = strings.Contains(e.glob, "/")
+		if e.glob == "" || path.IsAbs(e.glob) || !filepath.IsLocal(filepath.FromSlash(e.glob)) {
+			return nil, fmt.Errorf("exclude pattern %q must be relative to minecraft_dir", p)
+		}
+		if _, err := path.Match(e.glob, ""); err != nil {
+			return nil, fmt.Errorf("exclude pattern %q: %w", p, err)
+		}
+		parsed = append(parsed, e)
+	}
+	return parsed, nil
+}
+
+// Whether rel, a slash-separated path relative to the backed up directory,
+// is excluded.
+func excluded(patterns []excludePattern, rel string, isDir bool) bool {
+	for _, e := range patterns {
+		if e.dirOnly && !isDir {
+			continue
+		}
+		target := rel
+		if !e.nested {
+			target = path.Base(rel)
+		}
+		if ok, _ := path.Match(e.glob, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Translates a glob into an unanchored regular expression, with * and ?
+// stopping at slashes as they do in path.Match.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(`[^/]*`)
+		case '?':
+			b.WriteString(`[^/]`)
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			class := glob[i+1 : i+1+end]
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// bup index --exclude-rx arguments, matched against absolute paths in
+// which directories end with a slash.
+func bupExcludeArgs(patterns []excludePattern, dir string) []string {
+	var args []string
+	root := regexp.QuoteMeta(filepath.ToSlash(dir) + "/")
+	for _, e := range patterns {
+		rx := "^" + root
+		if !e.nested {
+			rx += "(.*/)?"
+		}
+		rx += globRegexp(e.glob)
+		if e.dirOnly {
+			rx += "/.*$"
+		} else {
+			rx += "(/.*)?$"
+		}
+		args = append(args, "--exclude-rx", rx)
+	}
+	return args
+}
+
+// restic backup --exclude arguments. restic anchors patterns starting with
+// a slash and matches the rest against any trailing part of the path. It
+// can't limit a pattern to directories.
+func resticExcludeArgs(patterns []excludePattern, dir string) []string {
+	var args []string
+	for _, e := range patterns {
+		p := e.glob
+		if e.nested {
+			p = filepath.ToSlash(dir) + "/" + p
+		}
+		args = append(args, "--exclude", p)
+	}
+	return args
+}
+
+// borg create --exclude arguments, as shell-style patterns matched against
+// archive paths, which are relative to the world directory. borg can't
+// limit a pattern to directories.
+func borgExcludeArgs(patterns []excludePattern) []string {
+	var args []string
+	for _, e := range patterns {
+		p := "sh:" + e.glob
+		if !e.nested {
+			p = "sh:**/" + e.glob
+		}
+		args = append(args, "--exclude", p)
+	}
+	return args
+}
@@ -0,0 +1,131 @@
+package mcbk
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Archive formats a snapshot can be exported as.
+var ExportFormats = []string{"zip", "tar.gz"}
+
+// Files only a server needs, left out of an export with StripServerFiles,
+// as exclude patterns. session.lock is in every world, the rest are the
+// server's player lists.
+var serverOnlyFiles = []string{"session.lock", "ops.json", "whitelist.json", "white-list.txt", "banned-players.json", "banned-ips.json", "usercache.json"}
+
+// What ExportSnapshot puts in the archive, and how.
+type ExportOptions struct {
+	Format           string   //One of ExportFormats
+	Paths            []string //Files and directories to export, relative to minecraft_dir. Empty exports all of the snapshot
+	StripServerFiles bool     //Leave out session.lock, ops.json, the whitelist and ban lists
+}
+
+// Writes a snapshot to w as a single archive, for handing to players or
+// importing as a singleplayer world. The snapshot is restored into a
+// temporary directory first, which needs room for a copy of the world.
+func (s *Server) ExportSnapshot(ctx context.Context, id string, w io.Writer, opts ExportOptions) error {
+	if !slices.Contains(ExportFormats, opts.Format) {
+		return fmt.Errorf("unknown export format %q, expected one of %v", opts.Format, ExportFormats)
+	}
+	for _, p := range opts.Paths {
+		if !filepath.IsLocal(filepath.FromSlash(p)) {
+			return fmt.Errorf("path %q must be inside minecraft_dir", p)
+		}
+	}
+	paths := removeNestedPaths(cleanPaths(opts.Paths))
+	var excludes []excludePattern
+	if opts.StripServerFiles {
+		excludes, _ = parseExcludes(serverOnlyFiles)
+	}
+
+	dir, err := os.MkdirTemp("", "mcbk-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if pr, ok := s.backend.(pathRestorer); ok && len(paths) > 0 {
+		err = pr.RestorePaths(ctx, id, dir, paths)
+	} else {
+		err = s.backend.Restore(ctx, id, dir)
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if ok, err := exists(filepath.Join(dir, p)); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("%s is not in snapshot %s", filepath.ToSlash(p), id)
+		}
+	}
+
+	s.log().Info("Exporting snapshot", "phase", "export", "snapshot", id, "format", opts.Format)
+	if opts.Format == "zip" {
+		return writeZip(ctx, w, dir, paths, excludes)
+	}
+	return writeTarGz(ctx, w, dir, paths, gzip.DefaultCompression, excludes)
+}
+
+// Writes the given paths under dir, or all of it, to w as a zip archive.
+// Symlinks and other special files are left out, as zip can't hold them
+// portably.
+func writeZip(ctx context.Context, w io.Writer, dir string, paths []string, excludes []excludePattern) error {
+	zw := zip.NewWriter(w)
+	err := walkPaths(dir, paths, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if excluded(excludes, filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil || d.IsDir() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(fw, f, info.Size())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
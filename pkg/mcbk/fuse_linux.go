@@ -0,0 +1,409 @@
+package mcbk
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The FUSE protocol, from <linux/fuse.h>. Version 7.19 is old enough for
+// every kernel mcbk runs on and has all a read-only filesystem needs.
+const (
+	FUSE_KERNEL_VERSION       = 7
+	FUSE_KERNEL_MINOR_VERSION = 19
+	FUSE_MAX_WRITE            = 128 * 1024
+	FUSE_ATTR_TIMEOUT         = 60 //Seconds the kernel may cache attributes and lookups, as nothing changes
+	FUSE_IN_HEADER_SIZE       = 40
+	FUSE_OUT_HEADER_SIZE      = 16
+	FOPEN_KEEP_CACHE          = 1 << 1
+)
+
+// FUSE opcodes.
+const (
+	FUSE_LOOKUP       = 1
+	FUSE_FORGET       = 2
+	FUSE_GETATTR      = 3
+	FUSE_READLINK     = 5
+	FUSE_OPEN         = 14
+	FUSE_READ         = 15
+	FUSE_STATFS       = 17
+	FUSE_RELEASE      = 18
+	FUSE_FLUSH        = 25
+	FUSE_INIT         = 26
+	FUSE_OPENDIR      = 27
+	FUSE_READDIR      = 28
+	FUSE_RELEASEDIR   = 29
+	FUSE_ACCESS       = 34
+	FUSE_INTERRUPT    = 36
+	FUSE_DESTROY      = 38
+	FUSE_BATCH_FORGET = 42
+)
+
+// Answers the kernel's FUSE requests for a snapshot mount, one at a time.
+type fuseServer struct {
+	dev   *os.File
+	m     *snapshotMount
+	mu    sync.Mutex
+	files map[uint64]*os.File //Open files, by handle
+	next  uint64
+}
+
+// Mounts m at dir and serves it until ctx is cancelled, then unmounts it.
+func serveFUSE(ctx context.Context, dir string, m *snapshotMount) error {
+	dev, err := mountFUSE(dir)
+	if err != nil {
+		return fmt.Errorf("mounting %s: %w", dir, err)
+	}
+	defer dev.Close()
+	s := &fuseServer{dev: dev, m: m, files: map[uint64]*os.File{}}
+	defer s.closeFiles()
+	done := make(chan error, 1)
+	go func() { done <- s.serve() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	if err := syscall.Unmount(dir, 0); err != nil {
+		if err := unmountFUSE(dir); err != nil {
+			//Lazily, so a shell sitting in dir doesn't keep it mounted
+			syscall.Unmount(dir, syscall.MNT_DETACH)
+		}
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(COMMAND_CANCEL_GRACE):
+		return fmt.Errorf("%s is still mounted", dir)
+	}
+}
+
+// Mounts a FUSE filesystem at dir and returns the device the kernel sends
+// its requests to. Root mounts it directly; anyone else has fusermount3 or
+// fusermount do it, which passes the device back over a socket.
+func mountFUSE(dir string) (*os.File, error) {
+	if os.Geteuid() == 0 {
+		dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0,allow_other", dev.Fd())
+		if err := syscall.Mount("mcbk", dir, "fuse.mcbk", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_RDONLY, opts); err != nil {
+			dev.Close()
+			return nil, err
+		}
+		return dev, nil
+	}
+
+	name, err := exec.LookPath("fusermount3")
+	if err != nil {
+		if name, err = exec.LookPath("fusermount"); err != nil {
+			return nil, errors.New("mounting without root needs fusermount3 or fusermount")
+		}
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	ours, theirs := os.NewFile(uintptr(fds[0]), "fusermount"), os.NewFile(uintptr(fds[1]), "fusermount")
+	defer ours.Close()
+	cmd := exec.Command(name, "-o", "ro,nosuid,nodev,fsname=mcbk,subtype=mcbk", "--", dir)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{theirs}
+	out, err := cmd.CombinedOutput()
+	theirs.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", name, err, out)
+	}
+
+	buf, oob := make([]byte, 1), make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(fds[0], buf, oob, 0)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return nil, fmt.Errorf("%s didn't pass back the FUSE device", name)
+	}
+	devs, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(devs) == 0 {
+		return nil, fmt.Errorf("%s didn't pass back the FUSE device", name)
+	}
+	return os.NewFile(uintptr(devs[0]), "/dev/fuse"), nil
+}
+
+// Reads and answers requests until the filesystem is unmounted.
+func (s *fuseServer) serve() error {
+	buf := make([]byte, FUSE_MAX_WRITE+64*1024)
+	for {
+		n, err := syscall.Read(int(s.dev.Fd()), buf)
+		switch {
+		case err == syscall.EINTR || err == syscall.EAGAIN || err == syscall.ENOENT:
+			continue
+		case err == syscall.ENODEV:
+			return nil
+		case err != nil:
+			return err
+		case n < FUSE_IN_HEADER_SIZE:
+			return fmt.Errorf("short FUSE request of %d bytes", n)
+		}
+		opcode := binary.NativeEndian.Uint32(buf[4:])
+		unique := binary.NativeEndian.Uint64(buf[8:])
+		node := binary.NativeEndian.Uint64(buf[16:])
+		data, errno := s.handle(opcode, node, buf[FUSE_IN_HEADER_SIZE:n])
+		switch opcode {
+		case FUSE_FORGET, FUSE_BATCH_FORGET, FUSE_INTERRUPT:
+			//Never answered; node IDs live as long as the mount
+			continue
+		}
+		s.reply(unique, errno, data)
+		if opcode == FUSE_DESTROY {
+			return nil
+		}
+	}
+}
+
+func (s *fuseServer) reply(unique uint64, errno syscall.Errno, data []byte) {
+	if errno != 0 {
+		data = nil
+	}
+	out := make([]byte, FUSE_OUT_HEADER_SIZE+len(data))
+	binary.NativeEndian.PutUint32(out[0:], uint32(len(out)))
+	binary.NativeEndian.PutUint32(out[4:], uint32(-int32(errno)))
+	binary.NativeEndian.PutUint64(out[8:], unique)
+	copy(out[FUSE_OUT_HEADER_SIZE:], data)
+	//Fails with ENOENT if the request was interrupted meanwhile
+	syscall.Write(int(s.dev.Fd()), out)
+}
+
+func (s *fuseServer) handle(opcode uint32, node uint64, in []byte) ([]byte, syscall.Errno) {
+	switch opcode {
+	case FUSE_INIT:
+		if len(in) < 12 || binary.NativeEndian.Uint32(in[0:]) != FUSE_KERNEL_VERSION {
+			return nil, syscall.EPROTO
+		}
+		out := make([]byte, 24)
+		binary.NativeEndian.PutUint32(out[0:], FUSE_KERNEL_VERSION)
+		binary.NativeEndian.PutUint32(out[4:], min(binary.NativeEndian.Uint32(in[4:]), FUSE_KERNEL_MINOR_VERSION))
+		binary.NativeEndian.PutUint32(out[8:], binary.NativeEndian.Uint32(in[8:])) //max_readahead
+		binary.NativeEndian.PutUint16(out[16:], 16)                                //max_background
+		binary.NativeEndian.PutUint16(out[18:], 12)                                //congestion_threshold
+		binary.NativeEndian.PutUint32(out[20:], FUSE_MAX_WRITE)
+		return out, 0
+	case FUSE_DESTROY, FUSE_FORGET, FUSE_BATCH_FORGET, FUSE_INTERRUPT, FUSE_FLUSH, FUSE_RELEASEDIR:
+		return nil, 0
+	case FUSE_LOOKUP:
+		name := cString(in)
+		id, err := s.m.lookup(node, name)
+		if err != nil {
+			return nil, errnoOf(err)
+		}
+		out := make([]byte, 40+fuseAttrSize)
+		binary.NativeEndian.PutUint64(out[0:], id)
+		binary.NativeEndian.PutUint64(out[16:], FUSE_ATTR_TIMEOUT) //entry_valid
+		binary.NativeEndian.PutUint64(out[24:], FUSE_ATTR_TIMEOUT) //attr_valid
+		s.putAttr(out[40:], id)
+		return out, 0
+	case FUSE_GETATTR:
+		if s.m.node(node) == nil {
+			return nil, syscall.ENOENT
+		}
+		out := make([]byte, 16+fuseAttrSize)
+		binary.NativeEndian.PutUint64(out[0:], FUSE_ATTR_TIMEOUT)
+		s.putAttr(out[16:], node)
+		return out, 0
+	case FUSE_READLINK:
+		n := s.m.node(node)
+		if n == nil || n.mode&fs.ModeSymlink == 0 {
+			return nil, syscall.EINVAL
+		}
+		return []byte(n.link), 0
+	case FUSE_ACCESS:
+		if len(in) >= 4 && binary.NativeEndian.Uint32(in[0:])&2 != 0 { //W_OK
+			return nil, syscall.EROFS
+		}
+		return nil, 0
+	case FUSE_OPEN:
+		if len(in) >= 4 && binary.NativeEndian.Uint32(in[0:])&syscall.O_ACCMODE != syscall.O_RDONLY {
+			return nil, syscall.EROFS
+		}
+		f, err := s.m.open(node)
+		if err != nil {
+			return nil, errnoOf(err)
+		}
+		s.mu.Lock()
+		s.next++
+		fh := s.next
+		s.files[fh] = f
+		s.mu.Unlock()
+		out := make([]byte, 16)
+		binary.NativeEndian.PutUint64(out[0:], fh)
+		binary.NativeEndian.PutUint32(out[8:], FOPEN_KEEP_CACHE)
+		return out, 0
+	case FUSE_READ:
+		if len(in) < 24 {
+			return nil, syscall.EINVAL
+		}
+		fh, offset, size := binary.NativeEndian.Uint64(in[0:]), binary.NativeEndian.Uint64(in[8:]), binary.NativeEndian.Uint32(in[16:])
+		s.mu.Lock()
+		f := s.files[fh]
+		s.mu.Unlock()
+		if f == nil {
+			return nil, syscall.EBADF
+		}
+		out := make([]byte, size)
+		n, err := f.ReadAt(out, int64(offset))
+		if err != nil && err != io.EOF {
+			return nil, syscall.EIO
+		}
+		return out[:n], 0
+	case FUSE_RELEASE:
+		if len(in) >= 8 {
+			fh := binary.NativeEndian.Uint64(in[0:])
+			s.mu.Lock()
+			if f := s.files[fh]; f != nil {
+				f.Close()
+				delete(s.files, fh)
+			}
+			s.mu.Unlock()
+		}
+		return nil, 0
+	case FUSE_OPENDIR:
+		n := s.m.node(node)
+		if n == nil {
+			return nil, syscall.ENOENT
+		}
+		if !n.mode.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		return make([]byte, 16), 0
+	case FUSE_READDIR:
+		if len(in) < 24 {
+			return nil, syscall.EINVAL
+		}
+		return s.readDir(node, binary.NativeEndian.Uint64(in[8:]), binary.NativeEndian.Uint32(in[16:]))
+	case FUSE_STATFS:
+		out := make([]byte, 80)
+		binary.NativeEndian.PutUint32(out[40:], 4096) //bsize
+		binary.NativeEndian.PutUint32(out[44:], 255)  //namelen
+		binary.NativeEndian.PutUint32(out[48:], 4096) //frsize
+		return out, 0
+	}
+	return nil, syscall.ENOSYS
+}
+
+// Lists a directory from the entry at offset on, as many entries as fit
+// in size bytes. "." and ".." come first, at offsets 0 and 1.
+func (s *fuseServer) readDir(node, offset uint64, size uint32) ([]byte, syscall.Errno) {
+	ids, err := s.m.readDir(node)
+	if err != nil {
+		return nil, errnoOf(err)
+	}
+	var out []byte
+	for i := offset; i < uint64(len(ids))+2; i++ {
+		var id uint64
+		var name string
+		var typ uint32
+		switch i {
+		case 0:
+			id, name, typ = node, ".", syscall.DT_DIR
+		case 1:
+			//The kernel fills in the parent itself
+			id, name, typ = node, "..", syscall.DT_DIR
+		default:
+			id = ids[i-2]
+			n := s.m.node(id)
+			name = n.name
+			switch {
+			case n.mode.IsDir():
+				typ = syscall.DT_DIR
+			case n.mode&fs.ModeSymlink != 0:
+				typ = syscall.DT_LNK
+			default:
+				typ = syscall.DT_REG
+			}
+		}
+		entry := make([]byte, (24+len(name)+7)&^7)
+		binary.NativeEndian.PutUint64(entry[0:], id)
+		binary.NativeEndian.PutUint64(entry[8:], i+1)
+		binary.NativeEndian.PutUint32(entry[16:], uint32(len(name)))
+		binary.NativeEndian.PutUint32(entry[20:], typ)
+		copy(entry[24:], name)
+		if len(out)+len(entry) > int(size) {
+			break
+		}
+		out = append(out, entry...)
+	}
+	return out, 0
+}
+
+const fuseAttrSize = 88 //sizeof(struct fuse_attr)
+
+// Writes the attributes of a node as a struct fuse_attr.
+func (s *fuseServer) putAttr(out []byte, id uint64) {
+	n := s.m.node(id)
+	mode := uint32(n.mode.Perm())
+	nlink := uint32(1)
+	switch {
+	case n.mode.IsDir():
+		mode |= syscall.S_IFDIR
+		nlink = 2
+	case n.mode&fs.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	default:
+		mode |= syscall.S_IFREG
+	}
+	secs, nsecs := uint64(n.mtime.Unix()), uint32(n.mtime.Nanosecond())
+	binary.NativeEndian.PutUint64(out[0:], id)
+	binary.NativeEndian.PutUint64(out[8:], uint64(n.size))
+	binary.NativeEndian.PutUint64(out[16:], (uint64(n.size)+511)/512)
+	for _, off := range []int{24, 32, 40} { //atime, mtime, ctime
+		binary.NativeEndian.PutUint64(out[off:], secs)
+	}
+	for _, off := range []int{48, 52, 56} {
+		binary.NativeEndian.PutUint32(out[off:], nsecs)
+	}
+	binary.NativeEndian.PutUint32(out[60:], mode)
+	binary.NativeEndian.PutUint32(out[64:], nlink)
+	binary.NativeEndian.PutUint32(out[68:], uint32(os.Getuid()))
+	binary.NativeEndian.PutUint32(out[72:], uint32(os.Getgid()))
+	binary.NativeEndian.PutUint32(out[80:], 4096) //blksize
+}
+
+func (s *fuseServer) closeFiles() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for fh, f := range s.files {
+		f.Close()
+		delete(s.files, fh)
+	}
+}
+
+// The error number to answer with for an error of the snapshot mount.
+func errnoOf(err error) syscall.Errno {
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.As(err, &errno):
+		return errno
+	}
+	return syscall.EIO
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
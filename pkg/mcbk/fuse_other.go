@@ -0,0 +1,13 @@
+//go:build !linux
+
+package mcbk
+
+import (
+	"context"
+	"errors"
+)
+
+// mcbk only speaks the Linux FUSE protocol.
+func serveFUSE(ctx context.Context, dir string, m *snapshotMount) error {
+	return errors.New("mounting tar and dedup snapshots is only supported on Linux")
+}
@@ -0,0 +1,301 @@
+package mcbk
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const GCS_DEFAULT_ENDPOINT = "https://storage.googleapis.com"
+const GCS_SCOPE = "https://www.googleapis.com/auth/devstorage.read_write" //OAuth scope requested for the service account
+const GCS_TOKEN_LIFETIME = time.Hour                                      //Longest an access token may be requested for
+
+// Settings for mirroring backups into a Google Cloud Storage bucket after
+// each successful backup, authenticated as a service account.
+type GCSConfig struct {
+	Bucket          string `json:"bucket"`           //Bucket to upload into. Empty disables uploads
+	CredentialsFile string `json:"credentials_file"` //Service account key file in JSON, defaults to $GOOGLE_APPLICATION_CREDENTIALS
+	Prefix          string `json:"prefix"`           //Name prefix for every uploaded object
+	StorageClass    string `json:"storage_class"`    //e.g. "NEARLINE", the bucket's default if empty
+	Endpoint        string `json:"endpoint"`         //Base URL of the JSON API, default https://storage.googleapis.com. For emulators
+	Retries         int    `json:"retries"`          //Attempts per request before giving up
+}
+
+// Whether uploads are configured.
+func (c GCSConfig) Enabled() bool {
+	return c.Bucket != ""
+}
+
+func (c GCSConfig) validate() []error {
+	var errs []error
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid gcs.endpoint %q, expected a URL such as https://storage.googleapis.com", c.Endpoint))
+		}
+	}
+	if c.Retries < 1 {
+		errs = append(errs, errors.New("gcs.retries must be at least 1"))
+	}
+	return errs
+}
+
+// The fields of a service account key file needed to sign in.
+type gcsServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// A minimal client for the Cloud Storage JSON API, covering the calls a
+// one-way sync needs.
+type gcsClient struct {
+	conf     GCSConfig
+	endpoint string
+	account  gcsServiceAccount
+	key      *rsa.PrivateKey
+	token    string
+	expires  time.Time
+	http     *http.Client
+	log      *slog.Logger
+}
+
+func newGCSClient(c GCSConfig, log *slog.Logger) (*gcsClient, error) {
+	path := c.CredentialsFile
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		return nil, errors.New("no GCS credentials, set gcs.credentials_file or GOOGLE_APPLICATION_CREDENTIALS to a service account key file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account gcsServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" || account.TokenURI == "" {
+		return nil, fmt.Errorf("%s isn't a service account key file", path)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: private_key isn't PEM encoded", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: parsing private_key: %w", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private_key isn't an RSA key", path)
+	}
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = GCS_DEFAULT_ENDPOINT
+	}
+	return &gcsClient{conf: c, endpoint: strings.TrimSuffix(endpoint, "/"), account: account, key: key, http: newUploadHTTPClient(), log: log}, nil
+}
+
+// Returns an access token, signing in again with a JWT signed by the
+// service account's key once the last one is about to expire. Called for
+// each attempt at a request, which is retried if signing in fails.
+func (c *gcsClient) accessToken(ctx context.Context) (string, error) {
+	if c.token != "" && time.Until(c.expires) > time.Minute {
+		return c.token, nil
+	}
+	now := time.Now()
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   c.account.ClientEmail,
+		"scope": GCS_SCOPE,
+		"aud":   c.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(GCS_TOKEN_LIFETIME).Unix(),
+	})
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("signing in as %s: %w", c.account.ClientEmail, gcsResponseError(resp))
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.AccessToken == "" {
+		return "", fmt.Errorf("signing in as %s: no access token in the response", c.account.ClientEmail)
+	}
+	c.token, c.expires = result.AccessToken, now.Add(time.Duration(result.ExpiresIn)*time.Second)
+	return c.token, nil
+}
+
+// Sends an authenticated request to path under the endpoint, retrying as
+// sendWithRetries does. body is called once per attempt and may be nil.
+// The caller must close the returned response's body.
+func (c *gcsClient) do(ctx context.Context, method, path string, query url.Values, contentType string, body func() (io.ReadCloser, int64, error)) (*http.Response, error) {
+	u := c.endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return sendWithRetries(ctx, c.log, "GCS", c.conf.Retries, method+" "+c.endpoint+path, func() (*http.Response, error) {
+		token, err := c.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		client := c.http
+		if body != nil {
+			rc, size, err := body()
+			if err != nil {
+				return nil, err
+			}
+			req.Body, req.ContentLength = rc, size
+			req.Header.Set("Content-Type", contentType)
+			client = uploadClient(c.http, size)
+		}
+		return client.Do(req)
+	}, gcsResponseError)
+}
+
+// Turns a Google API error response into an error, using the message from
+// its JSON body when there is one.
+func gcsResponseError(resp *http.Response) error {
+	var body struct {
+		Error json.RawMessage `json:"error"`
+		//The token endpoint's OAuth errors
+		Description string `json:"error_description"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) != nil {
+		return errors.New(resp.Status)
+	}
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body.Error, &apiErr) == nil && apiErr.Message != "" {
+		return fmt.Errorf("%s: %s", resp.Status, apiErr.Message)
+	}
+	if body.Description != "" {
+		return fmt.Errorf("%s: %s", resp.Status, body.Description)
+	}
+	return errors.New(resp.Status)
+}
+
+// The path of the bucket's objects in the API.
+func (c *gcsClient) objectsPath() string {
+	return "/storage/v1/b/" + url.PathEscape(c.conf.Bucket) + "/o"
+}
+
+func (c *gcsClient) list(ctx context.Context, prefix string) ([]remoteObject, error) {
+	var objects []remoteObject
+	token := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "fields": {"items(name,size,updated),nextPageToken"}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		resp, err := c.do(ctx, http.MethodGet, c.objectsPath(), query, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    int64     `json:"size,string"`
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing bucket listing: %w", err)
+		}
+		for _, item := range result.Items {
+			objects = append(objects, remoteObject{Key: item.Name, Size: item.Size, LastModified: item.Updated})
+		}
+		if result.NextPageToken == "" {
+			return objects, nil
+		}
+		token = result.NextPageToken
+	}
+}
+
+// Uploads the file in a single multipart request, its metadata first.
+func (c *gcsClient) put(ctx context.Context, key, path string, size int64) error {
+	metadata := map[string]string{"name": key}
+	if c.conf.StorageClass != "" {
+		metadata["storageClass"] = c.conf.StorageClass
+	}
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	boundary := "mcbk-" + fmt.Sprint(time.Now().UnixNano())
+	head := fmt.Sprintf("--%s\r\nContent-Type: application/json; charset=UTF-8\r\n\r\n%s\r\n--%s\r\nContent-Type: application/octet-stream\r\n\r\n", boundary, meta, boundary)
+	tail := "\r\n--" + boundary + "--\r\n"
+	query := url.Values{"uploadType": {"multipart"}}
+	resp, err := c.do(ctx, http.MethodPost, "/upload"+c.objectsPath(), query, "multipart/related; boundary="+boundary, func() (io.ReadCloser, int64, error) {
+		file, err := openUploadBody(path, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(strings.NewReader(head), file, strings.NewReader(tail)), file}, int64(len(head)) + size + int64(len(tail)), nil
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *gcsClient) delete(ctx context.Context, key string) error {
+	//The name is a single path segment, slashes and all
+	resp, err := c.do(ctx, http.MethodDelete, c.objectsPath()+"/"+url.PathEscape(key), nil, "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
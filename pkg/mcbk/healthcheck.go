@@ -0,0 +1,47 @@
+package mcbk
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+const HEALTHCHECK_MAX_BODY = 10000 //Bytes of detail sent with a ping
+
+// Pings the server's healthcheck_url the way healthchecks.io expects, so an
+// external watchdog alerts when backups stop arriving: <url>/start when a
+// backup begins, <url> when it succeeds and <url>/fail when it fails, with
+// details in the request body. Failed pings are only logged.
+func (s *Server) ping(kind EventKind, detail string) {
+	if s.conf.HealthcheckURL == "" {
+		return
+	}
+	target := strings.TrimSuffix(s.conf.HealthcheckURL, "/")
+	switch kind {
+	case EventStart:
+		target += "/start"
+	case EventFailure:
+		target += "/fail"
+	}
+	resp, err := httpClient.Post(target, "text/plain; charset=utf-8", strings.NewReader(truncate(detail, HEALTHCHECK_MAX_BODY)))
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			err = fmt.Errorf("%s: %s", resp.Status, msg)
+		}
+	}
+	if err != nil {
+		s.log().Warn("Error pinging healthcheck", "phase", "notify", "event", kind, "error", err)
+	}
+}
+
+// Checks that a healthcheck URL is absolute http(s).
+func validateHealthcheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid healthcheck_url %q, expected e.g. https://hc-ping.com/<uuid>", raw)
+	}
+	return nil
+}
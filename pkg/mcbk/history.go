@@ -0,0 +1,108 @@
+package mcbk
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The outcome of one backup run, as kept in the server's history file.
+type HistoryRecord struct {
+	Server           string     `json:"server"`
+	Start            time.Time  `json:"start"`
+	End              time.Time  `json:"end"`                    //When the backup finished, before pruning
+	Status           string     `json:"status"`                 //"success", "failure", "cancelled" or "skipped"
+	Cold             bool       `json:"cold,omitempty"`         //Taken while the server was stopped
+	Checked          bool       `json:"checked,omitempty"`      //The backend's data was verified afterwards
+	Snapshot         string     `json:"snapshot,omitempty"`     //ID of the new snapshot, on success
+	Bytes            int64      `json:"bytes,omitempty"`        //Data the backup wrote, as reported by the backend
+	SourceBytes      int64      `json:"source_bytes,omitempty"` //Size of the files backed up
+	RepoBytes        int64      `json:"repo_bytes,omitempty"`   //Space the backups took up afterwards, before pruning, if stored on this machine
+	RepoGrowth       int64      `json:"repo_growth,omitempty"`  //How much that grew by in the run, or the snapshot's size as reported by the backend if it isn't known
+	DedupRatio       float64    `json:"dedup_ratio,omitempty"`  //SourceBytes per byte of RepoGrowth
+	Pruned           int        `json:"pruned,omitempty"`       //Snapshots removed by pruning afterwards
+	Phase            string     `json:"phase,omitempty"`        //Step that failed
+	Error            string     `json:"error,omitempty"`
+	ReplicationError string     `json:"replication_error,omitempty"` //Why syncing to an rclone remote failed, if it did
+	SourceCorrupt    string     `json:"source_corrupt,omitempty"`    //Why source_check found the world files damaged; the snapshot may hold the damage
+	Tags             []string   `json:"tags,omitempty"`              //Labels the snapshot was taken with
+	Comment          string     `json:"comment,omitempty"`           //Note the snapshot was taken with
+	PinnedUntil      *time.Time `json:"pinned_until,omitempty"`      //Until when pruning leaves the snapshot alone, whatever its tags, e.g. one taken with -reason upgrade
+}
+
+// Where the server's history is kept. It is a JSON Lines file, one record
+// per run, so it can be appended to safely and read with any tool, rather
+// than an embedded database, which the standard library doesn't have.
+func (s *Server) historyPath() string {
+	if s.conf.HistoryPath != "" {
+		return s.conf.HistoryPath
+	}
+	return filepath.Join(s.conf.BackupRoot, s.conf.BackupDirPrefix+"_history.jsonl")
+}
+
+// Appends a record to the server's history. Failing to record a run is
+// logged but doesn't fail it.
+func (s *Server) recordHistory(rec HistoryRecord) {
+	rec.Server = s.conf.Name
+	line, err := json.Marshal(rec)
+	if err == nil {
+		err = appendLine(s.historyPath(), line)
+	}
+	if err != nil {
+		s.log().Warn("Error recording backup history", "phase", "history", "path", s.historyPath(), "error", err)
+	}
+}
+
+func appendLine(path string, line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Returns every recorded run of the server, oldest first. A server that
+// has never been backed up has no history rather than an error.
+func (s *Server) History() ([]HistoryRecord, error) {
+	f, err := os.Open(s.historyPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []HistoryRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			//Most likely a write cut short by a crash; the rest is still good
+			s.log().Warn("Skipping unreadable history record", "path", s.historyPath(), "line", line, "error", err)
+			continue
+		}
+		//history_path may be shared by several profiles
+		if rec.Server == s.conf.Name {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return records, fmt.Errorf("reading %s: %w", s.historyPath(), err)
+	}
+	return records, nil
+}
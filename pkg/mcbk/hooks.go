@@ -0,0 +1,82 @@
+package mcbk
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// User commands run at fixed points of a backup, each with "sh -c". They
+// get MCBK_* environment variables describing the run, see hookRun.env.
+type HooksConfig struct {
+	PreSave    string   `json:"pre_save"`    //Before world saving is turned off. A failure aborts the backup
+	PostSave   string   `json:"post_save"`   //After the snapshot is taken, while saving is still off. A failure fails the backup
+	PostBackup string   `json:"post_backup"` //After a successful backup
+	PostPrune  string   `json:"post_prune"`  //After old backups were pruned, or pruning failed
+	OnFailure  string   `json:"on_failure"`  //After a backup failed or was cancelled
+	Timeout    Duration `json:"timeout"`     //How long a hook may run before it is stopped
+}
+
+// What a hook is told about the run it belongs to.
+type hookRun struct {
+	Status   string //"running", "success", "failure" or "cancelled"
+	Snapshot Snapshot
+	Duration time.Duration
+	Err      error
+	Pruned   int
+}
+
+// Environment variables describing the run, in "KEY=value" form.
+func (s *Server) hookEnv(hook string, run hookRun) []string {
+	env := []string{
+		"MCBK_HOOK=" + hook,
+		"MCBK_SERVER=" + s.conf.Name,
+		"MCBK_BACKEND=" + s.conf.Backend,
+		"MCBK_MINECRAFT_DIR=" + s.conf.MinecraftDir,
+		"MCBK_STATUS=" + run.Status,
+		"MCBK_SNAPSHOT_ID=" + run.Snapshot.ID,
+		"MCBK_SNAPSHOT_SIZE=" + strconv.FormatInt(run.Snapshot.Size, 10),
+		"MCBK_DURATION=" + strconv.FormatFloat(run.Duration.Seconds(), 'f', 3, 64),
+		"MCBK_PRUNED=" + strconv.Itoa(run.Pruned),
+	}
+	if !run.Snapshot.Time.IsZero() {
+		env = append(env, "MCBK_SNAPSHOT_TIME="+run.Snapshot.Time.Format(time.RFC3339))
+	}
+	if run.Err != nil {
+		env = append(env, "MCBK_ERROR="+run.Err.Error(), "MCBK_PHASE="+errorPhase(run.Err))
+	}
+	return env
+}
+
+// Runs a hook command if one is configured. Its stdout is logged at debug
+// level; a non-zero exit is returned as an error.
+func (s *Server) runHook(ctx context.Context, hook, command string, run hookRun) error {
+	if command == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.conf.Hooks.Timeout.Duration)
+	defer cancel()
+
+	s.log().Debug("Running hook", "phase", hook, "command", command)
+	start := time.Now()
+	out, err := runCommandEnv(ctx, s.hookEnv(hook, run), hookShell[0], append(hookShell[1:], command)...)
+	if output := strings.TrimSpace(string(out)); output != "" {
+		s.log().Debug("Hook output", "phase", hook, "output", output)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook: %w", hook, err)
+	}
+	s.log().Debug("Hook finished", "phase", hook, "duration", time.Since(start))
+	return nil
+}
+
+// Runs a hook whose failure shouldn't affect the backup's outcome, only
+// logging any error. It still runs if ctx was cancelled.
+func (s *Server) runHookAndLog(ctx context.Context, hook, command string, run hookRun) {
+	err := s.runHook(context.WithoutCancel(ctx), hook, command, run)
+	if err != nil {
+		s.log().Warn("Hook failed", "phase", hook, "error", err)
+	}
+}
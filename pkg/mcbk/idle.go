@@ -0,0 +1,168 @@
+package mcbk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Returned by Runner.Backup when the backup was skipped because nobody has
+// played since the last one.
+var ErrServerIdle = errors.New("no players since the last backup")
+
+// Time of day at the start of a log line. Vanilla, Fabric and Forge write
+// "[12:34:56]" (Forge with the date in front), Paper and Spigot
+// "[12:34:56 INFO]".
+var logTimeRegexp = regexp.MustCompile(`^\[(?:\d{2}\w{3}\d{4} )?(\d{2}):(\d{2}):(\d{2})`)
+var joinRegexp = regexp.MustCompile(`: (\S+) joined the game\s*$`)
+var leaveRegexp = regexp.MustCompile(`: (\S+) left the game\s*$`)
+
+// A player joining or leaving, as read from the server log.
+type playerEvent struct {
+	time   time.Time
+	player string
+	joined bool
+}
+
+// Decides whether the server has been idle since its last successful
+// backup, so another one would capture nothing new. Returns the time of
+// that backup, or a reason the server may have changed.
+func (s *Server) idleSince() (time.Time, string) {
+	history, err := s.History()
+	if err != nil {
+		return time.Time{}, "the backup history can't be read"
+	}
+	var last time.Time
+	for _, rec := range history {
+		if rec.Status == "success" {
+			last = rec.Start
+		}
+	}
+	if last.IsZero() {
+		return last, "there is no earlier successful backup"
+	}
+	if time.Since(last) >= s.conf.MaxIdleSkip.Duration {
+		return last, "the last backup is older than max_idle_skip"
+	}
+	if s.conf.MinecraftLogPath == "" {
+		return last, "minecraft_log_path isn't set"
+	}
+	active, err := playersSince(s.conf.MinecraftLogPath, last)
+	if err != nil {
+		s.log().Warn("Error reading the server log for player activity", "phase", "idle-check", "error", err)
+		return last, "the server log can't be read"
+	}
+	return last, active
+}
+
+// Reads the server log for players online at any point since when.
+// Returns why the world may have changed, or "" if nobody has played.
+func playersSince(logPath string, since time.Time) (string, error) {
+	f, err := os.Open(logPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "there is no server log", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	//Nothing at all has been logged, let alone a join
+	if info.ModTime().Before(since) {
+		return "", nil
+	}
+
+	events, first, err := readPlayerEvents(f, info.ModTime())
+	if err != nil {
+		return "", err
+	}
+	//The log starts afresh on every start, so what happened before that is gone
+	if first.IsZero() || first.After(since) {
+		return "the server has restarted since", nil
+	}
+	online := map[string]bool{}
+	for _, ev := range events {
+		if ev.time.After(since) {
+			if ev.joined {
+				return ev.player + " joined since", nil
+			}
+			//Was already online at the last backup
+			return ev.player + " was online since", nil
+		}
+		if ev.joined {
+			online[ev.player] = true
+		} else {
+			delete(online, ev.player)
+		}
+	}
+	for player := range online {
+		return player + " is still online", nil
+	}
+	return "", nil
+}
+
+// Reads the joins and leaves from a log whose last line was written at
+// modTime, and the time of its first line. Lines only carry the time of
+// day, so dates are found by counting back from modTime, a day for each
+// time the clock went backwards.
+func readPlayerEvents(f *os.File, modTime time.Time) ([]playerEvent, time.Time, error) {
+	type line struct {
+		tod   time.Duration
+		event *playerEvent
+	}
+	var lines []line
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		text := scanner.Text()
+		m := logTimeRegexp.FindStringSubmatch(text)
+		if m == nil {
+			continue
+		}
+		h, _ := strconv.Atoi(m[1])
+		mins, _ := strconv.Atoi(m[2])
+		secs, _ := strconv.Atoi(m[3])
+		l := line{tod: time.Duration(h)*time.Hour + time.Duration(mins)*time.Minute + time.Duration(secs)*time.Second}
+		if j := joinRegexp.FindStringSubmatch(text); j != nil {
+			l.event = &playerEvent{player: j[1], joined: true}
+		} else if j := leaveRegexp.FindStringSubmatch(text); j != nil {
+			l.event = &playerEvent{player: j[1]}
+		}
+		lines = append(lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, time.Time{}, fmt.Errorf("reading %s: %w", f.Name(), err)
+	}
+	if len(lines) == 0 {
+		return nil, time.Time{}, nil
+	}
+
+	modTime = modTime.Local()
+	day := time.Date(modTime.Year(), modTime.Month(), modTime.Day(), 0, 0, 0, 0, time.Local)
+	//The last line can't be later in the day than the file was written
+	if lines[len(lines)-1].tod > modTime.Sub(day)+time.Minute {
+		day = day.AddDate(0, 0, -1)
+	}
+	times := make([]time.Time, len(lines))
+	for i := len(lines) - 1; i >= 0; i-- {
+		if i < len(lines)-1 && lines[i].tod > lines[i+1].tod {
+			day = day.AddDate(0, 0, -1)
+		}
+		times[i] = day.Add(lines[i].tod)
+	}
+	var events []playerEvent
+	for i, l := range lines {
+		if l.event != nil {
+			l.event.time = times[i]
+			events = append(events, *l.event)
+		}
+	}
+	return events, times[0], nil
+}
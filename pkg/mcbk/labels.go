@@ -0,0 +1,99 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Checks a tag given to "mcbk backup -tag". Tags are shown in lists
+// separated by commas, so they can't hold commas or spaces.
+func ValidateTag(tag string) error {
+	if tag == "" {
+		return errors.New("tags must not be empty")
+	}
+	if strings.ContainsFunc(tag, func(r rune) bool { return r == ',' || r <= ' ' }) {
+		return fmt.Errorf("tag %q must not contain commas, spaces or control characters", tag)
+	}
+	return nil
+}
+
+// Checks a comment given to "mcbk backup -comment".
+func ValidateComment(comment string) error {
+	if strings.ContainsAny(comment, "\r\n") {
+		return errors.New("comments must be a single line")
+	}
+	return nil
+}
+
+// Returns every snapshot in the server's backend, oldest first, with the
+// tags and comment each was taken with.
+func (s *Server) Snapshots(ctx context.Context) ([]Snapshot, error) {
+	snaps, err := s.backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.label(snaps)
+	return snaps, nil
+}
+
+// Fills in the tags and comments of snaps from the history file, where
+// they are kept so that every backend supports them.
+func (s *Server) label(snaps []Snapshot) {
+	labels := s.labels()
+	for i := range snaps {
+		if rec, ok := labels[snaps[i].ID]; ok {
+			snaps[i].Tags, snaps[i].Comment, snaps[i].PinnedUntil = rec.Tags, rec.Comment, rec.PinnedUntil
+		}
+	}
+}
+
+// The history records of snapshots taken with tags, a comment or a pin, by
+// snapshot ID. Failing to read the history is logged and leaves every
+// snapshot unlabeled.
+func (s *Server) labels() map[string]HistoryRecord {
+	records, err := s.History()
+	if err != nil {
+		s.log().Warn("Error reading backup history, snapshots are shown without their tags", "path", s.historyPath(), "error", err)
+		return nil
+	}
+	labels := map[string]HistoryRecord{}
+	for _, rec := range records {
+		if rec.Snapshot != "" && (len(rec.Tags) > 0 || rec.Comment != "" || rec.PinnedUntil != nil) {
+			labels[rec.Snapshot] = rec
+		}
+	}
+	return labels
+}
+
+// Whether pruning must leave snap alone: it was tagged, and
+// retention.prune_tagged doesn't say otherwise. A pinned snapshot is left
+// alone until its pin runs out and then treated like an untagged one, so
+// its tags don't keep it forever.
+func (r RetentionConfig) spares(snap Snapshot) bool {
+	if snap.PinnedUntil != nil {
+		return snap.pinned(time.Now())
+	}
+	return len(snap.Tags) > 0 && !r.PruneTagged
+}
+
+// The snapshots among snaps that pruning must leave alone, including the
+// keep_first ones.
+func (r RetentionConfig) spared(snaps []Snapshot) []Snapshot {
+	firsts := r.firsts(snaps)
+	var spared []Snapshot
+	for _, snap := range snaps {
+		if r.spares(snap) || len(firsts[snap.ID]) > 0 {
+			spared = append(spared, snap)
+		}
+	}
+	return spared
+}
+
+// Whether snaps includes one with the given ID.
+func containsSnapshot(snaps []Snapshot, id string) bool {
+	return slices.ContainsFunc(snaps, func(s Snapshot) bool { return s.ID == id })
+}
@@ -0,0 +1,197 @@
+package mcbk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	LOCK_POLL_INTERVAL = time.Second     //How often a held lock is retried while waiting for it
+	LOCK_STOP_GRACE    = 2 * time.Minute //How long a hung run is given to exit after being told to stop
+)
+
+// Returned by Lock when another run holds the server's lock and lock_wait
+// ran out.
+var ErrBackupInProgress = errors.New("another backup of this server is in progress")
+
+// What a lock file records about the run holding it. A clean unlock empties
+// the file, so a record found when taking the lock belongs to a run that
+// ended without releasing it.
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+	Daemon  bool      `json:"daemon,omitempty"` //Held by a long-running process such as "mcbk daemon", which is never stopped as hung
+}
+
+// Takes the server's lock file, so overlapping runs (e.g. from cron and the
+// daemon) can't toggle saving or write to the backend at the same time. If
+// another run holds it, waits up to lock_wait for it to finish, stopping
+// it first if it has held the lock for longer than lock_max_runtime. The
+// lock is released by calling unlock, or when the process exits.
+func (s *Server) Lock(ctx context.Context) (unlock func(), err error) {
+	return s.takeLock(ctx, s.lockPath(), s.conf.LockWait.Duration)
+}
+
+// Takes global_lock, which every backup holds, so runs from any process
+// back up one server at a time. Waits for it as long as it takes, until
+// ctx is done. Returns a no-op unlock when global_lock isn't set.
+func (s *Server) lockGlobal(ctx context.Context) (unlock func(), err error) {
+	if s.conf.GlobalLock == "" {
+		return func() {}, nil
+	}
+	return s.takeLock(ctx, s.conf.GlobalLock, -1)
+}
+
+// Takes the lock file at path, waiting up to wait for another run to
+// release it, or forever if wait is negative.
+func (s *Server) takeLock(ctx context.Context, path string, wait time.Duration) (func(), error) {
+	log := s.log().With("phase", "lock", "lock", path)
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	waiting, checked := false, false
+	for {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			if err := claimLock(f, s.daemon, log); err != nil {
+				f.Close()
+				return nil, err
+			}
+			return func() {
+				//Emptied while still held, so the next run sees a clean release
+				f.Truncate(0)
+				f.Close()
+			}, nil
+		}
+		if !checked {
+			hung, stopped := s.stopHungHolder(f, log)
+			checked = hung
+			if stopped {
+				//Wait for it to exit even when lock_wait wouldn't
+				deadline = later(deadline, time.Now().Add(LOCK_STOP_GRACE))
+			}
+		}
+		if wait >= 0 && !time.Now().Before(deadline) {
+			f.Close()
+			return nil, ErrBackupInProgress
+		}
+		if !waiting {
+			log.Info("Waiting for another run to release the lock", "lock_wait", wait)
+			waiting = true
+		}
+		pause := LOCK_POLL_INTERVAL
+		if wait >= 0 {
+			pause = min(pause, time.Until(deadline))
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Records this run in the lock file it just took, warning about a previous
+// holder that ended without releasing it, e.g. because it crashed or was
+// killed. World saving may still be off if it was backing up at the time.
+func claimLock(f *os.File, daemon bool, log *slog.Logger) error {
+	if prev, ok := readLockInfo(f); ok {
+		log.Warn("Recovered a lock left by a run that didn't finish, world saving may still be off if it was mid-backup", "pid", prev.PID, "host", prev.Host, "started", prev.Started)
+	}
+	host, _ := os.Hostname()
+	data, err := json.Marshal(LockInfo{PID: os.Getpid(), Host: host, Started: time.Now(), Daemon: daemon})
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(append(data, '\n'), 0)
+	return err
+}
+
+// Reads the run recorded in a lock file, if any.
+func readLockInfo(f *os.File) (LockInfo, bool) {
+	var info LockInfo
+	data, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<16))
+	if err != nil || len(data) == 0 || json.Unmarshal(data, &info) != nil || info.PID == 0 {
+		return info, false
+	}
+	return info, true
+}
+
+// Checks whether the run holding the lock file f has held it for longer
+// than lock_max_runtime, so it must be hung, and if so stops it. Only
+// another one-shot run on this host can be stopped; other holders, and a
+// daemon, which would take its other servers' backups and API down with
+// it, are just reported.
+func (s *Server) stopHungHolder(f *os.File, log *slog.Logger) (hung, stopped bool) {
+	info, ok := readLockInfo(f)
+	age := time.Since(info.Started)
+	if !ok || age <= s.conf.LockMaxRuntime.Duration {
+		return false, false
+	}
+	host, _ := os.Hostname()
+	if info.Daemon {
+		log.Warn("The lock has been held for longer than lock_max_runtime by a daemon, which isn't stopped; restart it if its backup is hung", "pid", info.PID, "host", info.Host, "started", info.Started)
+		return true, false
+	}
+	if info.Host != host || info.PID == os.Getpid() || !processAlive(info.PID) {
+		log.Warn("The lock has been held for longer than lock_max_runtime by a run that can't be stopped from here", "pid", info.PID, "host", info.Host, "started", info.Started)
+		return true, false
+	}
+	log.Warn("The lock has been held for longer than lock_max_runtime, stopping the hung run", "pid", info.PID, "started", info.Started, "age", age.Round(time.Second))
+	if err := stopProcess(info.PID); err != nil {
+		log.Error("Error stopping the hung run", "pid", info.PID, "error", err)
+		return true, false
+	}
+	return true, true
+}
+
+// The run holding the server's lock, if another process holds it now.
+func (s *Server) lockHolder() (*LockInfo, error) {
+	f, err := os.OpenFile(s.lockPath(), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	free, err := tryLock(f)
+	if free || err != nil {
+		return nil, err
+	}
+	//Empty if the holder has yet to record itself
+	info, _ := readLockInfo(f)
+	return &info, nil
+}
+
+// The lock file sits next to the backups, named after the repo prefix.
+func (s *Server) lockPath() string {
+	return filepath.Join(s.conf.BackupRoot, s.conf.BackupDirPrefix+".lock")
+}
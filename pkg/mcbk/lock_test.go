@@ -0,0 +1,110 @@
+package mcbk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockExcludesOtherRuns(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, "")
+	unlock, err := s.Lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Lock(ctx); !errors.Is(err, ErrBackupInProgress) {
+		t.Errorf("taking the held lock got error %v, want ErrBackupInProgress", err)
+	}
+	holder, err := s.lockHolder()
+	if err != nil || holder == nil || holder.PID != os.Getpid() {
+		t.Errorf("got holder %+v, %v, want this process", holder, err)
+	}
+
+	unlock()
+	if data, _ := os.ReadFile(s.lockPath()); len(data) > 0 {
+		t.Errorf("the released lock file still holds %s", data)
+	}
+	if holder, err := s.lockHolder(); holder != nil || err != nil {
+		t.Errorf("got holder %+v, %v after releasing the lock, want none", holder, err)
+	}
+	unlock, err = s.Lock(ctx)
+	if err != nil {
+		t.Fatalf("taking the released lock: %v", err)
+	}
+	unlock()
+}
+
+func TestLockWaitsForRelease(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, "lock_wait = \"10s\"")
+	unlock, err := s.Lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(100*time.Millisecond, unlock)
+	unlock, err = s.Lock(ctx)
+	if err != nil {
+		t.Fatalf("waiting for the lock: %v", err)
+	}
+	unlock()
+
+	//Giving up on the wait when ctx is cancelled
+	unlock, err = s.Lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	cancelled, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := s.Lock(cancelled); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting under a cancelled context got error %v", err)
+	}
+}
+
+func TestLockRecoversAfterCrash(t *testing.T) {
+	s := newTestServer(t, "")
+	//What a run that was killed while holding the lock leaves behind
+	data, err := json.Marshal(LockInfo{PID: 1 << 22, Host: "elsewhere", Started: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.lockPath(), data, 0660); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := s.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if holder, err := s.lockHolder(); err != nil || holder == nil || holder.PID != os.Getpid() {
+		t.Errorf("got holder %+v, %v, want this process to have replaced the old record", holder, err)
+	}
+}
+
+func TestLockGlobal(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, "")
+	unlock, err := s.lockGlobal(ctx)
+	if err != nil {
+		t.Fatalf("without global_lock: %v", err)
+	}
+	unlock()
+
+	s.conf.GlobalLock = filepath.Join(s.conf.BackupRoot, "global.lock")
+	unlock, err = s.lockGlobal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//It is waited for as long as it takes, until ctx is done
+	cancelled, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := s.lockGlobal(cancelled); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("taking the held global lock got error %v, want it to wait until ctx is done", err)
+	}
+	unlock()
+}
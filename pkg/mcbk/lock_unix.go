@@ -0,0 +1,31 @@
+//go:build unix
+
+package mcbk
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Takes an exclusive flock on f without blocking. Returns false if another
+// process, or another open file in this one, already holds it.
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Asks a process to exit, as SIGTERM does for a backup: it turns world
+// saving back on and releases its locks.
+func stopProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
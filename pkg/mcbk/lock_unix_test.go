@@ -0,0 +1,77 @@
+//go:build unix
+
+package mcbk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// Has a child process appear to hold the server's lock since an hour ago:
+// the lock is taken on its behalf and its record written, and released
+// once the child exits. Receives how the child exited.
+func holdLockInChild(t *testing.T, s *Server, daemon bool) <-chan error {
+	t.Helper()
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+	f, err := os.OpenFile(s.lockPath(), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := tryLock(f); !ok || err != nil {
+		t.Fatalf("taking the lock for the child: %t, %v", ok, err)
+	}
+	host, _ := os.Hostname()
+	data, err := json.Marshal(LockInfo{PID: cmd.Process.Pid, Host: host, Started: time.Now().Add(-time.Hour), Daemon: daemon})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		f.Close()
+		exited <- err
+	}()
+	return exited
+}
+
+func TestLockStopsHungRun(t *testing.T) {
+	s := newTestServer(t, "lock_max_runtime = \"1m\"")
+	exited := holdLockInChild(t, s, false)
+	unlock, err := s.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("taking the lock of a hung run: %v", err)
+	}
+	unlock()
+	//The lock was only released as the run exited
+	if err := <-exited; err == nil {
+		t.Error("the hung run exited by itself rather than being stopped")
+	}
+}
+
+func TestLockLeavesHungDaemonRunning(t *testing.T) {
+	s := newTestServer(t, "lock_max_runtime = \"1m\"")
+	exited := holdLockInChild(t, s, true)
+	if _, err := s.Lock(context.Background()); !errors.Is(err, ErrBackupInProgress) {
+		t.Errorf("taking a daemon's lock got error %v, want ErrBackupInProgress", err)
+	}
+	if holder, err := s.lockHolder(); err != nil || holder == nil || !holder.Daemon {
+		t.Errorf("got holder %+v, %v, want the daemon still holding the lock", holder, err)
+	}
+	select {
+	case err := <-exited:
+		t.Errorf("the daemon was stopped: %v", err)
+	default:
+	}
+}
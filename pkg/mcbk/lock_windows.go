@@ -0,0 +1,45 @@
+package mcbk
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Locks a byte of f without blocking. Returns false if another process, or
+// another open file in this one, already holds it. The byte is far past the
+// end of the file, since Windows locks keep others from reading what they
+// cover, and the record of the run holding the lock must stay readable.
+func tryLock(f *os.File) (bool, error) {
+	ol := syscall.Overlapped{OffsetHigh: 1}
+	r, _, err := procLockFileEx.Call(f.Fd(), LOCKFILE_EXCLUSIVE_LOCK|LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return true, nil
+	}
+	if errors.Is(err, ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// Ends a process. Windows has no SIGTERM to send, so it is killed and
+// doesn't get to turn world saving back on.
+func stopProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	defer p.Release()
+	return p.Kill()
+}
@@ -0,0 +1,56 @@
+package mcbk
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// A slog handler in the given format, "text" or "json". Durations are
+// logged as seconds and errors as their message, and backup steps add
+// phase, duration and error fields so "json" output can be filtered by
+// field in Loki, Elastic etc.
+func NewLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{ReplaceAttr: logAttr}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// Normalizes field values: durations are logged as seconds, and errors as
+// their message.
+func logAttr(groups []string, a slog.Attr) slog.Attr {
+	switch v := a.Value.Any().(type) {
+	case time.Duration:
+		a.Value = slog.Float64Value(v.Round(time.Millisecond).Seconds())
+	case error:
+		a.Value = slog.StringValue(v.Error())
+	}
+	return a
+}
+
+// An error tagged with the backup phase it happened in, such as "save-all"
+// or "backup", so logs and notifications can report where a run failed.
+type phaseError struct {
+	Phase string
+	Err   error
+}
+
+func (e *phaseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *phaseError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the phase an error happened in, or "" if it wasn't tagged.
+func errorPhase(err error) string {
+	var pe *phaseError
+	if errors.As(err, &pe) {
+		return pe.Phase
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+const LOG_POLL_INTERVAL = 100 * time.Millisecond //How often a followed log is checked for new lines
+
+// Follows a growing log file like tail -F, without needing tail. It starts at
+// the end of the file as it was when opened, and copes with the file being
+// rotated (as the server does with logs/latest.log on restart) or truncated
+// while waiting.
+type logFollower struct {
+	path    string
+	f       *os.File
+	info    fs.FileInfo
+	offset  int64
+	partial []byte
+}
+
+// Opens path and positions the follower at its current end. A missing file
+// is not an error; it is picked up from the start once it appears.
+func followLog(path string) (*logFollower, error) {
+	l := &logFollower{path: path}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f, l.info, l.offset = f, info, info.Size()
+	return l, nil
+}
+
+func (l *logFollower) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Calls match for every new complete line until it returns true, ctx is
+// done, or reading fails.
+func (l *logFollower) waitFor(ctx context.Context, match func(line string) bool) error {
+	buf := make([]byte, 32*1024)
+	for {
+		if l.f != nil {
+			n, err := l.f.ReadAt(buf, l.offset)
+			if n > 0 {
+				l.offset += int64(n)
+				if l.scan(buf[:n], match) {
+					return nil
+				}
+				continue
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+		if err := l.checkRotation(); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(LOG_POLL_INTERVAL):
+		}
+	}
+}
+
+// Splits newly read data into lines, carrying an incomplete last line over
+// to the next read.
+func (l *logFollower) scan(data []byte, match func(line string) bool) bool {
+	l.partial = append(l.partial, data...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			return false
+		}
+		line := string(bytes.TrimRight(l.partial[:i], "\r"))
+		l.partial = l.partial[i+1:]
+		if match(line) {
+			return true
+		}
+	}
+}
+
+// Reopens the log if the path now points to a different file, and rewinds
+// if the file was truncated. A replacement file is read from the start,
+// since everything in it is new.
+func (l *logFollower) checkRotation() error {
+	info, err := os.Stat(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil //Mid-rotation, the new file will show up shortly
+	}
+	if err != nil {
+		return err
+	}
+	if l.f != nil && os.SameFile(l.info, info) {
+		if info.Size() < l.offset {
+			l.offset, l.partial = 0, nil
+		}
+		return nil
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, l.info, l.offset, l.partial = f, info, 0, nil
+	return nil
+}
@@ -0,0 +1,177 @@
+package mcbk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings for rotating mcbk's own log file, which otherwise grows forever.
+type LogRotateConfig struct {
+	MaxSize ByteSize `json:"max_size"` //Rotate once the log would grow past this, e.g. "10MiB". 0 for no limit
+	MaxAge  Duration `json:"max_age"`  //Rotate once the log's first entry is older than this, e.g. "168h" for weekly. 0 for no limit
+	Keep    int      `json:"keep"`     //Rotated logs to keep, as <log_path>.1 (the newest) to .<keep>, default 5
+}
+
+func (c LogRotateConfig) Enabled() bool {
+	return c.MaxSize > 0 || c.MaxAge.Duration > 0
+}
+
+func (c *LogRotateConfig) setDefaults() {
+	if c.Keep == 0 {
+		c.Keep = 5
+	}
+}
+
+func (c LogRotateConfig) validate() []error {
+	var errs []error
+	if c.MaxSize < 0 {
+		errs = append(errs, errors.New("log_rotate.max_size must not be negative"))
+	}
+	if c.MaxAge.Duration < 0 {
+		errs = append(errs, errors.New("log_rotate.max_age must not be negative"))
+	}
+	if c.Keep < 1 {
+		errs = append(errs, fmt.Errorf("log_rotate.keep must be at least 1, got %d", c.Keep))
+	}
+	return errs
+}
+
+// mcbk's own log file, rotated as configured. A cron run and the daemon
+// may share the file, so before each write it is reopened if another
+// process has rotated it in the meantime.
+type LogFile struct {
+	path  string
+	conf  LogRotateConfig
+	mu    sync.Mutex
+	f     *os.File
+	size  int64
+	start time.Time //When the first entry in the file was written, zero while it is empty
+}
+
+// Opens the log file for appending, creating it and its directory if
+// needed.
+func OpenLogFile(path string, conf LogRotateConfig) (*LogFile, error) {
+	l := &LogFile{path: path, conf: conf}
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size, l.start = f, info.Size(), time.Time{}
+	if l.size > 0 {
+		l.start = firstEntryTime(l.path, info.ModTime())
+	}
+	return nil
+}
+
+// The time of the first entry in the log at path. Both log formats start
+// each line with it; if it can't be read, fallback is used.
+func firstEntryTime(path string, fallback time.Time) time.Time {
+	f, err := os.Open(path)
+	if err != nil {
+		return fallback
+	}
+	defer f.Close()
+	head := make([]byte, 128)
+	n, _ := io.ReadFull(f, head)
+	line, _, _ := bytes.Cut(head[:n], []byte("\n"))
+	for _, prefix := range []string{"time=", `{"time":"`} {
+		if rest, ok := strings.CutPrefix(string(line), prefix); ok {
+			if i := strings.IndexAny(rest, `" `); i >= 0 {
+				rest = rest[:i]
+			}
+			if t, err := time.Parse(time.RFC3339, rest); err == nil {
+				return t
+			}
+		}
+	}
+	return fallback
+}
+
+// Whether the file at the log's path is still the one open, rather than
+// one another process started by rotating.
+func (l *LogFile) current() bool {
+	open, err := l.f.Stat()
+	if err != nil {
+		return false
+	}
+	onDisk, err := os.Stat(l.path)
+	return err == nil && os.SameFile(open, onDisk)
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.current() {
+		l.f.Close()
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	if l.dueForRotation(len(p)) {
+		if err := l.rotate(); err != nil {
+			//Better a log that is too long than a lost entry; rotation is tried again on the next write
+			fmt.Fprintf(os.Stderr, "Error rotating %s: %s\n", l.path, err)
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	if l.start.IsZero() {
+		l.start = time.Now()
+	}
+	return n, err
+}
+
+func (l *LogFile) dueForRotation(next int) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.conf.MaxSize > 0 && l.size+int64(next) > int64(l.conf.MaxSize) {
+		return true
+	}
+	return l.conf.MaxAge.Duration > 0 && time.Since(l.start) >= l.conf.MaxAge.Duration
+}
+
+// Shifts <path>.1 to .2 and so on, dropping the oldest past log_rotate.keep,
+// moves the log to <path>.1 and starts a new one.
+func (l *LogFile) rotate() error {
+	for i := l.conf.Keep - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	l.f.Close()
+	err := os.Rename(l.path, l.path+".1")
+	if oerr := l.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,109 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	JOURNALD_SOCKET   = "/run/systemd/journal/socket"
+	SYSLOG_IDENTIFIER = "mcbk" //Program name logs are tagged with in syslog and the journal
+)
+
+// A slog handler for destinations that take one message at a time along
+// with its level, such as syslog. Each record is formatted like
+// NewLogHandler's, less the time the destination records itself, and
+// handed to send without its trailing newline.
+type sinkHandler struct {
+	inner slog.Handler
+	buf   *bytes.Buffer //What inner writes to, shared with every handler derived from this one
+	mu    *sync.Mutex
+	send  func(level slog.Level, msg string) error
+}
+
+func newSinkHandler(format string, send func(level slog.Level, msg string) error) slog.Handler {
+	buf := &bytes.Buffer{}
+	opts := &slog.HandlerOptions{ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return logAttr(groups, a)
+	}}
+	var inner slog.Handler = slog.NewTextHandler(buf, opts)
+	if format == "json" {
+		inner = slog.NewJSONHandler(buf, opts)
+	}
+	return &sinkHandler{inner: inner, buf: buf, mu: &sync.Mutex{}, send: send}
+}
+
+func (h *sinkHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *sinkHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+	return h.send(r.Level, strings.TrimSuffix(h.buf.String(), "\n"))
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sinkHandler{inner: h.inner.WithAttrs(attrs), buf: h.buf, mu: h.mu, send: h.send}
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	return &sinkHandler{inner: h.inner.WithGroup(name), buf: h.buf, mu: h.mu, send: h.send}
+}
+
+// The syslog severity of a slog level.
+func syslogPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// A slog handler sending records to the systemd journal over its native
+// socket, with their level as the entry's priority, so "journalctl -t mcbk
+// -p err" shows only failures.
+func NewJournalHandler(format string) (slog.Handler, error) {
+	conn, err := net.Dial("unixgram", JOURNALD_SOCKET)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to journald: %w", err)
+	}
+	return newSinkHandler(format, func(level slog.Level, msg string) error {
+		var entry bytes.Buffer
+		journalField(&entry, "PRIORITY", fmt.Sprint(syslogPriority(level)))
+		journalField(&entry, "SYSLOG_IDENTIFIER", SYSLOG_IDENTIFIER)
+		journalField(&entry, "MESSAGE", msg)
+		_, err := conn.Write(entry.Bytes())
+		return err
+	}), nil
+}
+
+// Appends a field in the journal's native format, which needs values
+// holding a newline to be prefixed with their length instead.
+func journalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteString("=" + value + "\n")
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
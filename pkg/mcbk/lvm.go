@@ -0,0 +1,102 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Settings for staging backups through an LVM snapshot.
+type LVMConfig struct {
+	Volume   string `json:"volume"`    //Logical volume holding minecraft_dir as "vg/lv", e.g. "vg0/minecraft". Empty disables LVM staging
+	Size     string `json:"size"`      //Room for changes made while the snapshot exists, passed to lvcreate: "2G", or "20%ORIGIN" for -l. Default "1G"
+	MountDir string `json:"mount_dir"` //Where the snapshot is mounted, default <backup_root>/<backup_dir_prefix>.snapshot
+}
+
+func (c LVMConfig) Enabled() bool {
+	return c.Volume != ""
+}
+
+func (c LVMConfig) validate() error {
+	vg, lv, ok := strings.Cut(c.Volume, "/")
+	if !ok || vg == "" || lv == "" || strings.Contains(lv, "/") {
+		return fmt.Errorf("lvm.volume %q must be written as \"vg/lv\"", c.Volume)
+	}
+	return nil
+}
+
+// Takes an LVM snapshot of the server's logical volume, which is instant,
+// so world saving can be turned back on while the backup is copied from
+// the snapshot, mounted read-only. Returns where minecraft_dir appears in
+// the mount, and a function that unmounts and removes the snapshot again.
+func (s *Server) lvmSnapshot(ctx context.Context) (string, func(), error) {
+	c := s.conf.LVM
+	out, err := runCommand(ctx, "findmnt", "-n", "-r", "-o", "TARGET,FSTYPE", "/dev/"+c.Volume)
+	if err != nil {
+		return "", nil, fmt.Errorf("finding where %s is mounted: %w", c.Volume, err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return "", nil, fmt.Errorf("logical volume %s isn't mounted", c.Volume)
+	}
+	//findmnt -r escapes spaces and the like as \x20
+	mount := strings.ReplaceAll(fields[0], `\x20`, " ")
+	rel, err := s.dirWithin(mount, "logical volume "+c.Volume)
+	if err != nil {
+		return "", nil, err
+	}
+
+	vg, _, _ := strings.Cut(c.Volume, "/")
+	name := s.stagingSnapshotName()
+	sizeFlag := "-L"
+	if strings.Contains(c.Size, "%") {
+		sizeFlag = "-l"
+	}
+	if _, err := runCommand(ctx, "lvcreate", "-s", "-n", name, sizeFlag, c.Size, c.Volume); err != nil {
+		return "", nil, err
+	}
+	snapshot := vg + "/" + name
+	s.log().Debug("Took LVM snapshot", "phase", "snapshot", "snapshot", snapshot)
+	remove := func() {
+		//Also after a cancelled backup, since a full snapshot becomes unusable
+		_, err := runCommand(context.WithoutCancel(ctx), "lvremove", "-f", snapshot)
+		if err != nil {
+			s.log().Error("Error removing LVM snapshot", "phase", "snapshot", "snapshot", snapshot, "error", err)
+		}
+	}
+
+	dir := c.MountDir
+	if dir == "" {
+		dir = filepath.Join(s.conf.BackupRoot, s.conf.BackupDirPrefix+".snapshot")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		remove()
+		return "", nil, err
+	}
+	options := "ro"
+	if fields[1] == "xfs" {
+		//XFS refuses to mount a second filesystem with the same UUID
+		options += ",nouuid"
+	}
+	if _, err := runCommand(ctx, "mount", "-o", options, "/dev/"+snapshot, dir); err != nil {
+		remove()
+		return "", nil, err
+	}
+	release := func() {
+		_, err := runCommand(context.WithoutCancel(ctx), "umount", dir)
+		if err != nil {
+			//Removing a mounted snapshot would fail as well
+			s.log().Error("Error unmounting LVM snapshot", "phase", "snapshot", "snapshot", snapshot, "dir", dir, "error", err)
+			return
+		}
+		remove()
+		if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.log().Warn("Error removing LVM snapshot mount directory", "phase", "snapshot", "dir", dir, "error", err)
+		}
+	}
+	return filepath.Join(dir, rel), release, nil
+}
@@ -0,0 +1,325 @@
+package mcbk
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const MAX_MANIFEST_PROBLEMS = 5 //Mismatches named when a restore doesn't match the manifest, the rest are only counted
+
+// The files of a snapshot as they were when it was taken, with the SHA-256
+// of each unless the server changed it before it could be hashed, written
+// by mcbk itself next to the backup. It lets snapshots be
+// verified, restores validated and snapshots compared by content whatever
+// the backend can tell about the files it stores.
+type Manifest struct {
+	Server   string         `json:"server"`
+	Snapshot string         `json:"snapshot"`
+	Time     time.Time      `json:"time"`  //When the manifest was written, as the backup finished
+	Files    []SnapshotFile `json:"files"` //Every regular file backed up, sorted by path
+}
+
+// Where the manifests of the server's snapshots are kept, one gzipped JSON
+// file per snapshot.
+func (s *Server) manifestDir() string {
+	return filepath.Join(s.conf.BackupRoot, s.conf.BackupDirPrefix+"_manifests")
+}
+
+// The manifest file of a snapshot. IDs may hold characters that can't be
+// in a file name, such as bup's colons, so those are replaced.
+func (s *Server) manifestPath(id string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, id)
+	return filepath.Join(s.manifestDir(), name+".json.gz")
+}
+
+// Reads the manifest of a snapshot. An error matching fs.ErrNotExist means
+// there is none, as for snapshots taken with skip_manifest or before
+// manifests were written.
+func (s *Server) readManifest(id string) (Manifest, error) {
+	m, err := readManifestFile(s.manifestPath(id))
+	if err == nil && m.Snapshot != id {
+		err = fmt.Errorf("the manifest of %s is for snapshot %s", id, m.Snapshot)
+	}
+	return m, err
+}
+
+func readManifestFile(path string) (Manifest, error) {
+	var m Manifest
+	f, err := os.Open(path)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err == nil {
+		err = json.NewDecoder(zr).Decode(&m)
+	}
+	if err != nil {
+		return m, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// A snapshot's manifest as it is built: the files are listed while the
+// server still isn't saving, so their sizes and modification times are
+// those backed up, and hashed by writeManifest once it is saving again.
+type manifestScan struct {
+	snap     Snapshot
+	dir      string
+	manifest Manifest
+	start    time.Time
+}
+
+// Lists the files just saved in snap from dir, or paths within it, for its
+// manifest. It runs before saving is turned back on, but only stats the
+// files. Those whose size and modification time match the newest manifest
+// keep the hash recorded there.
+func (s *Server) scanManifest(ctx context.Context, snap Snapshot, dir string, paths []string) (*manifestScan, error) {
+	scan := &manifestScan{snap: snap, dir: dir, manifest: Manifest{Server: s.conf.Name, Snapshot: snap.ID, Files: []SnapshotFile{}}, start: time.Now()}
+	excludes, err := parseExcludes(s.conf.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	previous := map[string]SnapshotFile{}
+	for _, f := range s.lastManifest().Files {
+		previous[f.Path] = f
+	}
+	err = walkPaths(dir, paths, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if excluded(excludes, filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := SnapshotFile{Path: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()}
+		if p, ok := previous[f.Path]; ok && p.Size == f.Size && p.ModTime.Equal(f.ModTime) {
+			f.SHA256 = p.SHA256
+		}
+		scan.manifest.Files = append(scan.manifest.Files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(scan.manifest.Files, func(a, b SnapshotFile) int { return strings.Compare(a.Path, b.Path) })
+	return scan, nil
+}
+
+// Hashes the files of a scan that changed since the last backup and writes
+// the snapshot's manifest. The server may be saving again by now, so a file
+// whose size or modification time differs from the scan after it was
+// hashed is left without a hash rather than given one of contents that
+// weren't backed up; only its size is checked then.
+func (s *Server) writeManifest(ctx context.Context, scan *manifestScan) error {
+	m := scan.manifest
+	hashed, changed := 0, 0
+	for i := range m.Files {
+		f := &m.Files[i]
+		if f.SHA256 != "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(scan.dir, filepath.FromSlash(f.Path))
+		sum, err := hashFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			changed++
+			continue
+		} else if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.Size() != f.Size || !info.ModTime().Equal(f.ModTime) {
+			changed++
+			continue
+		}
+		f.SHA256 = sum
+		hashed++
+	}
+	m.Time = time.Now()
+	if err := os.MkdirAll(s.manifestDir(), 0770); err != nil {
+		return err
+	}
+	if err := writeGzipJSON(s.manifestPath(scan.snap.ID), m); err != nil {
+		return err
+	}
+	s.log().Debug("Wrote the snapshot's manifest", "phase", "manifest", "snapshot", scan.snap.ID, "files", len(m.Files), "hashed", hashed, "changed", changed, "duration", time.Since(scan.start))
+	return nil
+}
+
+// Writes v as gzipped JSON to path, through a temporary file so a crash
+// never leaves half a file behind.
+func writeGzipJSON(path string, v any) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".mcbk-manifest-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	zw := gzip.NewWriter(tmp)
+	err = json.NewEncoder(zw).Encode(v)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// The most recently written manifest, or an empty one if there is none or
+// it can't be read, in which case every file is hashed again.
+func (s *Server) lastManifest() Manifest {
+	entries, err := os.ReadDir(s.manifestDir())
+	if err != nil {
+		return Manifest{}
+	}
+	var newest string
+	var newestTime time.Time
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !strings.HasSuffix(e.Name(), ".json.gz") || !info.Mode().IsRegular() {
+			continue
+		}
+		if info.ModTime().After(newestTime) {
+			newest, newestTime = e.Name(), info.ModTime()
+		}
+	}
+	if newest == "" {
+		return Manifest{}
+	}
+	m, err := readManifestFile(filepath.Join(s.manifestDir(), newest))
+	if err != nil {
+		return Manifest{}
+	}
+	return m
+}
+
+// Removes the manifests of snapshots that are gone, e.g. after pruning.
+// Failing to is only logged, as they take little space.
+func (s *Server) pruneManifests(ctx context.Context) {
+	entries, err := os.ReadDir(s.manifestDir())
+	if err != nil || len(entries) == 0 {
+		return
+	}
+	snaps, err := s.backend.List(ctx)
+	if err != nil {
+		s.log().Warn("Error listing snapshots, keeping every manifest", "phase", "prune", "error", err)
+		return
+	}
+	keep := map[string]bool{}
+	for _, snap := range snaps {
+		keep[filepath.Base(s.manifestPath(snap.ID))] = true
+	}
+	removed := 0
+	for _, e := range entries {
+		if keep[e.Name()] || !strings.HasSuffix(e.Name(), ".json.gz") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.manifestDir(), e.Name())); err != nil {
+			s.log().Warn("Error removing the manifest of a pruned snapshot", "phase", "prune", "file", e.Name(), "error", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		s.log().Debug("Removed the manifests of pruned snapshots", "phase", "prune", "removed", removed)
+	}
+}
+
+// Checks the files restored from a snapshot into dir against its manifest:
+// every file the manifest lists under paths must be there with the same
+// size and SHA-256. Snapshots without a manifest aren't checked.
+func (s *Server) validateRestore(ctx context.Context, id, dir string, paths []string) error {
+	m, err := s.readManifest(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	start := time.Now()
+	var problems []string
+	failed, checked := 0, 0
+	for _, f := range m.Files {
+		if !slices.ContainsFunc(paths, func(p string) bool {
+			p = filepath.ToSlash(p)
+			return f.Path == p || strings.HasPrefix(f.Path, p+"/")
+		}) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		checked++
+		path := filepath.Join(dir, filepath.FromSlash(f.Path))
+		problem := ""
+		info, err := os.Stat(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			problem = fmt.Sprintf("%s is missing", f.Path)
+		case err != nil:
+			return err
+		case info.Size() != f.Size:
+			problem = fmt.Sprintf("%s has %d bytes, the manifest lists %d", f.Path, info.Size(), f.Size)
+		default:
+			sum, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+			if f.SHA256 != "" && sum != f.SHA256 {
+				problem = fmt.Sprintf("%s has different contents than were backed up", f.Path)
+			}
+		}
+		if problem != "" {
+			if failed < MAX_MANIFEST_PROBLEMS {
+				problems = append(problems, problem)
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		if more := failed - len(problems); more > 0 {
+			problems = append(problems, fmt.Sprintf("and %d more", more))
+		}
+		return fmt.Errorf("the restored files don't match the snapshot's manifest, leaving the files alone: %s", strings.Join(problems, "; "))
+	}
+	s.log().Info("Restored files match the manifest", "phase", "restore", "snapshot", id, "files", checked, "duration", time.Since(start))
+	return nil
+}
@@ -0,0 +1,61 @@
+package mcbk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManifestHashesAfterScan(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, "")
+	world := filepath.Join(s.conf.MinecraftDir, "world")
+	for _, name := range []string{"a.mca", "b.mca"} {
+		if err := os.WriteFile(filepath.Join(world, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := Snapshot{ID: "first"}
+	scan, err := s.scanManifest(ctx, snap, s.conf.MinecraftDir, []string{"world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The server saves again before the manifest is hashed
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(filepath.Join(world, "b.mca"), []byte("saved since"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(world, "b.mca"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeManifest(ctx, scan); err != nil {
+		t.Fatal(err)
+	}
+	m, err := s.readManifest(snap.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := map[string]string{}
+	for _, f := range m.Files {
+		hashes[f.Path] = f.SHA256
+	}
+	if want, _ := hashFile(filepath.Join(world, "a.mca")); hashes["world/a.mca"] != want {
+		t.Errorf("world/a.mca has hash %q, want %q", hashes["world/a.mca"], want)
+	}
+	if h, ok := hashes["world/b.mca"]; !ok || h != "" {
+		t.Errorf("world/b.mca, saved after the scan, has hash %q (listed: %t), want it listed without one", h, ok)
+	}
+
+	//The next manifest keeps the unchanged file's hash and hashes the other
+	scan, err = s.scanManifest(ctx, Snapshot{ID: "second"}, s.conf.MinecraftDir, []string{"world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range scan.manifest.Files {
+		if (f.SHA256 != "") != (f.Path != "world/b.mca") {
+			t.Errorf("%s has hash %q before hashing, want only the unchanged files to keep theirs", f.Path, f.SHA256)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package mcbk
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const DEFAULT_MESSAGES_LANGUAGE = "en"
+
+// What mcbk says in-game. Each message is a template, see messageData, and
+// defaults to the built-in translation for language. The countdown
+// warnings are countdown.message.
+type MessagesConfig struct {
+	Language       string `json:"language"`        //Built-in translation the messages default to: "en", "de", "es", "fr", "it", "ja", "nl", "pl", "pt", "ru" or "zh"
+	BackupStart    string `json:"backup_start"`    //Broadcast as world saving is paused, e.g. "Backing up world..."
+	BackupComplete string `json:"backup_complete"` //Broadcast once the backup is saved, e.g. "Backup complete ({{.Size}} in {{.Duration}})"
+	TriggerStart   string `json:"trigger_start"`   //Broadcast when chat_trigger starts a backup
+	TriggerBusy    string `json:"trigger_busy"`    //Broadcast when that backup can't run because another one is
+	TriggerSkipped string `json:"trigger_skipped"` //Broadcast when it is outside backup_window
+	TriggerFailed  string `json:"trigger_failed"`  //Broadcast when it fails
+	TriggerDenied  string `json:"trigger_denied"`  //Told to a player not in chat_trigger.players
+	TriggerRunning string `json:"trigger_running"` //Told to a player while the backup they asked for runs
+}
+
+// What a message template can refer to. Fields that don't apply to a
+// message are empty.
+type messageData struct {
+	Server    string //Server name
+	Remaining string //Countdown: time left, e.g. "1m30s"
+	Seconds   int    //Countdown: time left in seconds
+	Duration  string //backup_complete: how long the backup took since saving was paused, e.g. "4.2s"
+	Size      string //backup_complete: size of the backup, e.g. "12.5 MiB", empty if the backend can't tell
+	Snapshot  string //backup_complete: ID of the new snapshot
+	Player    string //trigger_*: the player who asked for the backup
+	Error     string //trigger_skipped: why
+}
+
+// The built-in translations, by language code. Each has every message.
+var messageTranslations = map[string]map[string]string{
+	"en": {
+		"countdown":       "Backup in {{.Remaining}}...",
+		"backup_start":    "Backing up world...",
+		"backup_complete": "Backup complete",
+		"trigger_start":   "Backup requested by {{.Player}}, starting...",
+		"trigger_busy":    "Another backup is already in progress.",
+		"trigger_skipped": "Backup skipped: {{.Error}}.",
+		"trigger_failed":  "Backup failed, see mcbk's log for details.",
+		"trigger_denied":  "You aren't allowed to start backups.",
+		"trigger_running": "A backup requested in-game is already running.",
+	},
+	"de": {
+		"countdown":       "Backup in {{.Remaining}}...",
+		"backup_start":    "Welt wird gesichert...",
+		"backup_complete": "Backup abgeschlossen",
+		"trigger_start":   "Backup angefordert von {{.Player}}, wird gestartet...",
+		"trigger_busy":    "Es läuft bereits ein anderes Backup.",
+		"trigger_skipped": "Backup übersprungen: {{.Error}}.",
+		"trigger_failed":  "Backup fehlgeschlagen, Details stehen im Log von mcbk.",
+		"trigger_denied":  "Du darfst keine Backups starten.",
+		"trigger_running": "Ein im Spiel angefordertes Backup läuft bereits.",
+	},
+	"es": {
+		"countdown":       "Copia de seguridad en {{.Remaining}}...",
+		"backup_start":    "Haciendo copia de seguridad del mundo...",
+		"backup_complete": "Copia de seguridad completada",
+		"trigger_start":   "Copia de seguridad solicitada por {{.Player}}, iniciando...",
+		"trigger_busy":    "Ya hay otra copia de seguridad en curso.",
+		"trigger_skipped": "Copia de seguridad omitida: {{.Error}}.",
+		"trigger_failed":  "La copia de seguridad ha fallado, consulta el registro de mcbk para más detalles.",
+		"trigger_denied":  "No tienes permiso para iniciar copias de seguridad.",
+		"trigger_running": "Ya se está ejecutando una copia de seguridad solicitada en el juego.",
+	},
+	"fr": {
+		"countdown":       "Sauvegarde dans {{.Remaining}}...",
+		"backup_start":    "Sauvegarde du monde en cours...",
+		"backup_complete": "Sauvegarde terminée",
+		"trigger_start":   "Sauvegarde demandée par {{.Player}}, démarrage...",
+		"trigger_busy":    "Une autre sauvegarde est déjà en cours.",
+		"trigger_skipped": "Sauvegarde ignorée : {{.Error}}.",
+		"trigger_failed":  "La sauvegarde a échoué, voir le journal de mcbk pour plus de détails.",
+		"trigger_denied":  "Vous n'êtes pas autorisé à lancer des sauvegardes.",
+		"trigger_running": "Une sauvegarde demandée en jeu est déjà en cours.",
+	},
+	"it": {
+		"countdown":       "Backup tra {{.Remaining}}...",
+		"backup_start":    "Backup del mondo in corso...",
+		"backup_complete": "Backup completato",
+		"trigger_start":   "Backup richiesto da {{.Player}}, avvio in corso...",
+		"trigger_busy":    "Un altro backup è già in corso.",
+		"trigger_skipped": "Backup saltato: {{.Error}}.",
+		"trigger_failed":  "Backup non riuscito, vedi il log di mcbk per i dettagli.",
+		"trigger_denied":  "Non hai il permesso di avviare i backup.",
+		"trigger_running": "Un backup richiesto in gioco è già in corso.",
+	},
+	"ja": {
+		"countdown":       "{{.Remaining}}後にバックアップを開始します...",
+		"backup_start":    "ワールドをバックアップしています...",
+		"backup_complete": "バックアップが完了しました",
+		"trigger_start":   "{{.Player}} がバックアップをリクエストしました。開始します...",
+		"trigger_busy":    "別のバックアップが実行中です。",
+		"trigger_skipped": "バックアップをスキップしました: {{.Error}}。",
+		"trigger_failed":  "バックアップに失敗しました。詳細は mcbk のログを確認してください。",
+		"trigger_denied":  "バックアップを開始する権限がありません。",
+		"trigger_running": "ゲーム内でリクエストされたバックアップはすでに実行中です。",
+	},
+	"nl": {
+		"countdown":       "Back-up over {{.Remaining}}...",
+		"backup_start":    "Wereld wordt geback-upt...",
+		"backup_complete": "Back-up voltooid",
+		"trigger_start":   "Back-up aangevraagd door {{.Player}}, wordt gestart...",
+		"trigger_busy":    "Er loopt al een andere back-up.",
+		"trigger_skipped": "Back-up overgeslagen: {{.Error}}.",
+		"trigger_failed":  "Back-up mislukt, zie het logboek van mcbk voor details.",
+		"trigger_denied":  "Je mag geen back-ups starten.",
+		"trigger_running": "Er loopt al een in het spel aangevraagde back-up.",
+	},
+	"pl": {
+		"countdown":       "Kopia zapasowa za {{.Remaining}}...",
+		"backup_start":    "Tworzenie kopii zapasowej świata...",
+		"backup_complete": "Kopia zapasowa ukończona",
+		"trigger_start":   "Kopia zapasowa na żądanie gracza {{.Player}}, rozpoczynanie...",
+		"trigger_busy":    "Inna kopia zapasowa jest już w toku.",
+		"trigger_skipped": "Pominięto kopię zapasową: {{.Error}}.",
+		"trigger_failed":  "Kopia zapasowa nie powiodła się, szczegóły w logu mcbk.",
+		"trigger_denied":  "Nie masz uprawnień do uruchamiania kopii zapasowych.",
+		"trigger_running": "Kopia zapasowa zażądana w grze już trwa.",
+	},
+	"pt": {
+		"countdown":       "Backup em {{.Remaining}}...",
+		"backup_start":    "Fazendo backup do mundo...",
+		"backup_complete": "Backup concluído",
+		"trigger_start":   "Backup solicitado por {{.Player}}, iniciando...",
+		"trigger_busy":    "Outro backup já está em andamento.",
+		"trigger_skipped": "Backup ignorado: {{.Error}}.",
+		"trigger_failed":  "O backup falhou, veja o log do mcbk para mais detalhes.",
+		"trigger_denied":  "Você não tem permissão para iniciar backups.",
+		"trigger_running": "Um backup solicitado no jogo já está em andamento.",
+	},
+	"ru": {
+		"countdown":       "Резервное копирование через {{.Remaining}}...",
+		"backup_start":    "Создание резервной копии мира...",
+		"backup_complete": "Резервное копирование завершено",
+		"trigger_start":   "Резервное копирование по запросу {{.Player}}, начинаем...",
+		"trigger_busy":    "Другое резервное копирование уже выполняется.",
+		"trigger_skipped": "Резервное копирование пропущено: {{.Error}}.",
+		"trigger_failed":  "Резервное копирование не удалось, подробности в журнале mcbk.",
+		"trigger_denied":  "У вас нет прав на запуск резервного копирования.",
+		"trigger_running": "Резервное копирование, запрошенное в игре, уже выполняется.",
+	},
+	"zh": {
+		"countdown":       "{{.Remaining}}后开始备份...",
+		"backup_start":    "正在备份世界...",
+		"backup_complete": "备份完成",
+		"trigger_start":   "{{.Player}} 请求了备份，正在开始...",
+		"trigger_busy":    "另一个备份正在进行中。",
+		"trigger_skipped": "已跳过备份：{{.Error}}。",
+		"trigger_failed":  "备份失败，详情请查看 mcbk 的日志。",
+		"trigger_denied":  "你没有权限开始备份。",
+		"trigger_running": "游戏内请求的备份已在进行中。",
+	},
+}
+
+// Fills in every message left empty, and countdown.message, from the
+// built-in translation for messages.language.
+func (c *ServerConfig) setMessageDefaults() {
+	if c.Messages.Language == "" {
+		c.Messages.Language = DEFAULT_MESSAGES_LANGUAGE
+	}
+	for key, text := range c.Messages.templates() {
+		if *text == "" {
+			*text = cmp.Or(messageTranslations[c.Messages.Language][key], messageTranslations[DEFAULT_MESSAGES_LANGUAGE][key])
+		}
+	}
+	if c.Countdown.Message == "" {
+		c.Countdown.Message = cmp.Or(messageTranslations[c.Messages.Language]["countdown"], messageTranslations[DEFAULT_MESSAGES_LANGUAGE]["countdown"])
+	}
+}
+
+// Each message template, by its setting's name.
+func (c *MessagesConfig) templates() map[string]*string {
+	return map[string]*string{
+		"backup_start":    &c.BackupStart,
+		"backup_complete": &c.BackupComplete,
+		"trigger_start":   &c.TriggerStart,
+		"trigger_busy":    &c.TriggerBusy,
+		"trigger_skipped": &c.TriggerSkipped,
+		"trigger_failed":  &c.TriggerFailed,
+		"trigger_denied":  &c.TriggerDenied,
+		"trigger_running": &c.TriggerRunning,
+	}
+}
+
+func (c MessagesConfig) validate() []error {
+	var errs []error
+	if _, ok := messageTranslations[c.Language]; !ok {
+		errs = append(errs, fmt.Errorf("unknown messages.language %q, expected one of %s", c.Language, strings.Join(slices.Sorted(maps.Keys(messageTranslations)), ", ")))
+	}
+	templates := c.templates()
+	for _, key := range slices.Sorted(maps.Keys(templates)) {
+		if err := checkMessage(*templates[key]); err != nil {
+			errs = append(errs, fmt.Errorf("messages.%s: %w", key, err))
+		}
+	}
+	return errs
+}
+
+// Checks that a message template parses and only refers to messageData.
+func checkMessage(text string) error {
+	tmpl, err := template.New("message").Parse(text)
+	if err == nil {
+		err = tmpl.Execute(io.Discard, messageData{})
+	}
+	return err
+}
+
+// Fills in a message template. Templates are checked when the config is
+// loaded, so one that fails anyway is sent as it is rather than not at all.
+func formatMessage(text string, data messageData) string {
+	tmpl, err := template.New("message").Parse(text)
+	if err != nil {
+		return text
+	}
+	var msg strings.Builder
+	if err := tmpl.Execute(&msg, data); err != nil {
+		return text
+	}
+	return msg.String()
+}
+
+// Fills in one of the server's message templates.
+func (s *Server) message(text string, data messageData) string {
+	data.Server = s.conf.Name
+	return formatMessage(text, data)
+}
+
+// Formats how long a backup took for players, e.g. "4.2s" or "1m30s".
+func formatTook(d time.Duration) string {
+	if d < 10*time.Second {
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	}
+	return formatRemaining(d)
+}
@@ -0,0 +1,241 @@
+package mcbk
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-server counters and gauges, exported in the Prometheus text format.
+// Written by hand to keep mcbk free of third-party dependencies.
+type serverMetrics struct {
+	lastBackup          time.Time //Start of the last backup attempt
+	lastSuccess         time.Time //End of the last successful backup
+	lastDuration        time.Duration
+	lastSize            int64
+	sourceBytes         int64   //Size of the files backed up by the last successful backup
+	repoBytes           int64   //Space the backups took up after it
+	repoGrowth          int64   //How much it grew the backups by
+	dedupRatio          float64 //Bytes backed up per byte stored by it
+	inProgress          bool
+	progress            Progress //How far the running backup has got
+	successes           int64
+	failures            int64
+	prunes              int64
+	pruneFailures       int64
+	prunedSnapshots     int64
+	replications        int64
+	replicationFailures int64
+	lastErr             error //Why the last backup failed, nil if it succeeded
+}
+
+// Backup and prune metrics for a set of servers. Serves them over HTTP in
+// the Prometheus text format. Recording on a nil *Metrics is a no-op.
+type Metrics struct {
+	mu      sync.Mutex
+	servers map[string]*serverMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{servers: map[string]*serverMetrics{}}
+}
+
+// Adds a server so it is exported before its first backup.
+func (m *Metrics) Register(server string) {
+	m.update(server, func(sm *serverMetrics) {})
+}
+
+// Runs fn with the metrics for a server, creating them if needed.
+func (m *Metrics) update(server string, fn func(sm *serverMetrics)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm, ok := m.servers[server]
+	if !ok {
+		sm = &serverMetrics{}
+		m.servers[server] = sm
+	}
+	fn(sm)
+}
+
+// Returns a copy of a server's metrics, and whether it has any.
+func (m *Metrics) status(server string) (serverMetrics, bool) {
+	if m == nil {
+		return serverMetrics{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm, ok := m.servers[server]
+	if !ok {
+		return serverMetrics{}, false
+	}
+	return *sm, true
+}
+
+func (m *Metrics) backupStarted(server string, t time.Time) {
+	m.update(server, func(sm *serverMetrics) {
+		sm.lastBackup = t
+		sm.inProgress = true
+	})
+}
+
+func (m *Metrics) backupFinished(server string, d time.Duration, snap Snapshot, err error) {
+	m.update(server, func(sm *serverMetrics) {
+		sm.inProgress = false
+		sm.progress = Progress{}
+		sm.lastDuration = d
+		sm.lastErr = err
+		if err != nil {
+			sm.failures++
+			return
+		}
+		sm.successes++
+		sm.lastSuccess = time.Now()
+		sm.lastSize = snap.Size
+	})
+}
+
+func (m *Metrics) statsRecorded(server string, rec HistoryRecord) {
+	m.update(server, func(sm *serverMetrics) {
+		sm.sourceBytes, sm.repoBytes, sm.repoGrowth, sm.dedupRatio = rec.SourceBytes, rec.RepoBytes, rec.RepoGrowth, rec.DedupRatio
+	})
+}
+
+func (m *Metrics) progressed(p Progress) {
+	m.update(p.Server, func(sm *serverMetrics) {
+		sm.progress = p
+	})
+}
+
+func (m *Metrics) pruned(server string, removed int, err error) {
+	m.update(server, func(sm *serverMetrics) {
+		if err != nil {
+			sm.pruneFailures++
+			return
+		}
+		sm.prunes++
+		sm.prunedSnapshots += int64(removed)
+	})
+}
+
+func (m *Metrics) replicated(server string, err error) {
+	m.update(server, func(sm *serverMetrics) {
+		if err != nil {
+			sm.replicationFailures++
+			return
+		}
+		sm.replications++
+	})
+}
+
+// Writes every metric in the Prometheus text exposition format.
+func (m *Metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.servers))
+	for name := range m.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	gauge := func(name, help string, value func(sm *serverMetrics) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, n := range names {
+			fmt.Fprintf(w, "%s{server=%s} %g\n", name, promLabel(n), value(m.servers[n]))
+		}
+	}
+	counter := func(name, help string, statuses map[string]func(sm *serverMetrics) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		keys := make([]string, 0, len(statuses))
+		for k := range statuses {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, n := range names {
+			for _, k := range keys {
+				labels := "server=" + promLabel(n)
+				if k != "" {
+					labels += ",status=" + promLabel(k)
+				}
+				fmt.Fprintf(w, "%s{%s} %d\n", name, labels, statuses[k](m.servers[n]))
+			}
+		}
+	}
+	unix := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixNano()) / 1e9
+	}
+
+	gauge("mcbk_last_backup_start_timestamp_seconds", "Start time of the last backup attempt.", func(sm *serverMetrics) float64 {
+		return unix(sm.lastBackup)
+	})
+	gauge("mcbk_last_success_timestamp_seconds", "Completion time of the last successful backup.", func(sm *serverMetrics) float64 {
+		return unix(sm.lastSuccess)
+	})
+	gauge("mcbk_last_backup_duration_seconds", "Duration of the last backup attempt.", func(sm *serverMetrics) float64 {
+		return sm.lastDuration.Seconds()
+	})
+	gauge("mcbk_last_backup_size_bytes", "Size reported by the backend for the last successful backup.", func(sm *serverMetrics) float64 {
+		return float64(sm.lastSize)
+	})
+	gauge("mcbk_source_size_bytes", "Size of the files backed up by the last successful backup.", func(sm *serverMetrics) float64 {
+		return float64(sm.sourceBytes)
+	})
+	gauge("mcbk_repo_size_bytes", "Space the backups took up after the last successful backup, before pruning, or 0 if not stored on this machine.", func(sm *serverMetrics) float64 {
+		return float64(sm.repoBytes)
+	})
+	gauge("mcbk_last_backup_repo_growth_bytes", "How much the last successful backup grew the backups by.", func(sm *serverMetrics) float64 {
+		return float64(sm.repoGrowth)
+	})
+	gauge("mcbk_last_backup_dedup_ratio", "Bytes backed up per byte stored by the last successful backup, or 0 if not known.", func(sm *serverMetrics) float64 {
+		return sm.dedupRatio
+	})
+	gauge("mcbk_backup_in_progress", "Whether a backup is currently running.", func(sm *serverMetrics) float64 {
+		if sm.inProgress {
+			return 1
+		}
+		return 0
+	})
+	gauge("mcbk_backup_progress_bytes", "Bytes read so far by the running backup.", func(sm *serverMetrics) float64 {
+		return float64(sm.progress.Bytes)
+	})
+	gauge("mcbk_backup_progress_ratio", "How far the running backup has got, from 0 to 1, or 0 if its total isn't known.", func(sm *serverMetrics) float64 {
+		return sm.progress.Percent / 100
+	})
+	counter("mcbk_backups_total", "Backup attempts by outcome.", map[string]func(sm *serverMetrics) int64{
+		"success": func(sm *serverMetrics) int64 { return sm.successes },
+		"failure": func(sm *serverMetrics) int64 { return sm.failures },
+	})
+	counter("mcbk_prunes_total", "Prune runs by outcome.", map[string]func(sm *serverMetrics) int64{
+		"success": func(sm *serverMetrics) int64 { return sm.prunes },
+		"failure": func(sm *serverMetrics) int64 { return sm.pruneFailures },
+	})
+	counter("mcbk_pruned_snapshots_total", "Snapshots removed by the retention policy.", map[string]func(sm *serverMetrics) int64{
+		"": func(sm *serverMetrics) int64 { return sm.prunedSnapshots },
+	})
+	counter("mcbk_replications_total", "Syncs to rclone remotes by outcome.", map[string]func(sm *serverMetrics) int64{
+		"success": func(sm *serverMetrics) int64 { return sm.replications },
+		"failure": func(sm *serverMetrics) int64 { return sm.replicationFailures },
+	})
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeTo(w)
+}
+
+// Quotes a Prometheus label value.
+func promLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
@@ -0,0 +1,144 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Implemented by backends that can present their snapshots as a read-only
+// filesystem, for "mcbk mount".
+type mounter interface {
+	// Mounts the snapshots at dir, an existing empty directory, until ctx
+	// is cancelled, then unmounts them.
+	Mount(ctx context.Context, dir string) error
+}
+
+// Mounts every snapshot of the server read-only at dir, so files can be
+// copied out of them with the usual tools, and keeps them mounted until ctx
+// is cancelled. bup, restic and borg serve the mount with their own FUSE
+// support; tar archives and dedup snapshots are served natively, on Linux
+// only.
+func (s *Server) MountSnapshots(ctx context.Context, dir string) error {
+	m, ok := s.backend.(mounter)
+	if !ok {
+		return fmt.Errorf("the %s backend can't mount snapshots", s.conf.Backend)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", dir)
+	}
+	return m.Mount(ctx, dir)
+}
+
+// Runs a tool that serves a FUSE mount at dir in the foreground until ctx
+// is cancelled, then unmounts dir, which makes it exit.
+func runMountCommand(ctx context.Context, dir string, env []string, name string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		//It only exits on its own if mounting failed or someone unmounted dir
+		if err != nil {
+			return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	case <-ctx.Done():
+	}
+	if err := unmountFUSE(dir); err != nil {
+		cmd.Process.Signal(os.Interrupt)
+	}
+	select {
+	case <-done:
+	case <-time.After(COMMAND_CANCEL_GRACE):
+		cmd.Process.Kill()
+		<-done
+	}
+	return nil
+}
+
+// Unmounts a FUSE filesystem with whichever of fusermount3, fusermount
+// (Linux, without root) and umount is available.
+func unmountFUSE(dir string) error {
+	var errs []string
+	for _, c := range [][]string{{"fusermount3", "-u"}, {"fusermount", "-u"}, {"umount"}} {
+		if _, err := exec.LookPath(c[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(c[0], append(c[1:], dir)...).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", c[0], strings.TrimSpace(string(out))))
+	}
+	if errs == nil {
+		return fmt.Errorf("unmounting %s: none of fusermount3, fusermount or umount is installed", dir)
+	}
+	return fmt.Errorf("unmounting %s: %s", dir, strings.Join(errs, "; "))
+}
+
+// Mounts each repo with bup fuse in a directory of its own, named after it.
+func (b *bupBackend) Mount(ctx context.Context, dir string) error {
+	repos, err := b.repos()
+	if err != nil {
+		return err
+	}
+	if len(repos) == 0 {
+		return fmt.Errorf("there are no repos in %s", b.root)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(repos))
+	for i, repo := range repos {
+		mountpoint := filepath.Join(dir, filepath.Base(repo))
+		if err := os.MkdirAll(mountpoint, 0770); err != nil {
+			return err
+		}
+		defer os.Remove(mountpoint)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = runMountCommand(ctx, mountpoint, nil, "bup", slices.Concat([]string{"-d", repo, "fuse", "-f"}, b.conf.Flags["fuse"], []string{mountpoint})...)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mounts the server's snapshots with restic mount, which arranges them by
+// time, host and tag.
+func (b *resticBackend) Mount(ctx context.Context, dir string) error {
+	return runMountCommand(ctx, dir, b.env(), "restic", "mount", "--tag", b.tag, dir)
+}
+
+// Mounts the server's archives with borg mount, one directory per archive.
+func (b *borgBackend) Mount(ctx context.Context, dir string) error {
+	env, err := b.env()
+	if err != nil {
+		return err
+	}
+	return runMountCommand(ctx, dir, env, "borg", "mount", "-f", "--glob-archives", b.prefix+"-"+BORG_ARCHIVE_GLOB, "::", dir)
+}
@@ -0,0 +1,104 @@
+package mcbk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+const DEFAULT_MIN_FREE_INODES = 1000 //Free inodes the backup disk must have left, unless min_free_inodes says otherwise
+
+var errMountCheckUnsupported = errors.New("mount_check isn't supported on this platform")
+
+func (c ServerConfig) validateMountCheck() []error {
+	var errs []error
+	if c.MountCheck != "" {
+		if runtime.GOOS == "windows" {
+			errs = append(errs, errMountCheckUnsupported)
+		} else if !filepath.IsAbs(c.MountCheck) {
+			errs = append(errs, fmt.Errorf("mount_check %q must be an absolute path", c.MountCheck))
+		}
+	}
+	if c.MinFreeInodes < 0 {
+		errs = append(errs, errors.New("min_free_inodes must not be negative"))
+	}
+	return errs
+}
+
+// Checks that backup_root is on the filesystem mounted at mount_check, so
+// an unmounted backup disk fails the backup instead of quietly filling
+// the disk below the mount point. It must run before anything is written
+// to backup_root, which would otherwise be created there.
+func (s *Server) checkMount() error {
+	return checkMounted(s.conf.MountCheck, s.conf.BackupRoot)
+}
+
+// Checks that the log is on the filesystem mounted at mount_check if it is
+// kept in backup_root, as it is by default, so it isn't created on the disk
+// below an unmounted backup disk either.
+func (c *Config) CheckLogMount() error {
+	if !underAny(c.LogPath, []string{c.BackupRoot}) {
+		return nil
+	}
+	return checkMounted(c.MountCheck, c.BackupRoot)
+}
+
+func checkMounted(mount, root string) error {
+	if mount == "" {
+		return nil
+	}
+	dev, err := deviceID(mount)
+	if err != nil {
+		return fmt.Errorf("mount_check: %w", err)
+	}
+	if parent := filepath.Dir(mount); parent != mount {
+		parentDev, err := deviceID(parent)
+		if err != nil {
+			return fmt.Errorf("mount_check: %w", err)
+		}
+		if parentDev == dev {
+			return fmt.Errorf("nothing is mounted at %s (mount_check), not writing backups to the disk below it", mount)
+		}
+	}
+	rootDev, err := deviceID(existingParent(root))
+	if err != nil {
+		return fmt.Errorf("mount_check: %w", err)
+	}
+	if rootDev != dev {
+		return fmt.Errorf("backup_root %s isn't on the filesystem mounted at %s (mount_check)", root, mount)
+	}
+	return nil
+}
+
+// Writes and removes a file in backup_root, which catches a network mount
+// that went read-only before any time is spent on the backup.
+func (s *Server) checkWritable() error {
+	f, err := os.CreateTemp(s.conf.BackupRoot, ".mcbk-write-check-")
+	if errors.Is(err, syscall.EROFS) {
+		return fmt.Errorf("backup_root %s is on a read-only filesystem: %w", s.conf.BackupRoot, err)
+	}
+	if err != nil {
+		return fmt.Errorf("backup_root %s isn't writable: %w", s.conf.BackupRoot, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Makes sure the filesystem holding dir has min_free_inodes left, as one
+// that runs out fails every file written no matter how much space is free.
+func (s *Server) checkFreeInodes(dir string) error {
+	free, total, err := freeInodes(existingParent(dir))
+	if errors.Is(err, errFreeSpaceUnsupported) || err == nil && total == 0 {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("checking free inodes in %s: %w", dir, err)
+	}
+	s.log().Debug("Checked free inodes", "phase", "preflight", "dir", dir, "free", free, "total", total)
+	if free < s.conf.MinFreeInodes {
+		return fmt.Errorf("the filesystem holding %s is out of inodes: %d of %d free, fewer than min_free_inodes (%d); remove small files or backups", dir, free, total, s.conf.MinFreeInodes)
+	}
+	return nil
+}
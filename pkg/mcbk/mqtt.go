@@ -0,0 +1,316 @@
+package mcbk
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MQTT_TIMEOUT = 10 * time.Second //Limit on connecting to the broker and publishing one event
+
+// The lifecycle events published to MQTT.
+const (
+	MQTTStarted   = "started"   //A backup has started
+	MQTTSaved     = "saved"     //The backend has written the snapshot and world saving is back on
+	MQTTCompleted = "completed" //The backup succeeded, including any check
+	MQTTFailed    = "failed"    //The backup failed or was cancelled
+	MQTTPruned    = "pruned"    //Old backups were pruned, or pruning failed
+)
+
+// Settings for publishing backup events to an MQTT broker, e.g. for Home
+// Assistant automations.
+type MQTTConfig struct {
+	Broker      string `json:"broker"`                 //e.g. "mqtt://homeassistant.local:1883", or "mqtts://" for TLS. Empty disables MQTT
+	Username    string `json:"username"`               //Leave empty to connect without authenticating
+	Password    string `json:"password" secret:"true"` //Password for username
+	ClientID    string `json:"client_id"`              //Default "mcbk-<hostname>"
+	TopicPrefix string `json:"topic_prefix"`           //Events go to <topic_prefix>/<server>/event, default "mcbk"
+	QoS         int    `json:"qos"`                    //0 to publish at most once (default), 1 to have the broker confirm each message
+}
+
+// Whether events are published at all.
+func (c MQTTConfig) Enabled() bool {
+	return c.Broker != ""
+}
+
+func (c *MQTTConfig) setDefaults() {
+	if c.ClientID == "" {
+		host, _ := os.Hostname()
+		c.ClientID = "mcbk-" + host
+	}
+	if c.TopicPrefix == "" {
+		c.TopicPrefix = "mcbk"
+	}
+	c.TopicPrefix = strings.TrimSuffix(c.TopicPrefix, "/")
+}
+
+func (c MQTTConfig) validate() []error {
+	var errs []error
+	if _, err := c.address(); err != nil {
+		errs = append(errs, err)
+	}
+	if strings.ContainsAny(c.TopicPrefix, "+#") {
+		errs = append(errs, fmt.Errorf("mqtt.topic_prefix %q can't contain the wildcards + or #", c.TopicPrefix))
+	}
+	if c.QoS != 0 && c.QoS != 1 {
+		errs = append(errs, fmt.Errorf("mqtt.qos must be 0 or 1, got %d", c.QoS))
+	}
+	if c.Password != "" && c.Username == "" {
+		errs = append(errs, errors.New("mqtt.password needs mqtt.username"))
+	}
+	return errs
+}
+
+// The broker's host:port, from the broker URL.
+func (c MQTTConfig) address() (string, error) {
+	u, err := url.Parse(c.Broker)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("mqtt.broker must be a URL like \"mqtt://host:1883\", got %q", c.Broker)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		if port == "" {
+			port = "1883"
+		}
+	case "mqtts", "ssl":
+		if port == "" {
+			port = "8883"
+		}
+	default:
+		return "", fmt.Errorf("unknown mqtt.broker scheme %q, expected \"mqtt\" or \"mqtts\"", u.Scheme)
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// Publishes backup lifecycle events to an MQTT broker. Publishing on a nil
+// *MQTTPublisher is a no-op.
+type MQTTPublisher struct {
+	mu   sync.Mutex //Runs publish one at a time, as a second connection with the same client ID would drop the first
+	conf MQTTConfig
+}
+
+// Returns a publisher for the configured broker, or nil if MQTT isn't
+// enabled.
+func NewMQTTPublisher(c MQTTConfig) *MQTTPublisher {
+	if !c.Enabled() {
+		return nil
+	}
+	return &MQTTPublisher{conf: c}
+}
+
+// The payload of an event, published to <prefix>/<server>/event. Started,
+// completed and failed also go to <prefix>/<server>/state, retained, so
+// dashboards show how the last backup went even after a restart.
+type mqttEvent struct {
+	Event    string    `json:"event"` //One of the MQTT* constants
+	Server   string    `json:"server"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds,omitempty"` //Time since the backup started, or how long pruning took
+	Snapshot string    `json:"snapshot,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`  //Size of the new snapshot, if known
+	Pruned   *int      `json:"pruned,omitempty"` //Snapshots removed, for pruned
+	Error    string    `json:"error,omitempty"`
+}
+
+// Connects to the broker, publishes the event to its topics and
+// disconnects. A connection per event keeps a flaky broker from affecting
+// later ones; backups are rare enough for that to be cheap.
+func (p *MQTTPublisher) publish(ev mqttEvent) error {
+	if p == nil {
+		return nil
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addr, err := p.conf.address()
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{Timeout: MQTT_TIMEOUT}
+	var conn net.Conn
+	if strings.HasPrefix(p.conf.Broker, "mqtts:") || strings.HasPrefix(p.conf.Broker, "ssl:") {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(MQTT_TIMEOUT))
+
+	c := &mqttConn{w: conn, r: bufio.NewReader(conn)}
+	if err := c.connect(p.conf); err != nil {
+		return err
+	}
+	base := p.conf.TopicPrefix + "/" + mqttTopicLevel(ev.Server)
+	if err := c.publish(base+"/event", payload, p.conf.QoS, false); err != nil {
+		return err
+	}
+	if ev.Event == MQTTStarted || ev.Event == MQTTCompleted || ev.Event == MQTTFailed {
+		if err := c.publish(base+"/state", payload, p.conf.QoS, true); err != nil {
+			return err
+		}
+	}
+	return c.disconnect()
+}
+
+// Makes a server name safe to use as one level of a topic.
+func mqttTopicLevel(name string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(name)
+}
+
+// The few packets of MQTT 3.1.1 needed to publish, written by hand to keep
+// mcbk free of third-party dependencies.
+type mqttConn struct {
+	w      io.Writer
+	r      *bufio.Reader
+	nextID uint16
+}
+
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttDisconnect = 0xe0
+)
+
+func (c *mqttConn) connect(conf MQTTConfig) error {
+	var body bytes.Buffer
+	mqttString(&body, "MQTT")
+	body.WriteByte(4)   //Protocol level of 3.1.1
+	flags := byte(0x02) //Clean session
+	if conf.Username != "" {
+		flags |= 0x80
+	}
+	if conf.Password != "" {
+		flags |= 0x40
+	}
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(60)) //Keep alive, in seconds
+	mqttString(&body, conf.ClientID)
+	if conf.Username != "" {
+		mqttString(&body, conf.Username)
+	}
+	if conf.Password != "" {
+		mqttString(&body, conf.Password)
+	}
+	if err := c.send(mqttConnect, body.Bytes()); err != nil {
+		return err
+	}
+	kind, resp, err := c.receive()
+	if err != nil {
+		return fmt.Errorf("waiting for the broker to accept the connection: %w", err)
+	}
+	if kind != mqttConnack || len(resp) != 2 {
+		return fmt.Errorf("unexpected packet type %#x from the broker, expected CONNACK", kind)
+	}
+	switch resp[1] {
+	case 0:
+		return nil
+	case 4, 5:
+		return errors.New("the broker refused the connection: bad username or password, or not authorized")
+	default:
+		return fmt.Errorf("the broker refused the connection with code %d", resp[1])
+	}
+}
+
+func (c *mqttConn) publish(topic string, payload []byte, qos int, retain bool) error {
+	var body bytes.Buffer
+	mqttString(&body, topic)
+	kind := byte(mqttPublish | qos<<1)
+	if retain {
+		kind |= 0x01
+	}
+	c.nextID++
+	if qos > 0 {
+		binary.Write(&body, binary.BigEndian, c.nextID)
+	}
+	body.Write(payload)
+	if err := c.send(kind, body.Bytes()); err != nil {
+		return err
+	}
+	if qos == 0 {
+		return nil
+	}
+	kind, resp, err := c.receive()
+	if err != nil {
+		return fmt.Errorf("waiting for the broker to confirm %s: %w", topic, err)
+	}
+	if kind != mqttPuback || len(resp) != 2 || binary.BigEndian.Uint16(resp) != c.nextID {
+		return fmt.Errorf("unexpected packet type %#x from the broker, expected PUBACK", kind)
+	}
+	return nil
+}
+
+func (c *mqttConn) disconnect() error {
+	return c.send(mqttDisconnect, nil)
+}
+
+// Writes a packet: its type and flags, the remaining length and the body.
+func (c *mqttConn) send(kind byte, body []byte) error {
+	packet := []byte{kind}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := c.w.Write(append(packet, body...))
+	return err
+}
+
+// Reads a packet, returning its type without the flags, and its body.
+func (c *mqttConn) receive() (byte, []byte, error) {
+	kind, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("malformed packet length from the broker")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return kind & 0xf0, body, nil
+}
+
+// Writes s as MQTT's length-prefixed UTF-8 string.
+func mqttString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
@@ -0,0 +1,251 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+const DEFAULT_NETWORK_NAME = "network" //Name of the network when network.name isn't set
+
+// Settings for backing up the servers behind a Velocity or BungeeCord proxy
+// as one network, for "mcbk network".
+type NetworkConfig struct {
+	Name    string      `json:"name"`    //Name of the network in logs and reports, default "network"
+	Servers []string    `json:"servers"` //Profiles of the backend servers, in the order they are backed up; default every profile
+	Proxy   ProxyConfig `json:"proxy"`   //The proxy's console, for messages to every player on the network
+}
+
+// How to reach the console of the proxy in front of the servers. Only
+// broadcasts are sent to it, so they aren't verified and no log is needed.
+type ProxyConfig struct {
+	Software         string      `json:"software"`          //"velocity" or "bungeecord"
+	Transport        string      `json:"transport"`         //How commands reach the proxy: "screen", "tmux", "rcon" or "stdin"; empty to send no messages
+	ScreenSession    string      `json:"screen_session"`    //Session the proxy runs in, for screen
+	Tmux             TmuxConfig  `json:"tmux"`              //Pane the proxy runs in, for tmux
+	RCON             RCONConfig  `json:"rcon"`              //Connection to a proxy rcon plugin, for rcon
+	Stdin            StdinConfig `json:"stdin"`             //Pipe to the proxy's standard input, for stdin
+	BroadcastCommand string      `json:"broadcast_command"` //Command the message is sent with, default "alert" on bungeecord; velocity has none built in, so name a plugin's
+	StartMessage     string      `json:"start_message"`     //Sent before the first server is backed up, default "Network backup starting..."
+	FinishMessage    string      `json:"finish_message"`    //Sent after the last one, default "Network backup complete."
+}
+
+func (c *NetworkConfig) setDefaults() {
+	if c.Name == "" {
+		c.Name = DEFAULT_NETWORK_NAME
+	}
+	p := &c.Proxy
+	if p.BroadcastCommand == "" && p.Software == "bungeecord" {
+		p.BroadcastCommand = "alert"
+	}
+	if p.StartMessage == "" {
+		p.StartMessage = "Network backup starting..."
+	}
+	if p.FinishMessage == "" {
+		p.FinishMessage = "Network backup complete."
+	}
+	if p.RCON.Host == "" {
+		p.RCON.Host = "localhost"
+	}
+}
+
+// Checks the network against the server profiles it names.
+func (c NetworkConfig) validate(servers []ServerConfig) []error {
+	var errs []error
+	seen := map[string]bool{}
+	for _, name := range c.Servers {
+		if !slices.ContainsFunc(servers, func(s ServerConfig) bool { return s.Name == name }) {
+			errs = append(errs, fmt.Errorf("network.servers: no server named %q", name))
+		} else if seen[name] {
+			errs = append(errs, fmt.Errorf("network.servers: %q is listed twice", name))
+		}
+		seen[name] = true
+	}
+	p := c.Proxy
+	switch p.Software {
+	case "", "velocity", "bungeecord":
+	default:
+		errs = append(errs, fmt.Errorf("unknown network.proxy.software %q, expected \"velocity\" or \"bungeecord\"", p.Software))
+	}
+	type setting struct {
+		key, value string
+	}
+	var required []setting
+	switch p.Transport {
+	case "":
+		return errs
+	case "screen":
+		required = append(required, setting{"network.proxy.screen_session", p.ScreenSession})
+	case "tmux":
+		required = append(required, setting{"network.proxy.tmux.session", p.Tmux.Session})
+	case "rcon":
+		required = append(required, setting{"network.proxy.rcon.password", p.RCON.Password})
+		//No default, the backends' rcon usually has 25575
+		if p.RCON.Port < 1 || p.RCON.Port > 65535 {
+			errs = append(errs, fmt.Errorf("network.proxy.rcon.port %d is out of range", p.RCON.Port))
+		}
+	case "stdin":
+		required = append(required, setting{"network.proxy.stdin.path", p.Stdin.Path})
+	default:
+		errs = append(errs, fmt.Errorf("unknown network.proxy.transport %q, expected \"screen\", \"tmux\", \"rcon\" or \"stdin\"", p.Transport))
+	}
+	if runtime.GOOS == "windows" && (p.Transport == "screen" || p.Transport == "tmux") {
+		errs = append(errs, fmt.Errorf("the %s transport isn't supported on Windows, use rcon or stdin", p.Transport))
+	}
+	if p.BroadcastCommand == "" {
+		errs = append(errs, errors.New("network.proxy needs broadcast_command, the command of a broadcast plugin for velocity, e.g. \"broadcast\""))
+	}
+	for _, r := range required {
+		if r.value == "" {
+			errs = append(errs, fmt.Errorf("missing required setting %q", r.key))
+		}
+	}
+	return errs
+}
+
+// The servers of a network and the proxy in front of them.
+type Network struct {
+	conf    NetworkConfig
+	servers []*Server
+	proxy   Transport //Nil if no proxy.transport is set
+	logger  *slog.Logger
+}
+
+// Sets up a network of the given servers, in the order they should be
+// backed up, reaching the proxy as configured. Messages are logged to
+// logger, or slog's default logger if it is nil.
+func NewNetwork(c NetworkConfig, servers []*Server, logger *slog.Logger) (*Network, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	n := &Network{conf: c, servers: servers, logger: logger.With("network", c.Name)}
+	if c.Proxy.Transport != "" {
+		p := c.Proxy
+		t, err := NewTransport(ServerConfig{Transport: p.Transport, ScreenSession: p.ScreenSession, Tmux: p.Tmux, RCON: p.RCON, Stdin: p.Stdin,
+			VerifyTimeout: Duration{10 * time.Second}})
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		n.proxy = t
+	}
+	return n, nil
+}
+
+// The network's name.
+func (n *Network) Name() string {
+	return n.conf.Name
+}
+
+// Sends a message to every player on the network through the proxy, if one
+// is configured. Delivery isn't verified, and failing to reach the proxy
+// doesn't stop the backups.
+func (n *Network) broadcast(ctx context.Context, msg string) {
+	if n.proxy == nil {
+		return
+	}
+	if err := n.proxy.Send(ctx, n.conf.Proxy.BroadcastCommand+" "+msg); err != nil {
+		n.logger.Warn("Error sending a message through the proxy", "phase", "broadcast", "error", err)
+	}
+}
+
+// The outcome of backing up every server of a network.
+type NetworkReport struct {
+	Network string          `json:"network"`
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Servers []HistoryRecord `json:"servers"` //One run per server, in the order they were backed up
+}
+
+// How many of the servers weren't backed up. Skipped servers count too,
+// unless they were skipped as intended, outside backup_window or while idle.
+func (r NetworkReport) Failed() int {
+	failed := 0
+	for _, rec := range r.Servers {
+		if rec.Status != "success" && rec.Phase != "window" && rec.Phase != "idle-check" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// One line per server, e.g. "lobby: success, 1.2 GiB in 12s".
+func (r NetworkReport) String() string {
+	var b strings.Builder
+	for _, rec := range r.Servers {
+		fmt.Fprintf(&b, "%s: %s", rec.Server, rec.Status)
+		if rec.Status == "success" {
+			fmt.Fprintf(&b, ", %s in %s", FormatBytes(rec.Bytes), rec.End.Sub(rec.Start).Round(time.Second))
+		}
+		if rec.Error != "" {
+			b.WriteString(": " + rec.Error)
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Backs up the servers of a network one at a time, each as Backup would,
+// with a message through the proxy before the first and after the last.
+// Once every server is done, the results are logged and sent as a single
+// network_report notification. If ctx is cancelled, the servers not yet
+// backed up are reported as cancelled.
+func (r *Runner) BackupNetwork(ctx context.Context, n *Network) NetworkReport {
+	report := NetworkReport{Network: n.conf.Name, Start: time.Now()}
+	n.logger.Info("Starting network backup", "phase", "network", "servers", len(n.servers))
+	if n.proxy != nil {
+		defer n.proxy.Close()
+	}
+	n.broadcast(ctx, n.conf.Proxy.StartMessage)
+	for _, s := range n.servers {
+		start := time.Now()
+		if ctx.Err() != nil {
+			report.Servers = append(report.Servers, HistoryRecord{Server: s.conf.Name, Start: start, End: start, Status: "cancelled", Error: "network backup cancelled"})
+			continue
+		}
+		err := r.Backup(ctx, s)
+		report.Servers = append(report.Servers, s.lastRun(start, err))
+	}
+	report.End = time.Now()
+	//The proxy may be shutting down too
+	if ctx.Err() == nil {
+		n.broadcast(ctx, n.conf.Proxy.FinishMessage)
+	}
+
+	failed := report.Failed()
+	ev := Event{Kind: EventNetworkReport, Server: n.conf.Name, Time: report.End, Duration: report.End.Sub(report.Start), Report: report.String()}
+	if failed > 0 {
+		ev.Err = fmt.Errorf("%d of %d servers not backed up", failed, len(report.Servers))
+		n.logger.Error("Network backup finished with failures", "phase", "network", "duration", ev.Duration, "servers", len(report.Servers), "failed", failed)
+	} else {
+		n.logger.Info("Network backup complete", "phase", "network", "duration", ev.Duration, "servers", len(report.Servers))
+	}
+	for _, no := range r.Notifiers {
+		if err := no.Notify(ev); err != nil {
+			n.logger.Warn("Error sending notification", "phase", "notify", "event", ev.Kind, "error", err)
+		}
+	}
+	return report
+}
+
+// The history record of the run started at start, or if it left none,
+// e.g. because another run held the lock, one made up from its error.
+func (s *Server) lastRun(start time.Time, err error) HistoryRecord {
+	if history, herr := s.History(); herr == nil && len(history) > 0 {
+		if rec := history[len(history)-1]; !rec.Start.Before(start) {
+			return rec
+		}
+	}
+	rec := HistoryRecord{Server: s.conf.Name, Start: start, End: time.Now(), Status: "success"}
+	if err != nil {
+		rec.Status, rec.Error = "failure", err.Error()
+		if errors.Is(err, ErrBackupInProgress) {
+			rec.Status = "skipped"
+		}
+	}
+	return rec
+}
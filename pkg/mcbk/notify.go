@@ -0,0 +1,129 @@
+package mcbk
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// The points in a run that can trigger a notification.
+type EventKind string
+
+const (
+	EventStart   EventKind = "start"
+	EventSuccess EventKind = "success"
+	EventFailure EventKind = "failure"
+
+	EventReplicationFailure EventKind = "replication_failure" //Syncing to an rclone remote failed after a successful backup
+	EventSizeAnomaly        EventKind = "size_anomaly"        //The files to back up are far smaller than usual
+	EventSourceCorrupt      EventKind = "source_corrupt"      //source_check found the world files damaged, and they were backed up anyway
+	EventNetworkReport      EventKind = "network_report"      //Every server of a network has been backed up, or has failed to be
+	EventOverdue            EventKind = "overdue"             //No backup has succeeded for longer than watchdog.max_age
+)
+
+// Describes something that happened during a backup run.
+type Event struct {
+	Kind     EventKind
+	Server   string //Name of the server profile
+	Time     time.Time
+	Duration time.Duration //Time since the run started, for success and failure; for overdue, since the last successful backup
+	Snapshot Snapshot      //The new snapshot, for success and source_corrupt
+	Err      error         //What went wrong, for failure, replication_failure, size_anomaly, source_corrupt and overdue; for network_report, how many servers failed
+	Remote   string        //The rclone remote, for replication_failure
+	Report   string        //The outcome for each server, one per line, for network_report
+}
+
+// A destination for backup notifications.
+type Notifier interface {
+	Notify(ev Event) error
+}
+
+// Settings for one notification destination.
+type NotifyConfig struct {
+	Type     string        `json:"type"`                    //Kind of destination: "discord", "slack", "telegram", "email", "webhook", "ntfy" or "pushover"
+	URL      string        `json:"url" secret:"true"`       //Webhook URL for discord, slack and webhook, topic URL for ntfy; for telegram and pushover, an optional API server
+	BotToken string        `json:"bot_token" secret:"true"` //Telegram bot token
+	ChatID   int64         `json:"chat_id"`                 //Telegram chat to post to
+	SMTP     SMTPConfig    `json:"smtp"`                    //Mail server and message settings for email
+	Webhook  WebhookConfig `json:"webhook"`                 //Request settings for webhook
+	Push     PushConfig    `json:"push"`                    //Credentials and priorities for ntfy and pushover
+	Slack    SlackConfig   `json:"slack"`                   //Failure mentions for slack
+	Events   []EventKind   `json:"events"`                  //Which events to send, defaults to all but start
+}
+
+// Shared client so a slow webhook can't hang the run.
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// Builds the configured notifiers. Each one only passes on the events it
+// was configured for.
+func NewNotifiers(confs []NotifyConfig) ([]Notifier, error) {
+	var notifiers []Notifier
+	for i, c := range confs {
+		var n Notifier
+		switch c.Type {
+		case "discord":
+			n = &discordNotifier{url: c.URL}
+		case "slack":
+			n = &slackNotifier{url: c.URL, conf: c.Slack}
+		case "telegram":
+			n = &telegramNotifier{client: newTelegramClient(c.URL, c.BotToken), chat: c.ChatID}
+		case "email":
+			n = &emailNotifier{conf: c.SMTP}
+		case "webhook":
+			n = &webhookNotifier{url: c.URL, conf: c.Webhook}
+		case "ntfy":
+			n = &ntfyNotifier{url: c.URL, conf: c.Push}
+		case "pushover":
+			n = &pushoverNotifier{url: cmp.Or(c.URL, PUSHOVER_API_URL), conf: c.Push}
+		default:
+			return nil, fmt.Errorf("notify[%d]: unknown type %q", i, c.Type)
+		}
+		events := c.Events
+		if len(events) == 0 {
+			events = []EventKind{EventSuccess, EventFailure, EventReplicationFailure, EventSizeAnomaly, EventSourceCorrupt, EventNetworkReport, EventOverdue}
+		}
+		notifiers = append(notifiers, &filteredNotifier{name: c.Type, events: events, next: n})
+	}
+	return notifiers, nil
+}
+
+// A notifier together with the events it wants to hear about.
+type filteredNotifier struct {
+	name   string
+	events []EventKind
+	next   Notifier
+}
+
+func (f *filteredNotifier) Notify(ev Event) error {
+	if !slices.Contains(f.events, ev.Kind) {
+		return nil
+	}
+	if err := f.next.Notify(ev); err != nil {
+		return fmt.Errorf("%s: %w", f.name, err)
+	}
+	return nil
+}
+
+// What ev.Server names: a network for network_report, otherwise a server.
+func sourceLabel(ev Event) string {
+	if ev.Kind == EventNetworkReport {
+		return "Network"
+	}
+	return "Server"
+}
+
+// Formats a byte count for humans, e.g. 1.5 GiB.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package mcbk
+
+const DEFAULT_CONFIG_PATH = "/etc/mcbk.toml"
+
+// Defaults for settings whose natural choice depends on the OS.
+const (
+	DEFAULT_BACKEND   = "dedup"
+	DEFAULT_TRANSPORT = "screen"
+)
+
+// The default backend before dedup, still used by servers that leave
+// backend unset and already have its backups.
+const LEGACY_DEFAULT_BACKEND = "bup"
+
+// How hook commands are run.
+var hookShell = []string{"sh", "-c"}
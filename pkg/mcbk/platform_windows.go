@@ -0,0 +1,17 @@
+package mcbk
+
+const DEFAULT_CONFIG_PATH = `C:\ProgramData\mcbk\mcbk.toml`
+
+// Defaults for settings whose natural choice depends on the OS. bup, borg,
+// screen and tmux aren't available natively on Windows.
+const (
+	DEFAULT_BACKEND   = "dedup"
+	DEFAULT_TRANSPORT = "rcon"
+)
+
+// The default backend before dedup, still used by servers that leave
+// backend unset and already have its backups.
+const LEGACY_DEFAULT_BACKEND = "tar"
+
+// How hook commands are run.
+var hookShell = []string{"cmd", "/C"}
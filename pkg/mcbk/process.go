@@ -0,0 +1,368 @@
+package mcbk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What "mcbk run" sends first on every connection to its socket, once the
+// connection will see all output from then on.
+const PROCESS_READY_LINE = "mcbk-ready"
+
+// Settings for running the server under "mcbk run", which the process
+// transport sends commands through.
+type ProcessConfig struct {
+	Command     []string `json:"command"`      //Server command line, run in minecraft_dir, e.g. ["java", "-Xmx4G", "-jar", "server.jar", "nogui"]
+	Socket      string   `json:"socket"`       //Where "mcbk run" accepts commands, default <backup_root>/<backup_dir_prefix>.sock
+	StopTimeout Duration `json:"stop_timeout"` //How long to wait for the server to save and exit after "stop" before killing it, default 2m
+}
+
+// The socket "mcbk run" listens on for the server.
+func (c ServerConfig) processSocket() string {
+	if c.Process.Socket != "" {
+		return c.Process.Socket
+	}
+	return filepath.Join(c.BackupRoot, c.BackupDirPrefix+".sock")
+}
+
+// Runs the server as a child process and owns its console: output is copied
+// to mcbk's own standard output and to every client of the socket, and lines
+// typed on mcbk's standard input or sent by a client are written to the
+// server's standard input. This is what the process transport talks to.
+type Supervisor struct {
+	conf   ServerConfig
+	logger *slog.Logger
+
+	mu    sync.Mutex //Held while writing to stdin, so commands don't interleave
+	stdin io.WriteCloser
+
+	subsMu sync.Mutex
+	subs   map[chan string]struct{} //Clients following the output
+	done   chan struct{}            //Closed once the server has exited
+}
+
+// Sets up a supervisor for the server c describes, which must have
+// process.command set.
+func NewSupervisor(c ServerConfig, logger *slog.Logger) *Supervisor {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Supervisor{conf: c, logger: logger.With("server", c.Name, "phase", "supervise"), subs: map[chan string]struct{}{}, done: make(chan struct{})}
+}
+
+// Starts the server and supervises it until it exits, returning its exit
+// error. When ctx is done the server is sent "stop", and killed if it hasn't
+// exited within process.stop_timeout.
+func (v *Supervisor) Run(ctx context.Context, console io.Reader, out io.Writer) error {
+	if len(v.conf.Process.Command) == 0 {
+		return errors.New("process.command isn't set")
+	}
+	listener, err := v.listen()
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	cmd := exec.Command(v.conf.Process.Command[0], v.conf.Process.Command[1:]...)
+	cmd.Dir = v.conf.MinecraftDir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	//One pipe for both, so lines from either aren't split
+	cmd.Stderr = cmd.Stdout
+	v.stdin = stdin
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting the server: %w", err)
+	}
+	v.logger.Info("Server started", "pid", cmd.Process.Pid, "command", v.conf.Process.Command, "socket", listener.Addr().String())
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		v.copyOutput(output, out)
+	}()
+	go v.accept(listener)
+	go v.forward(console)
+
+	exited := make(chan error, 1)
+	go func() {
+		<-copied
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		v.logger.Info("Stopping the server", "timeout", v.conf.Process.StopTimeout)
+		if err := v.write("stop"); err != nil {
+			v.logger.Warn("Error sending stop to the server", "error", err)
+		}
+		select {
+		case err = <-exited:
+		case <-time.After(v.conf.Process.StopTimeout.Duration):
+			v.logger.Error("Server didn't stop in time, killing it")
+			cmd.Process.Kill()
+			err = <-exited
+		}
+	}
+	close(v.done)
+	if err != nil {
+		v.logger.Error("Server exited", "error", err)
+	} else {
+		v.logger.Info("Server exited")
+	}
+	return err
+}
+
+// Listens on the server's socket, replacing a stale one left behind by a
+// supervisor that crashed, but not one that is still in use. Only the user
+// mcbk runs as may connect, since commands sent through it run as an op.
+func (v *Supervisor) listen() (net.Listener, error) {
+	path := v.conf.processSocket()
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("the server is already being run, %s is in use", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Copies the server's output to out line by line, handing each line to the
+// clients following it as well.
+func (v *Supervisor) copyOutput(output io.Reader, out io.Writer) {
+	r := bufio.NewReader(output)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			io.WriteString(out, line)
+			v.publish(strings.TrimRight(line, "\r\n"))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (v *Supervisor) publish(line string) {
+	v.subsMu.Lock()
+	defer v.subsMu.Unlock()
+	for sub := range v.subs {
+		select {
+		case sub <- line:
+		default:
+			//A client that can't keep up misses lines rather than holding up the server
+		}
+	}
+}
+
+func (v *Supervisor) subscribe() chan string {
+	sub := make(chan string, 1024)
+	v.subsMu.Lock()
+	v.subs[sub] = struct{}{}
+	v.subsMu.Unlock()
+	return sub
+}
+
+func (v *Supervisor) unsubscribe(sub chan string) {
+	v.subsMu.Lock()
+	delete(v.subs, sub)
+	v.subsMu.Unlock()
+}
+
+// Writes a command to the server's console.
+func (v *Supervisor) write(command string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, err := io.WriteString(v.stdin, command+"\n")
+	return err
+}
+
+// Passes what is typed on mcbk's console on to the server's, so it can
+// still be used by hand.
+func (v *Supervisor) forward(console io.Reader) {
+	if console == nil {
+		return
+	}
+	scanner := bufio.NewScanner(console)
+	for scanner.Scan() {
+		if err := v.write(scanner.Text()); err != nil {
+			return
+		}
+	}
+}
+
+func (v *Supervisor) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go v.serve(conn)
+	}
+}
+
+// Handles one client. It sends a line holding a command, or nothing to only
+// follow the output, and then gets PROCESS_READY_LINE and every line the
+// server prints until either side hangs up.
+func (v *Supervisor) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	sub := v.subscribe()
+	defer v.unsubscribe(sub)
+	if _, err := io.WriteString(conn, PROCESS_READY_LINE+"\n"); err != nil {
+		return
+	}
+	if command = strings.TrimRight(command, "\r\n"); command != "" {
+		if err := v.write(command); err != nil {
+			v.logger.Warn("Error writing a command to the server", "error", err)
+			return
+		}
+	}
+
+	hungUp := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, r)
+		close(hungUp)
+	}()
+	for {
+		select {
+		case line := <-sub:
+			if _, err := io.WriteString(conn, line+"\n"); err != nil {
+				return
+			}
+		case <-hungUp:
+			return
+		case <-v.done:
+			return
+		}
+	}
+}
+
+// Sends commands to a server run by "mcbk run" through its socket, and
+// follows the server's output there to confirm them, so neither the server
+// log nor RCON is needed.
+type processTransport struct {
+	socket string
+}
+
+func (t *processTransport) Send(ctx context.Context, command string) error {
+	f, err := t.follow(ctx, command)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (t *processTransport) Close() error {
+	return nil
+}
+
+// Connects to the supervisor, sends command if it isn't empty, and returns a
+// follower of the output from then on.
+func (t *processTransport) follow(ctx context.Context, command string) (*processFollower, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", t.socket)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to mcbk run: %w", err)
+	}
+	f := &processFollower{conn: conn, r: bufio.NewReader(conn)}
+	if _, err := io.WriteString(conn, command+"\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	//Wait until the supervisor is sure to pass on everything printed from now on
+	err = f.waitFor(ctx, func(line string) bool { return line == PROCESS_READY_LINE })
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reads the output of a server run by "mcbk run" from its socket, like
+// logFollower does from the log.
+type processFollower struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	partial string
+}
+
+// Calls match for every new complete line until it returns true, ctx is
+// done, or the connection is lost.
+func (f *processFollower) waitFor(ctx context.Context, match func(line string) bool) error {
+	f.conn.SetReadDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() {
+		f.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	for {
+		line, err := f.r.ReadString('\n')
+		f.partial += line
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return errors.New("mcbk run closed the connection, the server may have stopped")
+			}
+			return err
+		}
+		line, f.partial = strings.TrimRight(f.partial, "\r\n"), ""
+		if match(line) {
+			return nil
+		}
+	}
+}
+
+func (f *processFollower) Close() error {
+	return f.conn.Close()
+}
+
+// Where the server's console output can be followed.
+type consoleFollower interface {
+	waitFor(ctx context.Context, match func(line string) bool) error
+	Close() error
+}
+
+// Starts following the server's console output: the output stream of
+// "mcbk run" with the process transport, otherwise the server log.
+func (s *Server) followConsole(ctx context.Context) (consoleFollower, error) {
+	if t, ok := s.transport.(*processTransport); ok {
+		return t.follow(ctx, "")
+	}
+	return followLog(s.conf.MinecraftLogPath)
+}
@@ -0,0 +1,117 @@
+package mcbk
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	PROGRESS_INTERVAL = time.Second //How often the progress of a backup is passed on while it runs
+	PROGRESS_LOG_STEP = 25          //Percentage steps logged as a backup goes
+)
+
+// How far the backend has got saving a backup.
+type Progress struct {
+	Server  string  `json:"server"`
+	Bytes   int64   `json:"bytes"`   //Bytes of the files to back up read so far
+	Total   int64   `json:"total"`   //Bytes to read in all, 0 if not known
+	Percent float64 `json:"percent"` //Bytes as a percentage of Total, 0 if not known
+	Done    bool    `json:"done"`    //Set on the last report of a backup, once the backend has finished
+}
+
+type progressKey struct{}
+
+// Follows the progress of one backup, passing it on no more often than
+// PROGRESS_INTERVAL and logging each PROGRESS_LOG_STEP percent.
+type progressTracker struct {
+	mu       sync.Mutex
+	p        Progress
+	total    int64                 //Total used when the backend doesn't know one
+	measure  func() (int64, error) //Totals the files to back up, run once if total is needed but not known
+	logged   int                   //Last percentage logged
+	last     time.Time             //When progress was last passed on
+	finished bool
+	log      *slog.Logger
+	publish  func(Progress)
+}
+
+// Starts following the progress of the backup of s. sourceBytes is the size
+// of the files to back up if the size check measured it, or 0.
+func (r *Runner) trackProgress(ctx context.Context, s *Server, sourceBytes int64) *progressTracker {
+	return &progressTracker{
+		p:     Progress{Server: s.conf.Name},
+		total: sourceBytes,
+		measure: func() (int64, error) {
+			return s.sourceSize(ctx)
+		},
+		log: s.log().With("phase", "backup"),
+		publish: func(p Progress) {
+			r.Metrics.progressed(p)
+			if r.Progress != nil {
+				r.Progress(p)
+			}
+		},
+	}
+}
+
+// Returns ctx carrying t, so the backend can report its progress to it.
+func withProgress(ctx context.Context, t *progressTracker) context.Context {
+	return context.WithValue(ctx, progressKey{}, t)
+}
+
+// Reports that the backend has read done bytes of the total it will read,
+// total being 0 if it can't tell. Then the files to back up are measured
+// instead, which takes a walk over them. Does nothing outside a backup.
+func reportProgress(ctx context.Context, done, total int64) {
+	if t, ok := ctx.Value(progressKey{}).(*progressTracker); ok {
+		t.report(done, total)
+	}
+}
+
+func (t *progressTracker) report(done, total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	if total <= 0 {
+		if t.total == 0 && t.measure != nil {
+			size, err := t.measure()
+			if err != nil {
+				t.log.Debug("Error measuring the files to back up, progress will be shown without a total", "error", err)
+			}
+			t.total, t.measure = size, nil
+		}
+		total = t.total
+	}
+	t.p.Bytes, t.p.Total, t.p.Percent = done, total, 0
+	if total > 0 {
+		t.p.Percent = min(100, float64(done)*100/float64(total))
+	}
+	//The end of the backup is logged anyway
+	if step := int(t.p.Percent) / PROGRESS_LOG_STEP * PROGRESS_LOG_STEP; step > t.logged && step < 100 {
+		t.logged = step
+		t.log.Info("Backup progress", "percent", step, "bytes", done, "total", total)
+	}
+	if time.Since(t.last) >= PROGRESS_INTERVAL {
+		t.last = time.Now()
+		t.publish(t.p)
+	}
+}
+
+// Passes on the last report once the backend has finished, and ignores any
+// that come after.
+func (t *progressTracker) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.finished = true
+	if !t.last.IsZero() {
+		t.p.Done = true
+		t.publish(t.p)
+	}
+}
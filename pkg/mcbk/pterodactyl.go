@@ -0,0 +1,71 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Settings for the pterodactyl transport, which sends commands through a
+// Pterodactyl panel's client API.
+type PterodactylConfig struct {
+	URL    string `json:"url"`                   //Address of the panel, e.g. "https://panel.example.com"
+	APIKey string `json:"api_key" secret:"true"` //Client API key from Account > API Credentials, "ptlc_..."
+	Server string `json:"server"`                //Identifier of the server, as in its panel URL, e.g. "1a7ce997"
+}
+
+func (c PterodactylConfig) validate() error {
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("pterodactyl.url must be the panel's http(s) address, got %q", c.URL)
+	}
+	if c.APIKey == "" || c.Server == "" {
+		return errors.New("pterodactyl needs api_key and server")
+	}
+	return nil
+}
+
+// Sends console commands through the panel, for servers run by Wings. The
+// panel doesn't return a command's output, so commands are confirmed
+// through the server log, which lives in the server's volume on the node.
+type pterodactylTransport struct {
+	conf PterodactylConfig
+}
+
+func (t *pterodactylTransport) Send(ctx context.Context, command string) error {
+	body, err := json.Marshal(map[string]string{"command": command})
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimSuffix(t.conf.URL, "/") + "/api/client/servers/" + url.PathEscape(t.conf.Server) + "/command"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.conf.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusBadGateway:
+		//Wings refuses commands while the server is stopped
+		return errors.New("pterodactyl: the server is offline")
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("pterodactyl returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (t *pterodactylTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,159 @@
+package mcbk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const PUSHOVER_API_URL = "https://api.pushover.net/1/messages.json"
+
+// Pushover repeats emergency-priority messages until acknowledged
+const (
+	PUSHOVER_EMERGENCY_RETRY  = 60   //Seconds between repeats
+	PUSHOVER_EMERGENCY_EXPIRE = 3600 //Seconds before giving up
+)
+
+// Settings for push notifications through ntfy or Pushover. Failures are
+// sent at a higher priority than other events, so they can be made to
+// break through do-not-disturb while successes stay quiet.
+type PushConfig struct {
+	Token           string `json:"token" secret:"true"` //ntfy access token, if the topic needs one, or the Pushover application token
+	User            string `json:"user" secret:"true"`  //Pushover user or group key
+	Priority        *int   `json:"priority"`            //Priority of start and success events: ntfy 1-5, default 3; Pushover -2 to 2, default 0
+	FailurePriority *int   `json:"failure_priority"`    //Priority of failure, replication_failure, size_anomaly and source_corrupt events: default 5 for ntfy, 1 for Pushover
+}
+
+// Fills in the priorities for the given notify type.
+func (c *PushConfig) setDefaults(kind string) {
+	normal, failure := 3, 5
+	if kind == "pushover" {
+		normal, failure = 0, 1
+	}
+	if c.Priority == nil {
+		c.Priority = &normal
+	}
+	if c.FailurePriority == nil {
+		c.FailurePriority = &failure
+	}
+}
+
+func (c *PushConfig) validate(kind, rawURL string) []error {
+	var errs []error
+	low, high := 1, 5
+	switch kind {
+	case "ntfy":
+		if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path == "" {
+			errs = append(errs, fmt.Errorf("ntfy needs the topic's http(s) url, got %q", rawURL))
+		}
+	case "pushover":
+		low, high = -2, 2
+		if c.Token == "" || c.User == "" {
+			errs = append(errs, errors.New("pushover needs push.token and push.user"))
+		}
+	}
+	for _, p := range []struct {
+		key   string
+		value int
+	}{{"push.priority", *c.Priority}, {"push.failure_priority", *c.FailurePriority}} {
+		if p.value < low || p.value > high {
+			errs = append(errs, fmt.Errorf("%s must be between %d and %d for %s", p.key, low, high, kind))
+		}
+	}
+	return errs
+}
+
+// The priority to send an event at.
+func (c *PushConfig) priority(ev Event) int {
+	if ev.Kind == EventFailure || ev.Kind == EventReplicationFailure || ev.Kind == EventSizeAnomaly || ev.Kind == EventSourceCorrupt || ev.Kind == EventOverdue ||
+		(ev.Kind == EventNetworkReport && ev.Err != nil) {
+		return *c.FailurePriority
+	}
+	return *c.Priority
+}
+
+// Publishes events to an ntfy topic, on ntfy.sh or a self-hosted server.
+type ntfyNotifier struct {
+	url  string
+	conf PushConfig
+}
+
+func (n *ntfyNotifier) Notify(ev Event) error {
+	data := newWebhookData(ev)
+	req, err := http.NewRequest(http.MethodPost, n.url, strings.NewReader(pushMessage(data)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", "Minecraft backup "+data.Status)
+	req.Header.Set("Priority", strconv.Itoa(n.conf.priority(ev)))
+	switch ev.Kind {
+	case EventSuccess:
+		req.Header.Set("Tags", "white_check_mark")
+	case EventFailure, EventReplicationFailure, EventSizeAnomaly, EventSourceCorrupt, EventOverdue:
+		req.Header.Set("Tags", "warning")
+	case EventNetworkReport:
+		req.Header.Set("Tags", "white_check_mark")
+		if ev.Err != nil {
+			req.Header.Set("Tags", "warning")
+		}
+	}
+	if n.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.conf.Token)
+	}
+	return sendPush(req, "ntfy")
+}
+
+// Sends events to the Pushover apps of a user or group.
+type pushoverNotifier struct {
+	url  string
+	conf PushConfig
+}
+
+func (n *pushoverNotifier) Notify(ev Event) error {
+	data := newWebhookData(ev)
+	priority := n.conf.priority(ev)
+	form := url.Values{
+		"token":     {n.conf.Token},
+		"user":      {n.conf.User},
+		"title":     {"Minecraft backup " + data.Status},
+		"message":   {truncate(pushMessage(data), 1024)},
+		"priority":  {strconv.Itoa(priority)},
+		"timestamp": {strconv.FormatInt(ev.Time.Unix(), 10)},
+	}
+	if priority == 2 {
+		form.Set("retry", strconv.Itoa(PUSHOVER_EMERGENCY_RETRY))
+		form.Set("expire", strconv.Itoa(PUSHOVER_EMERGENCY_EXPIRE))
+	}
+	req, err := http.NewRequest(http.MethodPost, n.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return sendPush(req, "pushover")
+}
+
+// The text of a push message: the summary line, then for network_report
+// the outcome for each server.
+func pushMessage(data webhookData) string {
+	if data.Report != "" {
+		return data.Message + "\n" + data.Report
+	}
+	return data.Message
+}
+
+func sendPush(req *http.Request, service string) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", service, resp.Status, msg)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// A cap on the space the server's backups may take up. After the retention
+// policy has run, the oldest snapshots are removed until the backups fit,
+// so they can't fill a disk shared with the live server.
+type QuotaConfig struct {
+	MaxSize    ByteSize `json:"max_size"`    //Most the backups may take up, e.g. "200GiB". 0 for no limit
+	MaxPercent float64  `json:"max_percent"` //Most the backups may take up as a percentage of the backup disk's size, e.g. 40. 0 for no limit
+}
+
+func (c QuotaConfig) Enabled() bool {
+	return c.MaxSize > 0 || c.MaxPercent > 0
+}
+
+func (c QuotaConfig) validate() []error {
+	var errs []error
+	if c.MaxSize < 0 {
+		errs = append(errs, errors.New("quota.max_size must not be negative"))
+	}
+	if c.MaxPercent < 0 || c.MaxPercent > 100 {
+		errs = append(errs, fmt.Errorf("quota.max_percent must be between 0 and 100, got %g", c.MaxPercent))
+	}
+	return errs
+}
+
+// The directory the server's backups are stored in, or "" if they aren't
+// on this machine.
+func (s *Server) storageDir() string {
+	if store, ok := s.backend.(fileStore); ok {
+		dir, _ := store.Files()
+		return dir
+	}
+	return s.localRepo()
+}
+
+// The number of bytes the backups may take up: the smaller of max_size and
+// max_percent of the backup disk.
+func (s *Server) quotaLimit() (int64, error) {
+	limit := int64(s.conf.Quota.MaxSize)
+	if s.conf.Quota.MaxPercent > 0 {
+		dir := s.storageDir()
+		total, err := diskSize(existingParent(dir))
+		if err != nil {
+			return 0, fmt.Errorf("finding the size of the disk holding %s: %w", dir, err)
+		}
+		byPercent := int64(s.conf.Quota.MaxPercent / 100 * float64(total))
+		if limit == 0 || byPercent < limit {
+			limit = byPercent
+		}
+	}
+	return limit, nil
+}
+
+// Removes the oldest snapshots, one at a time, until the backups fit the
+// quota. Usage is measured again after each removal, as deduplicating
+// backends free an unpredictable amount. The newest snapshot and tagged,
+// pinned and keep_first ones are never removed; if they alone are over the
+// quota, an error says so.
+func (s *Server) enforceQuota(ctx context.Context) (int, error) {
+	limit, err := s.quotaLimit()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for {
+		used, _, err := s.diskUsage(ctx)
+		if err != nil {
+			return removed, fmt.Errorf("measuring the backups: %w", err)
+		}
+		if used <= limit {
+			s.log().Debug("Backups are within the quota", "phase", "prune", "used", used, "quota", limit, "removed", removed)
+			return removed, nil
+		}
+		snaps, err := s.Snapshots(ctx)
+		if err != nil {
+			return removed, err
+		}
+		if len(snaps) <= 1 {
+			return removed, fmt.Errorf("the backups take up %s with only the newest snapshot left, over the quota of %s", FormatBytes(used), FormatBytes(limit))
+		}
+		newest := slices.MaxFunc(snaps, func(a, b Snapshot) int {
+			return a.Time.Compare(b.Time)
+		})
+		spared := s.conf.Retention.spared(snaps)
+		candidates := slices.DeleteFunc(snaps, func(snap Snapshot) bool {
+			return snap.ID == newest.ID || containsSnapshot(spared, snap.ID)
+		})
+		if len(candidates) == 0 {
+			return removed, fmt.Errorf("the backups take up %s with only the newest, tagged, pinned and keep_first snapshots left, over the quota of %s", FormatBytes(used), FormatBytes(limit))
+		}
+		oldest := slices.MinFunc(candidates, func(a, b Snapshot) int {
+			return a.Time.Compare(b.Time)
+		})
+		s.log().Info("Removing the oldest snapshot to stay within the quota", "phase", "prune", "snapshot", oldest.ID, "used", used, "quota", limit)
+		if err := s.backend.Delete(ctx, []Snapshot{oldest}); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+}
@@ -0,0 +1,90 @@
+package mcbk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Writes stand-ins for archives, size zero bytes each, into the tar
+// backend's directory, one per TAR_TIME_FORMAT stamp, and returns their
+// names. Listing and pruning only look at the names and sizes.
+func writeTestArchives(t *testing.T, s *Server, size int, stamps ...string) []string {
+	t.Helper()
+	dir, _ := s.backend.(fileStore).Files()
+	var names []string
+	for _, stamp := range stamps {
+		name := "world-" + stamp + ".tar.gz"
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// The IDs of the server's snapshots, oldest first.
+func snapshotIDs(t *testing.T, s *Server) []string {
+	t.Helper()
+	snaps, err := s.Snapshots(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, snap := range snaps {
+		ids = append(ids, snap.ID)
+	}
+	return ids
+}
+
+func TestEnforceQuota(t *testing.T) {
+	stamps := []string{"20240101-120000", "20240102-120000", "20240103-120000", "20240104-120000", "20240105-120000"}
+	for _, tt := range []struct {
+		name    string
+		quota   string
+		tagged  int //Index of a tagged archive, or -1
+		removed int
+		left    []int
+		err     string
+	}{
+		{"within the quota", "max_size = 5000", -1, 0, []int{0, 1, 2, 3, 4}, ""},
+		{"oldest first", "max_size = 2500", -1, 3, []int{3, 4}, ""},
+		{"size with a unit", "max_size = \"2KiB\"", -1, 3, []int{3, 4}, ""},
+		{"tagged snapshots are spared", "max_size = 2500", 0, 3, []int{0, 4}, ""},
+		{"the newest is never removed", "max_size = 500", -1, 4, []int{4}, "only the newest snapshot left"},
+		{"nothing left to remove", "max_size = 1500", 3, 3, []int{3, 4}, "only the newest, tagged, pinned and keep_first snapshots left"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, "[quota]\n"+tt.quota)
+			names := writeTestArchives(t, s, 1000, stamps...)
+			if tt.tagged >= 0 {
+				s.recordHistory(HistoryRecord{Status: "success", Snapshot: names[tt.tagged], Tags: []string{"keep"}})
+			}
+			removed, err := s.enforceQuota(context.Background())
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+			if removed != tt.removed {
+				t.Errorf("removed %d snapshots, want %d", removed, tt.removed)
+			}
+			var want []string
+			for _, i := range tt.left {
+				want = append(want, names[i])
+			}
+			if got := snapshotIDs(t, s); !slices.Equal(got, want) {
+				t.Errorf("left %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestQuotaLimit(t *testing.T) {
+	s := newTestServer(t, "[quota]\nmax_size = 1000\nmax_percent = 100")
+	//The whole disk is more than 1000 bytes, so max_size is the smaller
+	if limit, err := s.quotaLimit(); err != nil || limit != 1000 {
+		t.Errorf("got limit %d, %v, want 1000", limit, err)
+	}
+}
@@ -0,0 +1,71 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// One off-site copy kept in sync with rclone after each successful backup.
+// Any of rclone's remotes can be used (Google Drive, B2, OneDrive, SFTP...)
+// once it has been set up with "rclone config".
+type RcloneConfig struct {
+	Remote  string   `json:"remote"`  //Destination in rclone's remote:path form, e.g. "b2:my-bucket/minecraft"
+	Config  string   `json:"config"`  //rclone config file, default rclone's own
+	BwLimit string   `json:"bwlimit"` //Passed to --bwlimit, e.g. "10M" or "08:00,1M 23:00,off"
+	Flags   []string `json:"flags"`   //Extra rclone arguments, e.g. ["--transfers", "2"]
+}
+
+// Returns the local directory holding the server's backups and the rclone
+// filter arguments selecting its files there, since several profiles can
+// share a backup_root.
+func (s *Server) replicaSource() (string, []string, error) {
+	if store, ok := s.backend.(fileStore); ok {
+		dir, pattern := store.Files()
+		return dir, []string{"--include", "/" + pattern, "--include", "/" + pattern + "/**"}, nil
+	}
+	if dir := s.localRepo(); dir != "" {
+		return dir, nil, nil
+	}
+	return "", nil, fmt.Errorf("the %s repository isn't a local directory rclone could copy", s.conf.Backend)
+}
+
+// Syncs the backups to every configured rclone remote. Each remote is tried
+// even if an earlier one failed; the failures are returned together.
+func (r *Runner) replicate(ctx context.Context, s *Server) error {
+	dir, filters, err := s.replicaSource()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, c := range s.conf.Rclone {
+		s.log().Info("Replicating backups...", "phase", "replicate", "remote", c.Remote)
+		start := time.Now()
+		args := []string{"sync", dir, c.Remote}
+		if c.Config != "" {
+			args = append(args, "--config", c.Config)
+		}
+		if c.BwLimit != "" {
+			args = append(args, "--bwlimit", c.BwLimit)
+		}
+		args = append(args, filters...)
+		_, err := runCommand(ctx, "rclone", append(args, c.Flags...)...)
+		r.Metrics.replicated(s.conf.Name, err)
+		if err != nil {
+			s.log().Error("Error replicating backups", "phase", "replicate", "remote", c.Remote, "duration", time.Since(start), "error", err)
+			r.notify(ctx, s, Event{Kind: EventReplicationFailure, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start), Remote: c.Remote, Err: err})
+			errs = append(errs, fmt.Errorf("%s: %w", c.Remote, err))
+			continue
+		}
+		s.log().Info("Replication complete", "phase", "replicate", "remote", c.Remote, "duration", time.Since(start))
+	}
+	return errors.Join(errs...)
+}
+
+func (c *RcloneConfig) validate() error {
+	if c.Remote == "" {
+		return errors.New("missing remote")
+	}
+	return nil
+}
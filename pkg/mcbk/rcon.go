@@ -0,0 +1,168 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Minecraft RCON packet types
+const (
+	RCON_TYPE_RESPONSE = 0
+	RCON_TYPE_COMMAND  = 2
+	RCON_TYPE_LOGIN    = 3
+
+	RCON_MAX_PAYLOAD = 4096 //Responses longer than this are split over several packets
+)
+
+var errRCONAuth = errors.New("RCON authentication failed, check the password")
+
+// Sends commands over the server's RCON port and reads their responses
+// directly. The connection is opened on first use and reused for the run.
+type rconTransport struct {
+	addr     string
+	password string
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	nextID int32
+}
+
+func newRCONTransport(c RCONConfig, timeout time.Duration) *rconTransport {
+	return &rconTransport{
+		addr:     net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		password: c.Password,
+		timeout:  timeout,
+	}
+}
+
+func (t *rconTransport) Send(ctx context.Context, command string) error {
+	_, err := t.Query(ctx, command)
+	return err
+}
+
+// Runs a command and returns the server's response text.
+func (t *rconTransport) Query(ctx context.Context, command string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		if err := t.connect(ctx); err != nil {
+			return "", err
+		}
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(t.timeout)
+	}
+	t.conn.SetDeadline(deadline)
+	//Cancelling ctx expires the deadline, unblocking any pending read
+	conn := t.conn
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	resp, err := t.exchange(RCON_TYPE_COMMAND, command)
+	if err != nil {
+		//Drop the connection so the next command starts from a clean state
+		t.conn.Close()
+		t.conn = nil
+		return "", err
+	}
+	return resp, nil
+}
+
+func (t *rconTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+// Dials the server and logs in.
+func (t *rconTransport) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	if _, err := t.exchange(RCON_TYPE_LOGIN, t.password); err != nil {
+		conn.Close()
+		t.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Writes one request packet and reads its response, joining responses that
+// the server split over several packets.
+func (t *rconTransport) exchange(kind int32, body string) (string, error) {
+	t.nextID++
+	id := t.nextID
+	if err := writeRCONPacket(t.conn, id, kind, body); err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	for {
+		respID, _, payload, err := readRCONPacket(t.conn)
+		if err != nil {
+			return "", err
+		}
+		if respID == -1 {
+			return "", errRCONAuth
+		}
+		if respID != id {
+			return "", fmt.Errorf("RCON response id %d does not match request id %d", respID, id)
+		}
+		out.Write(payload)
+		if len(payload) < RCON_MAX_PAYLOAD {
+			return out.String(), nil
+		}
+	}
+}
+
+func writeRCONPacket(w io.Writer, id, kind int32, body string) error {
+	var buf bytes.Buffer
+	length := int32(4 + 4 + len(body) + 2)
+	binary.Write(&buf, binary.LittleEndian, length)
+	binary.Write(&buf, binary.LittleEndian, id)
+	binary.Write(&buf, binary.LittleEndian, kind)
+	buf.WriteString(body)
+	buf.Write([]byte{0, 0})
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readRCONPacket(r io.Reader) (id, kind int32, body []byte, err error) {
+	var length int32
+	if err = binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return
+	}
+	if length < 10 || length > RCON_MAX_PAYLOAD+10 {
+		err = fmt.Errorf("invalid RCON packet length %d", length)
+		return
+	}
+	packet := make([]byte, length)
+	if _, err = io.ReadFull(r, packet); err != nil {
+		return
+	}
+	id = int32(binary.LittleEndian.Uint32(packet[0:4]))
+	kind = int32(binary.LittleEndian.Uint32(packet[4:8]))
+	body = bytes.TrimRight(packet[8:], "\x00")
+	return
+}
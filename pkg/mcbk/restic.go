@@ -0,0 +1,277 @@
+package mcbk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const RESTIC_TAG = "mcbk" //Tag applied to our snapshots so a shared repo can hold other data too
+
+// Returns the tag for a server's snapshots. The implicit single server uses
+// the plain tag; named profiles get their own so they can share a repo.
+func resticTag(server string) string {
+	if server == DEFAULT_SERVER_NAME {
+		return RESTIC_TAG
+	}
+	return RESTIC_TAG + "-" + server
+}
+
+// Settings for the restic backend.
+type ResticConfig struct {
+	Repository   string `json:"repository"`             //Anything restic accepts for -r, e.g. /srv/restic or s3:...
+	Password     string `json:"password" secret:"true"` //Repository password
+	PasswordFile string `json:"password_file"`          //Or a file containing it
+	KeepWithin   string `json:"keep_within"`            //Passed to restic forget --keep-within when pruning
+}
+
+// Stores backups as snapshots in a restic repository.
+type resticBackend struct {
+	conf     ResticConfig
+	dir      string
+	tag      string
+	excludes []excludePattern
+	gc       GCConfig
+}
+
+// The restic JSON fields we care about.
+type resticSnapshot struct {
+	ID      string    `json:"id"`
+	ShortID string    `json:"short_id"`
+	Time    time.Time `json:"time"`
+	Summary *struct {
+		TotalBytesProcessed int64 `json:"total_bytes_processed"`
+	} `json:"summary"`
+}
+
+// Runs restic with the repository and password passed through the
+// environment, keeping the password off the command line.
+func (b *resticBackend) restic(ctx context.Context, args ...string) ([]byte, error) {
+	return runCommandEnv(ctx, b.env(), "restic", args...)
+}
+
+// The environment variables restic finds the repository and password in.
+func (b *resticBackend) env() []string {
+	env := []string{"RESTIC_REPOSITORY=" + b.conf.Repository}
+	if b.conf.PasswordFile != "" {
+		env = append(env, "RESTIC_PASSWORD_FILE="+b.conf.PasswordFile)
+	} else {
+		env = append(env, "RESTIC_PASSWORD="+b.conf.Password)
+	}
+	return env
+}
+
+// Initializes the repository if it doesn't exist yet.
+func (b *resticBackend) Init(ctx context.Context) error {
+	if _, err := b.restic(ctx, "cat", "config"); err == nil {
+		return nil
+	}
+	_, err := b.restic(ctx, "init")
+	return err
+}
+
+func (b *resticBackend) Save(ctx context.Context, dir string, paths []string) (Snapshot, error) {
+	args := append([]string{"backup", "--json", "--tag", b.tag}, resticExcludeArgs(b.excludes, dir)...)
+	//restic streams status messages, as often as 60 a second by default, and
+	//ends with a summary
+	env := append(b.env(), "RESTIC_PROGRESS_FPS=1")
+	out, err := runCommandStream(ctx, "", env, func(line string) bool {
+		var status struct {
+			MessageType string `json:"message_type"`
+			TotalBytes  int64  `json:"total_bytes"`
+			BytesDone   int64  `json:"bytes_done"`
+		}
+		if json.Unmarshal([]byte(line), &status) != nil || status.MessageType != "status" {
+			return false
+		}
+		//The total grows until restic has scanned every file
+		if status.TotalBytes > 0 {
+			reportProgress(ctx, status.BytesDone, status.TotalBytes)
+		}
+		return true
+	}, nil, "restic", append(args, absPaths(dir, paths)...)...)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		var msg struct {
+			MessageType string `json:"message_type"`
+			SnapshotID  string `json:"snapshot_id"`
+			DataAdded   int64  `json:"data_added"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &msg) != nil || msg.MessageType != "summary" {
+			continue
+		}
+		id := msg.SnapshotID
+		if len(id) > 8 {
+			id = id[:8]
+		}
+		return Snapshot{ID: id, Time: time.Now(), Repo: b.conf.Repository, Size: msg.DataAdded}, nil
+	}
+	return Snapshot{}, errors.New("restic backup did not report a snapshot")
+}
+
+func (b *resticBackend) List(ctx context.Context) ([]Snapshot, error) {
+	out, err := b.restic(ctx, "snapshots", "--json", "--tag", b.tag)
+	if err != nil {
+		return nil, err
+	}
+	var list []resticSnapshot
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("parsing restic snapshots: %w", err)
+	}
+	snaps := make([]Snapshot, 0, len(list))
+	for _, s := range list {
+		snap := Snapshot{ID: s.ShortID, Time: s.Time, Repo: b.conf.Repository}
+		if s.Summary != nil {
+			snap.Size = s.Summary.TotalBytesProcessed
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Time.Before(snaps[j].Time)
+	})
+	return snaps, nil
+}
+
+func (b *resticBackend) spaceTarget(ctx context.Context) (string, time.Time, error) {
+	return repoSpaceTarget(ctx, localRepoPath(b.conf.Repository), b)
+}
+
+// Restores the contents of the backed up directory into target.
+func (b *resticBackend) Restore(ctx context.Context, id, target string) error {
+	_, err := b.restic(ctx, "restore", id+":"+b.dir, "--target", target)
+	return err
+}
+
+// Restores only the given paths. They are included by absolute path, which
+// restic restores under their full path, so they are moved up afterwards.
+func (b *resticBackend) RestorePaths(ctx context.Context, id, target string, paths []string) error {
+	tmp, err := os.MkdirTemp(target, ".restic-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	args := []string{"restore", id, "--target", tmp}
+	for _, p := range paths {
+		args = append(args, "--include", filepath.ToSlash(filepath.Join(b.dir, p)))
+	}
+	if _, err := b.restic(ctx, args...); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		abs := filepath.Join(b.dir, p)
+		//restic stores C:\dir as /C/dir
+		if vol := filepath.VolumeName(abs); vol != "" {
+			abs = strings.TrimSuffix(vol, ":") + abs[len(vol):]
+		}
+		restored := filepath.Join(tmp, abs)
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(target, p)), 0770); err != nil {
+			return err
+		}
+		if err := os.Rename(restored, filepath.Join(target, p)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lists the files in a snapshot with restic ls.
+func (b *resticBackend) ListFiles(ctx context.Context, id string) ([]SnapshotFile, error) {
+	out, err := b.restic(ctx, "ls", "--json", id)
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.ToSlash(b.dir) + "/"
+	var files []SnapshotFile
+	//The first line describes the snapshot, the rest are its nodes
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		var node struct {
+			Type  string    `json:"type"`
+			Path  string    `json:"path"`
+			Size  int64     `json:"size"`
+			MTime time.Time `json:"mtime"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &node) != nil || node.Type == "dir" || node.Path == "" {
+			continue
+		}
+		rel, ok := strings.CutPrefix(node.Path, root)
+		if !ok {
+			continue
+		}
+		files = append(files, SnapshotFile{Path: rel, Size: node.Size, ModTime: node.MTime.Truncate(time.Second)})
+	}
+	return files, scanner.Err()
+}
+
+// Forgets snapshots older than keep_within and prunes unreferenced data.
+func (b *resticBackend) Prune(ctx context.Context) error {
+	_, err := b.restic(ctx, b.forgetArgs("--tag", b.tag, "--keep-within", b.conf.KeepWithin)...)
+	return err
+}
+
+// Forgets snapshots older than keep_within like Prune, except the spared
+// ones. restic can't be told to keep particular snapshots, so it is asked
+// which it would forget, and the rest of those are deleted.
+func (b *resticBackend) PruneSparing(ctx context.Context, spared []Snapshot) error {
+	out, err := b.restic(ctx, "forget", "--dry-run", "--json", "--tag", b.tag, "--keep-within", b.conf.KeepWithin)
+	if err != nil {
+		return err
+	}
+	var groups []struct {
+		Remove []resticSnapshot `json:"remove"`
+	}
+	if err := json.Unmarshal(out, &groups); err != nil {
+		return fmt.Errorf("parsing restic forget output: %w", err)
+	}
+	var remove []Snapshot
+	for _, g := range groups {
+		for _, s := range g.Remove {
+			if !containsSnapshot(spared, s.ShortID) {
+				remove = append(remove, Snapshot{ID: s.ShortID})
+			}
+		}
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+	return b.Delete(ctx, remove)
+}
+
+// Forgets the given snapshots and prunes the data only they referenced.
+func (b *resticBackend) Delete(ctx context.Context, snaps []Snapshot) error {
+	var ids []string
+	for _, s := range snaps {
+		ids = append(ids, s.ID)
+	}
+	_, err := b.restic(ctx, b.forgetArgs(ids...)...)
+	return err
+}
+
+// Arguments for restic forget, pruning the forgotten data unless gc.skip
+// is set.
+func (b *resticBackend) forgetArgs(args ...string) []string {
+	forget := []string{"forget"}
+	if !b.gc.Skip {
+		forget = append(forget, "--prune")
+		forget = append(forget, b.gc.thresholdArgs("--max-unused", "%")...)
+	}
+	return append(forget, args...)
+}
+
+// Checks the repository's structure. Reading back all the data as well
+// would download the whole repository, so that is left to the user.
+func (b *resticBackend) Check(ctx context.Context, snap Snapshot) error {
+	_, err := b.restic(ctx, "check")
+	return err
+}
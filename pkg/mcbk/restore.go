@@ -0,0 +1,193 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Implemented by backends that can restore part of a snapshot without
+// restoring all of it.
+type pathRestorer interface {
+	//Restores only the given paths, relative to the backed up directory,
+	//to the same places under target
+	RestorePaths(ctx context.Context, id, target string, paths []string) error
+}
+
+// Returned by RestorePaths when asked to restore into a world the server
+// has open, which would overwrite the restored files on its next save.
+var ErrWorldInUse = errors.New("the server has the world open; stop it first or restore to another directory")
+
+var playerUUIDRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Restores from a snapshot like RestorePaths, under the server's lock so a
+// backup can't capture the world half restored. id may be "latest". With
+// restart the server is stopped first and started again afterwards, even
+// if restoring failed, as the files are then left as they were. Returns
+// the ID of the snapshot restored.
+func (s *Server) Restore(ctx context.Context, id string, paths []string, target string, restart bool) (_ string, err error) {
+	unlock, err := s.Lock(ctx)
+	if err != nil {
+		return id, err
+	}
+	defer unlock()
+	id, err = s.ResolveSnapshot(ctx, id)
+	if err != nil {
+		return id, err
+	}
+	if restart {
+		if err := s.StopServer(ctx); err != nil {
+			return id, err
+		}
+		defer func() {
+			//Interrupting the restore shouldn't leave the server down
+			if startErr := s.StartServer(context.WithoutCancel(ctx)); startErr != nil {
+				err = errors.Join(err, startErr)
+			}
+		}()
+	}
+	err = s.RestorePaths(ctx, id, paths, target)
+	if err != nil {
+		s.log().Error("Restore failed", "phase", "restore", "snapshot", id, "error", err)
+	}
+	return id, err
+}
+
+// Turns "latest" into the ID of the newest snapshot, passing any other ID
+// through unchanged.
+func (s *Server) ResolveSnapshot(ctx context.Context, id string) (string, error) {
+	if id != "latest" {
+		return id, nil
+	}
+	snaps, err := s.backend.List(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(snaps) == 0 {
+		return "", errors.New("there are no snapshots")
+	}
+	return snaps[len(snaps)-1].ID, nil
+}
+
+// Restores some files or directories from a snapshot, such as one region
+// file, replacing whatever is there now. paths are relative to
+// minecraft_dir, and an empty list restores the whole snapshot. If target
+// is empty the paths are put back in place in minecraft_dir, which is
+// refused with ErrWorldInUse while the server is running; otherwise they
+// are put in the same places under target. Everything is restored into a
+// staging directory first and checked against the snapshot's manifest, if
+// it has one, so a failed or damaged restore leaves the files alone.
+func (s *Server) RestorePaths(ctx context.Context, id string, paths []string, target string) error {
+	for _, p := range paths {
+		if !filepath.IsLocal(filepath.FromSlash(p)) {
+			return fmt.Errorf("path %q must be inside minecraft_dir", p)
+		}
+	}
+	paths = removeNestedPaths(cleanPaths(paths))
+	if target == "" {
+		target = s.conf.MinecraftDir
+		inUse, err := worldInUse(target)
+		if err != nil {
+			return fmt.Errorf("checking if the world is in use: %w", err)
+		}
+		if inUse {
+			return ErrWorldInUse
+		}
+	}
+	if err := os.MkdirAll(target, 0770); err != nil {
+		return err
+	}
+	//Inside target, so moving the files into place is a rename
+	staging, err := os.MkdirTemp(target, ".mcbk-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	pr, ok := s.backend.(pathRestorer)
+	if ok && len(paths) > 0 {
+		err = pr.RestorePaths(ctx, id, staging, paths)
+	} else {
+		err = s.backend.Restore(ctx, id, staging)
+	}
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		entries, err := os.ReadDir(staging)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			paths = append(paths, e.Name())
+		}
+	}
+
+	for _, p := range paths {
+		if ok, err := exists(filepath.Join(staging, p)); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("%s is not in snapshot %s", filepath.ToSlash(p), id)
+		}
+	}
+	if err := s.validateRestore(ctx, id, staging, paths); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		dest := filepath.Join(target, p)
+		if err := os.MkdirAll(filepath.Dir(dest), 0770); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(staging, p), dest); err != nil {
+			return err
+		}
+		s.log().Info("Restored", "phase", "restore", "snapshot", id, "path", filepath.ToSlash(p), "target", target)
+	}
+	return nil
+}
+
+// The path of a player's data file within minecraft_dir, in the world
+// named by level-name in server.properties, or in minecraft_dir itself if
+// that is a world.
+func (s *Server) PlayerDataPath(uuid string) (string, error) {
+	if !playerUUIDRegexp.MatchString(uuid) {
+		return "", fmt.Errorf("invalid player UUID %q, expected e.g. 069a79f4-44e9-4726-a5be-fca90e38aaf5", uuid)
+	}
+	file := filepath.Join("playerdata", strings.ToLower(uuid)+".dat")
+	if ok, err := exists(filepath.Join(s.conf.MinecraftDir, "level.dat")); err != nil || ok {
+		return file, err
+	}
+	level, err := readProperty(filepath.Join(s.conf.MinecraftDir, "server.properties"), "level-name")
+	if err != nil {
+		return "", err
+	}
+	if level == "" {
+		level = "world"
+	}
+	return filepath.Join(level, file), nil
+}
+
+// Whether path is one of paths or inside one of them.
+func underAny(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, p+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanPaths(paths []string) []string {
+	cleaned := make([]string, len(paths))
+	for i, p := range paths {
+		cleaned[i] = filepath.Clean(filepath.FromSlash(p))
+	}
+	return cleaned
+}
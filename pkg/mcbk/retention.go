@@ -0,0 +1,290 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A grandfather-father-son retention policy. Each keep_* rule keeps the
+// newest snapshot in each of the last N hours/days/weeks/months that have
+// snapshots, and a snapshot survives if any rule wants it. When no rule is
+// set, each backend's built-in pruning is used instead. Either way, tagged
+// snapshots are kept unless prune_tagged is set, and so is the first
+// snapshot of every period named in keep_first.
+type RetentionConfig struct {
+	KeepLast    int      `json:"keep_last"`    //Always keep this many of the newest snapshots
+	KeepHourly  int      `json:"keep_hourly"`  //Newest snapshot for each of the last N hours
+	KeepDaily   int      `json:"keep_daily"`   //Newest snapshot for each of the last N days
+	KeepWeekly  int      `json:"keep_weekly"`  //Newest snapshot for each of the last N ISO weeks
+	KeepMonthly int      `json:"keep_monthly"` //Newest snapshot for each of the last N months
+	KeepFirst   []string `json:"keep_first"`   //Keep the first snapshot of every "day", "week", "month" or "year" forever, e.g. ["month"]
+	PruneTagged bool     `json:"prune_tagged"` //Treat snapshots taken with "mcbk backup -tag" like any other
+}
+
+// Names a snapshot's period for the rules keeping one per period, by the
+// period's name in keep_first.
+var retentionPeriods = map[string]func(t time.Time) string{
+	"day": func(t time.Time) string { return t.Format("2006-01-02") },
+	"week": func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	},
+	"month": func(t time.Time) string { return t.Format("2006-01") },
+	"year":  func(t time.Time) string { return t.Format("2006") },
+}
+
+// Whether any rule is set.
+func (r RetentionConfig) Enabled() bool {
+	return r.KeepLast+r.KeepHourly+r.KeepDaily+r.KeepWeekly+r.KeepMonthly > 0
+}
+
+// Settings for reclaiming the space of removed snapshots: bup gc after bup
+// rm, restic's prune after forget and borg compact.
+type GCConfig struct {
+	Threshold *int `json:"threshold"` //Percent of a pack that must be unused before it is rewritten. Defaults to each tool's own: 10 for bup and borg, 5 for restic
+	Skip      bool `json:"skip"`      //Leave removed data on disk, e.g. to collect it by hand at a quieter time
+}
+
+func (c GCConfig) validate() error {
+	if c.Threshold != nil && (*c.Threshold < 0 || *c.Threshold > 100) {
+		return fmt.Errorf("gc.threshold must be a percentage between 0 and 100, got %d", *c.Threshold)
+	}
+	return nil
+}
+
+// The tool's threshold flag with the configured value, or nothing to keep
+// the tool's default.
+func (c GCConfig) thresholdArgs(flag, suffix string) []string {
+	if c.Threshold == nil {
+		return nil
+	}
+	return []string{flag, strconv.Itoa(*c.Threshold) + suffix}
+}
+
+// Implemented by backends that can apply a retention policy natively, like
+// borg prune. mcbk's own engine is then only used to preview it.
+type retentionPruner interface {
+	PruneRetention(ctx context.Context, r RetentionConfig) (removed int, err error)
+}
+
+// The outcome of the retention policy for one snapshot.
+type RetentionDecision struct {
+	Snapshot Snapshot
+	Keep     bool
+	Reasons  []string //Rules that kept it, e.g. "daily", "monthly"
+}
+
+// One GFS rule: how many buckets to keep and how to name a snapshot's bucket.
+type retentionRule struct {
+	name   string
+	count  int
+	bucket func(t time.Time) string
+}
+
+// Decides which snapshots to keep. The result is in the same order as snaps.
+// The newest snapshot is always kept, whatever the policy says. Tagged
+// snapshots are kept without counting towards any rule, so they don't
+// displace the scheduled ones, and so are the keep_first ones.
+func ApplyRetention(snaps []Snapshot, r RetentionConfig) []RetentionDecision {
+	rules := []retentionRule{
+		{"last", r.KeepLast, nil},
+		{"hourly", r.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", r.KeepDaily, retentionPeriods["day"]},
+		{"weekly", r.KeepWeekly, retentionPeriods["week"]},
+		{"monthly", r.KeepMonthly, retentionPeriods["month"]},
+	}
+
+	decisions := make([]RetentionDecision, len(snaps))
+	firsts := r.firsts(snaps)
+	var order []int
+	for i, s := range snaps {
+		decisions[i].Snapshot = s
+		if r.spares(s) {
+			decisions[i].Keep = true
+			decisions[i].Reasons = []string{"tagged"}
+			if s.PinnedUntil != nil {
+				decisions[i].Reasons = []string{"pinned"}
+			}
+		}
+		if periods := firsts[s.ID]; len(periods) > 0 {
+			decisions[i].Keep = true
+			for _, period := range periods {
+				decisions[i].Reasons = append(decisions[i].Reasons, "first-of-"+period)
+			}
+		}
+		if decisions[i].Keep {
+			continue
+		}
+		order = append(order, i)
+	}
+	//Walk newest first so each bucket is represented by its newest snapshot
+	sort.SliceStable(order, func(a, b int) bool {
+		return snaps[order[a]].Time.After(snaps[order[b]].Time)
+	})
+
+	for _, rule := range rules {
+		kept := 0
+		lastBucket := ""
+		for n, i := range order {
+			if kept >= rule.count {
+				break
+			}
+			bucket := fmt.Sprint(n)
+			if rule.bucket != nil {
+				bucket = rule.bucket(snaps[i].Time.Local())
+			}
+			if bucket == lastBucket {
+				continue
+			}
+			lastBucket = bucket
+			kept++
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, rule.name)
+		}
+	}
+	if len(order) > 0 && !decisions[order[0]].Keep {
+		decisions[order[0]].Keep = true
+		decisions[order[0]].Reasons = append(decisions[order[0]].Reasons, "newest")
+	}
+	return decisions
+}
+
+// The snapshots among snaps that are the first of a keep_first period,
+// mapped from their IDs to the periods they are the first of. Being kept
+// forever, they stay the first ones however the newer snapshots are pruned.
+func (r RetentionConfig) firsts(snaps []Snapshot) map[string][]string {
+	if len(r.KeepFirst) == 0 {
+		return nil
+	}
+	order := slices.SortedStableFunc(slices.Values(snaps), func(a, b Snapshot) int {
+		return a.Time.Compare(b.Time)
+	})
+	firsts := map[string][]string{}
+	for _, period := range r.KeepFirst {
+		bucket := retentionPeriods[period]
+		lastBucket := ""
+		for _, snap := range order {
+			if b := bucket(snap.Time.Local()); b != lastBucket {
+				lastBucket = b
+				firsts[snap.ID] = append(firsts[snap.ID], period)
+			}
+		}
+	}
+	return firsts
+}
+
+func (r RetentionConfig) validate() []error {
+	var errs []error
+	if min(r.KeepLast, r.KeepHourly, r.KeepDaily, r.KeepWeekly, r.KeepMonthly) < 0 {
+		errs = append(errs, errors.New("retention keep_* settings must not be negative"))
+	}
+	for _, period := range r.KeepFirst {
+		if _, ok := retentionPeriods[period]; !ok {
+			errs = append(errs, fmt.Errorf("unknown retention.keep_first period %q, expected \"day\", \"week\", \"month\" or \"year\"", period))
+		}
+	}
+	return errs
+}
+
+// Applies the retention policy, then the quota if one is set, and removes
+// the manifests of the snapshots that went. Returns how many snapshots
+// were removed.
+func (s *Server) prune(ctx context.Context) (int, error) {
+	removed, err := s.pruneRetention(ctx)
+	if err == nil && s.conf.Quota.Enabled() {
+		var n int
+		n, err = s.enforceQuota(ctx)
+		removed += n
+	}
+	s.pruneManifests(ctx)
+	return removed, err
+}
+
+// Applies the retention policy to the backend, or the backend's built-in
+// pruning if no policy is configured. Returns how many snapshots were
+// removed, which is always 0 for built-in pruning since backends don't
+// report it.
+func (s *Server) pruneRetention(ctx context.Context) (int, error) {
+	if !s.conf.Retention.Enabled() {
+		return 0, s.pruneBuiltin(ctx)
+	}
+	snaps, err := s.Snapshots(ctx)
+	if err != nil {
+		return 0, err
+	}
+	//The backend's own policy knows nothing of tags
+	if p, ok := s.backend.(retentionPruner); ok && len(s.conf.Retention.spared(snaps)) == 0 {
+		return p.PruneRetention(ctx, s.conf.Retention)
+	}
+
+	var remove []Snapshot
+	for _, d := range ApplyRetention(snaps, s.conf.Retention) {
+		if !d.Keep {
+			remove = append(remove, d.Snapshot)
+		}
+	}
+	if len(remove) == 0 {
+		return 0, nil
+	}
+	s.log().Info("Removing snapshots", "phase", "prune", "remove", len(remove), "total", len(snaps))
+	if err := s.backend.Delete(ctx, remove); err != nil {
+		return 0, err
+	}
+	return len(remove), nil
+}
+
+// Implemented by backends whose built-in pruning can leave some snapshots
+// alone, so that tagged snapshots survive it.
+type sparingPruner interface {
+	PruneSparing(ctx context.Context, spared []Snapshot) error
+}
+
+// Runs the backend's built-in pruning, sparing tagged and pinned
+// snapshots and the keep_first ones. The snapshots are only listed if
+// keep_first is set or the history says any may need sparing.
+func (s *Server) pruneBuiltin(ctx context.Context) error {
+	now := time.Now()
+	sparing := slices.ContainsFunc(slices.Collect(maps.Values(s.labels())), func(rec HistoryRecord) bool {
+		if rec.PinnedUntil != nil {
+			return now.Before(*rec.PinnedUntil)
+		}
+		return len(rec.Tags) > 0 && !s.conf.Retention.PruneTagged
+	}) || len(s.conf.Retention.KeepFirst) > 0
+	if !sparing {
+		return s.backend.Prune(ctx)
+	}
+	snaps, err := s.Snapshots(ctx)
+	if err != nil {
+		return err
+	}
+	spared := s.conf.Retention.spared(snaps)
+	if len(spared) == 0 {
+		return s.backend.Prune(ctx)
+	}
+	p, ok := s.backend.(sparingPruner)
+	if !ok {
+		return fmt.Errorf("the %s backend's built-in pruning can't spare tagged or keep_first snapshots; set a retention policy, or retention.prune_tagged and no keep_first", s.conf.Backend)
+	}
+	s.log().Debug("Sparing tagged snapshots from pruning", "phase", "prune", "spared", len(spared))
+	return p.PruneSparing(ctx, spared)
+}
+
+// What the retention policy would do to the server's snapshots, without
+// removing anything. Returns nil decisions if no policy is configured and
+// the backend's built-in pruning would run instead.
+func (s *Server) PreviewRetention(ctx context.Context) ([]RetentionDecision, error) {
+	if !s.conf.Retention.Enabled() {
+		return nil, nil
+	}
+	snaps, err := s.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyRetention(snaps, s.conf.Retention), nil
+}
@@ -0,0 +1,264 @@
+package mcbk
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Snapshots taken at the given times, with the times as their IDs.
+func snapshotsAt(times ...time.Time) []Snapshot {
+	var snaps []Snapshot
+	for _, t := range times {
+		snaps = append(snaps, Snapshot{ID: t.Format(time.DateTime), Time: t})
+	}
+	return snaps
+}
+
+// The IDs of the snapshots the decisions keep, in their order.
+func keptIDs(decisions []RetentionDecision) []string {
+	var kept []string
+	for _, d := range decisions {
+		if d.Keep {
+			kept = append(kept, d.Snapshot.ID)
+		}
+	}
+	return kept
+}
+
+func TestApplyRetention(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		r     RetentionConfig
+		times []time.Time
+		want  []time.Time
+	}{
+		{"keep_last", RetentionConfig{KeepLast: 2}, []time.Time{
+			date(2024, time.January, 1, 8, 0, 0),
+			date(2024, time.January, 1, 9, 0, 0),
+			date(2024, time.January, 1, 10, 0, 0),
+		}, []time.Time{
+			date(2024, time.January, 1, 9, 0, 0),
+			date(2024, time.January, 1, 10, 0, 0),
+		}},
+		{"hourly keeps the newest of each hour", RetentionConfig{KeepHourly: 2}, []time.Time{
+			date(2024, time.January, 1, 9, 59, 59),
+			date(2024, time.January, 1, 10, 0, 0),
+			date(2024, time.January, 1, 10, 59, 0),
+			date(2024, time.January, 1, 11, 0, 0),
+		}, []time.Time{
+			date(2024, time.January, 1, 10, 59, 0),
+			date(2024, time.January, 1, 11, 0, 0),
+		}},
+		{"daily keeps the newest of each day", RetentionConfig{KeepDaily: 2}, []time.Time{
+			date(2024, time.January, 1, 8, 0, 0),
+			date(2024, time.January, 1, 20, 0, 0),
+			date(2024, time.January, 2, 8, 0, 0),
+			date(2024, time.January, 3, 8, 0, 0),
+			date(2024, time.January, 3, 20, 0, 0),
+		}, []time.Time{
+			date(2024, time.January, 2, 8, 0, 0),
+			date(2024, time.January, 3, 20, 0, 0),
+		}},
+		{"daily counts days with snapshots, not calendar days", RetentionConfig{KeepDaily: 2}, []time.Time{
+			date(2024, time.January, 1, 12, 0, 0),
+			date(2024, time.January, 5, 12, 0, 0),
+			date(2024, time.January, 10, 12, 0, 0),
+		}, []time.Time{
+			date(2024, time.January, 5, 12, 0, 0),
+			date(2024, time.January, 10, 12, 0, 0),
+		}},
+		{"days end at midnight", RetentionConfig{KeepDaily: 2}, []time.Time{
+			date(2024, time.January, 1, 0, 0, 0),
+			date(2024, time.January, 1, 23, 59, 59),
+			date(2024, time.January, 2, 0, 0, 0),
+		}, []time.Time{
+			date(2024, time.January, 1, 23, 59, 59),
+			date(2024, time.January, 2, 0, 0, 0),
+		}},
+		{"weekly uses ISO weeks starting on Monday", RetentionConfig{KeepWeekly: 2}, []time.Time{
+			date(2024, time.January, 1, 12, 0, 0), //Monday of week 1
+			date(2024, time.January, 7, 12, 0, 0), //Sunday of week 1
+			date(2024, time.January, 8, 12, 0, 0), //Monday of week 2
+		}, []time.Time{
+			date(2024, time.January, 7, 12, 0, 0),
+			date(2024, time.January, 8, 12, 0, 0),
+		}},
+		{"weekly across the new year", RetentionConfig{KeepWeekly: 2}, []time.Time{
+			date(2024, time.December, 29, 12, 0, 0), //Sunday of 2024-W52
+			date(2024, time.December, 30, 12, 0, 0), //Monday of 2025-W01
+			date(2025, time.January, 5, 12, 0, 0),   //Sunday of 2025-W01
+		}, []time.Time{
+			date(2024, time.December, 29, 12, 0, 0),
+			date(2025, time.January, 5, 12, 0, 0),
+		}},
+		{"monthly keeps the newest of each month", RetentionConfig{KeepMonthly: 2}, []time.Time{
+			date(2024, time.January, 31, 23, 59, 59),
+			date(2024, time.February, 1, 0, 0, 0),
+			date(2024, time.February, 29, 12, 0, 0),
+			date(2024, time.March, 1, 0, 0, 0),
+		}, []time.Time{
+			date(2024, time.February, 29, 12, 0, 0),
+			date(2024, time.March, 1, 0, 0, 0),
+		}},
+		{"monthly across the new year", RetentionConfig{KeepMonthly: 2}, []time.Time{
+			date(2023, time.November, 30, 12, 0, 0),
+			date(2023, time.December, 31, 12, 0, 0),
+			date(2024, time.January, 1, 12, 0, 0),
+		}, []time.Time{
+			date(2023, time.December, 31, 12, 0, 0),
+			date(2024, time.January, 1, 12, 0, 0),
+		}},
+		{"keep_last overlapping daily", RetentionConfig{KeepLast: 2, KeepDaily: 2}, []time.Time{
+			date(2024, time.January, 1, 8, 0, 0),
+			date(2024, time.January, 1, 20, 0, 0),
+			date(2024, time.January, 2, 8, 0, 0),
+			date(2024, time.January, 2, 20, 0, 0),
+		}, []time.Time{
+			date(2024, time.January, 1, 20, 0, 0),
+			date(2024, time.January, 2, 8, 0, 0),
+			date(2024, time.January, 2, 20, 0, 0),
+		}},
+		{"each rule counts on its own", RetentionConfig{KeepDaily: 1, KeepWeekly: 2, KeepMonthly: 3}, []time.Time{
+			date(2024, time.January, 15, 12, 0, 0),
+			date(2024, time.February, 10, 12, 0, 0),
+			date(2024, time.February, 20, 12, 0, 0),
+			date(2024, time.February, 27, 12, 0, 0),
+			date(2024, time.February, 28, 12, 0, 0),
+		}, []time.Time{
+			date(2024, time.January, 15, 12, 0, 0),
+			date(2024, time.February, 20, 12, 0, 0),
+			date(2024, time.February, 28, 12, 0, 0),
+		}},
+		{"the newest is kept even by no rule", RetentionConfig{}, []time.Time{
+			date(2024, time.January, 1, 12, 0, 0),
+			date(2024, time.January, 2, 12, 0, 0),
+		}, []time.Time{
+			date(2024, time.January, 2, 12, 0, 0),
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := keptIDs(ApplyRetention(snapshotsAt(tt.times...), tt.r))
+			var want []string
+			for _, snap := range snapshotsAt(tt.want...) {
+				want = append(want, snap.ID)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("kept %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyRetentionReasons(t *testing.T) {
+	snaps := snapshotsAt(
+		date(2024, time.January, 1, 20, 0, 0),
+		date(2024, time.January, 2, 8, 0, 0),
+		date(2024, time.January, 2, 20, 0, 0),
+	)
+	decisions := ApplyRetention(snaps, RetentionConfig{KeepLast: 1, KeepDaily: 2})
+	for i, want := range [][]string{{"daily"}, nil, {"last", "daily"}} {
+		if d := decisions[i]; !slices.Equal(d.Reasons, want) || d.Keep != (want != nil) {
+			t.Errorf("%s: kept %t for %v, want %v", d.Snapshot.ID, d.Keep, d.Reasons, want)
+		}
+	}
+}
+
+func TestApplyRetentionKeepsInputOrder(t *testing.T) {
+	snaps := snapshotsAt(
+		date(2024, time.March, 1, 12, 0, 0),
+		date(2024, time.January, 1, 12, 0, 0),
+		date(2024, time.February, 1, 12, 0, 0),
+	)
+	decisions := ApplyRetention(snaps, RetentionConfig{KeepMonthly: 2})
+	for i, d := range decisions {
+		if d.Snapshot.ID != snaps[i].ID {
+			t.Fatalf("decision %d is for %s, want %s", i, d.Snapshot.ID, snaps[i].ID)
+		}
+	}
+	if got := keptIDs(decisions); !slices.Equal(got, []string{snaps[0].ID, snaps[2].ID}) {
+		t.Errorf("kept %v, want March and February", got)
+	}
+}
+
+func TestApplyRetentionTagged(t *testing.T) {
+	snaps := snapshotsAt(
+		date(2024, time.January, 1, 12, 0, 0),
+		date(2024, time.January, 2, 12, 0, 0),
+		date(2024, time.January, 3, 12, 0, 0),
+	)
+	snaps[2].Tags = []string{"before-upgrade"}
+	//The tagged snapshot doesn't take the place of the newest scheduled one
+	decisions := ApplyRetention(snaps, RetentionConfig{KeepDaily: 1})
+	if got := keptIDs(decisions); !slices.Equal(got, []string{snaps[1].ID, snaps[2].ID}) {
+		t.Errorf("kept %v, want the tagged snapshot and the one before it", got)
+	}
+	if !slices.Equal(decisions[2].Reasons, []string{"tagged"}) {
+		t.Errorf("the tagged snapshot was kept for %v", decisions[2].Reasons)
+	}
+
+	decisions = ApplyRetention(snaps, RetentionConfig{KeepDaily: 1, PruneTagged: true})
+	if got := keptIDs(decisions); !slices.Equal(got, []string{snaps[2].ID}) {
+		t.Errorf("with prune_tagged kept %v, want only the newest", got)
+	}
+}
+
+func TestApplyRetentionKeepFirst(t *testing.T) {
+	snaps := snapshotsAt(
+		date(2023, time.December, 20, 12, 0, 0),
+		date(2024, time.January, 3, 12, 0, 0),
+		date(2024, time.January, 20, 12, 0, 0),
+		date(2024, time.February, 2, 12, 0, 0),
+		date(2024, time.February, 25, 12, 0, 0),
+		date(2024, time.March, 10, 12, 0, 0),
+		date(2024, time.March, 11, 12, 0, 0),
+	)
+	r := RetentionConfig{KeepLast: 2, KeepDaily: 1, KeepFirst: []string{"month", "year"}}
+	decisions := ApplyRetention(snaps, r)
+	//The firsts don't count towards keep_last, so it reaches back to February
+	for i, want := range [][]string{
+		{"first-of-month", "first-of-year"},
+		{"first-of-month", "first-of-year"},
+		nil,
+		{"first-of-month"},
+		{"last"},
+		{"first-of-month"},
+		{"last", "daily"},
+	} {
+		if d := decisions[i]; !slices.Equal(d.Reasons, want) || d.Keep != (want != nil) {
+			t.Errorf("%s: kept %t for %v, want %v", d.Snapshot.ID, d.Keep, d.Reasons, want)
+		}
+	}
+
+	//Pruning what went and adding newer snapshots leaves the firsts the firsts
+	var kept []Snapshot
+	for _, d := range decisions {
+		if d.Keep {
+			kept = append(kept, d.Snapshot)
+		}
+	}
+	kept = append(kept, snapshotsAt(date(2024, time.March, 12, 12, 0, 0), date(2024, time.March, 13, 12, 0, 0))...)
+	got := keptIDs(ApplyRetention(kept, RetentionConfig{KeepLast: 1, KeepFirst: r.KeepFirst}))
+	want := []string{snaps[0].ID, snaps[1].ID, snaps[3].ID, snaps[5].ID, kept[len(kept)-1].ID}
+	if !slices.Equal(got, want) {
+		t.Errorf("pruning again kept %v, want %v", got, want)
+	}
+}
+
+func TestPruneKeepsFirstOverQuota(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, "[retention]\nkeep_last = 2\nkeep_first = [\"month\"]\n[quota]\nmax_size = 1000")
+	names := writeTestArchives(t, s, 1000, "20240103-120000", "20240120-120000", "20240202-120000", "20240210-120000", "20240225-120000")
+	//Retention removes January 20th, the quota February 10th, the oldest
+	//left that isn't the first of its month, then gives up as the rest are
+	//still over it
+	_, err := s.prune(ctx)
+	if err == nil || !strings.Contains(err.Error(), "keep_first") {
+		t.Errorf("pruning got error %v, want it to report the quota can't be met", err)
+	}
+	if got, want := snapshotIDs(t, s), []string{names[0], names[2], names[4]}; !slices.Equal(got, want) {
+		t.Errorf("left %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,339 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// How a backup of one server will run, decided before anything on the
+// server is changed.
+type Plan struct {
+	Server    *Server
+	Cold      bool //The server isn't running, so its files are copied without any in-game commands
+	Countdown bool //Warn players with the configured countdown first
+	Prune     bool //Apply the retention policy afterwards
+	Upload    bool //Mirror the backups to S3, GCS or Azure afterwards
+	Replicate bool //Sync the backups to the rclone remotes afterwards
+	Check     bool //Verify the backend's data afterwards, failing the backup if it is damaged
+
+	Include []string //Include patterns backed up on top of worlds and include this time, e.g. upgrade.paths
+}
+
+// Checks whether the server is up and decides how to back it up. Returns
+// an error if no backup should be taken, e.g. because the server isn't
+// responding but its world is still in use.
+func (s *Server) Plan(ctx context.Context) (Plan, error) {
+	p := Plan{Server: s, Prune: true, Upload: len(s.conf.uploadTargets()) > 0, Replicate: len(s.conf.Rclone) > 0, Check: s.checkDue()}
+	switch {
+	case s.conf.Set != "":
+		//The game doesn't write a set's files, so they are copied as they are
+		p.Cold = true
+		return p, nil
+	case s.conf.Agent.remote():
+		//The host prunes, checks and uploads its own backups
+		return Plan{Server: s}, nil
+	case s.conf.Agent.Enabled():
+		//The host checks on the server when the world is pulled
+		return p, nil
+	}
+	if s.isMinecraftAlive(ctx) {
+		p.Countdown = len(s.conf.Countdown.Steps) > 0
+		return p, nil
+	}
+	if s.conf.RequireOnline {
+		//Nothing to do if minecraft won't respond
+		s.log().Debug("Server is not responding, skipping backup", "phase", "alive-check")
+		return p, errors.New("server is not responding")
+	}
+	inUse, err := worldInUse(s.conf.MinecraftDir)
+	if err != nil {
+		s.log().Error("Error checking if the world is in use, skipping backup", "phase", "alive-check", "error", err)
+		return p, err
+	}
+	if inUse {
+		//A hung server may still write to the world, so copying it as is isn't safe
+		s.log().Error("Server is not responding but its world is still in use, skipping backup", "phase", "alive-check")
+		return p, errors.New("server is not responding but its world is in use")
+	}
+	s.log().Info("Server is not running, taking a cold backup", "phase", "alive-check")
+	p.Cold = true
+	return p, nil
+}
+
+// Runs backups and pruning for any number of servers, reporting to shared
+// notifiers and metrics. The zero value runs without reporting anywhere.
+type Runner struct {
+	Notifiers    []Notifier
+	Metrics      *Metrics       //May be nil
+	MQTT         *MQTTPublisher //Where to publish lifecycle events for home automation. May be nil
+	Tracer       *Tracer        //Where to export traces of each run. May be nil
+	Force        bool           //Back up even servers with skip_idle that nobody has played on, or whose files are far smaller than usual
+	Slots        chan struct{}  //Its capacity caps how many backups run at once, across copies of the Runner. Nil for no limit
+	Tags         []string       //Labels for the snapshots taken, which pruning then leaves alone
+	Comment      string         //Note recorded with the snapshots taken
+	IgnoreWindow bool           //Back up even when backup_window doesn't allow it
+	Reason       string         //Why the backups are taken; REASON_UPGRADE forces them, tags them pre-upgrade, adds upgrade.paths and pins them for upgrade.pin
+	Progress     func(Progress) //Called with how far each backup has got, at most once every PROGRESS_INTERVAL and once more when it is done. May be nil
+}
+
+// Backs up the server if it is reachable, then prunes old backups, sending
+// notifications along the way. Returns an error if no backup was taken,
+// ErrBackupInProgress if another run holds the server's lock,
+// ErrOutsideWindow if backup_window doesn't allow a backup now and
+// ErrServerIdle if nobody has played since the last backup. A panic is
+// turned into an error, so it can't take down backups of other servers.
+func (r *Runner) Backup(ctx context.Context, s *Server) (err error) {
+	ctx, span := r.trace(ctx, s, "backup")
+	defer func() {
+		if errors.Is(err, ErrBackupInProgress) || errors.Is(err, ErrOutsideWindow) || errors.Is(err, ErrServerIdle) {
+			//Skipping isn't a failure
+			span.set("mcbk.skipped", err.Error())
+			span.end(nil)
+			return
+		}
+		span.end(err)
+	}()
+	defer func() {
+		if p := recover(); p != nil {
+			s.log().Error("Backup panicked", "error", p, "stack", string(debug.Stack()))
+			err = fmt.Errorf("backup panicked: %v", p)
+		}
+	}()
+	//Before the lock, whose file would otherwise land on the disk below
+	//an unmounted backup_root
+	if err := s.checkMount(); err != nil {
+		s.log().Error("Backup disk isn't mounted, not backing up", "phase", "preflight", "error", err)
+		s.ping(EventFailure, err.Error())
+		r.notify(ctx, s, Event{Kind: EventFailure, Server: s.conf.Name, Time: time.Now(), Err: err})
+		return err
+	}
+	unlock, err := s.Lock(ctx)
+	if errors.Is(err, ErrBackupInProgress) {
+		//Not a failure: the other run will report its own result
+		s.log().Warn("Another backup is in progress, skipping this one", "phase", "lock")
+		return err
+	}
+	if err != nil {
+		s.log().Error("Error taking the backup lock", "phase", "lock", "error", err)
+		s.ping(EventFailure, err.Error())
+		return err
+	}
+	defer unlock()
+	//Only once the lock is held, another run may still be using the transport
+	defer s.Close()
+	ctx, done := s.cancellable(ctx)
+	defer done()
+	release, err := r.acquireSlot(ctx, s)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start := time.Now()
+	if err := s.checkWindow(start); err != nil && !r.ignoreWindow() {
+		s.log().Info("Outside the backup window, skipping this backup", "phase", "window", "error", err)
+		//Skipping is intended, so the watchdog shouldn't alert
+		s.ping(EventSuccess, "Skipped, "+err.Error())
+		s.recordHistory(HistoryRecord{Start: start, End: time.Now(), Status: "skipped", Phase: "window", Error: err.Error()})
+		return err
+	}
+	if s.conf.SkipIdle && !r.force() {
+		last, reason := s.idleSince()
+		if reason == "" {
+			s.log().Info("No players since the last backup, skipping this one", "phase", "idle-check", "last_backup", last)
+			//Skipping is intended, so the watchdog shouldn't alert
+			s.ping(EventSuccess, "Skipped, no players since the backup at "+last.Format(time.RFC3339))
+			s.recordHistory(HistoryRecord{Start: start, End: time.Now(), Status: "skipped", Phase: "idle-check", Error: ErrServerIdle.Error()})
+			return ErrServerIdle
+		}
+		s.log().Debug("Server may have changed, backing up", "phase", "idle-check", "reason", reason)
+	}
+	unlockGlobal, err := s.lockGlobal(ctx)
+	if err != nil {
+		s.log().Error("Error taking the global lock", "phase", "lock", "error", err)
+		return err
+	}
+	defer unlockGlobal()
+	var p Plan
+	err = traced(ctx, "alive-check", func(ctx context.Context) (err error) {
+		p, err = s.Plan(ctx)
+		return err
+	})
+	span.set("mcbk.cold", p.Cold)
+	if err != nil {
+		//Any run without a backup is a failure as far as the watchdog is concerned
+		s.ping(EventFailure, err.Error())
+		s.recordHistory(HistoryRecord{Start: start, End: time.Now(), Status: "skipped", Phase: "alive-check", Error: err.Error()})
+		return err
+	}
+	_, err = r.Run(ctx, p)
+	return err
+}
+
+// Carries out a plan: the backup itself, then pruning and uploading as
+// planned, with notifications, metrics, hooks and healthcheck pings. The
+// caller should hold the server's Lock, as Backup does.
+func (r *Runner) Run(ctx context.Context, p Plan) (Snapshot, error) {
+	s := p.Server
+	p = r.adjust(p)
+	start := time.Now()
+	ctx = withRunStart(ctx, start)
+	r.notify(ctx, s, Event{Kind: EventStart, Server: s.conf.Name, Time: start})
+	s.ping(EventStart, "")
+	r.Metrics.backupStarted(s.conf.Name, start)
+	r.publish(s, mqttEvent{Event: MQTTStarted, Server: s.conf.Name, Time: start})
+
+	sourceBytes, err := r.checkSize(ctx, s, start)
+	repoBefore := s.repoSizeBefore(ctx)
+	var snap Snapshot
+	var corrupt error
+	if err == nil && s.conf.Agent.remote() {
+		snap, err = s.remoteBackup(ctx, r.Force, r.Tags, r.Comment, r.Reason)
+	} else if err == nil {
+		progress := r.trackProgress(ctx, s, sourceBytes)
+		snap, corrupt, err = s.runBackup(withProgress(ctx, progress), p)
+		progress.finish()
+		if err == nil {
+			r.publish(s, mqttEvent{Event: MQTTSaved, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start).Seconds(), Snapshot: snap.ID, Bytes: snap.Size})
+		}
+	}
+	//After save-on, as a check can take a while
+	if err == nil && p.Check {
+		err = traced(ctx, "check", func(ctx context.Context) error {
+			return s.checkSnapshot(ctx, snap)
+		})
+	}
+	r.Metrics.backupFinished(s.conf.Name, time.Since(start), snap, err)
+	rec := HistoryRecord{Start: start, Cold: p.Cold, Checked: err == nil && p.Check, SourceBytes: sourceBytes, Tags: r.tags(), Comment: r.Comment, PinnedUntil: r.pinnedUntil(s, start)}
+	if err != nil {
+		rec.Phase, rec.Error = errorPhase(err), err.Error()
+	}
+	if corrupt != nil {
+		rec.SourceCorrupt = corrupt.Error()
+	}
+	if ctx.Err() != nil {
+		reason := cancelReason(ctx)
+		if !errors.Is(reason, ErrBackupCancelled) {
+			s.interrupted.Store(true)
+		}
+		s.log().Error("Backup cancelled", "phase", errorPhase(err), "duration", time.Since(start), "reason", reason, "error", err)
+		r.notify(ctx, s, Event{Kind: EventFailure, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start), Err: reason})
+		r.publish(s, mqttEvent{Event: MQTTFailed, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start).Seconds(), Error: reason.Error()})
+		s.runHookAndLog(ctx, "on-failure", s.conf.Hooks.OnFailure, hookRun{Status: "cancelled", Duration: time.Since(start), Err: err})
+		err = fmt.Errorf("%w: %w", reason, ctx.Err())
+		s.ping(EventFailure, err.Error())
+		rec.End, rec.Status = time.Now(), "cancelled"
+		s.recordHistory(rec)
+		return snap, err
+	}
+	if err != nil {
+		s.log().Error("Backup failed", "phase", errorPhase(err), "duration", time.Since(start), "error", err)
+		r.notify(ctx, s, Event{Kind: EventFailure, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start), Err: err})
+		r.publish(s, mqttEvent{Event: MQTTFailed, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start).Seconds(), Error: err.Error()})
+		s.runHookAndLog(ctx, "on-failure", s.conf.Hooks.OnFailure, hookRun{Status: "failure", Duration: time.Since(start), Err: err})
+		s.ping(EventFailure, err.Error())
+		rec.End, rec.Status = time.Now(), "failure"
+		s.recordHistory(rec)
+		return snap, err
+	}
+	snap.Tags, snap.Comment, snap.PinnedUntil = rec.Tags, rec.Comment, rec.PinnedUntil
+	s.log().Info("Backup complete", "phase", "backup", "duration", time.Since(start), "snapshot", snap.ID, "size", snap.Size)
+	r.notify(ctx, s, Event{Kind: EventSuccess, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start), Snapshot: snap})
+	r.publish(s, mqttEvent{Event: MQTTCompleted, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start).Seconds(), Snapshot: snap.ID, Bytes: snap.Size})
+	if corrupt != nil {
+		r.notify(ctx, s, Event{Kind: EventSourceCorrupt, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start), Snapshot: snap, Err: corrupt})
+	}
+	s.runHookAndLog(ctx, "post-backup", s.conf.Hooks.PostBackup, hookRun{Status: "success", Snapshot: snap, Duration: time.Since(start)})
+
+	rec.End, rec.Status, rec.Snapshot, rec.Bytes = time.Now(), "success", snap.ID, snap.Size
+	s.recordStats(ctx, &rec, repoBefore)
+	r.Metrics.statsRecorded(s.conf.Name, rec)
+	if p.Prune {
+		rec.Pruned, _ = r.Prune(ctx, s)
+	}
+	//After pruning, so the bucket mirrors the retention policy too
+	if p.Upload {
+		s.upload(ctx)
+	}
+	//Reported on its own, the local backup has still succeeded
+	if p.Replicate {
+		if err := r.replicate(ctx, s); err != nil {
+			rec.ReplicationError = err.Error()
+		}
+	}
+	s.ping(EventSuccess, fmt.Sprintf("Backup %s took %s, %s added", snap.ID, time.Since(start).Round(time.Millisecond), FormatBytes(snap.Size)))
+	s.recordHistory(rec)
+	return snap, nil
+}
+
+// Applies the retention policy, or the backend's built-in pruning, and
+// records the outcome in the log, metrics and the post-prune hook. Returns
+// how many snapshots were removed. The caller should hold the server's Lock.
+func (r *Runner) Prune(ctx context.Context, s *Server) (int, error) {
+	s.log().Info("Pruning old backups...", "phase", "prune")
+	ctx, span := r.trace(ctx, s, "prune")
+	start := time.Now()
+	var removed int
+	err := withPhaseTimeout(ctx, s.conf.PhaseTimeouts.Prune.Duration, func(ctx context.Context) (err error) {
+		removed, err = s.prune(ctx)
+		return err
+	})
+	r.Metrics.pruned(s.conf.Name, removed, err)
+	span.set("mcbk.pruned", removed)
+	span.end(err)
+	run := hookRun{Status: "success", Duration: time.Since(start), Pruned: removed}
+	ev := mqttEvent{Event: MQTTPruned, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start).Seconds(), Pruned: &removed}
+	if err != nil {
+		ev.Error = err.Error()
+		s.log().Error("Error pruning old backups", "phase", "prune", "duration", time.Since(start), "error", err)
+		run.Status, run.Err = "failure", &phaseError{"prune", err}
+	}
+	r.publish(s, ev)
+	s.runHookAndLog(ctx, "post-prune", s.conf.Hooks.PostPrune, run)
+	return removed, err
+}
+
+// Waits until fewer than cap(r.Slots) backups are running, so several
+// servers backing up at once don't overwhelm the disk.
+func (r *Runner) acquireSlot(ctx context.Context, s *Server) (func(), error) {
+	if r.Slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case r.Slots <- struct{}{}:
+	default:
+		s.log().Info("Waiting for other backups to finish", "phase", "queue", "concurrency", cap(r.Slots))
+		select {
+		case r.Slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return func() { <-r.Slots }, nil
+}
+
+// Sends the event to every notifier. Delivery failures are logged but never
+// fail the backup itself.
+func (r *Runner) notify(ctx context.Context, s *Server, ev Event) {
+	_, span := startSpan(ctx, "notify")
+	span.set("mcbk.event", ev.Kind)
+	var errs []error
+	for _, n := range r.Notifiers {
+		if err := n.Notify(ev); err != nil {
+			s.log().Warn("Error sending notification", "phase", "notify", "event", ev.Kind, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	span.end(errors.Join(errs...))
+}
+
+// Publishes the event to MQTT, if it is set up. Failures are logged but
+// never fail the backup itself.
+func (r *Runner) publish(s *Server, ev mqttEvent) {
+	if err := r.MQTT.publish(ev); err != nil {
+		s.log().Warn("Error publishing to MQTT", "phase", "mqtt", "event", ev.Event, "error", err)
+	}
+}
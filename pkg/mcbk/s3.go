@@ -0,0 +1,265 @@
+package mcbk
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const S3_MAX_PUT_SIZE = 5 << 30 //Largest object a single PUT may upload
+const S3_EMPTY_PAYLOAD_HASH = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Settings for mirroring backups into an S3-compatible bucket after each
+// successful backup.
+type S3Config struct {
+	Bucket       string `json:"bucket"`                   //Bucket to upload into. Empty disables uploads
+	Endpoint     string `json:"endpoint"`                 //Base URL of an S3-compatible service, defaults to AWS for the region
+	Region       string `json:"region"`                   //Signing region, default us-east-1
+	AccessKey    string `json:"access_key" secret:"true"` //Defaults to $AWS_ACCESS_KEY_ID
+	SecretKey    string `json:"secret_key" secret:"true"` //Defaults to $AWS_SECRET_ACCESS_KEY
+	Prefix       string `json:"prefix"`                   //Key prefix for every uploaded object
+	StorageClass string `json:"storage_class"`            //e.g. "STANDARD_IA", the bucket's default if empty
+	PathStyle    bool   `json:"path_style"`               //Use endpoint/bucket/key URLs, needed by most self-hosted services
+	Retries      int    `json:"retries"`                  //Attempts per request before giving up
+}
+
+// Whether uploads are configured.
+func (c S3Config) Enabled() bool {
+	return c.Bucket != ""
+}
+
+// A minimal S3 client covering the calls a one-way sync needs, signed with
+// AWS Signature Version 4.
+type s3Client struct {
+	conf      S3Config
+	endpoint  *url.URL
+	accessKey string
+	secretKey string
+	token     string
+	http      *http.Client
+	log       *slog.Logger
+}
+
+func newS3Client(c S3Config, log *slog.Logger) (*s3Client, error) {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3.endpoint %q, expected a URL such as https://minio.example.com:9000", endpoint)
+	}
+	client := &s3Client{
+		conf:      c,
+		endpoint:  u,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		http:      newUploadHTTPClient(),
+		log:       log,
+	}
+	if client.accessKey == "" {
+		client.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if client.secretKey == "" {
+		client.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if client.accessKey == "" || client.secretKey == "" {
+		return nil, errors.New("no S3 credentials, set s3.access_key and s3.secret_key or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return client, nil
+}
+
+// Builds the URL for a key, or for the bucket itself if key is empty.
+func (c *s3Client) url(key string, query map[string]string) *url.URL {
+	u := *c.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if c.conf.PathStyle {
+		path += "/" + c.conf.Bucket
+	} else {
+		u.Host = c.conf.Bucket + "." + u.Host
+	}
+	u.Path = path + "/" + key
+	u.RawPath = s3Escape(u.Path, false)
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, s3Escape(k, true)+"="+s3Escape(query[k], true))
+	}
+	u.RawQuery = strings.Join(parts, "&")
+	return &u
+}
+
+// URI-encodes s the way SigV4 expects: everything except unreserved
+// characters, and slashes too unless it is a path.
+func s3Escape(s string, escapeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		case b == '/' && !escapeSlash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Adds SigV4 authentication headers to req. Every x-amz-* header already
+// set is included in the signature.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+
+	names := []string{"host"}
+	for k := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signed, payloadHash}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + c.conf.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.conf.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signed, signature))
+}
+
+// Sends a signed request, retrying as sendWithRetries does. body is called
+// once per attempt to get the payload and its length, and may be nil. The
+// caller must close the returned response's body.
+func (c *s3Client) do(ctx context.Context, method, key string, query map[string]string, header http.Header, body func() (io.ReadCloser, int64, error)) (*http.Response, error) {
+	return sendWithRetries(ctx, c.log, "S3", c.conf.Retries, method+" "+c.url(key, nil).Redacted(), func() (*http.Response, error) {
+		return c.try(ctx, method, key, query, header, body)
+	}, xmlResponseError)
+}
+
+func (c *s3Client) try(ctx context.Context, method, key string, query map[string]string, header http.Header, body func() (io.ReadCloser, int64, error)) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(key, query).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+	payloadHash := S3_EMPTY_PAYLOAD_HASH
+	client := c.http
+	if body != nil {
+		rc, size, err := body()
+		if err != nil {
+			return nil, err
+		}
+		//S3 rejects chunked uploads, so the length has to be known
+		req.Body, req.ContentLength = rc, size
+		payloadHash = "UNSIGNED-PAYLOAD"
+		client = uploadClient(c.http, size)
+	}
+	c.sign(req, payloadHash, time.Now())
+	return client.Do(req)
+}
+
+// Lists every object whose key starts with prefix.
+func (c *s3Client) list(ctx context.Context, prefix string) ([]remoteObject, error) {
+	var objects []remoteObject
+	token := ""
+	for {
+		query := map[string]string{"list-type": "2", "prefix": prefix}
+		if token != "" {
+			query["continuation-token"] = token
+		}
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents              []remoteObject
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing bucket listing: %w", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Uploads the file at path as key.
+func (c *s3Client) put(ctx context.Context, key, path string, size int64) error {
+	if size > S3_MAX_PUT_SIZE {
+		return fmt.Errorf("%s is larger than the 5 GiB S3 allows in one upload", path)
+	}
+	header := http.Header{}
+	if c.conf.StorageClass != "" {
+		header.Set("X-Amz-Storage-Class", c.conf.StorageClass)
+	}
+	resp, err := c.do(ctx, http.MethodPut, key, nil, header, func() (io.ReadCloser, int64, error) {
+		body, err := openUploadBody(path, size)
+		return body, size, err
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,181 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Service name secrets are stored under in the OS keyring.
+const KEYRING_SERVICE = "mcbk"
+
+// A ${NAME} reference to an environment variable in a secret setting.
+var envRefRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Resolves the secret settings of a parsed config tree before it is decoded
+// into t, so passwords and tokens needn't be written into the config file.
+// Fields tagged `secret:"true"` may refer to environment variables as
+// ${NAME}, or be given as <key>_file, read from a file, or <key>_keyring,
+// looked up in the OS keyring, instead.
+func resolveSecrets(tree map[string]any, t reflect.Type, path string) error {
+	fields := map[string]reflect.StructField{}
+	collectFields(t, fields)
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		f := fields[key]
+		keyPath := path + key
+		if f.Tag.Get("secret") == "true" {
+			if err := resolveSecret(tree, key, fields); err != nil {
+				return fmt.Errorf("%s: %w", keyPath, err)
+			}
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		switch v := tree[key].(type) {
+		case map[string]any:
+			if ft.Kind() == reflect.Struct {
+				if err := resolveSecrets(v, ft, keyPath+"."); err != nil {
+					return err
+				}
+			}
+		case []any:
+			if ft.Kind() != reflect.Slice || ft.Elem().Kind() != reflect.Struct {
+				continue
+			}
+			for i, elem := range v {
+				if m, ok := elem.(map[string]any); ok {
+					if err := resolveSecrets(m, ft.Elem(), fmt.Sprintf("%s[%d].", keyPath, i)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Adds the fields of struct type t to fields by their json names, including
+// those of embedded structs, as encoding/json sees them.
+func collectFields(t reflect.Type, fields map[string]reflect.StructField) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			collectFields(f.Type, fields)
+			continue
+		}
+		if name != "" && name != "-" && f.IsExported() {
+			fields[name] = f
+		}
+	}
+}
+
+// Fills in the secret setting key of tree from its _file or _keyring
+// variant, if one is given, and expands environment variables in it.
+// Variants that are settings of their own, like restic's password_file,
+// are left for the backend to handle.
+func resolveSecret(tree map[string]any, key string, fields map[string]reflect.StructField) error {
+	for _, variant := range []string{"_file", "_keyring"} {
+		ref, ok := tree[key+variant]
+		if _, own := fields[key+variant]; !ok || own {
+			continue
+		}
+		name, ok := ref.(string)
+		if !ok {
+			return fmt.Errorf("%s%s must be a string", key, variant)
+		}
+		if _, ok := tree[key]; ok {
+			return fmt.Errorf("set only one of %s and %s%s", key, key, variant)
+		}
+		var value string
+		var err error
+		if variant == "_file" {
+			value, err = readSecretFile(name)
+		} else {
+			value, err = keyringLookup(name)
+		}
+		if err != nil {
+			return err
+		}
+		tree[key] = value
+		delete(tree, key+variant)
+	}
+
+	var err error
+	expand := func(s string) string {
+		return envRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+			name := envRefRegexp.FindStringSubmatch(ref)[1]
+			v, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %s isn't set", name)
+			}
+			return v
+		})
+	}
+	switch v := tree[key].(type) {
+	case string:
+		tree[key] = expand(v)
+	case map[string]any:
+		//Tables of secrets, like webhook headers
+		for k, s := range v {
+			if s, ok := s.(string); ok {
+				v[k] = expand(s)
+			}
+		}
+	}
+	return err
+}
+
+// Reads a secret from a file such as a Docker or systemd credential, without
+// the trailing newline most editors add.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Looks up the secret stored in the OS keyring for account under
+// KEYRING_SERVICE: with secret-tool (libsecret) on Linux and the security
+// tool on macOS.
+func keyringLookup(account string) (string, error) {
+	var cmd *exec.Cmd
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "security", "find-generic-password", "-s", KEYRING_SERVICE, "-a", account, "-w")
+	case "windows":
+		return "", errors.New("the OS keyring isn't supported on Windows, use an environment variable or a file")
+	default:
+		cmd = exec.CommandContext(ctx, "secret-tool", "lookup", "service", KEYRING_SERVICE, "account", account)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", fmt.Errorf("looking up %q in the keyring: %w", account, err)
+	}
+	value := strings.TrimRight(string(out), "\r\n")
+	if value == "" {
+		//secret-tool exits cleanly when there is no such secret
+		return "", fmt.Errorf("no secret for %q in the keyring", account)
+	}
+	return value, nil
+}
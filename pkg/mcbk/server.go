@@ -0,0 +1,403 @@
+package mcbk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A configured minecraft server, with the transport used to talk to it and
+// the backend its backups go to.
+type Server struct {
+	conf      ServerConfig
+	backend   Backend
+	transport Transport
+	patterns  verifyPatterns
+	logger    *slog.Logger
+	daemon    bool //Runs in a long-running process, recorded in the locks it takes
+
+	runMu       sync.Mutex
+	cancelRun   context.CancelCauseFunc //Cancels the backup running in this process, nil if there is none
+	interrupted atomic.Bool             //A backup was cancelled along with its context
+}
+
+// Sets up a server's backend and transport. Messages are logged to logger,
+// or slog's default logger if it is nil.
+func NewServer(c ServerConfig, logger *slog.Logger) (*Server, error) {
+	var b Backend = &hostBackend{host: c.Agent.SSH.Host}
+	var err error
+	if !c.Agent.remote() {
+		b, err = NewBackend(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var t Transport = agentTransport{host: c.Agent.SSH.Host}
+	if !c.Agent.Enabled() {
+		t, err = NewTransport(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p, err := c.Verify.compile()
+	if err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Server{conf: c, backend: b, transport: t, patterns: p, logger: logger}, nil
+}
+
+// Marks the server as run by a long-running process such as "mcbk daemon",
+// so the locks it takes are never stopped as hung by other runs.
+func (s *Server) SetDaemon() {
+	s.daemon = true
+}
+
+// The server's profile name.
+func (s *Server) Name() string {
+	return s.conf.Name
+}
+
+func (s *Server) Config() ServerConfig {
+	return s.conf
+}
+
+// Where the server's backups are stored.
+func (s *Server) Backend() Backend {
+	return s.backend
+}
+
+// Releases the transport's connection, if it keeps one.
+func (s *Server) Close() error {
+	return s.transport.Close()
+}
+
+// The server's logger, tagged with its name.
+func (s *Server) log() *slog.Logger {
+	return s.logger.With("server", s.conf.Name)
+}
+
+// Checks there is room for the backup, then runs the save-off, save-all,
+// backup, save-on sequence (save hold, save query, copy, save resume and
+// backup on Bedrock). Returned errors
+// are phaseErrors describing the step that failed, e.g. "saving world: <cause>".
+// World saving is turned back on even if ctx is cancelled part way through.
+// For a cold backup the files are backed up directly instead. corrupt says
+// why the world files look damaged, if source_check found anything, in
+// which case they are backed up anyway.
+func (s *Server) runBackup(ctx context.Context, p Plan) (snap Snapshot, corrupt error, err error) {
+	start := time.Now()
+	if s.conf.Agent.Enabled() {
+		//The host's mcbk runs the in-game commands, leaving a copy here
+		//that is backed up like the files of a stopped server
+		s.log().Info("Copying the world from the host...", "phase", "agent", "host", s.conf.Agent.SSH.Host)
+		if err = s.pullWorld(ctx); err != nil {
+			return snap, corrupt, &phaseError{"agent", err}
+		}
+	}
+	err = s.checkWritable()
+	if err == nil {
+		err = s.checkFreeSpace(ctx)
+	}
+	if err != nil {
+		return snap, corrupt, &phaseError{"preflight", err}
+	}
+	err = s.runHook(ctx, "pre-save", s.conf.Hooks.PreSave, hookRun{Status: "running"})
+	if err != nil {
+		return snap, corrupt, &phaseError{"pre-save", err}
+	}
+
+	savingOff := false
+	var pausedAt time.Time //When players were told the backup started
+	source := s.conf.MinecraftDir
+	staged := false //source is a copy of only the world files
+	if !p.Cold && !s.conf.Agent.Enabled() {
+		if p.Countdown {
+			err = traced(ctx, "countdown", s.countdown)
+			if err != nil {
+				return snap, corrupt, &phaseError{"countdown", err}
+			}
+		}
+
+		savingOff = true
+		defer func() {
+			if !savingOff {
+				return
+			}
+			//ctx may already be cancelled, so save-on runs without it; each
+			//attempt still has its own timeout
+			saveErr := s.sendCommandAndVerify(context.WithoutCancel(ctx), "save-on")
+			if saveErr != nil && err == nil {
+				err = &phaseError{"save-on", fmt.Errorf("turning world saving back on: %w", saveErr)}
+			} else if saveErr != nil {
+				s.log().Error("Error turning world saving back on", "phase", "save-on", "error", saveErr)
+			}
+		}()
+
+		s.broadcast(ctx, s.message(s.conf.Messages.BackupStart, messageData{}))
+		pausedAt = time.Now()
+
+		err = traced(ctx, "save-off", func(ctx context.Context) error {
+			return s.sendCommandAndVerify(ctx, "save-off")
+		})
+		if err != nil {
+			return snap, corrupt, &phaseError{"save-off", fmt.Errorf("turning off world saving: %w", err)}
+		}
+
+		if s.conf.ServerFlavor == BEDROCK_FLAVOR {
+			//"save hold" already has the server prepare a consistent copy
+			s.log().Info("Copying held world files...", "phase", "save-all")
+			dir, release, err := s.bedrockStage(ctx)
+			if err != nil {
+				return snap, corrupt, &phaseError{"save-all", fmt.Errorf("copying held world files: %w", err)}
+			}
+			defer release()
+			source, staged = dir, true
+		} else {
+			s.log().Info("Saving minecraft world...", "phase", "save-all")
+			saveStart := time.Now()
+			err = traced(ctx, "save-all", func(ctx context.Context) error {
+				return s.sendCommandAndVerify(ctx, "save-all")
+			})
+			if err != nil {
+				return snap, corrupt, &phaseError{"save-all", fmt.Errorf("saving world: %w", err)}
+			}
+			s.log().Debug("World saved", "phase", "save-all", "duration", time.Since(saveStart))
+
+			//While saving is off, so the dumps match the world
+			if err = s.dumpDatabases(ctx); err != nil {
+				return snap, corrupt, &phaseError{"dump", err}
+			}
+
+			if staging := s.conf.snapshotStaging(); staging != "" {
+				dir, release, err := s.stageSnapshot(ctx)
+				if err != nil {
+					return snap, corrupt, &phaseError{"snapshot", fmt.Errorf("taking %s snapshot: %w", staging, err)}
+				}
+				defer release()
+				source = dir
+			}
+		}
+
+		if source != s.conf.MinecraftDir {
+			//The copy won't change, so the server may save again while it is backed up
+			savingOff = false
+			err = s.sendCommandAndVerify(ctx, "save-on")
+			if err != nil {
+				return snap, corrupt, &phaseError{"save-on", fmt.Errorf("turning world saving back on: %w", err)}
+			}
+			s.log().Debug("World saving back on, backing up from the copy", "phase", "snapshot", "source", source)
+		}
+	}
+
+	if p.Cold && !s.conf.Agent.Enabled() {
+		if err = s.dumpDatabases(ctx); err != nil {
+			return snap, corrupt, &phaseError{"dump", err}
+		}
+	}
+
+	s.log().Info("Backing up...", "phase", "backup", "cold", p.Cold)
+	saveStart := time.Now()
+	paths, err := s.backupPaths(p.Include...)
+	if err != nil {
+		return snap, corrupt, &phaseError{"backup", err}
+	}
+	if staged {
+		//The copy holds exactly the files the server listed
+		paths = nil
+	}
+	if len(paths) > 0 {
+		s.log().Debug("Backing up worlds", "phase", "backup", "paths", paths)
+	}
+	//Once saved, so the server isn't halfway through writing the files
+	corrupt = s.checkSource(ctx, source, paths)
+	if corrupt != nil {
+		s.log().Warn("The world files look damaged, backing them up anyway", "phase", "source-check", "error", corrupt)
+	}
+	saveCtx, span := startSpan(ctx, "save")
+	err = withPhaseTimeout(saveCtx, s.conf.PhaseTimeouts.Backup.Duration, func(ctx context.Context) error {
+		if err := s.backend.Init(ctx); err != nil {
+			return fmt.Errorf("preparing backup destination: %w", err)
+		}
+		snap, err = s.backend.Save(ctx, source, paths)
+		if err != nil {
+			return fmt.Errorf("saving backup: %w", err)
+		}
+		return nil
+	})
+	span.set("mcbk.snapshot", snap.ID)
+	span.set("mcbk.bytes", snap.Size)
+	span.end(err)
+	if err != nil {
+		return snap, corrupt, &phaseError{"backup", err}
+	}
+	s.log().Debug("Backend save finished", "phase", "backup", "duration", time.Since(saveStart))
+	s.logDedupSavings(ctx)
+	//A snapshot without a manifest is still a good backup, so failing to
+	//write one is only logged. The files are only listed while saving may
+	//still be off, and hashed once it is back on.
+	var manifest *manifestScan
+	if !s.conf.SkipManifest {
+		manifest, err = s.scanManifest(ctx, snap, source, paths)
+		if err != nil {
+			s.log().Warn("Error listing the files for the snapshot's manifest", "phase", "manifest", "snapshot", snap.ID, "error", err)
+		}
+	}
+
+	err = s.runHook(ctx, "post-save", s.conf.Hooks.PostSave, hookRun{Status: "running", Snapshot: snap, Duration: time.Since(start)})
+	if err != nil {
+		return snap, corrupt, &phaseError{"post-save", err}
+	}
+
+	if savingOff {
+		savingOff = false
+		err = s.sendCommandAndVerify(context.WithoutCancel(ctx), "save-on")
+		if err != nil {
+			return snap, corrupt, &phaseError{"save-on", fmt.Errorf("turning world saving back on: %w", err)}
+		}
+	}
+	if !p.Cold && !s.conf.Agent.Enabled() {
+		data := messageData{Duration: formatTook(time.Since(pausedAt)), Snapshot: snap.ID}
+		if snap.Size > 0 {
+			data.Size = FormatBytes(snap.Size)
+		}
+		s.broadcast(ctx, s.message(s.conf.Messages.BackupComplete, data))
+	}
+
+	if manifest != nil {
+		err = traced(ctx, "manifest", func(ctx context.Context) error {
+			return s.writeManifest(ctx, manifest)
+		})
+		if err != nil {
+			s.log().Warn("Error writing the snapshot's manifest", "phase", "manifest", "snapshot", snap.ID, "error", err)
+		}
+	}
+	return snap, corrupt, nil
+}
+
+// Quick check to see if the minecraft server is alive and responsive
+func (s *Server) isMinecraftAlive(ctx context.Context) bool {
+	return s.sendCommandAndVerify(ctx, "list") == nil
+}
+
+func (s *Server) sendCommand(ctx context.Context, command string) error {
+	return s.transport.Send(ctx, command)
+}
+
+// Sends the given command string to the minecraft server and confirms
+// that it worked, retrying with exponential backoff if it fails or isn't
+// confirmed in time, e.g. because the server is lagging.
+func (s *Server) sendCommandAndVerify(ctx context.Context, command string) error {
+	delay := s.conf.CommandRetryWait.Duration
+	for attempt := 0; ; attempt++ {
+		err := s.verifyCommand(ctx, command)
+		if err == nil || attempt >= *s.conf.CommandRetries || ctx.Err() != nil || errors.Is(err, errRCONAuth) {
+			return err
+		}
+		s.log().Warn("Command not confirmed, retrying", "command", command, "attempt", attempt+1, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// What is sent to the server for a command: Bedrock's equivalent, or the
+// configured save_all_command.
+func (s *Server) commandText(command string) string {
+	switch {
+	case s.conf.ServerFlavor == BEDROCK_FLAVOR && bedrockCommands[command] != "":
+		return bedrockCommands[command]
+	case command == "save-all":
+		return s.conf.SaveAllCommand
+	}
+	return command
+}
+
+// Makes a single attempt at a command, looking for its verification
+// pattern in the server log output to confirm that it was sucessfully
+// executed. Transports that return responses directly are checked against
+// the response instead.
+func (s *Server) verifyCommand(ctx context.Context, command string) error {
+	_, err := s.queryCommand(ctx, command)
+	return err
+}
+
+// Like verifyCommand, also returning the response or log line that
+// confirmed the command.
+func (s *Server) queryCommand(ctx context.Context, command string) (string, error) {
+	timeout := s.conf.CommandTimeouts.get(command, s.conf.VerifyTimeout.Duration)
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	match := s.patterns[command]
+	text := s.commandText(command)
+	if q, ok := s.transport.(Querier); ok {
+		resp, err := q.Query(attemptCtx, text)
+		if attemptCtx.Err() != nil && ctx.Err() == nil {
+			return "", errors.New("Command verification timeout")
+		}
+		if err != nil {
+			return "", err
+		}
+		if !match.MatchString(resp) {
+			return "", fmt.Errorf("Unexpected response to %q: %q", text, resp)
+		}
+		return resp, nil
+	}
+
+	follower, err := s.followConsole(attemptCtx)
+	if err != nil {
+		return "", err
+	}
+	defer follower.Close()
+
+	if s.conf.Verify.Marker {
+		err = s.awaitMarker(attemptCtx, follower)
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return "", errors.New("Verification marker not seen in the server log")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	err = s.sendCommand(attemptCtx, text)
+	if err != nil {
+		return "", err
+	}
+
+	var resp string
+	err = follower.waitFor(attemptCtx, func(line string) bool {
+		resp = line
+		return match.MatchString(line)
+	})
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return "", errors.New("Command verification timeout")
+	}
+	return resp, err
+}
+
+// Says a unique marker and waits for the server to log it. Lines before it,
+// such as late output from an earlier command or another admin's, can't
+// confirm the command sent next.
+func (s *Server) awaitMarker(ctx context.Context, follower consoleFollower) error {
+	id := make([]byte, 8)
+	rand.Read(id)
+	marker := "mcbk-verify-" + hex.EncodeToString(id)
+	if err := s.sendCommand(ctx, "say "+marker); err != nil {
+		return err
+	}
+	return follower.waitFor(ctx, func(line string) bool {
+		return strings.Contains(line, marker)
+	})
+}
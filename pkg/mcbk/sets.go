@@ -0,0 +1,104 @@
+package mcbk
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const BACKUP_SET_INTERVAL = 24 * time.Hour //How often a backup set is backed up, unless its interval says otherwise
+
+// Files of a server backed up apart from its worlds, such as plugins, mods
+// and configs, which change rarely but are painful to lose. Each set gets
+// a profile of its own, named <server>-<set>, with its own snapshots,
+// schedule and retention.
+type BackupSetConfig struct {
+	Name      string          `json:"name"`      //Added to the server's name, backup_dir_prefix and tar.name, e.g. "configs"
+	Include   []string        `json:"include"`   //Glob patterns for the paths under minecraft_dir in the set, e.g. ["plugins", "*.json"]
+	Exclude   []string        `json:"exclude"`   //Glob patterns to leave out, default the server's exclude
+	Interval  Duration        `json:"interval"`  //How often "mcbk daemon" and systemd timers back the set up, default 24h
+	Retention RetentionConfig `json:"retention"` //Which of its snapshots to keep, default the backend's built-in pruning
+}
+
+func (c *BackupSetConfig) setDefaults() {
+	if c.Interval.Duration == 0 {
+		c.Interval.Duration = BACKUP_SET_INTERVAL
+	}
+}
+
+func (c ServerConfig) validateSets() []error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, set := range c.Sets {
+		switch {
+		case set.Name == "":
+			errs = append(errs, fmt.Errorf("sets[%d]: missing required setting \"name\"", i))
+		case seen[set.Name]:
+			errs = append(errs, fmt.Errorf("sets[%d]: duplicate name %q", i, set.Name))
+		case strings.ContainsAny(set.Name, `/\`):
+			errs = append(errs, fmt.Errorf("sets[%d]: name %q must not contain path separators", i, set.Name))
+		}
+		seen[set.Name] = true
+		if len(set.Include) == 0 {
+			errs = append(errs, fmt.Errorf("sets[%d]: missing required setting \"include\"", i))
+		}
+	}
+	if len(c.Sets) > 0 && c.Agent.Enabled() {
+		errs = append(errs, errors.New("sets aren't supported with agent, define them on the host"))
+	}
+	return errs
+}
+
+// The profiles of the server's backup sets. They share everything with
+// the server but what is backed up, where it is kept, when and for how
+// long, and leave out what only makes sense for worlds.
+func (c ServerConfig) setProfiles() []ServerConfig {
+	var profiles []ServerConfig
+	for _, set := range c.Sets {
+		if set.Name == "" {
+			continue //Reported by validateSets
+		}
+		p := c.clone()
+		p.Name = c.Name + "-" + set.Name
+		p.Set = set.Name
+		p.Sets = nil
+		p.BackupDirPrefix = c.BackupDirPrefix + "-" + set.Name
+		p.Tar.Name = c.Tar.Name + "-" + set.Name
+		p.Dedup.Dir = c.Dedup.Dir + "-" + set.Name
+		p.HistoryPath = ""
+		p.HealthcheckURL = ""
+		p.Watchdog.MaxAge.Duration = 0
+		p.Worlds, p.Include = nil, slices.Clone(set.Include)
+		if set.Exclude != nil {
+			p.Exclude = slices.Clone(set.Exclude)
+		}
+		p.Interval = set.Interval
+		p.Activity = ActivityConfig{}
+		p.Retention = set.Retention
+		p.Quota = QuotaConfig{}
+		p.Countdown = CountdownConfig{}
+		p.ChatTrigger = ChatTriggerConfig{}
+		p.SkipIdle, p.RequireOnline = false, false
+		p.SizeCheck.MinRatio = 0
+		p.SourceCheck.Enabled = false
+		p.ZFS, p.Btrfs, p.LVM = ZFSConfig{}, BtrfsConfig{}, LVMConfig{}
+		p.Databases.Dump = nil
+		profiles = append(profiles, p)
+	}
+	return profiles
+}
+
+// Adds the profiles of every server's backup sets, each after its server.
+func withSetProfiles(servers []ServerConfig) []ServerConfig {
+	var all []ServerConfig
+	for _, s := range servers {
+		for i := range s.Sets {
+			s.Sets[i].setDefaults()
+		}
+		all = append(all, s)
+		all = append(all, s.setProfiles()...)
+	}
+	return all
+}
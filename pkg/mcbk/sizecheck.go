@@ -0,0 +1,111 @@
+package mcbk
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Settings for catching backups that are far smaller than usual, the sign
+// of a wrong minecraft_dir, a disk that isn't mounted or a wiped world.
+type SizeCheckConfig struct {
+	MinRatio float64 `json:"min_ratio"` //Flag backups whose files total less than this fraction of the recent average, e.g. 0.5. 0 turns the check off
+	Window   int     `json:"window"`    //How many earlier successful backups make up the average, default 5
+	Action   string  `json:"action"`    //"warn" to send a size_anomaly notification and back up anyway, or "fail" to fail the backup instead
+}
+
+func (c SizeCheckConfig) Enabled() bool {
+	return c.MinRatio > 0
+}
+
+func (c *SizeCheckConfig) setDefaults() {
+	if c.Window == 0 {
+		c.Window = 5
+	}
+	if c.Action == "" {
+		c.Action = "warn"
+	}
+}
+
+func (c SizeCheckConfig) validate() []error {
+	var errs []error
+	if c.MinRatio < 0 || c.MinRatio >= 1 {
+		errs = append(errs, fmt.Errorf("size_check.min_ratio must be at least 0 and below 1, got %g", c.MinRatio))
+	}
+	if c.Window < 1 {
+		errs = append(errs, fmt.Errorf("size_check.window must be at least 1, got %d", c.Window))
+	}
+	if c.Action != "warn" && c.Action != "fail" {
+		errs = append(errs, fmt.Errorf("unknown size_check.action %q, expected \"warn\" or \"fail\"", c.Action))
+	}
+	return errs
+}
+
+// Totals the files the next backup would store.
+func (s *Server) sourceSize(ctx context.Context) (int64, error) {
+	excludes, err := parseExcludes(s.conf.Exclude)
+	if err != nil {
+		return 0, err
+	}
+	paths, err := s.backupPaths()
+	if err != nil {
+		return 0, err
+	}
+	return changedSize(ctx, s.conf.MinecraftDir, paths, excludes, time.Time{})
+}
+
+// Compares the size of the files to back up with the average of the last
+// size_check.window successful backups, returning why it looks wrong if it
+// is too small. Delta sizes aren't compared, as deduplicating backends
+// store next to nothing when little has changed.
+func (s *Server) sizeAnomaly(size int64) error {
+	history, err := s.History()
+	if err != nil {
+		s.log().Warn("Error reading history, skipping the size check", "phase", "size-check", "error", err)
+		return nil
+	}
+	var total int64
+	n := 0
+	for i := len(history) - 1; i >= 0 && n < s.conf.SizeCheck.Window; i-- {
+		if history[i].Status == "success" && history[i].SourceBytes > 0 {
+			total += history[i].SourceBytes
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	avg := total / int64(n)
+	if float64(size) >= s.conf.SizeCheck.MinRatio*float64(avg) {
+		return nil
+	}
+	return fmt.Errorf("the files to back up total %s, only %.1f%% of the %s average of the last %d backups; check that minecraft_dir is right and its disk is mounted",
+		FormatBytes(size), 100*float64(size)/float64(avg), FormatBytes(avg), n)
+}
+
+// Measures the files to back up when size_check is on. A size far below
+// the recent average fails the backup with action "fail", unless forced;
+// otherwise it is sent as a size_anomaly and the backup goes ahead.
+func (r *Runner) checkSize(ctx context.Context, s *Server, start time.Time) (int64, error) {
+	//A server on another host is only here once the backup has started
+	if !s.conf.SizeCheck.Enabled() || s.conf.Agent.Enabled() {
+		return 0, nil
+	}
+	size, err := s.sourceSize(ctx)
+	if err != nil {
+		//The backup itself will fail if the files really can't be read
+		s.log().Warn("Error measuring the files to back up, skipping the size check", "phase", "size-check", "error", err)
+		return 0, nil
+	}
+	anomaly := s.sizeAnomaly(size)
+	if anomaly == nil {
+		s.log().Debug("Backup size looks normal", "phase", "size-check", "size", size)
+		return size, nil
+	}
+	if s.conf.SizeCheck.Action == "fail" && !r.force() {
+		return size, &phaseError{"size-check", anomaly}
+	}
+	s.log().Warn("Backup is much smaller than usual", "phase", "size-check", "size", size, "error", anomaly)
+	r.notify(ctx, s, Event{Kind: EventSizeAnomaly, Server: s.conf.Name, Time: time.Now(), Duration: time.Since(start), Err: anomaly})
+	return size, nil
+}
@@ -0,0 +1,149 @@
+package mcbk
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Settings for the slack notifier.
+type SlackConfig struct {
+	Mention string `json:"mention"` //"here" or "channel" to mention @here or @channel on failure and replication_failure, "" for none
+}
+
+func (c SlackConfig) validate(url string) []error {
+	var errs []error
+	if url == "" {
+		errs = append(errs, errors.New("missing url"))
+	}
+	if c.Mention != "" && c.Mention != "here" && c.Mention != "channel" {
+		errs = append(errs, fmt.Errorf("unknown slack.mention %q, expected \"here\" or \"channel\"", c.Mention))
+	}
+	return errs
+}
+
+// Posts events to a Slack channel through an incoming webhook, formatted
+// with Block Kit.
+type slackNotifier struct {
+	url  string
+	conf SlackConfig
+}
+
+type slackText struct {
+	Type  string `json:"type"`
+	Text  string `json:"text"`
+	Emoji bool   `json:"emoji,omitempty"` //Render :emoji: codes in plain_text
+}
+
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text,omitempty"`
+	Fields   []slackText `json:"fields,omitempty"`
+	Elements []slackText `json:"elements,omitempty"`
+}
+
+// Escapes the characters Slack treats as markup in mrkdwn text.
+func slackEscape(s string) string {
+	var b bytes.Buffer
+	for _, r := range s {
+		switch r {
+		case '&':
+			b.WriteString("&amp;")
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (n *slackNotifier) Notify(ev Event) error {
+	var title, errLabel string
+	mention := false
+	var fields []slackText
+	field := func(name, value string) {
+		fields = append(fields, slackText{Type: "mrkdwn", Text: "*" + name + "*\n" + slackEscape(value)})
+	}
+	if ev.Server != DEFAULT_SERVER_NAME {
+		field(sourceLabel(ev), ev.Server)
+	}
+	switch ev.Kind {
+	case EventStart:
+		title = ":arrows_counterclockwise: Minecraft backup started"
+	case EventSuccess:
+		title = ":white_check_mark: Minecraft backup complete"
+		field("Duration", ev.Duration.Round(time.Second).String())
+		if ev.Snapshot.Size > 0 {
+			field("Size", FormatBytes(ev.Snapshot.Size))
+		}
+		if ev.Snapshot.ID != "" {
+			field("Snapshot", ev.Snapshot.ID)
+		}
+	case EventFailure:
+		title = ":x: Minecraft backup FAILED"
+		errLabel, mention = "Error", true
+		field("Duration", ev.Duration.Round(time.Second).String())
+	case EventReplicationFailure:
+		title = ":x: Minecraft backup replication FAILED"
+		errLabel, mention = "Error", true
+		field("Remote", ev.Remote)
+	case EventSizeAnomaly:
+		title = ":warning: Minecraft backup much smaller than usual"
+		errLabel = "Warning"
+	case EventSourceCorrupt:
+		title = ":warning: Minecraft backup taken from a world that may be corrupt"
+		errLabel = "Warning"
+		field("Snapshot", ev.Snapshot.ID)
+	case EventOverdue:
+		title = ":x: Minecraft backup OVERDUE"
+		errLabel, mention = "Error", true
+	case EventNetworkReport:
+		title = ":white_check_mark: Minecraft network backup complete"
+		if ev.Err != nil {
+			title = ":x: Minecraft network backup FAILED"
+			errLabel, mention = "Error", true
+		}
+		field("Duration", ev.Duration.Round(time.Second).String())
+		field("Servers", truncate(ev.Report, 1900))
+	}
+
+	//Header text is plain, so the mention goes in a section of its own
+	blocks := []slackBlock{{Type: "header", Text: &slackText{Type: "plain_text", Text: title, Emoji: true}}}
+	text := title
+	if mention && n.conf.Mention != "" {
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "<!" + n.conf.Mention + ">"}})
+		text = "<!" + n.conf.Mention + "> " + text
+	}
+	if len(fields) > 0 {
+		blocks = append(blocks, slackBlock{Type: "section", Fields: fields})
+	}
+	if errLabel != "" && ev.Err != nil {
+		//Section text is limited to 3000 characters
+		msg := "*" + errLabel + "*\n```" + truncate(slackEscape(ev.Err.Error()), 2900) + "```"
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: msg}})
+	}
+	blocks = append(blocks, slackBlock{Type: "context", Elements: []slackText{{Type: "mrkdwn",
+		Text: fmt.Sprintf("<!date^%d^{date_short_pretty} at {time_secs}|%s>", ev.Time.Unix(), ev.Time.Format(time.RFC3339))}}})
+
+	//text is shown in notifications and by clients that can't render blocks
+	body, err := json.Marshal(map[string]any{"text": text, "blocks": blocks})
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("slack returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
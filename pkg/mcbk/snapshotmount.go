@@ -0,0 +1,317 @@
+package mcbk
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A file or directory in a snapshot mount. Node IDs are indexes into
+// snapshotMount.nodes; 1 is the root, which holds a directory per snapshot.
+type mountNode struct {
+	name     string
+	mode     fs.FileMode //Type and permissions, with write permission removed
+	size     int64
+	mtime    time.Time
+	link     string            //Target of a symlink
+	children map[string]uint64 //Of a directory, by name
+	names    []string          //Of a directory, in snapshot order, for listing
+	snapshot string            //ID of the snapshot the node is in, empty for the root
+	path     string            //Slash-separated path within the snapshot
+	chunks   []string          //dedup: the file's chunks
+	loaded   bool              //Whether a directory's children are known; snapshots are read on first use
+	cache    string            //Where the file's contents were extracted to
+}
+
+// A file, directory or symlink in a snapshot, as a mountSource lists it.
+type mountEntry struct {
+	path   string      //Slash-separated, relative to the snapshot
+	mode   fs.FileMode //Type and permissions
+	size   int64
+	mtime  time.Time
+	link   string   //Target of a symlink
+	chunks []string //dedup: the file's chunks, so it can be read without listing the snapshot again
+}
+
+// A backend whose snapshots mcbk mounts itself rather than with a tool of
+// its own.
+type mountSource interface {
+	// The files in a snapshot, in the order they were saved. Entries of
+	// any other type are left out.
+	mountEntries(ctx context.Context, id string) ([]mountEntry, error)
+	// Writes the contents of a regular file in a mounted snapshot to f,
+	// which is empty.
+	extract(ctx context.Context, n *mountNode, f *os.File) error
+}
+
+// The snapshots of a backend as a tree of read-only files, read from the
+// backend as they are needed. File contents are extracted into a temporary
+// directory the first time they are opened.
+type snapshotMount struct {
+	ctx      context.Context
+	src      mountSource
+	cacheDir string
+	mu       sync.Mutex
+	nodes    []*mountNode
+}
+
+// Sets up a mount of snaps from src, each in a directory at the root named
+// by dirName.
+func newSnapshotMount(ctx context.Context, src mountSource, snaps []Snapshot, dirName func(Snapshot) string) (*snapshotMount, error) {
+	cacheDir, err := os.MkdirTemp("", "mcbk-mount-")
+	if err != nil {
+		return nil, err
+	}
+	m := &snapshotMount{ctx: ctx, src: src, cacheDir: cacheDir}
+	root := &mountNode{mode: fs.ModeDir | 0555, mtime: time.Now(), children: map[string]uint64{}, loaded: true}
+	m.nodes = []*mountNode{nil, root}
+	for _, snap := range snaps {
+		m.add(root, &mountNode{name: dirName(snap), mode: fs.ModeDir | 0555, mtime: snap.Time, children: map[string]uint64{}, snapshot: snap.ID})
+	}
+	return m, nil
+}
+
+// Removes the extracted files.
+func (m *snapshotMount) Close() error {
+	return os.RemoveAll(m.cacheDir)
+}
+
+func (m *snapshotMount) add(parent, n *mountNode) uint64 {
+	id := uint64(len(m.nodes))
+	m.nodes = append(m.nodes, n)
+	if _, ok := parent.children[n.name]; !ok {
+		parent.names = append(parent.names, n.name)
+	}
+	parent.children[n.name] = id
+	return id
+}
+
+// The node with the given ID, or nil.
+func (m *snapshotMount) node(id uint64) *mountNode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id == 0 || id >= uint64(len(m.nodes)) {
+		return nil
+	}
+	return m.nodes[id]
+}
+
+// Lists the snapshot holding the directory, if that hasn't been done yet.
+func (m *snapshotMount) load(id uint64) (*mountNode, error) {
+	dir := m.node(id)
+	if dir == nil {
+		return nil, fs.ErrNotExist
+	}
+	if !dir.mode.IsDir() {
+		return nil, errors.New("not a directory")
+	}
+	m.mu.Lock()
+	loaded := dir.loaded
+	m.mu.Unlock()
+	if loaded {
+		return dir, nil
+	}
+	entries, err := m.src.mountEntries(m.ctx, dir.snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if dir.loaded {
+		return dir, nil
+	}
+	for _, e := range entries {
+		rel := path.Clean(strings.TrimPrefix(e.path, "/"))
+		if rel == "." || !fs.ValidPath(rel) {
+			continue
+		}
+		parent := dir
+		parts := strings.Split(rel, "/")
+		for _, part := range parts[:len(parts)-1] {
+			id, ok := parent.children[part]
+			if !ok {
+				id = m.add(parent, &mountNode{name: part, mode: fs.ModeDir | 0555, mtime: e.mtime, children: map[string]uint64{}, snapshot: dir.snapshot, loaded: true})
+			}
+			parent = m.nodes[id]
+		}
+		n := &mountNode{name: parts[len(parts)-1], mtime: e.mtime, snapshot: dir.snapshot, path: rel, loaded: true}
+		perm := e.mode.Perm() &^ 0222
+		switch {
+		case e.mode.IsDir():
+			if id, ok := parent.children[n.name]; ok {
+				m.nodes[id].mtime = e.mtime
+				continue
+			}
+			n.mode, n.children = fs.ModeDir|perm|0500, map[string]uint64{}
+		case e.mode.IsRegular():
+			n.mode, n.size, n.chunks = perm|0400, e.size, e.chunks
+		case e.mode&fs.ModeSymlink != 0:
+			n.mode, n.link, n.size = fs.ModeSymlink|0777, e.link, int64(len(e.link))
+		default:
+			continue
+		}
+		m.add(parent, n)
+	}
+	dir.loaded = true
+	return dir, nil
+}
+
+// The ID of the child of a directory with the given name.
+func (m *snapshotMount) lookup(parent uint64, name string) (uint64, error) {
+	dir, err := m.load(parent)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := dir.children[name]
+	if !ok {
+		return 0, fs.ErrNotExist
+	}
+	return id, nil
+}
+
+// The IDs of the children of a directory, in snapshot order.
+func (m *snapshotMount) readDir(id uint64) ([]uint64, error) {
+	dir, err := m.load(id)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]uint64, len(dir.names))
+	for i, name := range dir.names {
+		ids[i] = dir.children[name]
+	}
+	return ids, nil
+}
+
+// Opens a file for reading, extracting it from its snapshot first unless
+// that was done already.
+func (m *snapshotMount) open(id uint64) (*os.File, error) {
+	n := m.node(id)
+	if n == nil {
+		return nil, fs.ErrNotExist
+	}
+	if !n.mode.IsRegular() {
+		return nil, errors.New("not a regular file")
+	}
+	m.mu.Lock()
+	cache := n.cache
+	m.mu.Unlock()
+	if cache != "" {
+		return os.Open(cache)
+	}
+
+	f, err := os.CreateTemp(m.cacheDir, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := m.src.extract(m.ctx, n, f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	m.mu.Lock()
+	if n.cache == "" {
+		n.cache = f.Name()
+	}
+	m.mu.Unlock()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reads the headers of an archive.
+func (b *tarBackend) mountEntries(ctx context.Context, id string) ([]mountEntry, error) {
+	var entries []mountEntry
+	err := b.open(ctx, id, func(r io.Reader) error {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			switch hdr.Typeflag {
+			case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+				entries = append(entries, mountEntry{path: hdr.Name, mode: hdr.FileInfo().Mode(), size: hdr.Size, mtime: hdr.ModTime, link: hdr.Linkname})
+			}
+		}
+	})
+	return entries, err
+}
+
+// Finds the file in its archive, reading the archive up to the end.
+func (b *tarBackend) extract(ctx context.Context, n *mountNode, f *os.File) error {
+	found := false
+	err := b.open(ctx, n.snapshot, func(r io.Reader) error {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			//The last entry for a path wins, as it does when extracting
+			if hdr.Typeflag != tar.TypeReg || path.Clean(strings.TrimPrefix(hdr.Name, "/")) != n.path {
+				continue
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				return err
+			}
+			found = true
+		}
+	})
+	if err == nil && !found {
+		err = fs.ErrNotExist
+	}
+	return err
+}
+
+// Serves the archives as a read-only filesystem at dir.
+func (b *tarBackend) Mount(ctx context.Context, dir string) error {
+	snaps, err := b.List(ctx)
+	if err != nil {
+		return err
+	}
+	m, err := newSnapshotMount(ctx, b, snaps, func(snap Snapshot) string {
+		return strings.TrimSuffix(strings.TrimSuffix(snap.ID, AGE_SUFFIX), ".tar.gz")
+	})
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return serveFUSE(ctx, dir, m)
+}
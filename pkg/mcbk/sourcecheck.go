@@ -0,0 +1,118 @@
+package mcbk
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Settings for checking the world files for corruption before each backup,
+// so a damaged world is noticed before every backup kept has inherited it.
+type SourceCheckConfig struct {
+	Enabled bool `json:"enabled"` //Parse every level.dat and region file header before backing up
+	Sample  int  `json:"sample"`  //Only check this many region files, the most recently written. 0 checks them all
+}
+
+func (c SourceCheckConfig) validate() []error {
+	if c.Sample < 0 {
+		return []error{fmt.Errorf("source_check.sample must not be negative, got %d", c.Sample)}
+	}
+	return nil
+}
+
+// A world file found by checkSource.
+type worldFile struct {
+	rel     string
+	path    string
+	modTime time.Time
+}
+
+// Parses the level.dat files and region file headers among the files to
+// back up from dir, returning what looks damaged, or nil. The backup goes
+// ahead either way, flagged as taken from a source that may be corrupt.
+// Errors reading dir are only logged, as the backup itself will fail if the
+// files really can't be read.
+func (s *Server) checkSource(ctx context.Context, dir string, paths []string) error {
+	if !s.conf.SourceCheck.Enabled {
+		return nil
+	}
+	start := time.Now()
+	excludes, err := parseExcludes(s.conf.Exclude)
+	if err != nil {
+		return nil
+	}
+	var levels, regions []worldFile
+	err = walkPaths(dir, paths, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && excluded(excludes, filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := d.Name()
+		if !d.Type().IsRegular() || name != "level.dat" && !strings.HasSuffix(name, ".mca") && !strings.HasSuffix(name, ".mcr") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := worldFile{rel: filepath.ToSlash(rel), path: path, modTime: info.ModTime()}
+		if name == "level.dat" {
+			levels = append(levels, f)
+		} else {
+			regions = append(regions, f)
+		}
+		return nil
+	})
+	if err != nil {
+		s.log().Warn("Error looking for world files, skipping the source check", "phase", "source-check", "error", err)
+		return nil
+	}
+	if n := s.conf.SourceCheck.Sample; n > 0 && len(regions) > n {
+		//The ones the server has been writing to are the likeliest to be damaged
+		slices.SortFunc(regions, func(a, b worldFile) int { return b.modTime.Compare(a.modTime) })
+		regions = regions[:n]
+	}
+
+	var problems []string
+	for _, f := range levels {
+		if err := checkLevelDat(f.path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s doesn't parse: %s", f.rel, err))
+		}
+	}
+	chunks := 0
+	for _, f := range regions {
+		n, err := checkRegionFile(f.path)
+		chunks += n
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s has a damaged header: %s", f.rel, err))
+		}
+	}
+	if len(levels) == 0 {
+		problems = append(problems, "no level.dat found, so no world")
+	}
+	s.log().Debug("Checked the world files", "phase", "source-check", "level_dats", len(levels), "region_files", len(regions),
+		"chunks", chunks, "problems", len(problems), "duration", time.Since(start))
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("source may be corrupt: %s", problems[0])
+	}
+	return fmt.Errorf("source may be corrupt: %s (and %d more problems)", problems[0], len(problems)-1)
+}
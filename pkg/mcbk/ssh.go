@@ -0,0 +1,219 @@
+package mcbk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Settings for reaching another host over SSH, to keep tar archives on for
+// servers without spare local disk, or to back up a server running there.
+// Only key-based logins are used, and the host's key must already be in
+// known_hosts.
+type SSHConfig struct {
+	Host         string `json:"host"`          //Host to connect to. For tar.ssh, empty keeps archives in tar.dir
+	Port         int    `json:"port"`          //Default 22
+	User         string `json:"user"`          //Login name, defaults to ssh's own choice
+	IdentityFile string `json:"identity_file"` //Private key to log in with
+	KnownHosts   string `json:"known_hosts"`   //File holding the host's public key, e.g. from ssh-keyscan. A host with any other key is refused
+	Path         string `json:"path"`          //For tar.ssh, the directory on the host to keep archives in, relative to the login's home unless absolute
+}
+
+func (c SSHConfig) Enabled() bool {
+	return c.Host != ""
+}
+
+// Checks the connection settings, named in errors by key, e.g. "tar.ssh".
+func (c SSHConfig) validate(key string) []error {
+	var errs []error
+	if c.IdentityFile == "" || c.KnownHosts == "" {
+		errs = append(errs, fmt.Errorf("%s needs identity_file and known_hosts", key))
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("%s.port must be between 1 and 65535, got %d", key, c.Port))
+	}
+	if strings.HasPrefix(c.Host, "-") || strings.ContainsAny(c.Host+c.User, " @") {
+		errs = append(errs, fmt.Errorf("%s.host must be a host name and user a login name, got %q and %q", key, c.Host, c.User))
+	}
+	return errs
+}
+
+// Where the archives live, as shown for snapshots, e.g. "mc@backup:/srv/mc".
+func (c SSHConfig) location() string {
+	host := c.Host
+	if c.User != "" {
+		host = c.User + "@" + host
+	}
+	return host + ":" + c.Path
+}
+
+// Arguments for ssh that run command on the host without ever prompting:
+// BatchMode fails instead of asking for a password or to accept an
+// unknown host key.
+func (c SSHConfig) args(command string) []string {
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=" + c.KnownHosts,
+		"-o", "IdentitiesOnly=yes",
+		"-i", c.IdentityFile,
+	}
+	if c.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(c.Port))
+	}
+	if c.User != "" {
+		args = append(args, "-l", c.User)
+	}
+	return append(args, c.Host, "--", command)
+}
+
+// Quotes s for the remote POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Runs a command on the host, with stderr kept for the error.
+func (c SSHConfig) run(ctx context.Context, command string, setup func(cmd *exec.Cmd) error, run func() error) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ssh", c.args(command)...)
+	cmd.WaitDelay = COMMAND_CANCEL_GRACE
+	cmd.Stderr = &stderr
+	if err := setup(cmd); err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting ssh: %w", err)
+	}
+	err := run()
+	werr := cmd.Wait()
+	msg := strings.TrimSpace(stderr.String())
+	switch {
+	case werr != nil && msg != "":
+		return fmt.Errorf("ssh %s: %w: %s", c.Host, werr, msg)
+	case werr != nil && err == nil:
+		return fmt.Errorf("ssh %s: %w", c.Host, werr)
+	}
+	return err
+}
+
+// Runs a command on the host that needs no input, returning its output.
+func (c SSHConfig) output(ctx context.Context, command string) ([]byte, error) {
+	var out bytes.Buffer
+	err := c.run(ctx, command, func(cmd *exec.Cmd) error {
+		cmd.Stdout = &out
+		return nil
+	}, func() error { return nil })
+	return out.Bytes(), err
+}
+
+// Keeps tar archives in a directory on another host, reached by running
+// POSIX shell commands over ssh.
+type sshTarStore struct {
+	conf SSHConfig
+}
+
+func (s sshTarStore) location() string {
+	return s.conf.location()
+}
+
+func (s sshTarStore) file(name string) string {
+	return shellQuote(path.Join(s.conf.Path, name))
+}
+
+func (s sshTarStore) init(ctx context.Context) error {
+	_, err := s.conf.output(ctx, "mkdir -p -- "+shellQuote(s.conf.Path))
+	return err
+}
+
+// Streams the archive to a hidden file on the host, then renames it into
+// place in a second command, once the whole archive was written and the
+// host has exactly as many bytes as were sent. A dropped connection ends
+// the remote cat as if the archive were complete, so it can't be trusted
+// to decide on its own.
+func (s sshTarStore) create(ctx context.Context, name string, write func(io.Writer) error) (int64, error) {
+	tmp := s.file("." + name + ".partial")
+	var in io.WriteCloser
+	counter := &countingWriter{}
+	err := s.conf.run(ctx, "cat > "+tmp, func(cmd *exec.Cmd) (err error) {
+		in, err = cmd.StdinPipe()
+		counter.w = in
+		return err
+	}, func() error {
+		err := write(counter)
+		if cerr := in.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if err == nil {
+		_, err = s.conf.output(ctx, fmt.Sprintf(`[ "$(wc -c < %s)" -eq %d ] && mv -- %s %s || { echo "the archive arrived incomplete" >&2; exit 1; }`,
+			tmp, counter.n, tmp, s.file(name)))
+	}
+	if err != nil {
+		s.conf.output(context.WithoutCancel(ctx), "rm -f -- "+tmp)
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// Lists the files in the directory whose names start with prefix, with
+// their sizes.
+func (s sshTarStore) list(ctx context.Context, prefix string) ([]tarEntry, error) {
+	command := fmt.Sprintf(`cd -- %s 2>/dev/null || exit 0; for f in %s*; do [ -f "$f" ] && printf '%%s %%s\n' "$(wc -c < "$f")" "$f"; done; exit 0`,
+		shellQuote(s.conf.Path), shellQuote(prefix))
+	out, err := s.conf.output(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	var entries []tarEntry
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		size, name, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		n, err := strconv.ParseInt(size, 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("unexpected line listing %s: %q", s.location(), scanner.Text())
+		}
+		entries = append(entries, tarEntry{name: name, size: n})
+	}
+	return entries, nil
+}
+
+func (s sshTarStore) open(ctx context.Context, name string, read func(io.Reader) error) error {
+	var out io.ReadCloser
+	return s.conf.run(ctx, "cat -- "+s.file(name), func(cmd *exec.Cmd) (err error) {
+		out, err = cmd.StdoutPipe()
+		return err
+	}, func() error {
+		err := read(out)
+		if err == nil {
+			//Lets cat finish rather than fail writing what read didn't need
+			_, err = io.Copy(io.Discard, out)
+		}
+		//Stops the transfer if read failed
+		out.Close()
+		return err
+	})
+}
+
+func (s sshTarStore) remove(ctx context.Context, name string) error {
+	_, err := s.conf.output(ctx, "rm -- "+s.file(name))
+	return err
+}
+
+// Counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
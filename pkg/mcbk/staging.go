@@ -0,0 +1,49 @@
+package mcbk
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Which filesystem snapshot backups are staged through: "zfs", "btrfs",
+// "lvm", or "" to back up minecraft_dir directly.
+func (c ServerConfig) snapshotStaging() string {
+	switch {
+	case c.ZFS.Enabled():
+		return "zfs"
+	case c.Btrfs.Enabled():
+		return "btrfs"
+	case c.LVM.Enabled():
+		return "lvm"
+	}
+	return ""
+}
+
+// Takes the filesystem snapshot picked by snapshotStaging. Returns where
+// minecraft_dir appears in it, and a function that removes it again.
+func (s *Server) stageSnapshot(ctx context.Context) (string, func(), error) {
+	switch s.conf.snapshotStaging() {
+	case "btrfs":
+		return s.btrfsSnapshot(ctx)
+	case "lvm":
+		return s.lvmSnapshot(ctx)
+	}
+	return s.zfsSnapshot(ctx)
+}
+
+// Name for a new snapshot of the server's filesystem.
+func (s *Server) stagingSnapshotName() string {
+	return "mcbk-" + s.conf.Name + "-" + time.Now().UTC().Format(ZFS_SNAPSHOT_TIME_FORMAT)
+}
+
+// The path of minecraft_dir relative to root, the mountpoint of the
+// filesystem being snapshotted, which must hold it.
+func (s *Server) dirWithin(root, what string) (string, error) {
+	rel, err := filepath.Rel(root, s.conf.MinecraftDir)
+	if err != nil || !filepath.IsLocal(rel) && rel != "." {
+		return "", fmt.Errorf("minecraft_dir %s is not inside %s, mounted at %s", s.conf.MinecraftDir, what, root)
+	}
+	return rel, nil
+}
@@ -0,0 +1,115 @@
+package mcbk
+
+import (
+	"context"
+	"time"
+)
+
+// Measures the space the server's backups take up before a backup, for
+// working out how much it grew. Returns -1 if it can't be measured, e.g.
+// for a repository reached over the network.
+func (s *Server) repoSizeBefore(ctx context.Context) int64 {
+	if s.conf.Agent.remote() {
+		return -1
+	}
+	size, ok, err := s.diskUsage(ctx)
+	if err != nil || !ok {
+		return -1
+	}
+	return size
+}
+
+// Fills in the statistics of a successful run: the size of the files backed
+// up, the size of the backups after it and how much they grew, and from
+// those the deduplication ratio. repoBefore is from repoSizeBefore. Where
+// the backups aren't on this machine, the size the backend reported for the
+// new snapshot stands in for the growth.
+func (s *Server) recordStats(ctx context.Context, rec *HistoryRecord, repoBefore int64) {
+	//The files and the backups are both on the host, which records its own
+	if s.conf.Agent.remote() {
+		rec.RepoGrowth = rec.Bytes
+		return
+	}
+	if rec.SourceBytes == 0 {
+		size, err := s.sourceSize(ctx)
+		if err != nil {
+			s.log().Warn("Error measuring the files backed up for statistics", "phase", "stats", "error", err)
+		}
+		rec.SourceBytes = size
+	}
+	rec.RepoGrowth = rec.Bytes
+	if repoBefore >= 0 {
+		if size, ok, err := s.diskUsage(ctx); err != nil {
+			s.log().Warn("Error measuring the backups for statistics", "phase", "stats", "error", err)
+		} else if ok {
+			rec.RepoBytes, rec.RepoGrowth = size, size-repoBefore
+		}
+	}
+	if rec.SourceBytes > 0 && rec.RepoGrowth > 0 {
+		rec.DedupRatio = float64(rec.SourceBytes) / float64(rec.RepoGrowth)
+	}
+	s.log().Info("Backup statistics", "phase", "stats", "source_bytes", rec.SourceBytes, "repo_bytes", rec.RepoBytes,
+		"repo_growth", rec.RepoGrowth, "dedup_ratio", rec.DedupRatio)
+}
+
+// A summary of a server's backup runs over a period, from its history.
+type Stats struct {
+	Server       string    `json:"server"`
+	Since        time.Time `json:"since"`
+	Runs         int       `json:"runs"`
+	Successes    int       `json:"successes"`
+	SourceBytes  int64     `json:"source_bytes"`  //Size of the files backed up by the last successful run
+	SourceGrowth int64     `json:"source_growth"` //How much that grew since the first successful run of the period
+	RepoBytes    int64     `json:"repo_bytes"`    //Space the backups took up after the last successful run, 0 if not known
+	RepoGrowth   int64     `json:"repo_growth"`   //Total the backups grew by over the period, before pruning
+	DedupRatio   float64   `json:"dedup_ratio"`   //Bytes backed up per byte stored over the period, 0 if not known
+	AvgDuration  float64   `json:"avg_duration_seconds"`
+	MaxDuration  float64   `json:"max_duration_seconds"`
+}
+
+// Sums up the runs recorded in the server's history since the given time.
+func (s *Server) Stats(since time.Time) (Stats, error) {
+	st := Stats{Server: s.conf.Name, Since: since}
+	history, err := s.History()
+	if err != nil {
+		return st, err
+	}
+	var first *HistoryRecord
+	var total time.Duration
+	var dedupSource, dedupStored int64
+	for i, rec := range history {
+		if rec.Start.Before(since) || rec.Status == "skipped" {
+			continue
+		}
+		st.Runs++
+		d := rec.End.Sub(rec.Start)
+		total += d
+		st.MaxDuration = max(st.MaxDuration, d.Seconds())
+		if rec.Status != "success" {
+			continue
+		}
+		st.Successes++
+		if rec.SourceBytes > 0 {
+			if first == nil {
+				first = &history[i]
+			}
+			st.SourceBytes, st.SourceGrowth = rec.SourceBytes, rec.SourceBytes-first.SourceBytes
+		}
+		if rec.RepoBytes > 0 {
+			st.RepoBytes = rec.RepoBytes
+		}
+		st.RepoGrowth += rec.RepoGrowth
+		//Only runs that recorded both, so the ratio isn't skewed
+		if rec.DedupRatio > 0 {
+			dedupSource += rec.SourceBytes
+			dedupStored += rec.RepoGrowth
+		}
+	}
+	if st.Runs > 0 {
+		st.AvgDuration = total.Seconds() / float64(st.Runs)
+	}
+	if dedupStored > 0 {
+		st.DedupRatio = float64(dedupSource) / float64(dedupStored)
+	}
+	return st, nil
+}
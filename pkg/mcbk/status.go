@@ -0,0 +1,134 @@
+package mcbk
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A snapshot of a server's backup state, as shown by "mcbk status".
+type Status struct {
+	Server       string     `json:"server"`
+	Reachable    bool       `json:"reachable"`             //The server answered "list"
+	InProgress   bool       `json:"in_progress"`           //Another process holds the server's backup lock
+	LockHolder   *LockInfo  `json:"lock_holder,omitempty"` //The run holding it
+	LastSuccess  *time.Time `json:"last_success"`          //When the last successful backup was taken
+	LastSnapshot string     `json:"last_snapshot,omitempty"`
+	LastSize     int64      `json:"last_size"`              //Bytes the last successful backup added, 0 if unknown
+	LastFailure  *time.Time `json:"last_failure,omitempty"` //Start of the last failed run, if it came after the last success
+	LastError    string     `json:"last_error,omitempty"`
+	NextRun      *time.Time `json:"next_run"`   //When the daemon will back up next, nil if no daemon is scheduling the server
+	DiskUsage    *int64     `json:"disk_usage"` //Bytes the server's backups take up, nil if they aren't stored locally
+}
+
+// Gathers the server's backup state. Reaching the server takes a single
+// "list" with no retries, so a status check waits at most verify_timeout.
+// The caller closes the server's transport afterwards.
+func (s *Server) Status(ctx context.Context) (Status, error) {
+	st := Status{Server: s.conf.Name}
+	st.Reachable = s.verifyCommand(ctx, "list") == nil
+
+	holder, err := s.lockHolder()
+	if err != nil {
+		return st, err
+	}
+	st.InProgress, st.LockHolder = holder != nil, holder
+
+	history, err := s.History()
+	if err != nil {
+		return st, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		r := history[i]
+		if r.Status == "success" {
+			st.LastSuccess, st.LastSnapshot, st.LastSize = &r.Start, r.Snapshot, r.Bytes
+			break
+		}
+		if r.Status == "failure" && st.LastFailure == nil {
+			st.LastFailure, st.LastError = &r.Start, r.Error
+		}
+	}
+	if st.LastSuccess == nil {
+		//Backups taken before history was kept
+		snaps, err := s.backend.List(ctx)
+		if err != nil {
+			return st, err
+		}
+		if len(snaps) > 0 {
+			last := snaps[len(snaps)-1]
+			st.LastSuccess, st.LastSnapshot, st.LastSize = &last.Time, last.ID, last.Size
+		}
+	}
+
+	if next, err := s.nextRun(); err != nil {
+		return st, err
+	} else if !next.IsZero() {
+		st.NextRun = &next
+	}
+	if size, ok, err := s.diskUsage(ctx); err != nil {
+		return st, err
+	} else if ok {
+		st.DiskUsage = &size
+	}
+	return st, nil
+}
+
+// Where the daemon records when it will next back up the server.
+func (s *Server) nextRunPath() string {
+	return filepath.Join(s.conf.BackupRoot, s.conf.BackupDirPrefix+".next")
+}
+
+// Records when the daemon will next back up the server, for "mcbk status".
+// The zero time clears it, for when the daemon stops.
+func (s *Server) RecordNextRun(t time.Time) {
+	var err error
+	if t.IsZero() {
+		err = os.Remove(s.nextRunPath())
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+	} else {
+		err = os.WriteFile(s.nextRunPath(), []byte(t.Format(time.RFC3339)+"\n"), 0660)
+	}
+	if err != nil {
+		s.log().Warn("Error recording the next scheduled backup", "path", s.nextRunPath(), "error", err)
+	}
+}
+
+// When the daemon will next back up the server, or the zero time if no
+// daemon has recorded it.
+func (s *Server) nextRun() (time.Time, error) {
+	data, err := os.ReadFile(s.nextRunPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+}
+
+// Totals the space the server's backups take up, if they are stored on
+// this machine.
+func (s *Server) diskUsage(ctx context.Context) (int64, bool, error) {
+	if store, ok := s.backend.(fileStore); ok {
+		files, err := listLocalFiles(store.Files())
+		var total int64
+		for _, info := range files {
+			total += info.Size()
+		}
+		return total, true, err
+	}
+	dir := s.localRepo()
+	if dir == "" {
+		return 0, false, nil
+	}
+	size, err := changedSize(ctx, dir, nil, nil, time.Time{})
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, true, nil
+	}
+	return size, true, err
+}
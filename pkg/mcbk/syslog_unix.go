@@ -0,0 +1,29 @@
+//go:build unix
+
+package mcbk
+
+import (
+	"fmt"
+	"log/slog"
+	"log/syslog"
+)
+
+// A slog handler sending records to the local syslog daemon under the
+// daemon facility, with their level as the message's severity.
+func NewSyslogHandler(format string) (slog.Handler, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, SYSLOG_IDENTIFIER)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+	return newSinkHandler(format, func(level slog.Level, msg string) error {
+		switch syslogPriority(level) {
+		case 3:
+			return w.Err(msg)
+		case 4:
+			return w.Warning(msg)
+		case 6:
+			return w.Info(msg)
+		}
+		return w.Debug(msg)
+	}), nil
+}
@@ -0,0 +1,10 @@
+package mcbk
+
+import (
+	"errors"
+	"log/slog"
+)
+
+func NewSyslogHandler(format string) (slog.Handler, error) {
+	return nil, errors.New("syslog isn't available on Windows, use log_output = \"file\"")
+}
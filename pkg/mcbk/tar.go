@@ -0,0 +1,625 @@
+package mcbk
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const TAR_TIME_FORMAT = "20060102-150405" //Timestamp embedded in archive names
+
+// Settings for the tar backend.
+type TarConfig struct {
+	Dir              string    `json:"dir"`               //Where archives are written, defaults to backup_root
+	Name             string    `json:"name"`              //Archive name prefix, archives are <name>-YYYYMMDD-HHMMSS.tar.gz
+	CompressionLevel *int      `json:"compression_level"` //gzip level from 0 (none) to 9 (best), default 6
+	Keep             int       `json:"keep"`              //Number of archives kept when pruning
+	Age              AgeConfig `json:"age"`               //Encrypt archives with age, so off-site copies can't be read by the storage provider
+	SSH              SSHConfig `json:"ssh"`               //Keep archives on another host instead of in dir
+}
+
+// Writes each backup as a standalone timestamped .tar.gz archive, using
+// only the standard library, or .tar.gz.age when encrypting with age.
+type tarBackend struct {
+	store    tarStore
+	name     string
+	level    int
+	keep     int
+	excludes []excludePattern
+	age      AgeConfig
+}
+
+// A tar backend keeping its archives in a local directory, which features
+// like S3 uploads and the quota work on directly.
+type localTarBackend struct {
+	*tarBackend
+	dir string
+}
+
+func newTarBackend(c TarConfig, excludes []excludePattern) Backend {
+	level := gzip.DefaultCompression
+	if c.CompressionLevel != nil {
+		level = *c.CompressionLevel
+	}
+	b := &tarBackend{name: c.Name, level: level, keep: c.Keep, excludes: excludes, age: c.Age}
+	if c.SSH.Enabled() {
+		b.store = sshTarStore{conf: c.SSH}
+		return b
+	}
+	b.store = localTarStore{dir: c.Dir}
+	return localTarBackend{tarBackend: b, dir: c.Dir}
+}
+
+// Where the tar backend keeps its archives. Names are plain file names.
+type tarStore interface {
+	location() string
+	init(ctx context.Context) error
+	//Writes a new file with what write produces, only making it visible
+	//under name once complete, and returns its size
+	create(ctx context.Context, name string, write func(io.Writer) error) (int64, error)
+	//Lists the files whose names start with prefix
+	list(ctx context.Context, prefix string) ([]tarEntry, error)
+	open(ctx context.Context, name string, read func(io.Reader) error) error
+	remove(ctx context.Context, name string) error
+}
+
+type tarEntry struct {
+	name string
+	size int64
+}
+
+// Every finished archive, encrypted or not; partial ones are hidden.
+func (b localTarBackend) Files() (string, string) {
+	return b.dir, b.name + "-*.tar.gz*"
+}
+
+func (b *tarBackend) Init(ctx context.Context) error {
+	return b.store.init(ctx)
+}
+
+// Archives dir into a new file. The archive is written under a temporary
+// name and renamed once complete, so a failed run never leaves a truncated
+// archive that looks like a real one.
+func (b *tarBackend) Save(ctx context.Context, dir string, paths []string) (Snapshot, error) {
+	now := time.Now()
+	name := b.name + "-" + now.Format(TAR_TIME_FORMAT) + ".tar.gz"
+	if b.age.Enabled() {
+		name += AGE_SUFFIX
+	}
+	size, err := b.store.create(ctx, name, func(w io.Writer) error {
+		if b.age.Enabled() {
+			return b.age.encrypt(ctx, w, func(w io.Writer) error {
+				return writeTarGz(ctx, w, dir, paths, b.level, b.excludes)
+			})
+		}
+		return writeTarGz(ctx, w, dir, paths, b.level, b.excludes)
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{ID: name, Time: now, Repo: b.store.location(), Size: size}, nil
+}
+
+// Writes a gzipped tarball of everything under dir, or under paths within
+// it, that isn't excluded, with names relative to dir. Stops between files
+// if ctx is cancelled, and reports progress after each one.
+func writeTarGz(ctx context.Context, w io.Writer, dir string, paths []string, level int, excludes []excludePattern) error {
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gz)
+	var done int64
+	err = walkPaths(dir, paths, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if excluded(excludes, filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.CopyN(tw, f, hdr.Size)
+		done += n
+		reportProgress(ctx, done, 0)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Every archive is a full copy.
+func (b localTarBackend) spaceTarget(ctx context.Context) (string, time.Time, error) {
+	return b.dir, time.Time{}, nil
+}
+
+func (b *tarBackend) List(ctx context.Context) ([]Snapshot, error) {
+	entries, err := b.store.list(ctx, b.name+"-")
+	if err != nil {
+		return nil, err
+	}
+	var snaps []Snapshot
+	for _, e := range entries {
+		stamp := strings.TrimPrefix(strings.TrimSuffix(e.name, AGE_SUFFIX), b.name+"-")
+		stamp, ok := strings.CutSuffix(stamp, ".tar.gz")
+		if !ok {
+			continue
+		}
+		t, err := time.ParseInLocation(TAR_TIME_FORMAT, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		snaps = append(snaps, Snapshot{ID: e.name, Time: t, Repo: b.store.location(), Size: e.size})
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Time.Before(snaps[j].Time)
+	})
+	return snaps, nil
+}
+
+// Runs read with the gzipped tarball of the archive with the given file
+// name, decrypting it first if it was encrypted.
+func (b *tarBackend) open(ctx context.Context, id string, read func(r io.Reader) error) error {
+	if !validTarName(id) {
+		return fmt.Errorf("invalid tar snapshot id %q", id)
+	}
+	return b.store.open(ctx, id, func(r io.Reader) error {
+		if strings.HasSuffix(id, AGE_SUFFIX) {
+			return b.age.decrypt(ctx, r, read)
+		}
+		return read(r)
+	})
+}
+
+// Whether id is a plain file name, which can't point outside the archive
+// directory.
+func validTarName(id string) bool {
+	return id != "" && filepath.Base(id) == id && !strings.ContainsAny(id, `/\`)
+}
+
+// Extracts the archive with the given file name into target.
+func (b *tarBackend) Restore(ctx context.Context, id, target string) error {
+	return b.open(ctx, id, func(r io.Reader) error {
+		return extractTarGz(ctx, r, target, nil)
+	})
+}
+
+// Extracts only the given paths from an archive, skipping the rest of it.
+func (b *tarBackend) RestorePaths(ctx context.Context, id, target string, paths []string) error {
+	return b.open(ctx, id, func(r io.Reader) error {
+		return extractTarGz(ctx, r, target, paths)
+	})
+}
+
+// Lists the files in an archive from its headers, without extracting it.
+func (b *tarBackend) ListFiles(ctx context.Context, id string) ([]SnapshotFile, error) {
+	return b.listFiles(ctx, id, false)
+}
+
+// Lists the regular files in an archive with the SHA-256 hashes of their
+// contents, reading the whole archive.
+func (b *tarBackend) HashFiles(ctx context.Context, id string) ([]SnapshotFile, error) {
+	return b.listFiles(ctx, id, true)
+}
+
+func (b *tarBackend) listFiles(ctx context.Context, id string, hash bool) ([]SnapshotFile, error) {
+	var files []SnapshotFile
+	err := b.open(ctx, id, func(r io.Reader) error {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr := tar.NewReader(gz)
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeDir || hash && hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			f := SnapshotFile{Path: hdr.Name, Size: hdr.Size, ModTime: hdr.ModTime.Truncate(time.Second)}
+			if hash {
+				h := sha256.New()
+				if _, err := io.Copy(h, tr); err != nil {
+					return fmt.Errorf("%s: %w", hdr.Name, err)
+				}
+				f.SHA256 = hex.EncodeToString(h.Sum(nil))
+			}
+			files = append(files, f)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Extracts a gzipped tarball into target, refusing entries that would
+// escape it, whether by their name, a symlink pointing out of target or a
+// symlink to write through. Symlinks are created last, see pendingSymlinks.
+// If paths isn't empty, only entries at or below them are extracted.
+func extractTarGz(ctx context.Context, r io.Reader, target string, paths []string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	links := &pendingSymlinks{target: target}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return links.create()
+		}
+		if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(filepath.FromSlash(hdr.Name)) {
+			return fmt.Errorf("refusing to extract %q outside of target", hdr.Name)
+		}
+		if len(paths) > 0 && !underAny(filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/")), paths) {
+			continue
+		}
+		path, err := extractPath(target, filepath.FromSlash(hdr.Name))
+		if err != nil {
+			return err
+		}
+		mode := fs.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, mode|0700)
+		case tar.TypeReg:
+			err = writeFileFrom(path, tr, mode)
+		case tar.TypeSymlink:
+			links.add(filepath.FromSlash(hdr.Name), path, hdr.Linkname)
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeSymlink {
+			os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+		}
+	}
+}
+
+// Where to extract name, a local path, under target. No directory on the
+// way may be a symlink, as writing through one could reach outside target,
+// and a symlink already at name is removed so it is replaced rather than
+// followed.
+func extractPath(target, name string) (string, error) {
+	dir := target
+	parts := strings.Split(name, string(filepath.Separator))
+	for i, part := range parts {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		if i < len(parts)-1 {
+			return "", fmt.Errorf("refusing to extract %q through the symlink %s", filepath.ToSlash(name), filepath.ToSlash(filepath.Join(parts[:i+1]...)))
+		}
+		if err := os.Remove(dir); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(target, name), nil
+}
+
+// The symlinks met while extracting into target. They are created last,
+// once every other entry is, and each is checked against all of them as
+// well as what is on disk, so whether one leads out of target can't depend
+// on the order of the entries.
+type pendingSymlinks struct {
+	target string
+	links  []pendingSymlink
+	names  map[string]bool //Of every pending symlink, cleaned
+}
+
+type pendingSymlink struct {
+	name string //Local path under target
+	path string //Where it goes
+	link string //What it points at
+}
+
+func (p *pendingSymlinks) add(name, path, link string) {
+	if p.names == nil {
+		p.names = map[string]bool{}
+	}
+	name = filepath.Clean(name)
+	p.links = append(p.links, pendingSymlink{name: name, path: path, link: link})
+	p.names[name] = true
+}
+
+// Whether the local path name under target is, or will be, a symlink.
+func (p *pendingSymlinks) isSymlink(name string) bool {
+	if p.names[name] {
+		return true
+	}
+	info, err := os.Lstat(filepath.Join(p.target, name))
+	return err == nil && info.Mode()&fs.ModeSymlink != 0
+}
+
+// Checks that a symlink is relative and stays inside target without
+// passing through another symlink, and that no symlink leads to where it
+// goes.
+func (p *pendingSymlinks) check(l pendingSymlink) error {
+	refuse := func(why string) error {
+		return fmt.Errorf("refusing to extract the symlink %q to %q %s", filepath.ToSlash(l.name), l.link, why)
+	}
+	if filepath.IsAbs(l.link) || filepath.VolumeName(l.link) != "" {
+		return refuse("as it is absolute")
+	}
+	var resolved []string
+	if dir := filepath.Dir(l.name); dir != "." {
+		resolved = strings.Split(dir, string(filepath.Separator))
+	}
+	for i := range resolved {
+		if p.isSymlink(filepath.Join(resolved[:i+1]...)) {
+			return refuse("inside another symlink")
+		}
+	}
+	for _, part := range strings.Split(filepath.FromSlash(l.link), string(filepath.Separator)) {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(resolved) == 0 {
+				return refuse("outside of target")
+			}
+			resolved = resolved[:len(resolved)-1]
+		default:
+			resolved = append(resolved, part)
+			if p.isSymlink(filepath.Join(resolved...)) {
+				return refuse("through another symlink")
+			}
+		}
+	}
+	return nil
+}
+
+// Checks every pending symlink, then creates them. Whatever is already
+// where one goes is replaced unless it is a directory.
+func (p *pendingSymlinks) create() error {
+	for _, l := range p.links {
+		if err := p.check(l); err != nil {
+			return err
+		}
+	}
+	for _, l := range p.links {
+		if info, err := os.Lstat(l.path); err == nil {
+			if info.IsDir() {
+				return fmt.Errorf("refusing to replace the directory %q with a symlink", filepath.ToSlash(l.name))
+			}
+			if err := os.Remove(l.path); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(l.path), 0770); err != nil {
+			return err
+		}
+		if err := os.Symlink(l.link, l.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFileFrom(path string, r io.Reader, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Reads the whole archive back, so gzip checks its checksum and age, if it
+// was encrypted, that it wasn't tampered with.
+func (b *tarBackend) Check(ctx context.Context, snap Snapshot) error {
+	return b.open(ctx, snap.ID, func(r io.Reader) error {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr := tar.NewReader(gz)
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			_, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		//The checksum comes after the end of the tarball
+		_, err = io.Copy(io.Discard, gz)
+		return err
+	})
+}
+
+// Deletes all but the newest keep archives.
+func (b *tarBackend) Prune(ctx context.Context) error {
+	return b.PruneSparing(ctx, nil)
+}
+
+// Prunes like Prune, leaving the spared archives alone and not counting
+// them towards keep.
+func (b *tarBackend) PruneSparing(ctx context.Context, spared []Snapshot) error {
+	all, err := b.List(ctx)
+	if err != nil {
+		return err
+	}
+	var snaps []Snapshot
+	for _, s := range all {
+		if !containsSnapshot(spared, s.ID) {
+			snaps = append(snaps, s)
+		}
+	}
+	for len(snaps) > b.keep {
+		if err := b.store.remove(ctx, snaps[0].ID); err != nil {
+			return err
+		}
+		snaps = snaps[1:]
+	}
+	return nil
+}
+
+func (b *tarBackend) Delete(ctx context.Context, snaps []Snapshot) error {
+	for _, s := range snaps {
+		if !validTarName(s.ID) {
+			return fmt.Errorf("invalid tar snapshot id %q", s.ID)
+		}
+		if err := b.store.remove(ctx, s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keeps tar archives in a local directory.
+type localTarStore struct {
+	dir string
+}
+
+func (s localTarStore) location() string {
+	return s.dir
+}
+
+func (s localTarStore) init(ctx context.Context) error {
+	return os.MkdirAll(s.dir, 0770)
+}
+
+func (s localTarStore) create(ctx context.Context, name string, write func(io.Writer) error) (int64, error) {
+	path := filepath.Join(s.dir, name)
+	tmp := filepath.Join(s.dir, "."+name+".partial")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if err != nil {
+		return 0, err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s localTarStore) list(ctx context.Context, prefix string) ([]tarEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, prefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []tarEntry
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().IsRegular() {
+			entries = append(entries, tarEntry{name: filepath.Base(p), size: info.Size()})
+		}
+	}
+	return entries, nil
+}
+
+func (s localTarStore) open(ctx context.Context, name string, read func(io.Reader) error) error {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return read(f)
+}
+
+func (s localTarStore) remove(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
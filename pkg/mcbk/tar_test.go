@@ -0,0 +1,123 @@
+package mcbk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A gzipped tarball of the given headers, with body as each regular
+// file's contents.
+func tarGz(t *testing.T, body string, hdrs ...tar.Header) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(body))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTarGzRefusesEscapes(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		hdrs []tar.Header
+	}{
+		{"dotdot name", []tar.Header{
+			{Name: "../evil", Typeflag: tar.TypeReg},
+		}},
+		{"file through a symlink", []tar.Header{
+			{Name: "world/link", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "world/link/evil", Typeflag: tar.TypeReg},
+		}},
+		{"absolute symlink", []tar.Header{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/tmp"},
+		}},
+		{"symlink out of target", []tar.Header{
+			{Name: "world/link", Typeflag: tar.TypeSymlink, Linkname: "../../evil"},
+		}},
+		{"symlink through a symlink", []tar.Header{
+			{Name: "self", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "self/.."},
+		}},
+		{"symlink through a later symlink", []tar.Header{
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "self/.."},
+			{Name: "self", Typeflag: tar.TypeSymlink, Linkname: "."},
+		}},
+		{"symlink inside a later symlink", []tar.Header{
+			{Name: "world/link/up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "world/link", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			target := filepath.Join(root, "target")
+			if err := os.Mkdir(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := extractTarGz(context.Background(), tarGz(t, "evil", tt.hdrs...), target, nil)
+			if err == nil || !strings.Contains(err.Error(), "refusing") {
+				t.Errorf("extracting got error %v, want a refusal", err)
+			}
+			if _, err := os.Lstat(filepath.Join(root, "evil")); err == nil {
+				t.Error("a file was written outside of target")
+			}
+			if _, err := os.Lstat(filepath.Join(target, "up")); err == nil {
+				t.Error("a symlink was created despite the refusal")
+			}
+		})
+	}
+}
+
+func TestExtractTarGzReplacesSymlinks(t *testing.T) {
+	root := t.TempDir()
+	target := filepath.Join(root, "target")
+	outside := filepath.Join(root, "outside")
+	if err := os.WriteFile(outside, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(target, "world"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	//Left behind by an earlier restore, or planted
+	if err := os.Symlink(outside, filepath.Join(target, "world", "level.dat")); err != nil {
+		t.Fatal(err)
+	}
+	archive := tarGz(t, "level",
+		tar.Header{Name: "world/", Typeflag: tar.TypeDir, Mode: 0755},
+		tar.Header{Name: "world/level.dat", Typeflag: tar.TypeReg},
+		tar.Header{Name: "world/latest", Typeflag: tar.TypeSymlink, Linkname: "level.dat"},
+	)
+	if err := extractTarGz(context.Background(), archive, target, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(outside); string(data) != "keep" {
+		t.Errorf("the file outside of target now holds %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(target, "world", "latest")); string(data) != "level" {
+		t.Errorf("world/latest reads %q, want the extracted level.dat", data)
+	}
+}
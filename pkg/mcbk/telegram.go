@@ -0,0 +1,316 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TELEGRAM_API_URL = "https://api.telegram.org"
+const TELEGRAM_POLL_TIMEOUT = 50 * time.Second //How long each getUpdates long poll waits for messages
+
+// Settings for the Telegram bot that "mcbk daemon" runs.
+type TelegramBotConfig struct {
+	BotToken     string  `json:"bot_token" secret:"true"` //Token from @BotFather. Empty disables the bot.
+	AllowedChats []int64 `json:"allowed_chats"`           //Chats whose commands are obeyed; anything else is ignored
+	APIURL       string  `json:"api_url"`                 //Bot API server, defaults to api.telegram.org
+}
+
+// Calls methods of the Telegram Bot API.
+type telegramClient struct {
+	api   string
+	token string
+}
+
+func newTelegramClient(api, token string) *telegramClient {
+	if api == "" {
+		api = TELEGRAM_API_URL
+	}
+	return &telegramClient{api: strings.TrimSuffix(api, "/"), token: token}
+}
+
+// Posts params as JSON to a Bot API method and decodes its result into
+// result, if given. client must allow for any long poll timeout in params.
+func (t *telegramClient) call(ctx context.Context, client *http.Client, method string, params, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.api+"/bot"+t.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		//The URL contains the token, keep it out of logs and notifications
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return fmt.Errorf("telegram %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("telegram %s returned %s", method, resp.Status)
+	}
+	if !reply.OK {
+		return fmt.Errorf("telegram %s: %s", method, reply.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(reply.Result, result)
+	}
+	return nil
+}
+
+// Sends a plain text message to a chat.
+func (t *telegramClient) send(ctx context.Context, chat int64, text string) error {
+	return t.call(ctx, httpClient, "sendMessage", map[string]any{"chat_id": chat, "text": text}, nil)
+}
+
+// Posts events to a Telegram chat through a bot.
+type telegramNotifier struct {
+	client *telegramClient
+	chat   int64
+}
+
+func (n *telegramNotifier) Notify(ev Event) error {
+	var text string
+	switch ev.Kind {
+	case EventStart:
+		text = "Minecraft backup started"
+	case EventSuccess:
+		text = fmt.Sprintf("Minecraft backup complete in %s", ev.Duration.Round(time.Second))
+		if ev.Snapshot.Size > 0 {
+			text += ", " + FormatBytes(ev.Snapshot.Size)
+		}
+		if ev.Snapshot.ID != "" {
+			text += "\nSnapshot: " + ev.Snapshot.ID
+		}
+	case EventFailure:
+		text = "Minecraft backup FAILED\n" + truncate(ev.Err.Error(), 1024)
+	case EventReplicationFailure:
+		text = "Minecraft backup replication to " + ev.Remote + " FAILED\n" + truncate(ev.Err.Error(), 1024)
+	case EventSizeAnomaly:
+		text = "Minecraft backup much smaller than usual\n" + truncate(ev.Err.Error(), 1024)
+	case EventSourceCorrupt:
+		text = "Minecraft backup " + ev.Snapshot.ID + " taken from a world that may be corrupt\n" + truncate(ev.Err.Error(), 1024)
+	case EventOverdue:
+		text = "Minecraft backup OVERDUE\n" + truncate(ev.Err.Error(), 1024)
+	case EventNetworkReport:
+		text = fmt.Sprintf("Minecraft network backup complete in %s", ev.Duration.Round(time.Second))
+		if ev.Err != nil {
+			text = "Minecraft network backup FAILED: " + ev.Err.Error()
+		}
+		text += "\n" + truncate(ev.Report, 3072)
+	}
+	if ev.Server != DEFAULT_SERVER_NAME {
+		text = "[" + ev.Server + "] " + text
+	}
+	return n.client.send(context.Background(), n.chat, text)
+}
+
+// Answers commands sent to the bot from the allowed chats, so admins can
+// check on and trigger backups from their phone.
+type TelegramBot struct {
+	conf    TelegramBotConfig
+	client  *telegramClient
+	poll    *http.Client
+	runner  *Runner
+	servers []*Server
+	logger  *slog.Logger
+	running sync.Map //Names of servers with a /backupnow in progress
+}
+
+// Sets up a bot for the given servers. Backups triggered through it are
+// run by runner, whose Metrics are also used to answer /status.
+func NewTelegramBot(c TelegramBotConfig, runner *Runner, servers []*Server, logger *slog.Logger) *TelegramBot {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &TelegramBot{
+		conf:    c,
+		client:  newTelegramClient(c.APIURL, c.BotToken),
+		poll:    &http.Client{Timeout: TELEGRAM_POLL_TIMEOUT + 15*time.Second},
+		runner:  runner,
+		servers: servers,
+		logger:  logger.With("phase", "telegram"),
+	}
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+// Long-polls for commands until ctx is done. Backups started by /backupnow
+// keep ctx, so they are cancelled along with the bot.
+func (b *TelegramBot) Run(ctx context.Context) {
+	b.logger.Info("Telegram bot started", "allowed_chats", len(b.conf.AllowedChats))
+	var offset int64
+	for {
+		var updates []telegramUpdate
+		params := map[string]any{"offset": offset, "timeout": int(TELEGRAM_POLL_TIMEOUT.Seconds()), "allowed_updates": []string{"message"}}
+		err := b.client.call(ctx, b.poll, "getUpdates", params, &updates)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			b.logger.Warn("Error polling for Telegram commands", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil {
+				continue
+			}
+			chat := u.Message.Chat.ID
+			if !slices.Contains(b.conf.AllowedChats, chat) {
+				b.logger.Warn("Ignoring command from a chat that isn't allowed", "chat", chat)
+				continue
+			}
+			reply := b.handle(ctx, chat, u.Message.Text)
+			if reply == "" {
+				continue
+			}
+			if err := b.client.send(ctx, chat, reply); err != nil {
+				b.logger.Warn("Error replying to Telegram command", "chat", chat, "error", err)
+			}
+		}
+	}
+}
+
+// Runs a command and returns the reply. Commands take an optional list of
+// server names and default to every server.
+func (b *TelegramBot) handle(ctx context.Context, chat int64, text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return ""
+	}
+	//In groups, commands may be addressed as /status@SomeBot
+	command, _, _ := strings.Cut(fields[0], "@")
+	servers, err := b.pick(fields[1:])
+	if err != nil {
+		return err.Error()
+	}
+	b.logger.Info("Received Telegram command", "chat", chat, "command", command)
+
+	var lines []string
+	switch command {
+	case "/backupnow":
+		for _, s := range servers {
+			lines = append(lines, b.backupNow(ctx, chat, s))
+		}
+	case "/status":
+		for _, s := range servers {
+			lines = append(lines, b.status(s))
+		}
+	case "/lastbackup":
+		for _, s := range servers {
+			lines = append(lines, b.lastBackup(ctx, s))
+		}
+	default:
+		return "Unknown command. Try /backupnow, /status or /lastbackup, optionally followed by server names."
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Looks up servers by name, or returns every server if none are named.
+func (b *TelegramBot) pick(names []string) ([]*Server, error) {
+	if len(names) == 0 {
+		return b.servers, nil
+	}
+	var picked []*Server
+	for _, name := range names {
+		i := slices.IndexFunc(b.servers, func(s *Server) bool { return s.Name() == name })
+		if i < 0 {
+			return nil, fmt.Errorf("No server named %q", name)
+		}
+		picked = append(picked, b.servers[i])
+	}
+	return picked, nil
+}
+
+// Starts a backup in the background and reports the outcome to chat when
+// it is done. Overlap with a scheduled backup is prevented by the server's
+// lock. Asking for a backup overrides skip_idle.
+func (b *TelegramBot) backupNow(ctx context.Context, chat int64, s *Server) string {
+	if _, busy := b.running.LoadOrStore(s.Name(), true); busy {
+		return s.Name() + ": a backup requested here is already running"
+	}
+	forced := *b.runner
+	forced.Force = true
+	go func() {
+		defer b.running.Delete(s.Name())
+		reply := s.Name() + ": backup complete"
+		if err := forced.Backup(ctx, s); errors.Is(err, ErrBackupInProgress) {
+			reply = s.Name() + ": another backup is already in progress"
+		} else if err != nil {
+			reply = s.Name() + ": backup failed: " + truncate(err.Error(), 1024)
+		}
+		if err := b.client.send(context.WithoutCancel(ctx), chat, reply); err != nil {
+			b.logger.Warn("Error replying to Telegram command", "chat", chat, "error", err)
+		}
+	}()
+	return s.Name() + ": backup started"
+}
+
+// Summarizes the server's recent backups from the runner's metrics.
+func (b *TelegramBot) status(s *Server) string {
+	sm, ok := b.runner.Metrics.status(s.Name())
+	switch {
+	case !ok || sm.lastBackup.IsZero():
+		return s.Name() + ": no backups since the daemon started"
+	case sm.inProgress:
+		return fmt.Sprintf("%s: backing up since %s", s.Name(), sm.lastBackup.Format(time.TimeOnly))
+	}
+	text := fmt.Sprintf("%s: %d ok, %d failed since the daemon started", s.Name(), sm.successes, sm.failures)
+	if !sm.lastSuccess.IsZero() {
+		text += fmt.Sprintf("; last success %s ago", time.Since(sm.lastSuccess).Round(time.Minute))
+	}
+	if sm.lastErr != nil {
+		text += "; last attempt failed: " + truncate(sm.lastErr.Error(), 512)
+	}
+	return text
+}
+
+// Describes the newest snapshot in the server's backend.
+func (b *TelegramBot) lastBackup(ctx context.Context, s *Server) string {
+	snaps, err := s.Backend().List(ctx)
+	if err != nil {
+		return s.Name() + ": error listing snapshots: " + truncate(err.Error(), 512)
+	}
+	if len(snaps) == 0 {
+		return s.Name() + ": no snapshots yet"
+	}
+	last := snaps[len(snaps)-1]
+	text := fmt.Sprintf("%s: %s at %s (%s ago)", s.Name(), last.ID, last.Time.Format("2006-01-02 15:04"), time.Since(last.Time).Round(time.Minute))
+	if last.Size > 0 {
+		text += ", " + FormatBytes(last.Size)
+	}
+	return text
+}
@@ -0,0 +1,460 @@
+package mcbk
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A deliberately small TOML reader so the script keeps its "Go and bup only"
+// dependency list. It understands the subset a config file needs: comments,
+// bare/quoted/dotted keys, [tables], [[arrays of tables]], basic and literal
+// strings, integers, floats, booleans, arrays and inline tables. Dates and
+// multi-line strings are not supported.
+
+type tomlParser struct {
+	src     []rune
+	pos     int
+	line    int
+	defined map[uintptr]bool //Tables that had a [header] already
+}
+
+type tomlError struct {
+	Line int
+	Msg  string
+}
+
+func (e *tomlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Parses TOML source into nested maps, slices and scalar values.
+func parseTOML(data []byte) (map[string]any, error) {
+	p := &tomlParser{src: []rune(string(data)), line: 1, defined: map[uintptr]bool{}}
+	root := map[string]any{}
+	current := root
+	for {
+		p.skipSpaceAndComments()
+		if p.eof() {
+			return root, nil
+		}
+		var err error
+		switch p.peek() {
+		case '[':
+			current, err = p.parseTableHeader(root)
+		default:
+			err = p.parseKeyValue(current)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Decodes TOML into v by way of encoding/json, so config structs only need
+// json tags. Unknown keys are rejected to catch typos early.
+func decodeTOML(data []byte, v any) error {
+	tree, err := parseTOML(data)
+	if err != nil {
+		return err
+	}
+	return decodeTOMLTree(tree, v)
+}
+
+// Decodes an already parsed TOML value into v. Fields of v that the tree
+// doesn't mention keep their current values.
+func decodeTOMLTree(tree any, v any) error {
+	buf, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("setting %q: cannot use %s as %s", typeErr.Field, typeErr.Value, typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("unknown setting %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return err
+}
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return &tomlError{Line: p.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *tomlParser) peek() rune {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *tomlParser) next() rune {
+	r := p.peek()
+	p.pos++
+	if r == '\n' {
+		p.line++
+	}
+	return r
+}
+
+// Skips spaces and tabs on the current line.
+func (p *tomlParser) skipInline() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+// Skips all whitespace, newlines and comments.
+func (p *tomlParser) skipSpaceAndComments() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+		case '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.next()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Requires the rest of the line to be empty or a comment.
+func (p *tomlParser) expectEndOfLine() error {
+	p.skipInline()
+	if p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.next()
+		}
+	}
+	if p.peek() == '\r' {
+		p.next()
+	}
+	if !p.eof() && p.peek() != '\n' {
+		return p.errorf("unexpected %q after value", p.peek())
+	}
+	return nil
+}
+
+func (p *tomlParser) parseTableHeader(root map[string]any) (map[string]any, error) {
+	p.next()
+	isArray := false
+	if p.peek() == '[' {
+		p.next()
+		isArray = true
+	}
+	p.skipInline()
+	keys, err := p.parseKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	p.skipInline()
+	if p.next() != ']' || (isArray && p.next() != ']') {
+		return nil, p.errorf("malformed table header")
+	}
+	if err := p.expectEndOfLine(); err != nil {
+		return nil, err
+	}
+
+	parent, err := p.descend(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := keys[len(keys)-1]
+	if isArray {
+		existing, ok := parent[last]
+		if !ok {
+			existing = []any{}
+		}
+		list, ok := existing.([]any)
+		if !ok {
+			return nil, p.errorf("key %q is not an array of tables", last)
+		}
+		table := map[string]any{}
+		parent[last] = append(list, table)
+		return table, nil
+	}
+	table, ok := parent[last].(map[string]any)
+	switch {
+	case !ok && parent[last] != nil:
+		return nil, p.errorf("key %q is already defined", last)
+	case !ok:
+		table = map[string]any{}
+		parent[last] = table
+	case p.defined[reflect.ValueOf(table).Pointer()]:
+		//Only tables created implicitly, by [a.b] before [a], may get a header later
+		return nil, p.errorf("table [%s] is defined twice", strings.Join(keys, "."))
+	}
+	p.defined[reflect.ValueOf(table).Pointer()] = true
+	return table, nil
+}
+
+// Walks (and creates) nested tables for a dotted key path. When a path
+// element is an array of tables, the most recently defined entry is used.
+func (p *tomlParser) descend(table map[string]any, keys []string) (map[string]any, error) {
+	for _, k := range keys {
+		switch v := table[k].(type) {
+		case nil:
+			child := map[string]any{}
+			table[k] = child
+			table = child
+		case map[string]any:
+			table = v
+		case []any:
+			if len(v) == 0 {
+				return nil, p.errorf("key %q is an empty array", k)
+			}
+			child, ok := v[len(v)-1].(map[string]any)
+			if !ok {
+				return nil, p.errorf("key %q is not a table", k)
+			}
+			table = child
+		default:
+			return nil, p.errorf("key %q is not a table", k)
+		}
+	}
+	return table, nil
+}
+
+func (p *tomlParser) parseKeyValue(table map[string]any) error {
+	if err := p.parseAssignment(table); err != nil {
+		return err
+	}
+	return p.expectEndOfLine()
+}
+
+func (p *tomlParser) parseAssignment(table map[string]any) error {
+	keys, err := p.parseKeyPath()
+	if err != nil {
+		return err
+	}
+	p.skipInline()
+	if p.next() != '=' {
+		return p.errorf("expected '=' after key %q", strings.Join(keys, "."))
+	}
+	p.skipInline()
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	parent, err := p.descend(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, ok := parent[last]; ok {
+		return p.errorf("key %q is defined twice", strings.Join(keys, "."))
+	}
+	parent[last] = value
+	return nil
+}
+
+func (p *tomlParser) parseKeyPath() ([]string, error) {
+	var keys []string
+	for {
+		p.skipInline()
+		var key string
+		var err error
+		switch r := p.peek(); {
+		case r == '"':
+			key, err = p.parseBasicString()
+		case r == '\'':
+			key, err = p.parseLiteralString()
+		case isBareKeyRune(r):
+			start := p.pos
+			for !p.eof() && isBareKeyRune(p.peek()) {
+				p.next()
+			}
+			key = string(p.src[start:p.pos])
+		default:
+			return nil, p.errorf("expected a key, found %q", r)
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		p.skipInline()
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.next()
+	}
+}
+
+func isBareKeyRune(r rune) bool {
+	return r == '_' || r == '-' || (r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)))
+}
+
+func (p *tomlParser) parseValue() (any, error) {
+	switch r := p.peek(); {
+	case r == '"':
+		return p.parseBasicString()
+	case r == '\'':
+		return p.parseLiteralString()
+	case r == '[':
+		return p.parseArray()
+	case r == '{':
+		return p.parseInlineTable()
+	case r == 't' || r == 'f':
+		return p.parseBool()
+	case r == '+' || r == '-' || unicode.IsDigit(r):
+		return p.parseNumber()
+	case r == 0:
+		return nil, p.errorf("unexpected end of file")
+	default:
+		return nil, p.errorf("unexpected %q at start of value", r)
+	}
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	p.next()
+	var sb strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		r := p.next()
+		switch r {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			esc := p.next()
+			switch esc {
+			case 'n':
+				sb.WriteRune('\n')
+			case 't':
+				sb.WriteRune('\t')
+			case 'r':
+				sb.WriteRune('\r')
+			case '"', '\\':
+				sb.WriteRune(esc)
+			case 'u', 'U':
+				n := 4
+				if esc == 'U' {
+					n = 8
+				}
+				if p.pos+n > len(p.src) {
+					return "", p.errorf("truncated unicode escape")
+				}
+				code, err := strconv.ParseUint(string(p.src[p.pos:p.pos+n]), 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				p.pos += n
+				sb.WriteRune(rune(code))
+			default:
+				return "", p.errorf("invalid escape sequence \\%c", esc)
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	p.next()
+	start := p.pos
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		if p.next() == '\'' {
+			return string(p.src[start : p.pos-1]), nil
+		}
+	}
+}
+
+func (p *tomlParser) parseBool() (bool, error) {
+	for _, word := range []string{"true", "false"} {
+		end := p.pos + len(word)
+		if end <= len(p.src) && string(p.src[p.pos:end]) == word {
+			p.pos = end
+			return word == "true", nil
+		}
+	}
+	return false, p.errorf("invalid boolean")
+}
+
+func (p *tomlParser) parseNumber() (any, error) {
+	start := p.pos
+	for !p.eof() && strings.ContainsRune("+-0123456789._eExabcdefABCDEFo", p.peek()) {
+		p.next()
+	}
+	text := strings.ReplaceAll(string(p.src[start:p.pos]), "_", "")
+	//ParseInt would read these as octal
+	if digits := strings.TrimLeft(text, "+-"); len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+		return nil, p.errorf("invalid number %q, leading zeros are not allowed", text)
+	}
+	if i, err := strconv.ParseInt(text, 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f, nil
+	}
+	return nil, p.errorf("invalid number %q", text)
+}
+
+func (p *tomlParser) parseArray() ([]any, error) {
+	p.next()
+	list := []any{}
+	for {
+		p.skipSpaceAndComments()
+		if p.peek() == ']' {
+			p.next()
+			return list, nil
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		p.skipSpaceAndComments()
+		switch p.next() {
+		case ',':
+		case ']':
+			return list, nil
+		default:
+			return nil, p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+func (p *tomlParser) parseInlineTable() (map[string]any, error) {
+	p.next()
+	table := map[string]any{}
+	p.skipInline()
+	if p.peek() == '}' {
+		p.next()
+		return table, nil
+	}
+	for {
+		p.skipInline()
+		if err := p.parseAssignment(table); err != nil {
+			return nil, err
+		}
+		p.skipInline()
+		switch p.next() {
+		case ',':
+		case '}':
+			return table, nil
+		default:
+			return nil, p.errorf("expected ',' or '}' in inline table")
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package mcbk
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		src  string
+		want map[string]any
+	}{
+		{"scalars", `
+a = "x\ty\u00e9" # comment
+b = 'C:\path'
+c = -42
+d = 1_000
+e = 0x1F
+f = 0.5
+g = 1e3
+h = true
+i = 0
+j = -0.25
+`, map[string]any{"a": "x\tyé", "b": `C:\path`, "c": int64(-42), "d": int64(1000), "e": int64(31), "f": 0.5, "g": 1000.0, "h": true, "i": int64(0), "j": -0.25}},
+		{"arrays and inline tables", `
+a = [1, 2,
+  3,]
+b = { x = "y", z.w = 1 }
+`, map[string]any{"a": []any{int64(1), int64(2), int64(3)}, "b": map[string]any{"x": "y", "z": map[string]any{"w": int64(1)}}}},
+		{"tables and dotted keys", `
+top = 1
+[rcon]
+port = 25575
+[daemon.dashboard]
+enabled = true
+"quoted key".x = 2
+`, map[string]any{"top": int64(1), "rcon": map[string]any{"port": int64(25575)}, "daemon": map[string]any{"dashboard": map[string]any{"enabled": true, "quoted key": map[string]any{"x": int64(2)}}}}},
+		{"a super-table defined after its sub-table", `
+[a.b]
+x = 1
+[a]
+y = 2
+`, map[string]any{"a": map[string]any{"b": map[string]any{"x": int64(1)}, "y": int64(2)}}},
+		{"arrays of tables", `
+[[server]]
+name = "a"
+[server.rcon]
+port = 1
+[[server]]
+name = "b"
+[server.rcon]
+port = 2
+`, map[string]any{"server": []any{
+			map[string]any{"name": "a", "rcon": map[string]any{"port": int64(1)}},
+			map[string]any{"name": "b", "rcon": map[string]any{"port": int64(2)}},
+		}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"leading zero", "a = 010", "line 1: invalid number \"010\", leading zeros are not allowed"},
+		{"leading zero with a sign", "a = -007", "leading zeros"},
+		{"leading zero in a float", "a = 01.5", "leading zeros"},
+		{"invalid number", "a = 1x", "invalid number"},
+		{"table defined twice", "[rcon]\nport = 1\n\n[rcon]\nhost = \"x\"", "line 4: table [rcon] is defined twice"},
+		{"dotted table defined twice", "[a.b]\n[a.b]", "table [a.b] is defined twice"},
+		{"key defined twice", "a = 1\na = 2", "key \"a\" is defined twice"},
+		{"table over a value", "a = 1\n[a]", "key \"a\" is already defined"},
+		{"array of tables over a table", "[a]\n[[a]]", "not an array of tables"},
+		{"value after value", "a = 1 2", "unexpected"},
+		{"malformed header", "[a", "malformed table header"},
+		{"unterminated string", "a = \"x", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML([]byte(tt.src))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTOMLRejectsUnknownSettings(t *testing.T) {
+	var c struct {
+		Port int `json:"port"`
+	}
+	if err := decodeTOML([]byte("prot = 1"), &c); err == nil || !strings.Contains(err.Error(), "unknown setting \"prot\"") {
+		t.Errorf("got error %v, want the unknown setting named", err)
+	}
+	if err := decodeTOML([]byte("port = \"x\""), &c); err == nil || !strings.Contains(err.Error(), "setting \"port\"") {
+		t.Errorf("got error %v, want the mistyped setting named", err)
+	}
+}
@@ -0,0 +1,269 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TRACING_TIMEOUT = 10 * time.Second //Limit on exporting the spans of one run
+
+// A W3C traceparent, as passed in $TRACEPARENT by whatever started mcbk.
+var traceparentRegexp = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// Settings for exporting OpenTelemetry traces of backup runs over OTLP,
+// e.g. to Jaeger, Tempo or an OpenTelemetry Collector.
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`              //OTLP/HTTP endpoint, e.g. "http://localhost:4318"; spans are posted to <endpoint>/v1/traces. Empty disables tracing
+	Headers     map[string]string `json:"headers" secret:"true"` //Extra request headers, e.g. { Authorization = "Bearer ..." }
+	ServiceName string            `json:"service_name"`          //service.name of the exported spans, default "mcbk"
+}
+
+// Whether traces are exported at all.
+func (c TracingConfig) Enabled() bool {
+	return c.Endpoint != ""
+}
+
+func (c *TracingConfig) setDefaults() {
+	if c.ServiceName == "" {
+		c.ServiceName = "mcbk"
+	}
+}
+
+func (c TracingConfig) validate() []error {
+	var errs []error
+	if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("tracing.endpoint must be an http(s) URL like \"http://localhost:4318\", got %q", c.Endpoint))
+	}
+	return errs
+}
+
+// Exports a trace of every backup run, with a span for each step, so where
+// the time goes can be followed across many servers. A run started with a
+// W3C traceparent in $TRACEPARENT joins that trace. Tracing on a nil
+// *Tracer is a no-op.
+type Tracer struct {
+	conf TracingConfig
+	host string
+}
+
+// Returns a tracer exporting to the configured endpoint, or nil if tracing
+// isn't enabled.
+func NewTracer(c TracingConfig) *Tracer {
+	if !c.Enabled() {
+		return nil
+	}
+	host, _ := os.Hostname()
+	return &Tracer{conf: c, host: host}
+}
+
+// The spans of one trace, collected as they end and exported together when
+// its root span does.
+type trace struct {
+	tracer *Tracer
+	id     string
+	log    *slog.Logger
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+// A step of a run being traced. Methods on a nil *span do nothing, so code
+// can trace its steps whether tracing is set up or not.
+type span struct {
+	trace  *trace
+	id     string
+	parent string
+	root   bool
+	name   string
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs map[string]any
+}
+
+type spanKey struct{}
+
+// Starts a span named name as a child of the span in ctx, if there is one.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return ctx, nil
+	}
+	sp := &span{trace: parent.trace, id: randomHex(8), parent: parent.id, name: name, start: time.Now()}
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// Runs fn in a span named name, as a child of the span in ctx, ending it
+// with fn's error.
+func traced(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	ctx, sp := startSpan(ctx, name)
+	err := fn(ctx)
+	sp.end(err)
+	return err
+}
+
+// Starts a span named name as a child of the span in ctx, or if there is
+// none, as the root of a new trace of the server's run.
+func (r *Runner) trace(ctx context.Context, s *Server, name string) (context.Context, *span) {
+	if ctx.Value(spanKey{}) != nil || r.Tracer == nil {
+		return startSpan(ctx, name)
+	}
+	t := &trace{tracer: r.Tracer, id: randomHex(16), log: s.log()}
+	sp := &span{trace: t, id: randomHex(8), root: true, name: name, start: time.Now()}
+	if m := traceparentRegexp.FindStringSubmatch(os.Getenv("TRACEPARENT")); m != nil {
+		t.id, sp.parent = m[1], m[2]
+	}
+	sp.set("mcbk.server", s.conf.Name)
+	sp.set("mcbk.backend", s.conf.Backend)
+	sp.set("mcbk.transport", s.conf.Transport)
+	s.log().Debug("Tracing the run", "phase", "tracing", "trace_id", t.id)
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// Records an attribute of the span, e.g. the size of what it saved.
+func (sp *span) set(key string, value any) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.attrs == nil {
+		sp.attrs = map[string]any{}
+	}
+	sp.attrs[key] = value
+}
+
+// Ends the span, marking it failed if err isn't nil. Ending the root span
+// exports the whole trace; failing to is logged but never fails the run.
+func (sp *span) end(err error) {
+	if sp == nil {
+		return
+	}
+	s := otlpSpan{
+		TraceID:      sp.trace.id,
+		SpanID:       sp.id,
+		ParentSpanID: sp.parent,
+		Name:         sp.name,
+		Kind:         1, //SPAN_KIND_INTERNAL
+		Start:        strconv.FormatInt(sp.start.UnixNano(), 10),
+		End:          strconv.FormatInt(time.Now().UnixNano(), 10),
+		Status:       otlpStatus{Code: 1}, //STATUS_CODE_OK
+	}
+	if err != nil {
+		s.Status = otlpStatus{Code: 2, Message: err.Error()} //STATUS_CODE_ERROR
+	}
+	sp.mu.Lock()
+	for _, key := range slices.Sorted(maps.Keys(sp.attrs)) {
+		s.Attributes = append(s.Attributes, otlpAttribute(key, sp.attrs[key]))
+	}
+	sp.mu.Unlock()
+
+	t := sp.trace
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	spans := t.spans
+	t.mu.Unlock()
+	if !sp.root {
+		return
+	}
+	if err := t.tracer.export(spans); err != nil {
+		t.log.Warn("Error exporting the trace", "phase", "tracing", "trace_id", t.id, "error", err)
+	}
+}
+
+// Posts spans to the endpoint as OTLP/HTTP JSON.
+func (t *Tracer) export(spans []otlpSpan) error {
+	resource := []map[string]any{otlpAttribute("service.name", t.conf.ServiceName)}
+	if t.host != "" {
+		resource = append(resource, otlpAttribute("host.name", t.host))
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource":   map[string]any{"attributes": resource},
+			"scopeSpans": []map[string]any{{"scope": map[string]string{"name": "mcbk"}, "spans": spans}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TRACING_TIMEOUT)
+	defer cancel()
+	endpoint := strings.TrimSuffix(t.conf.Endpoint, "/") + "/v1/traces"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", endpoint, resp.Status, msg)
+	}
+	return nil
+}
+
+// A span in OTLP's JSON encoding, where IDs are hex and times are
+// nanoseconds since the epoch, as strings.
+type otlpSpan struct {
+	TraceID      string           `json:"traceId"`
+	SpanID       string           `json:"spanId"`
+	ParentSpanID string           `json:"parentSpanId,omitempty"`
+	Name         string           `json:"name"`
+	Kind         int              `json:"kind"`
+	Start        string           `json:"startTimeUnixNano"`
+	End          string           `json:"endTimeUnixNano"`
+	Attributes   []map[string]any `json:"attributes,omitempty"`
+	Status       otlpStatus       `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// An attribute in OTLP's JSON encoding, typed by its Go value.
+func otlpAttribute(key string, value any) map[string]any {
+	var v map[string]any
+	switch value := value.(type) {
+	case bool:
+		v = map[string]any{"boolValue": value}
+	case int:
+		v = map[string]any{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]any{"doubleValue": value}
+	default:
+		v = map[string]any{"stringValue": fmt.Sprint(value)}
+	}
+	return map[string]any{"key": key, "value": v}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,164 @@
+package mcbk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A way of delivering console commands to the minecraft server.
+type Transport interface {
+	Send(ctx context.Context, command string) error
+	Close() error
+}
+
+// Transports that can read a command's response directly implement Querier,
+// which lets verification skip tailing the server log.
+type Querier interface {
+	Query(ctx context.Context, command string) (string, error)
+}
+
+// Creates the command transport selected for a server.
+func NewTransport(c ServerConfig) (Transport, error) {
+	switch c.Transport {
+	case "screen":
+		return &screenTransport{session: c.ScreenSession}, nil
+	case "tmux":
+		return &tmuxTransport{target: c.Tmux.target()}, nil
+	case "rcon":
+		return newRCONTransport(c.RCON, c.VerifyTimeout.Duration), nil
+	case "stdin":
+		return &stdinTransport{path: c.Stdin.Path}, nil
+	case "process":
+		return &processTransport{socket: c.processSocket()}, nil
+	case "pterodactyl":
+		return &pterodactylTransport{conf: c.Pterodactyl}, nil
+	case "docker":
+		if c.Docker.Mode == "attach" {
+			return &dockerAttachTransport{conf: c.Docker}, nil
+		}
+		return &dockerExecTransport{conf: c.Docker}, nil
+	case "mark2":
+		return &mark2Transport{conf: c.Mark2}, nil
+	case "msm":
+		return &msmTransport{conf: c.MSM}, nil
+	case "amp":
+		return &ampTransport{conf: c.AMP}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", c.Transport)
+}
+
+// Stuffs commands into the first window of a screen session.
+type screenTransport struct {
+	session string
+}
+
+func (t *screenTransport) Send(ctx context.Context, command string) error {
+	_, err := runCommand(ctx, "screen", "-S", t.session, "-p", "0", "-X", "stuff", command+"\\r")
+	return err
+}
+
+func (t *screenTransport) Close() error {
+	return nil
+}
+
+// Settings for the tmux transport. Window and pane may be left empty to use
+// the session's current ones.
+type TmuxConfig struct {
+	Session string `json:"session"`
+	Window  string `json:"window"`
+	Pane    string `json:"pane"`
+}
+
+// Builds a tmux target of the form session:window.pane.
+func (c TmuxConfig) target() string {
+	t := c.Session + ":" + c.Window
+	if c.Pane != "" {
+		t += "." + c.Pane
+	}
+	return t
+}
+
+// Types commands into a tmux pane with send-keys.
+type tmuxTransport struct {
+	target string
+}
+
+func (t *tmuxTransport) Send(ctx context.Context, command string) error {
+	//-l sends the command literally, so words like "Enter" aren't key names
+	_, err := runCommand(ctx, "tmux", "send-keys", "-t", t.target, "-l", command)
+	if err != nil {
+		return err
+	}
+	_, err = runCommand(ctx, "tmux", "send-keys", "-t", t.target, "Enter")
+	return err
+}
+
+func (t *tmuxTransport) Close() error {
+	return nil
+}
+
+// Settings for the stdin transport.
+type StdinConfig struct {
+	Path string `json:"path"` //FIFO or Windows named pipe (e.g. \\.\pipe\minecraft) connected to the server's standard input
+}
+
+// Writes commands to a pipe that feeds the server console, for servers
+// started by a wrapper rather than inside screen or tmux. The pipe is kept
+// open between commands.
+type stdinTransport struct {
+	path string
+	f    *os.File
+}
+
+func (t *stdinTransport) Send(ctx context.Context, command string) error {
+	if t.f == nil {
+		f, err := openPipe(ctx, t.path)
+		if err != nil {
+			return err
+		}
+		t.f = f
+	}
+	_, err := io.WriteString(t.f, command+"\n")
+	if err != nil {
+		//The reader went away, reconnect on the next command
+		t.f.Close()
+		t.f = nil
+	}
+	return err
+}
+
+func (t *stdinTransport) Close() error {
+	if t.f == nil {
+		return nil
+	}
+	err := t.f.Close()
+	t.f = nil
+	return err
+}
+
+// Opens a pipe for writing. Opening a FIFO blocks until something reads
+// from it, so this gives up when ctx is done.
+func openPipe(ctx context.Context, path string) (*os.File, error) {
+	type result struct {
+		f   *os.File
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		done <- result{f, err}
+	}()
+	select {
+	case r := <-done:
+		return r.f, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.f != nil {
+				r.f.Close()
+			}
+		}()
+		return nil, fmt.Errorf("opening %s: %w", path, ctx.Err())
+	}
+}
@@ -0,0 +1,92 @@
+package mcbk
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const REASON_UPGRADE = "upgrade"        //Runner.Reason for a backup ahead of a server version upgrade
+const UPGRADE_TAG = "pre-upgrade"       //Tag of snapshots taken with REASON_UPGRADE
+const UPGRADE_PIN = 30 * 24 * time.Hour //How long pruning leaves them alone, unless upgrade.pin says otherwise
+
+// What an upgrade replaces or rewrites: server jars and their libraries'
+// launchers, mods, plugins with their data folders, and config files.
+var defaultUpgradePaths = []string{"*.jar", "mods", "plugins", "config", "server.properties", "*.json", "*.yml", "*.yaml"}
+
+// What "mcbk backup -reason upgrade" keeps besides the worlds: what an
+// upgrade replaces or migrates, so it can be rolled back whole.
+type UpgradeConfig struct {
+	Paths []string `json:"paths"` //Include patterns backed up on top of worlds and include, default the server jars, mods, plugins and configs
+	Pin   Duration `json:"pin"`   //How long pruning leaves the snapshot alone, default 30 days
+}
+
+func (c *UpgradeConfig) setDefaults() {
+	if c.Paths == nil {
+		c.Paths = slices.Clone(defaultUpgradePaths)
+	}
+	if c.Pin.Duration == 0 {
+		c.Pin.Duration = UPGRADE_PIN
+	}
+}
+
+func (c UpgradeConfig) validate() []error {
+	errs := validateIncludes(c.Paths)
+	for i, err := range errs {
+		errs[i] = fmt.Errorf("upgrade.paths: %w", err)
+	}
+	if c.Pin.Duration < 0 {
+		errs = append(errs, errors.New("upgrade.pin must not be negative"))
+	}
+	return errs
+}
+
+// Checks a reason given to "mcbk backup -reason".
+func ValidateReason(reason string) error {
+	if reason != "" && reason != REASON_UPGRADE {
+		return fmt.Errorf("unknown reason %q, expected %q", reason, REASON_UPGRADE)
+	}
+	return nil
+}
+
+// Whether the backup must be taken regardless of skip_idle, size_check and
+// backup_window.
+func (r *Runner) force() bool {
+	return r.Force || r.Reason == REASON_UPGRADE
+}
+
+func (r *Runner) ignoreWindow() bool {
+	return r.IgnoreWindow || r.Reason == REASON_UPGRADE
+}
+
+// The tags the snapshots are taken with.
+func (r *Runner) tags() []string {
+	if r.Reason == REASON_UPGRADE && !slices.Contains(r.Tags, UPGRADE_TAG) {
+		return append(slices.Clone(r.Tags), UPGRADE_TAG)
+	}
+	return r.Tags
+}
+
+// Adds what the reason for the backup calls for to a plan.
+func (r *Runner) adjust(p Plan) Plan {
+	if r.Reason == REASON_UPGRADE {
+		p.Include = p.Server.conf.Upgrade.Paths
+	}
+	return p
+}
+
+// Until when pruning must leave the snapshot of a backup started at start
+// alone, or nil if only its tags decide.
+func (r *Runner) pinnedUntil(s *Server, start time.Time) *time.Time {
+	if r.Reason != REASON_UPGRADE {
+		return nil
+	}
+	t := start.Add(s.conf.Upgrade.Pin.Duration)
+	return &t
+}
+
+// Whether the snapshot is pinned, so pruning leaves it alone for now.
+func (snap Snapshot) pinned(now time.Time) bool {
+	return snap.PinnedUntil != nil && now.Before(*snap.PinnedUntil)
+}
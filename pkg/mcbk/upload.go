@@ -0,0 +1,256 @@
+package mcbk
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const UPLOAD_RETRY_BASE_DELAY = time.Second     //Delay before the first retry of a cloud storage request, doubled for each further one
+const UPLOAD_RETRY_MAX_DELAY = 30 * time.Second //Upper bound for the retry delay
+const UPLOAD_REQUEST_TIMEOUT = 2 * time.Minute  //Limit on a cloud storage request, plus the upload itself for one with a body, so a stalled connection fails and is retried
+const UPLOAD_MIN_RATE = 128 << 10               //Bytes per second below which an upload is given up as stalled
+
+// The client cloud storage requests are sent with.
+func newUploadHTTPClient() *http.Client {
+	return &http.Client{Timeout: UPLOAD_REQUEST_TIMEOUT}
+}
+
+// The client to send a request with a body of size bytes with: client,
+// with its timeout extended by the time the body takes at UPLOAD_MIN_RATE.
+func uploadClient(client *http.Client, size int64) *http.Client {
+	upload := *client
+	upload.Timeout += time.Duration(size/UPLOAD_MIN_RATE) * time.Second
+	return &upload
+}
+
+// A bucket, or container, that backups are mirrored into.
+type objectStore interface {
+	//Lists every object whose key starts with prefix
+	list(ctx context.Context, prefix string) ([]remoteObject, error)
+	//Uploads the file at path, size bytes long, as key
+	put(ctx context.Context, key, path string, size int64) error
+	delete(ctx context.Context, key string) error
+}
+
+// An object as returned by a bucket listing.
+type remoteObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// A cloud storage service the backups of a server are mirrored into.
+type uploadTarget struct {
+	name     string //Its config section, e.g. "s3"
+	label    string //For the log, e.g. "S3"
+	location string //Bucket or container, for the log
+	prefix   string
+	open     func(log *slog.Logger) (objectStore, error)
+}
+
+// The cloud storage services configured for uploads, in the order they
+// are synced.
+func (c ServerConfig) uploadTargets() []uploadTarget {
+	var targets []uploadTarget
+	if c.S3.Enabled() {
+		targets = append(targets, uploadTarget{"s3", "S3", c.S3.Bucket, c.S3.Prefix, func(log *slog.Logger) (objectStore, error) {
+			return newS3Client(c.S3, log)
+		}})
+	}
+	if c.GCS.Enabled() {
+		targets = append(targets, uploadTarget{"gcs", "Google Cloud Storage", "gs://" + c.GCS.Bucket, c.GCS.Prefix, func(log *slog.Logger) (objectStore, error) {
+			return newGCSClient(c.GCS, log)
+		}})
+	}
+	if c.Azure.Enabled() {
+		targets = append(targets, uploadTarget{"azure", "Azure Blob Storage", c.Azure.containerURL(), c.Azure.Prefix, func(log *slog.Logger) (objectStore, error) {
+			return newAzureClient(c.Azure, log)
+		}})
+	}
+	return targets
+}
+
+// Mirrors the backups into every configured bucket in turn. A failed
+// upload is logged but doesn't stop the others, or fail the backup, which
+// is already safe on local disk.
+func (s *Server) upload(ctx context.Context) {
+	for _, t := range s.conf.uploadTargets() {
+		if err := s.syncToStore(ctx, t); err != nil {
+			s.log().Error("Error uploading to "+t.label, "phase", "upload", "error", err)
+		}
+	}
+}
+
+// Sends a request made by try, retrying with exponential backoff on
+// network errors, throttling and server errors, up to retries attempts in
+// all. what describes the request in errors, so must not include any
+// credentials. respErr turns an error response into an error. The caller
+// must close the returned response's body.
+func sendWithRetries(ctx context.Context, log *slog.Logger, service string, retries int, what string, try func() (*http.Response, error), respErr func(*http.Response) error) (*http.Response, error) {
+	delay := UPLOAD_RETRY_BASE_DELAY
+	for attempt := 1; ; attempt++ {
+		resp, err := try()
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		retryable := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if err == nil {
+			err = respErr(resp)
+			resp.Body.Close()
+		}
+		err = fmt.Errorf("%s: %w", what, err)
+		if !retryable || attempt >= retries || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Warn(service+" request failed, retrying", "phase", "upload", "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, UPLOAD_RETRY_MAX_DELAY)
+	}
+}
+
+// Turns an S3 or Azure error response into an error, using the code and
+// message from its XML body when there is one.
+func xmlResponseError(resp *http.Response) error {
+	var body struct {
+		Code    string
+		Message string
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &body) == nil && body.Code != "" {
+		return fmt.Errorf("%s: %s: %s", resp.Status, body.Code, body.Message)
+	}
+	return errors.New(resp.Status)
+}
+
+// Mirrors the backend's files into the bucket: new and changed files are
+// uploaded, and objects whose local file is gone, e.g. after pruning, are
+// deleted. Only objects matching the backend's own naming are ever
+// deleted, so a bucket or prefix shared with other data is safe.
+func (s *Server) syncToStore(ctx context.Context, t uploadTarget) error {
+	store, ok := s.backend.(fileStore)
+	if !ok {
+		return fmt.Errorf("the %s backend doesn't support uploading to %s", s.conf.Backend, t.label)
+	}
+	client, err := t.open(s.log())
+	if err != nil {
+		return err
+	}
+	dir, pattern := store.Files()
+	local, err := listLocalFiles(dir, pattern)
+	if err != nil {
+		return err
+	}
+	prefix := strings.Trim(t.prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	s.log().Info("Uploading to "+t.label+"...", "phase", "upload", "location", t.location, "prefix", prefix)
+	start := time.Now()
+	objects, err := client.list(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	remote := map[string]remoteObject{}
+	for _, o := range objects {
+		remote[o.Key] = o
+	}
+
+	var uploaded, deleted int
+	var uploadedBytes int64
+	for _, rel := range slices.Sorted(maps.Keys(local)) {
+		info := local[rel]
+		key := prefix + rel
+		//LastModified may only have second precision
+		if o, ok := remote[key]; ok && o.Size == info.Size() && !info.ModTime().Truncate(time.Second).After(o.LastModified) {
+			continue
+		}
+		s.log().Debug("Uploading file", "phase", "upload", "key", key, "size", info.Size())
+		if err := client.put(ctx, key, filepath.Join(dir, filepath.FromSlash(rel)), info.Size()); err != nil {
+			return err
+		}
+		uploaded++
+		uploadedBytes += info.Size()
+	}
+
+	//Never mirror an empty backup set, it more likely means the disk is missing
+	if len(local) > 0 {
+		for key := range remote {
+			rel := strings.TrimPrefix(key, prefix)
+			top, _, _ := strings.Cut(rel, "/")
+			if _, ok := local[rel]; ok {
+				continue
+			}
+			if match, _ := filepath.Match(pattern, top); !match {
+				continue
+			}
+			s.log().Debug("Deleting object", "phase", "upload", "key", key)
+			if err := client.delete(ctx, key); err != nil {
+				return err
+			}
+			deleted++
+		}
+	}
+	s.log().Info("Upload complete", "phase", "upload", "location", t.location, "duration", time.Since(start), "files", uploaded, "bytes", uploadedBytes, "size", FormatBytes(uploadedBytes), "deleted", deleted)
+	return nil
+}
+
+// Finds every regular file in dir whose top-level entry matches pattern,
+// keyed by slash-separated path relative to dir.
+func listLocalFiles(dir, pattern string) (map[string]fs.FileInfo, error) {
+	tops, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]fs.FileInfo{}
+	for _, top := range tops {
+		err := filepath.WalkDir(top, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			files[filepath.ToSlash(rel)] = info
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Opens the file at path for uploading as a body of size bytes, bounded in
+// case the file grows while being uploaded.
+func openUploadBody(path string, size int64) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, size), f}, nil
+}
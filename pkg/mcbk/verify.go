@@ -0,0 +1,158 @@
+package mcbk
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const DEFAULT_SERVER_FLAVOR = "vanilla"
+
+// Regular expressions matched against the server's output to confirm that
+// a command worked. Blank patterns come from the server_flavor's set.
+type VerifyConfig struct {
+	List    string `json:"list"`     //Response to "list", used to check that the server is up
+	SaveOff string `json:"save_off"` //Response to "save-off"
+	SaveAll string `json:"save_all"` //Response to "save-all"
+	SaveOn  string `json:"save_on"`  //Response to "save-on"
+	Marker  bool   `json:"marker"`   //Precede each command with a "say" of a unique marker and only accept matches logged after it
+}
+
+// Built-in patterns for each server_flavor. Vanilla changed its messages in
+// 1.13, so both wordings are accepted, and finding saving already in the
+// wanted state counts as success. Bukkit-based servers may answer with
+// their own wording instead.
+var vanillaPatterns = VerifyConfig{
+	List:    `players online`,
+	SaveOff: `Turned off world auto-saving|Automatic saving is now disabled|Saving is already turned off`,
+	SaveAll: `Saved the (world|game)`,
+	SaveOn:  `Turned on world auto-saving|Automatic saving is now enabled|Saving is already turned on`,
+}
+
+var bukkitPatterns = VerifyConfig{
+	List:    vanillaPatterns.List,
+	SaveOff: vanillaPatterns.SaveOff + `|Disabled level saving`,
+	SaveAll: vanillaPatterns.SaveAll + `|Save complete`,
+	SaveOn:  vanillaPatterns.SaveOn + `|Enabled level saving`,
+}
+
+var flavorPatterns = map[string]VerifyConfig{
+	"vanilla": vanillaPatterns,
+	"spigot":  bukkitPatterns,
+	"paper":   bukkitPatterns,
+	//Fabric and Forge keep vanilla's command messages
+	"fabric":       vanillaPatterns,
+	"forge":        vanillaPatterns,
+	BEDROCK_FLAVOR: bedrockPatterns,
+}
+
+// The command that saves the world for each server_flavor, when it isn't
+// plain "save-all". Paper and Spigot write chunks asynchronously, and
+// only "save-all flush" waits for those writes to finish before reporting
+// that the world was saved.
+var flavorSaveAllCommands = map[string]string{
+	"spigot": "save-all flush",
+	"paper":  "save-all flush",
+}
+
+// Guesses the server_flavor of the server in dir from the files its
+// software leaves behind, falling back to DEFAULT_SERVER_FLAVOR.
+func DetectFlavor(dir string) string {
+	for _, f := range []struct {
+		flavor string
+		paths  []string
+	}{
+		{BEDROCK_FLAVOR, []string{"bedrock_server", "bedrock_server.exe"}},
+		{"paper", []string{"config/paper-global.yml", "paper.yml"}},
+		{"spigot", []string{"spigot.yml"}},
+		{"fabric", []string{".fabric", "fabric-server-launch.jar", "fabric-server-launcher.properties"}},
+		{"forge", []string{"libraries/net/minecraftforge", "libraries/net/neoforged"}},
+	} {
+		for _, p := range f.paths {
+			if ok, _ := exists(filepath.Join(dir, filepath.FromSlash(p))); ok {
+				return f.flavor
+			}
+		}
+	}
+	return DEFAULT_SERVER_FLAVOR
+}
+
+// Fills in blank patterns from a flavor's built-in set.
+func (v *VerifyConfig) setDefaults(flavor string) {
+	builtin := flavorPatterns[flavor]
+	for _, p := range []struct {
+		value   *string
+		builtin string
+	}{
+		{&v.List, builtin.List},
+		{&v.SaveOff, builtin.SaveOff},
+		{&v.SaveAll, builtin.SaveAll},
+		{&v.SaveOn, builtin.SaveOn},
+	} {
+		if *p.value == "" {
+			*p.value = p.builtin
+		}
+	}
+}
+
+// Compiled verification patterns, keyed by command.
+type verifyPatterns map[string]*regexp.Regexp
+
+// Compiles every pattern, naming the setting of any that is invalid.
+func (v VerifyConfig) compile() (verifyPatterns, error) {
+	patterns := verifyPatterns{}
+	for _, p := range []struct{ command, key, expr string }{
+		{"list", "verify.list", v.List},
+		{"save-off", "verify.save_off", v.SaveOff},
+		{"save-all", "verify.save_all", v.SaveAll},
+		{"save-on", "verify.save_on", v.SaveOn},
+	} {
+		re, err := regexp.Compile(p.expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.key, err)
+		}
+		patterns[p.command] = re
+	}
+	return patterns, nil
+}
+
+// How long to wait for each command to be confirmed. saving a large world
+// can take far longer than answering "list".
+type CommandTimeoutsConfig struct {
+	List    Duration `json:"list"`
+	SaveOff Duration `json:"save_off"`
+	SaveAll Duration `json:"save_all"`
+	SaveOn  Duration `json:"save_on"`
+}
+
+func (t *CommandTimeoutsConfig) fields() map[string]*Duration {
+	return map[string]*Duration{"list": &t.List, "save-off": &t.SaveOff, "save-all": &t.SaveAll, "save-on": &t.SaveOn}
+}
+
+// Fills in blank timeouts with verify_timeout.
+func (t *CommandTimeoutsConfig) setDefaults(fallback Duration) {
+	for _, d := range t.fields() {
+		if d.Duration == 0 {
+			*d = fallback
+		}
+	}
+}
+
+func (t CommandTimeoutsConfig) validate() error {
+	for _, d := range t.fields() {
+		if d.Duration < 0 {
+			return errors.New("command_timeouts must not be negative")
+		}
+	}
+	return nil
+}
+
+// The timeout for a command, or fallback for commands without their own.
+func (t CommandTimeoutsConfig) get(command string, fallback time.Duration) time.Duration {
+	if d, ok := t.fields()[command]; ok {
+		return d.Duration
+	}
+	return fallback
+}
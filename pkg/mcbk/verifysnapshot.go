@@ -0,0 +1,327 @@
+package mcbk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const MAX_VERIFY_PROBLEMS = 100 //Problems listed in a verify report, the rest are only counted
+
+// The outcome of verifying a snapshot.
+type VerifyReport struct {
+	Server      string   `json:"server"`
+	Snapshot    string   `json:"snapshot"`
+	Checked     bool     `json:"checked"`      //The backend's integrity check ran
+	Deep        bool     `json:"deep"`         //The snapshot was restored and inspected
+	Files       int      `json:"files"`        //Files restored
+	Size        int64    `json:"size"`         //Bytes restored
+	Manifest    bool     `json:"manifest"`     //The files were compared with the snapshot's manifest or the backend's listing of it
+	Stored      bool     `json:"stored"`       //That was the manifest mcbk wrote when the snapshot was taken
+	Hashed      int      `json:"hashed"`       //Files compared by SHA-256 as well as size
+	LevelDats   int      `json:"level_dats"`   //level.dat files that parsed
+	RegionFiles int      `json:"region_files"` //Region files whose headers parsed
+	Chunks      int      `json:"chunks"`       //Chunks listed in those headers
+	Problems    []string `json:"problems"`     //What failed, at most MAX_VERIFY_PROBLEMS of them
+	Failed      int      `json:"failed"`       //Number of problems, including those left out of Problems
+	Duration    Duration `json:"duration"`
+}
+
+func (r *VerifyReport) Passed() bool {
+	return r.Failed == 0
+}
+
+func (r *VerifyReport) problem(format string, args ...any) {
+	if r.Failed < MAX_VERIFY_PROBLEMS {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+	r.Failed++
+}
+
+// Verifies a snapshot, given by ID or "latest", with the backend's own
+// integrity check, and if mcbk wrote a manifest when it was taken, by
+// comparing that with the backend's listing of the snapshot without
+// restoring it. If deep is set, the snapshot is also restored into a
+// temporary directory under dir, or the system's if dir is empty, where
+// every file is compared with the manifest, or the backend's listing if
+// there is none, by SHA-256 where hashes are known, and every level.dat
+// and region file header must parse. A damaged snapshot is reported in
+// the report's problems, not as an error.
+func (s *Server) VerifySnapshot(ctx context.Context, id string, deep bool, dir string) (VerifyReport, error) {
+	start := time.Now()
+	report := VerifyReport{Server: s.Name(), Deep: deep, Problems: []string{}}
+	snaps, err := s.backend.List(ctx)
+	if err != nil {
+		return report, err
+	}
+	if len(snaps) == 0 {
+		return report, errors.New("there are no snapshots")
+	}
+	snap := snaps[len(snaps)-1]
+	if id != "latest" {
+		i := indexSnapshot(snaps, id)
+		if i < 0 {
+			return report, fmt.Errorf("no snapshot %q", id)
+		}
+		snap = snaps[i]
+	}
+	report.Snapshot = snap.ID
+	log := s.log().With("phase", "verify", "snapshot", snap.ID)
+
+	if _, ok := s.backend.(checker); ok {
+		report.Checked = true
+		if err := s.checkSnapshot(ctx, snap); err != nil {
+			report.problem("%s", err)
+		}
+	}
+	if deep {
+		if err := s.verifyRestore(ctx, snap.ID, dir, &report); err != nil {
+			return report, err
+		}
+	} else if err := s.compareListing(ctx, snap.ID, &report); err != nil {
+		return report, err
+	}
+	report.Duration.Duration = time.Since(start)
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	if report.Passed() {
+		log.Info("Snapshot verified", "deep", deep, "files", report.Files, "duration", report.Duration.Duration)
+	} else {
+		log.Error("Snapshot verification failed", "deep", deep, "problems", report.Failed, "first", report.Problems[0])
+	}
+	return report, nil
+}
+
+func indexSnapshot(snaps []Snapshot, id string) int {
+	for i, s := range snaps {
+		if s.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// A file as restored for verification.
+type restoredFile struct {
+	path    string //Full path on disk
+	size    int64
+	regular bool
+}
+
+// Restores the snapshot into a temporary directory and inspects it.
+func (s *Server) verifyRestore(ctx context.Context, id, dir string, report *VerifyReport) error {
+	staging, err := os.MkdirTemp(dir, "mcbk-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	s.log().Info("Restoring snapshot for verification...", "phase", "verify", "snapshot", id, "dir", staging)
+	if err := s.backend.Restore(ctx, id, staging); err != nil {
+		if ctx.Err() == nil {
+			report.problem("restoring the snapshot failed: %s", err)
+		}
+		return nil
+	}
+
+	restored := map[string]restoredFile{}
+	err = filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(staging, path)
+		if err != nil {
+			return err
+		}
+		restored[filepath.ToSlash(rel)] = restoredFile{path: path, size: info.Size(), regular: info.Mode().IsRegular()}
+		report.Files++
+		report.Size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.compareManifest(ctx, id, restored, report); err != nil {
+		return err
+	}
+	worlds := 0
+	for _, rel := range slices.Sorted(maps.Keys(restored)) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f := restored[rel]
+		if !f.regular {
+			continue
+		}
+		switch name := filepath.Base(rel); {
+		case name == "level.dat":
+			worlds++
+			if err := checkLevelDat(f.path); err != nil {
+				report.problem("%s doesn't parse: %s", rel, err)
+			} else {
+				report.LevelDats++
+			}
+		case strings.HasSuffix(name, ".mca") || strings.HasSuffix(name, ".mcr"):
+			chunks, err := checkRegionFile(f.path)
+			report.Chunks += chunks
+			if err != nil {
+				report.problem("%s has a damaged header: %s", rel, err)
+			} else {
+				report.RegionFiles++
+			}
+		}
+	}
+	if worlds == 0 {
+		report.problem("the snapshot holds no level.dat, so no world")
+	}
+	return nil
+}
+
+// The files of a snapshot to check it against: its manifest, or else the
+// backend's listing of it, hashed if the backend can. ok is false if there
+// is neither.
+func (s *Server) snapshotListing(ctx context.Context, id string, report *VerifyReport) (files []SnapshotFile, ok bool, err error) {
+	m, err := s.readManifest(id)
+	if err == nil {
+		report.Stored = true
+		return m.Files, true, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		report.problem("%s", err)
+	}
+	return s.backendListing(ctx, id)
+}
+
+// The backend's listing of a snapshot's files, hashed if it can. ok is
+// false if it can't list them.
+func (s *Server) backendListing(ctx context.Context, id string) (files []SnapshotFile, ok bool, err error) {
+	switch b := s.backend.(type) {
+	case fileHasher:
+		files, err = b.HashFiles(ctx, id)
+	case fileLister:
+		files, err = b.ListFiles(ctx, id)
+	default:
+		return nil, false, nil
+	}
+	return files, true, err
+}
+
+// Compares the restored files with the snapshot's manifest, or the
+// backend's listing of it: the same files, of the same sizes and, where
+// hashes are known, the same contents. Backends that can't list a
+// snapshot's files are skipped if there is no manifest.
+func (s *Server) compareManifest(ctx context.Context, id string, restored map[string]restoredFile, report *VerifyReport) error {
+	manifest, ok, err := s.snapshotListing(ctx, id, report)
+	if !ok {
+		return nil
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			report.problem("listing the snapshot's files failed: %s", err)
+		}
+		return ctx.Err()
+	}
+	report.Manifest = true
+
+	listed := map[string]bool{}
+	for _, m := range manifest {
+		listed[m.Path] = true
+		f, ok := restored[m.Path]
+		switch {
+		case !ok:
+			report.problem("%s is in the snapshot but wasn't restored", m.Path)
+		case !f.regular:
+		case f.size != m.Size:
+			report.problem("%s was restored with %d bytes, the snapshot lists %d", m.Path, f.size, m.Size)
+		case m.SHA256 != "":
+			sum, err := hashFile(f.path)
+			if err != nil {
+				return err
+			}
+			if sum != m.SHA256 {
+				report.problem("%s was restored with different contents than the snapshot holds", m.Path)
+			}
+			report.Hashed++
+		}
+	}
+	for _, rel := range slices.Sorted(maps.Keys(restored)) {
+		//Hashing backends and manifests only list regular files
+		if !listed[rel] && restored[rel].regular {
+			report.problem("%s was restored but isn't in the snapshot's listing", rel)
+		}
+	}
+	return nil
+}
+
+// Compares the manifest mcbk wrote when the snapshot was taken with the
+// backend's listing of it, which catches files lost or damaged in storage
+// without restoring anything. Needs both a manifest and a backend that can
+// list a snapshot's files.
+func (s *Server) compareListing(ctx context.Context, id string, report *VerifyReport) error {
+	m, err := s.readManifest(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		report.problem("%s", err)
+		return nil
+	}
+	listing, ok, err := s.backendListing(ctx, id)
+	if !ok {
+		return nil
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			report.problem("listing the snapshot's files failed: %s", err)
+		}
+		return ctx.Err()
+	}
+	report.Manifest, report.Stored = true, true
+
+	stored := map[string]SnapshotFile{}
+	for _, f := range listing {
+		stored[f.Path] = f
+	}
+	for _, f := range m.Files {
+		l, ok := stored[f.Path]
+		switch {
+		case !ok:
+			report.problem("%s was backed up but isn't in the snapshot", f.Path)
+		case l.Size != f.Size:
+			report.problem("%s is stored with %d bytes, %d were backed up", f.Path, l.Size, f.Size)
+		case l.SHA256 != "" && f.SHA256 != "":
+			if l.SHA256 != f.SHA256 {
+				report.problem("%s is stored with different contents than were backed up", f.Path)
+			}
+			report.Hashed++
+		}
+	}
+	return nil
+}
+
+// The hex SHA-256 hash of a file's contents.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
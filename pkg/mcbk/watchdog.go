@@ -0,0 +1,131 @@
+package mcbk
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const WATCHDOG_POLL = 5 * time.Minute //How often "mcbk daemon" checks for overdue backups
+
+// Alerts when a server has gone too long without a successful backup,
+// whatever the reason: failing runs, skipped ones, or a scheduler that
+// stopped running them at all.
+type WatchdogConfig struct {
+	MaxAge Duration `json:"max_age"` //Notify once the last successful backup is older than this, e.g. "26h". 0 disables the watchdog
+	Repeat Duration `json:"repeat"`  //How often "mcbk daemon" repeats the alert while the backups stay overdue, default 24h
+}
+
+func (c WatchdogConfig) Enabled() bool {
+	return c.MaxAge.Duration > 0
+}
+
+func (c *WatchdogConfig) setDefaults() {
+	if c.Repeat.Duration == 0 {
+		c.Repeat.Duration = 24 * time.Hour
+	}
+}
+
+func (c WatchdogConfig) validate() []error {
+	var errs []error
+	if c.MaxAge.Duration < 0 {
+		errs = append(errs, errors.New("watchdog.max_age must not be negative"))
+	}
+	if c.Repeat.Duration < 0 {
+		errs = append(errs, errors.New("watchdog.repeat must not be negative"))
+	}
+	return errs
+}
+
+// When the last successful backup was taken, from the history or, for
+// backups taken before history was kept, the newest snapshot. Zero if
+// there is none.
+func (s *Server) lastSuccess(ctx context.Context) (time.Time, error) {
+	history, err := s.History()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Status == "success" {
+			return history[i].Start, nil
+		}
+	}
+	snaps, err := s.backend.List(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(snaps) == 0 {
+		return time.Time{}, nil
+	}
+	return snaps[len(snaps)-1].Time, nil
+}
+
+// Checks once whether the server has gone more than maxAge without a
+// successful backup, notifying if so, for "mcbk watchdog". Returns
+// whether it has, or an error if that can't be told.
+func (r *Runner) Watchdog(ctx context.Context, s *Server, maxAge time.Duration) (bool, error) {
+	last, err := s.lastSuccess(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !last.IsZero() && time.Since(last) <= maxAge {
+		return false, nil
+	}
+	r.alertOverdue(ctx, s, last, maxAge)
+	return true, nil
+}
+
+// Checks every WATCHDOG_POLL whether the server has gone more than
+// watchdog.max_age without a successful backup, until ctx is done, for
+// "mcbk daemon". The alert is sent once the backups become overdue and
+// then every watchdog.repeat until one succeeds. If the server has never
+// been backed up, the time is counted from when watching started.
+func (r *Runner) WatchOverdue(ctx context.Context, s *Server) {
+	conf := s.conf.Watchdog
+	if !conf.Enabled() {
+		return
+	}
+	start := time.Now()
+	var alerted time.Time
+	ticker := time.NewTicker(WATCHDOG_POLL)
+	defer ticker.Stop()
+	for {
+		//The daemon backs up every server as it starts, so the first
+		//check waits for that
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		last, err := s.lastSuccess(ctx)
+		if err != nil {
+			s.log().Warn("Error checking for overdue backups", "phase", "watchdog", "error", err)
+		} else {
+			if last.After(alerted) {
+				//A backup succeeded since the last alert
+				alerted = time.Time{}
+			}
+			due := cmp.Or(last, start).Add(conf.MaxAge.Duration)
+			if time.Now().After(due) && (alerted.IsZero() || time.Since(alerted) >= conf.Repeat.Duration) {
+				r.alertOverdue(ctx, s, last, conf.MaxAge.Duration)
+				alerted = time.Now()
+			}
+		}
+	}
+}
+
+// Notifies that the server's backups are overdue, the last successful one
+// having been taken at last, or never if it is zero.
+func (r *Runner) alertOverdue(ctx context.Context, s *Server, last time.Time, maxAge time.Duration) {
+	err := errors.New("no successful backup recorded")
+	ev := Event{Kind: EventOverdue, Server: s.conf.Name, Time: time.Now()}
+	if !last.IsZero() {
+		ev.Duration = time.Since(last)
+		err = fmt.Errorf("no successful backup since %s, %s ago", last.Format(time.DateTime), ev.Duration.Round(time.Minute))
+	}
+	ev.Err = err
+	s.log().Error("Backups are overdue", "phase", "watchdog", "max_age", maxAge, "error", err)
+	r.notify(ctx, s, ev)
+}
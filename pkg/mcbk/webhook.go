@@ -0,0 +1,181 @@
+package mcbk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const DEFAULT_WEBHOOK_BODY = `{"server": {{json .Server}}, "event": {{json .Event}}, "status": {{json .Status}}, ` +
+	`"time": {{json .Time}}, "duration_seconds": {{.Seconds}}, "snapshot": {{json .Snapshot}}, "bytes": {{.Bytes}}, ` +
+	`"error": {{json .Error}}, "remote": {{json .Remote}}, "report": {{json .Report}}, "message": {{json .Message}}}`
+
+// Settings for a generic HTTP webhook destination. The URL is the
+// notify block's url.
+type WebhookConfig struct {
+	Method      string            `json:"method"`                //HTTP method, default POST
+	Headers     map[string]string `json:"headers" secret:"true"` //Extra request headers, e.g. { Authorization = "Bearer ..." }
+	ContentType string            `json:"content_type"`          //Content-Type of the body, default application/json
+	Body        string            `json:"body"`                  //Template for the request body, see webhookData. Defaults to a JSON object with every field
+}
+
+// What webhook body templates can refer to. The json function formats any
+// value as JSON, e.g. {"text": {{json .Message}}}.
+type webhookData struct {
+	Server   string    //The server, or the network for network_report
+	Event    EventKind //"start", "success", "failure", "replication_failure", "size_anomaly", "source_corrupt" or "network_report"
+	Status   string    //"started", "complete", "FAILED", "replication to <remote> FAILED", "much smaller than usual" or "taken from a world that may be corrupt"
+	Time     time.Time
+	Duration string  //e.g. "1m30s", empty for start events
+	Seconds  float64 //The duration in seconds
+	Snapshot string  //ID of the new snapshot, on success and source_corrupt
+	Size     string  //Size of the new snapshot, e.g. "1.5 GiB", if known
+	Bytes    int64   //The same in bytes
+	Error    string  //What went wrong, on failure, size_anomaly or source_corrupt
+	Remote   string  //The rclone remote, for replication_failure
+	Report   string  //The outcome for each server, one per line, for network_report
+	Message  string  //One line summing it all up, e.g. "Backup of survival complete after 1m30s"
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func (c *WebhookConfig) setDefaults() {
+	c.Method = strings.ToUpper(c.Method)
+	if c.Method == "" {
+		c.Method = http.MethodPost
+	}
+	if c.ContentType == "" {
+		c.ContentType = "application/json"
+	}
+	if c.Body == "" {
+		c.Body = DEFAULT_WEBHOOK_BODY
+	}
+}
+
+func (c *WebhookConfig) validate(rawURL string) []error {
+	var errs []error
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("webhook needs an http(s) url, got %q", rawURL))
+	}
+	switch c.Method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		errs = append(errs, fmt.Errorf("unsupported webhook.method %q, expected GET, POST, PUT or PATCH", c.Method))
+	}
+	if _, err := parseWebhookBody(c); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Parses the body template, checking that it only refers to fields
+// webhookData has.
+func parseWebhookBody(c *WebhookConfig) (*template.Template, error) {
+	t, err := template.New("body").Funcs(webhookFuncs).Parse(c.Body)
+	if err == nil {
+		err = t.Execute(io.Discard, webhookData{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("webhook.body: %w", err)
+	}
+	return t, nil
+}
+
+// Sends events to any HTTP endpoint, such as ntfy.sh, Gotify or
+// PagerDuty, with a templated body.
+type webhookNotifier struct {
+	url  string
+	conf WebhookConfig
+}
+
+// Describes an event for templates and push messages.
+func newWebhookData(ev Event) webhookData {
+	data := webhookData{Server: ev.Server, Event: ev.Kind, Time: ev.Time, Remote: ev.Remote, Report: ev.Report}
+	switch ev.Kind {
+	case EventStart:
+		data.Status = "started"
+	case EventSuccess:
+		data.Status = "complete"
+		data.Snapshot, data.Bytes = ev.Snapshot.ID, ev.Snapshot.Size
+		if ev.Snapshot.Size > 0 {
+			data.Size = FormatBytes(ev.Snapshot.Size)
+		}
+	case EventFailure:
+		data.Status = "FAILED"
+		data.Error = ev.Err.Error()
+	case EventReplicationFailure:
+		data.Status = "replication to " + ev.Remote + " FAILED"
+		data.Error = ev.Err.Error()
+	case EventSizeAnomaly:
+		data.Status = "much smaller than usual"
+		data.Error = ev.Err.Error()
+	case EventSourceCorrupt:
+		data.Status = "taken from a world that may be corrupt"
+		data.Snapshot, data.Error = ev.Snapshot.ID, ev.Err.Error()
+	case EventOverdue:
+		data.Status = "OVERDUE"
+		data.Error = ev.Err.Error()
+	case EventNetworkReport:
+		data.Status = "complete"
+		if ev.Err != nil {
+			data.Status, data.Error = "FAILED", ev.Err.Error()
+		}
+	}
+	data.Message = "Backup of " + ev.Server + " " + data.Status
+	if ev.Kind == EventNetworkReport {
+		data.Message = "Backup of network " + ev.Server + " " + data.Status
+	}
+	if ev.Kind != EventStart {
+		data.Duration = ev.Duration.Round(time.Second).String()
+		data.Seconds = ev.Duration.Seconds()
+		//The size check runs before the backup, and an overdue backup
+		//never ran, so there's no "after"
+		if ev.Kind != EventSizeAnomaly && ev.Kind != EventOverdue {
+			data.Message += " after " + data.Duration
+		}
+	}
+	if data.Error != "" {
+		data.Message += ": " + data.Error
+	}
+	return data
+}
+
+func (n *webhookNotifier) Notify(ev Event) error {
+	data := newWebhookData(ev)
+	tmpl, err := parseWebhookBody(&n.conf)
+	if err != nil {
+		return err
+	}
+	var body strings.Builder
+	if err := tmpl.Execute(&body, data); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(n.conf.Method, n.url, strings.NewReader(body.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", n.conf.ContentType)
+	for k, v := range n.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
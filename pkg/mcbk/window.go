@@ -0,0 +1,173 @@
+package mcbk
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Returned by Runner.Backup when the backup was skipped because
+// backup_window doesn't allow one at the time.
+var ErrOutsideWindow = errors.New("backups aren't allowed at this time")
+
+// When backups may run, in the local time zone. Each period is written as
+// "HH:MM-HH:MM", optionally after the days it starts on, e.g. "Sat
+// 18:00-02:00" or "Mon,Wed-Fri 09:00-17:00". A period that ends at or
+// before its start runs past midnight.
+type BackupWindowConfig struct {
+	Allow    []string `json:"allow"`    //Periods backups may run in, e.g. ["02:00-06:00"]. Empty allows any time outside the blackouts
+	Blackout []string `json:"blackout"` //Periods backups must not run in, e.g. ["Sat 18:00-02:00"] for event nights
+}
+
+// A parsed backup_window period.
+type timeWindow struct {
+	days       [7]bool //Days the period starts on, by time.Weekday
+	start, end int     //Minutes since midnight
+}
+
+// Parses a period such as "02:00-06:00" or "Fri-Sun 18:00-24:00".
+func parseTimeWindow(s string) (timeWindow, error) {
+	var w timeWindow
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("invalid period %q, expected e.g. \"02:00-06:00\" or \"Sat 18:00-02:00\"", s)
+	}
+	if len(fields) == 1 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	} else {
+		for _, part := range strings.Split(fields[0], ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			first, ok1 := parseWeekday(from)
+			last, ok2 := first, true
+			if isRange {
+				last, ok2 = parseWeekday(to)
+			}
+			if !ok1 || !ok2 {
+				return w, fmt.Errorf("invalid days %q in period %q, expected e.g. \"Sat\" or \"Mon,Wed-Fri\"", fields[0], s)
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	from, to, ok := strings.Cut(fields[len(fields)-1], "-")
+	var err1, err2 error
+	w.start, err1 = parseClock(from, false)
+	w.end, err2 = parseClock(to, true)
+	if !ok || err1 != nil || err2 != nil {
+		return w, fmt.Errorf("invalid times in period %q, expected e.g. \"02:00-06:00\"", s)
+	}
+	return w, nil
+}
+
+// Parses a day name, or at least its first three letters.
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if len(s) >= 3 && strings.HasPrefix(strings.ToLower(d.String()), s) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// Parses "HH:MM" into minutes since midnight. "24:00" is allowed as the end
+// of a period.
+func parseClock(s string, end bool) (int, error) {
+	if end && s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Whether t falls in the period.
+func (w timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && m >= w.start && m < w.end
+	}
+	//Runs past midnight, so it may have started the day before
+	return w.days[day] && m >= w.start || w.days[(day+6)%7] && m < w.end
+}
+
+func parseTimeWindows(periods []string) ([]timeWindow, error) {
+	windows := make([]timeWindow, len(periods))
+	for i, p := range periods {
+		w, err := parseTimeWindow(p)
+		if err != nil {
+			return nil, err
+		}
+		windows[i] = w
+	}
+	return windows, nil
+}
+
+func (c BackupWindowConfig) validate() []error {
+	var errs []error
+	if _, err := parseTimeWindows(c.Allow); err != nil {
+		errs = append(errs, fmt.Errorf("backup_window.allow: %w", err))
+	}
+	if _, err := parseTimeWindows(c.Blackout); err != nil {
+		errs = append(errs, fmt.Errorf("backup_window.blackout: %w", err))
+	}
+	return errs
+}
+
+// Returns t if backups may run then, otherwise the first minute after it
+// when they may. Returns the zero time if that is more than a week away,
+// since the periods then never allow a backup.
+func (c BackupWindowConfig) NextAllowed(t time.Time) time.Time {
+	//Checked by validate
+	allow, _ := parseTimeWindows(c.Allow)
+	blackout, _ := parseTimeWindows(c.Blackout)
+	allows := func(t time.Time) bool {
+		for _, w := range blackout {
+			if w.contains(t) {
+				return false
+			}
+		}
+		if len(allow) == 0 {
+			return true
+		}
+		for _, w := range allow {
+			if w.contains(t) {
+				return true
+			}
+		}
+		return false
+	}
+	if allows(t) {
+		return t
+	}
+	next := t.Truncate(time.Minute)
+	for range 8 * 24 * 60 {
+		next = next.Add(time.Minute)
+		if allows(next) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// Returns nil if backup_window allows a backup at t, otherwise
+// ErrOutsideWindow saying when one next may run.
+func (s *Server) checkWindow(t time.Time) error {
+	next := s.conf.BackupWindow.NextAllowed(t)
+	switch {
+	case next.Equal(t):
+		return nil
+	case next.IsZero():
+		return ErrOutsideWindow
+	}
+	return fmt.Errorf("%w, next allowed at %s", ErrOutsideWindow, next.Format("Mon 15:04"))
+}
@@ -0,0 +1,104 @@
+package mcbk
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 2024-01-01 was a Monday
+var (
+	monday    = date(2024, time.January, 1, 0, 0, 0)
+	tuesday   = monday.AddDate(0, 0, 1)
+	wednesday = monday.AddDate(0, 0, 2)
+	friday    = monday.AddDate(0, 0, 4)
+	saturday  = monday.AddDate(0, 0, 5)
+	sunday    = monday.AddDate(0, 0, 6)
+)
+
+// The given time of day on day.
+func at(day time.Time, hour, min int) time.Time {
+	return day.Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute)
+}
+
+func TestParseTimeWindowErrors(t *testing.T) {
+	for _, period := range []string{"", "02:00", "2am-6am", "25:00-26:00", "24:00-02:00", "Xyz 02:00-06:00", "Mo 02:00-06:00", "Mon 02:00-06:00 extra"} {
+		if _, err := parseTimeWindow(period); err == nil {
+			t.Errorf("%q: no error", period)
+		}
+	}
+	for _, period := range []string{"02:00-06:00", "00:00-24:00", "Sat 18:00-02:00", "Mon,Wed-Fri 09:00-17:00", "saturday 10:00-11:00", "Fri-Mon 20:00-23:00"} {
+		if _, err := parseTimeWindow(period); err != nil {
+			t.Errorf("%q: %v", period, err)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	for _, tt := range []struct {
+		period string
+		t      time.Time
+		want   bool
+	}{
+		{"02:00-06:00", at(saturday, 2, 0), true},
+		{"02:00-06:00", at(saturday, 5, 59), true},
+		{"02:00-06:00", at(saturday, 6, 0), false},
+		{"02:00-06:00", at(saturday, 1, 59), false},
+		{"Sat 18:00-02:00", at(saturday, 18, 0), true},
+		{"Sat 18:00-02:00", at(sunday, 1, 59), true},
+		{"Sat 18:00-02:00", at(sunday, 2, 0), false},
+		{"Sat 18:00-02:00", at(sunday, 18, 0), false},
+		{"Sat 18:00-02:00", at(saturday, 1, 0), false},
+		{"Mon,Wed-Fri 09:00-17:00", at(monday, 9, 0), true},
+		{"Mon,Wed-Fri 09:00-17:00", at(tuesday, 10, 0), false},
+		{"Mon,Wed-Fri 09:00-17:00", at(wednesday, 10, 0), true},
+		{"Mon,Wed-Fri 09:00-17:00", at(friday, 16, 59), true},
+		{"Fri-Sun 18:00-24:00", at(sunday, 23, 59), true},
+		{"Fri-Sun 18:00-24:00", at(monday.AddDate(0, 0, 7), 0, 0), false},
+		{"Sat-Mon 22:00-01:00", at(monday, 23, 0), true},
+		{"Sat-Mon 22:00-01:00", at(tuesday, 0, 30), true},
+		{"Sat-Mon 22:00-01:00", at(tuesday, 23, 0), false},
+	} {
+		w, err := parseTimeWindow(tt.period)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(tt.t); got != tt.want {
+			t.Errorf("%q contains %s = %t, want %t", tt.period, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestNextAllowed(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		c    BackupWindowConfig
+		t    time.Time
+		want time.Time
+	}{
+		{"no periods", BackupWindowConfig{}, at(saturday, 12, 34), at(saturday, 12, 34)},
+		{"inside an allowed period", BackupWindowConfig{Allow: []string{"02:00-06:00"}}, at(saturday, 3, 0), at(saturday, 3, 0)},
+		{"before the next allowed period", BackupWindowConfig{Allow: []string{"02:00-06:00"}}, at(saturday, 12, 34).Add(56 * time.Second), at(sunday, 2, 0)},
+		{"during a blackout", BackupWindowConfig{Blackout: []string{"Sat 18:00-02:00"}}, at(saturday, 20, 0), at(sunday, 2, 0)},
+		{"a blackout over an allowed period", BackupWindowConfig{Allow: []string{"02:00-06:00"}, Blackout: []string{"Sun 00:00-24:00"}}, at(saturday, 12, 0), at(monday.AddDate(0, 0, 7), 2, 0)},
+		{"never allowed", BackupWindowConfig{Allow: []string{"02:00-06:00"}, Blackout: []string{"00:00-24:00"}}, at(saturday, 12, 0), time.Time{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.NextAllowed(tt.t); !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckWindow(t *testing.T) {
+	s := newTestServer(t, "[backup_window]\nallow = [\"02:00-06:00\"]")
+	if err := s.checkWindow(at(saturday, 3, 0)); err != nil {
+		t.Errorf("inside the window: %v", err)
+	}
+	err := s.checkWindow(at(saturday, 12, 0))
+	if !errors.Is(err, ErrOutsideWindow) || !strings.Contains(err.Error(), "next allowed at Sun 02:00") {
+		t.Errorf("outside the window got error %v, want ErrOutsideWindow naming the next allowed time", err)
+	}
+}
@@ -0,0 +1,252 @@
+package mcbk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	MAX_LEVEL_DAT_SIZE = 64 << 20 //Refuse to decompress level.dat files past this, which are damaged or not level.dat at all
+	REGION_SECTOR_SIZE = 4096
+	MAX_NBT_DEPTH      = 512 //As enforced by the game
+)
+
+// Checks that a level.dat parses as NBT, either a gzipped Java Edition one
+// holding a Data compound, or a Bedrock Edition one with its 8 byte header.
+func checkLevelDat(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		nbt, err := io.ReadAll(io.LimitReader(gz, MAX_LEVEL_DAT_SIZE))
+		if err != nil {
+			return fmt.Errorf("decompressing: %w", err)
+		}
+		children, err := parseNBT(nbt, binary.BigEndian)
+		if err != nil {
+			return err
+		}
+		if children["Data"] != nbtCompound {
+			return errors.New("no Data compound")
+		}
+		return nil
+	}
+	//Bedrock: storage version and length, then little-endian NBT
+	if len(data) < 8 || int(binary.LittleEndian.Uint32(data[4:8])) != len(data)-8 {
+		return errors.New("neither gzipped NBT nor a Bedrock level.dat header")
+	}
+	_, err = parseNBT(data[8:], binary.LittleEndian)
+	return err
+}
+
+const (
+	nbtEnd       = 0
+	nbtByteArray = 7
+	nbtString    = 8
+	nbtList      = 9
+	nbtCompound  = 10
+	nbtIntArray  = 11
+	nbtLongArray = 12
+)
+
+// Sizes of the fixed-size NBT tags by type: byte, short, int, long, float
+// and double.
+var nbtSizes = map[byte]int{1: 1, 2: 2, 3: 4, 4: 8, 5: 4, 6: 8}
+
+// Sizes of the elements of the NBT array tags by type.
+var nbtArraySizes = map[byte]int{nbtByteArray: 1, nbtIntArray: 4, nbtLongArray: 8}
+
+// Walks an NBT document, whose root must be a compound taking up all of
+// data, and returns the types of the root's children by name.
+func parseNBT(data []byte, order binary.ByteOrder) (map[string]byte, error) {
+	r := &nbtReader{data: data, order: order}
+	tag, err := r.take(1)
+	if err != nil {
+		return nil, err
+	}
+	if tag[0] != nbtCompound {
+		return nil, fmt.Errorf("root tag has type %d, expected a compound", tag[0])
+	}
+	if _, err := r.string(); err != nil {
+		return nil, err
+	}
+	children := map[string]byte{}
+	if err := r.compound(children); err != nil {
+		return nil, err
+	}
+	if len(r.data) > 0 {
+		return nil, fmt.Errorf("%d bytes left over after the root tag", len(r.data))
+	}
+	return children, nil
+}
+
+type nbtReader struct {
+	data  []byte
+	order binary.ByteOrder
+	depth int
+}
+
+func (r *nbtReader) take(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b, nil
+}
+
+func (r *nbtReader) length() (int, error) {
+	b, err := r.take(4)
+	if err != nil {
+		return 0, err
+	}
+	n := int32(r.order.Uint32(b))
+	if n < 0 {
+		return 0, fmt.Errorf("negative length %d", n)
+	}
+	return int(n), nil
+}
+
+func (r *nbtReader) string() (string, error) {
+	b, err := r.take(2)
+	if err != nil {
+		return "", err
+	}
+	s, err := r.take(int(r.order.Uint16(b)))
+	return string(s), err
+}
+
+// Reads a compound's tags up to its end tag, noting their types by name in
+// children if it isn't nil.
+func (r *nbtReader) compound(children map[string]byte) error {
+	for {
+		tag, err := r.take(1)
+		if err != nil {
+			return err
+		}
+		if tag[0] == nbtEnd {
+			return nil
+		}
+		name, err := r.string()
+		if err != nil {
+			return err
+		}
+		if children != nil {
+			children[name] = tag[0]
+		}
+		if err := r.payload(tag[0]); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+}
+
+func (r *nbtReader) payload(tag byte) error {
+	if size, ok := nbtSizes[tag]; ok {
+		_, err := r.take(size)
+		return err
+	}
+	if size, ok := nbtArraySizes[tag]; ok {
+		n, err := r.length()
+		if err != nil {
+			return err
+		}
+		_, err = r.take(n * size)
+		return err
+	}
+	if tag == nbtString {
+		_, err := r.string()
+		return err
+	}
+	if tag != nbtList && tag != nbtCompound {
+		return fmt.Errorf("unknown tag type %d", tag)
+	}
+
+	r.depth++
+	defer func() { r.depth-- }()
+	if r.depth > MAX_NBT_DEPTH {
+		return errors.New("nested too deeply")
+	}
+	if tag == nbtCompound {
+		return r.compound(nil)
+	}
+	elem, err := r.take(1)
+	if err != nil {
+		return err
+	}
+	n, err := r.length()
+	if err != nil {
+		return err
+	}
+	if n > 0 && elem[0] == nbtEnd {
+		return errors.New("list of end tags")
+	}
+	for i := 0; i < n; i++ {
+		if err := r.payload(elem[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks a region file's header: every chunk it lists must lie within the
+// file and start with a plausible length and a known compression type.
+// Returns how many chunks the file holds. The chunks themselves aren't
+// decompressed.
+func checkRegionFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	//The game leaves empty region files behind for regions it never wrote to
+	if info.Size() == 0 {
+		return 0, nil
+	}
+	header := make([]byte, 2*REGION_SECTOR_SIZE)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, fmt.Errorf("reading the header: %w", err)
+	}
+	sectors := (info.Size() + REGION_SECTOR_SIZE - 1) / REGION_SECTOR_SIZE
+	chunks := 0
+	for i := 0; i < 1024; i++ {
+		loc := binary.BigEndian.Uint32(header[i*4:])
+		offset, count := int64(loc>>8), int64(loc&0xff)
+		if offset == 0 && count == 0 {
+			continue
+		}
+		x, z := i%32, i/32
+		if offset < 2 || count == 0 || offset+count > sectors {
+			return chunks, fmt.Errorf("chunk %d,%d lies at sectors %d-%d, outside the file's %d", x, z, offset, offset+count, sectors)
+		}
+		var chunk [5]byte
+		if _, err := f.ReadAt(chunk[:], offset*REGION_SECTOR_SIZE); err != nil {
+			return chunks, fmt.Errorf("chunk %d,%d: %w", x, z, err)
+		}
+		length := int64(binary.BigEndian.Uint32(chunk[:4]))
+		if length == 0 || length+4 > count*REGION_SECTOR_SIZE {
+			return chunks, fmt.Errorf("chunk %d,%d has length %d, which doesn't fit its %d sectors", x, z, length, count)
+		}
+		//1 gzip, 2 zlib, 3 none, 4 LZ4, 127 custom; 128 is set for chunks kept in a separate .mcc file
+		switch chunk[4] &^ 128 {
+		case 1, 2, 3, 4, 127:
+		default:
+			return chunks, fmt.Errorf("chunk %d,%d has unknown compression type %d", x, z, chunk[4])
+		}
+		chunks++
+	}
+	return chunks, nil
+}
@@ -0,0 +1,26 @@
+package mcbk
+
+import (
+	"path/filepath"
+)
+
+// Whether a minecraft server has the world open, judged by the lock it
+// holds on session.lock. dir may be a world or the server directory
+// containing worlds.
+func worldInUse(dir string) (bool, error) {
+	locks, err := filepath.Glob(filepath.Join(dir, "session.lock"))
+	if err != nil {
+		return false, err
+	}
+	more, err := filepath.Glob(filepath.Join(dir, "*", "session.lock"))
+	if err != nil {
+		return false, err
+	}
+	for _, path := range append(locks, more...) {
+		locked, err := fileLocked(path)
+		if err != nil || locked {
+			return locked, err
+		}
+	}
+	return false, nil
+}
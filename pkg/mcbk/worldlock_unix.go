@@ -0,0 +1,23 @@
+//go:build unix
+
+package mcbk
+
+import (
+	"os"
+	"syscall"
+)
+
+// Whether another process holds a lock on the file, the way a running
+// minecraft server locks its world's session.lock.
+func fileLocked(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lk); err != nil {
+		return false, err
+	}
+	return lk.Type != syscall.F_UNLCK, nil
+}
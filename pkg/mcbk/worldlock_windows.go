@@ -0,0 +1,41 @@
+package mcbk
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	LOCKFILE_FAIL_IMMEDIATELY = 0x1
+	LOCKFILE_EXCLUSIVE_LOCK   = 0x2
+	ERROR_LOCK_VIOLATION      = syscall.Errno(33)
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// Whether another process holds a lock on the file, the way a running
+// minecraft server locks its world's session.lock. Windows can't query a
+// lock, so this briefly takes one on the first byte and releases it again.
+func fileLocked(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), LOCKFILE_EXCLUSIVE_LOCK|LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		if errors.Is(err, ERROR_LOCK_VIOLATION) {
+			return true, nil
+		}
+		return false, err
+	}
+	procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	return false, nil
+}
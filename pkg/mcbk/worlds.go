@@ -0,0 +1,230 @@
+package mcbk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const WORLDS_AUTO = "auto" //Entry in worlds that expands to every world the server has
+
+// bukkit.yml's settings.world-container, which moves every world into a
+// subdirectory of the server directory.
+var worldContainerRegexp = regexp.MustCompile(`^\s+world-container:\s*["']?([^"'#]*?)["']?\s*(#.*)?$`)
+
+func validateWorlds(worlds []string) []error {
+	var errs []error
+	for _, w := range worlds {
+		if w != WORLDS_AUTO && !filepath.IsLocal(filepath.FromSlash(w)) {
+			errs = append(errs, fmt.Errorf("worlds entry %q must be a path inside minecraft_dir, or %q", w, WORLDS_AUTO))
+		}
+	}
+	return errs
+}
+
+func validateIncludes(patterns []string) []error {
+	var errs []error
+	for _, p := range patterns {
+		if p == "" || path.IsAbs(p) || !filepath.IsLocal(filepath.FromSlash(p)) {
+			errs = append(errs, fmt.Errorf("include pattern %q must be relative to minecraft_dir", p))
+		} else if _, err := path.Match(p, ""); err != nil {
+			errs = append(errs, fmt.Errorf("include pattern %q: %w", p, err))
+		}
+	}
+	return errs
+}
+
+// Returns the paths under minecraft_dir that the next backup should hold,
+// relative to it, or nil to back up all of minecraft_dir. Paths matching
+// the extra include patterns are added if they exist.
+func (s *Server) backupPaths(extra ...string) ([]string, error) {
+	if len(s.conf.Worlds) == 0 && len(s.conf.Include) == 0 {
+		return nil, nil
+	}
+	dir := s.conf.MinecraftDir
+	var paths []string
+	for _, w := range s.conf.Worlds {
+		if w == WORLDS_AUTO {
+			found, err := discoverWorlds(dir)
+			if err != nil {
+				return nil, fmt.Errorf("finding worlds: %w", err)
+			}
+			if len(found) == 0 {
+				return nil, fmt.Errorf("no worlds found in %s", dir)
+			}
+			paths = append(paths, found...)
+			continue
+		}
+		if ok, err := exists(filepath.Join(dir, filepath.FromSlash(w))); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("%q from worlds not found in %s", w, dir)
+		}
+		paths = append(paths, filepath.Clean(filepath.FromSlash(w)))
+	}
+	found, err := expandIncludes(dir, s.conf.Include, true)
+	if err != nil {
+		return nil, err
+	}
+	paths = append(paths, found...)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("include matches nothing in %s", dir)
+	}
+	//Whatever a server lacks, e.g. plugins on a vanilla one, is left out
+	found, err = expandIncludes(dir, slices.Concat(s.conf.Databases.include(), extra), false)
+	if err != nil {
+		return nil, err
+	}
+	paths = append(paths, found...)
+	return removeNestedPaths(paths), nil
+}
+
+// Finds the paths under dir matching the include patterns, relative to it.
+// If strict, a plain path that isn't there fails like a missing worlds
+// entry, while a pattern matching nothing is allowed, e.g. for a world that
+// is reset and may be missing for a while.
+func expandIncludes(dir string, patterns []string, strict bool) ([]string, error) {
+	var paths []string
+	for _, p := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil {
+			return nil, err
+		}
+		if strict && len(matches) == 0 && !strings.ContainsAny(p, "*?[\\") {
+			return nil, fmt.Errorf("%q from include not found in %s", p, dir)
+		}
+		for _, m := range matches {
+			rel, err := filepath.Rel(dir, m)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, rel)
+		}
+	}
+	return paths, nil
+}
+
+// Finds the worlds of a server, Bukkit style: the level-name world from
+// server.properties, its separate _nether and _the_end dimensions, and any
+// extra worlds such as Multiverse's, which are found by their level.dat.
+// Worlds are looked for in bukkit.yml's world-container if one is set.
+// Vanilla servers keep their dimensions inside the one world, so only it
+// is found.
+func discoverWorlds(dir string) ([]string, error) {
+	level, err := readProperty(filepath.Join(dir, "server.properties"), "level-name")
+	if err != nil {
+		return nil, err
+	}
+	if level == "" {
+		level = "world"
+	}
+	container, err := worldContainer(filepath.Join(dir, "bukkit.yml"))
+	if err != nil {
+		return nil, err
+	}
+
+	var worlds []string
+	for _, name := range []string{level, level + "_nether", level + "_the_end"} {
+		if info, err := os.Stat(filepath.Join(dir, container, name)); err == nil && info.IsDir() {
+			worlds = append(worlds, filepath.Join(container, name))
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, container))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		world := filepath.Join(container, e.Name())
+		if !e.IsDir() || slices.Contains(worlds, world) {
+			continue
+		}
+		if ok, err := exists(filepath.Join(dir, world, "level.dat")); err != nil {
+			return nil, err
+		} else if ok {
+			worlds = append(worlds, world)
+		}
+	}
+	return worlds, nil
+}
+
+// Reads a key from a .properties file, returning "" if the file or key
+// doesn't exist.
+func readProperty(path, key string) (string, error) {
+	props, err := readProperties(path)
+	return props[key], err
+}
+
+// Reads a server's server.properties, e.g. to find its level-name or RCON
+// settings. A missing file gives an empty map.
+func ReadServerProperties(dir string) (map[string]string, error) {
+	return readProperties(filepath.Join(dir, "server.properties"))
+}
+
+// Parses the key=value lines of a .properties file, skipping comments.
+func readProperties(path string) (map[string]string, error) {
+	props := map[string]string{}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return props, nil
+	} else if err != nil {
+		return props, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			props[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return props, scanner.Err()
+}
+
+// Returns the world container set in bukkit.yml, relative to the server
+// directory, or "." if there is none.
+func worldContainer(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ".", nil
+	} else if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		m := worldContainerRegexp.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil || m[1] == "" {
+			continue
+		}
+		container := filepath.FromSlash(m[1])
+		if !filepath.IsLocal(container) {
+			return "", fmt.Errorf("%s: world-container %q is outside the server directory", path, m[1])
+		}
+		return container, nil
+	}
+	return ".", nil
+}
+
+// Sorts paths and drops duplicates and any path inside another one, so
+// nothing is backed up twice.
+func removeNestedPaths(paths []string) []string {
+	slices.Sort(paths)
+	var kept []string
+	for _, p := range paths {
+		if len(kept) > 0 {
+			last := kept[len(kept)-1]
+			if p == last || strings.HasPrefix(p, last+string(filepath.Separator)) {
+				continue
+			}
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
@@ -0,0 +1,184 @@
+package mcbk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Settings for the mark2 transport, for servers run by the mark2 wrapper.
+type Mark2Config struct {
+	Name string `json:"name"` //Server name given to mark2 start, as passed to mark2 send -n. mark2 picks its only server when empty
+}
+
+// Sends commands with mark2 send, which doesn't return their output, so
+// they are confirmed through the server log.
+type mark2Transport struct {
+	conf Mark2Config
+}
+
+func (t *mark2Transport) Send(ctx context.Context, command string) error {
+	args := []string{"send"}
+	if t.conf.Name != "" {
+		args = append(args, "-n", t.conf.Name)
+	}
+	_, err := runCommand(ctx, "mark2", append(args, command)...)
+	return err
+}
+
+func (t *mark2Transport) Close() error {
+	return nil
+}
+
+// Settings for the msm transport, for servers run by Minecraft Server
+// Manager.
+type MSMConfig struct {
+	Server string `json:"server"` //Name of the server in msm, as in "msm <server> start"
+}
+
+// Sends commands with msm <server> cmd, which like the screen session msm
+// runs the server in gives no output back, so they are confirmed through
+// the server log.
+type msmTransport struct {
+	conf MSMConfig
+}
+
+func (t *msmTransport) Send(ctx context.Context, command string) error {
+	_, err := runCommand(ctx, "msm", t.conf.Server, "cmd", command)
+	return err
+}
+
+func (t *msmTransport) Close() error {
+	return nil
+}
+
+// Settings for the amp transport, which sends commands through the API of a
+// CubeCoders AMP instance.
+type AMPConfig struct {
+	URL      string `json:"url"`                    //Address of AMP, e.g. "http://localhost:8080"
+	Instance string `json:"instance"`               //ID or name of the instance when url is the ADS controller, empty when it is the instance itself
+	Username string `json:"username"`               //AMP user with permission to use the instance's console
+	Password string `json:"password" secret:"true"` //That user's password
+}
+
+func (c AMPConfig) validate() error {
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("amp.url must be AMP's http(s) address, got %q", c.URL)
+	}
+	if c.Username == "" || c.Password == "" {
+		return errors.New("amp needs username and password")
+	}
+	return nil
+}
+
+// The address of an API method of the instance, through the ADS controller
+// if an instance is set.
+func (c AMPConfig) endpoint(method string) string {
+	base := strings.TrimSuffix(c.URL, "/")
+	if c.Instance != "" {
+		base += "/API/ADSModule/Servers/" + url.PathEscape(c.Instance)
+	}
+	return base + "/API/" + method
+}
+
+// Sends console commands through AMP's API. AMP answers without the
+// command's output, so commands are confirmed through the server log,
+// which lives in the instance's directory under ~/.ampdata/instances. The
+// session is kept for the run and renewed if AMP drops it.
+type ampTransport struct {
+	conf AMPConfig
+
+	mu        sync.Mutex
+	sessionID string
+}
+
+// What AMP returns instead of a method's result when a call fails, with
+// a 200 status.
+type ampError struct {
+	Title   string `json:"Title"`
+	Message string `json:"Message"`
+}
+
+func (t *ampTransport) Send(ctx context.Context, command string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if t.sessionID == "" {
+			if err := t.login(ctx); err != nil {
+				return err
+			}
+		}
+		var ampErr ampError
+		err := t.call(ctx, "Core/SendConsoleMessage", map[string]string{"message": command, "SESSIONID": t.sessionID}, &ampErr)
+		if err == nil && ampErr.Title != "" {
+			err = fmt.Errorf("amp: %s: %s", ampErr.Title, ampErr.Message)
+			if strings.Contains(ampErr.Title, "Unauthorized") && attempt == 0 {
+				//The session expired, log in again
+				t.sessionID = ""
+				continue
+			}
+		}
+		return err
+	}
+}
+
+func (t *ampTransport) login(ctx context.Context) error {
+	var resp struct {
+		Success       bool   `json:"success"`
+		SessionID     string `json:"sessionID"`
+		ResultReason  string `json:"resultReason"`
+		ResultMessage string `json:"resultMessage"`
+	}
+	err := t.call(ctx, "Core/Login", map[string]any{"username": t.conf.Username, "password": t.conf.Password, "token": "", "rememberMe": false}, &resp)
+	if err != nil {
+		return fmt.Errorf("amp login: %w", err)
+	}
+	if !resp.Success || resp.SessionID == "" {
+		return fmt.Errorf("amp login failed: %s", strings.TrimSpace(resp.ResultReason+" "+resp.ResultMessage))
+	}
+	t.sessionID = resp.SessionID
+	return nil
+}
+
+// Calls an API method with the given parameters, decoding its result, if
+// any, into out.
+func (t *ampTransport) call(ctx context.Context, method string, params, out any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.conf.endpoint(method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("amp returned %s: %.512s", resp.Status, data)
+	}
+	//Methods without a result answer with nothing, or null
+	if len(bytes.TrimSpace(data)) == 0 || !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (t *ampTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,55 @@
+package mcbk
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const ZFS_SNAPSHOT_TIME_FORMAT = "20060102-150405" //Suffix of the ZFS, btrfs and LVM snapshots mcbk takes, in UTC
+
+// Settings for staging backups through a ZFS snapshot.
+type ZFSConfig struct {
+	Dataset string `json:"dataset"` //Dataset holding minecraft_dir, e.g. "tank/minecraft". Empty disables ZFS staging
+}
+
+func (c ZFSConfig) Enabled() bool {
+	return c.Dataset != ""
+}
+
+// Snapshots the server's dataset, which is instant, so world saving can be
+// turned back on while the backup is copied from the snapshot. Returns
+// where minecraft_dir appears in the snapshot, and a function that destroys
+// it again.
+func (s *Server) zfsSnapshot(ctx context.Context) (string, func(), error) {
+	dataset := s.conf.ZFS.Dataset
+	out, err := runCommand(ctx, "zfs", "get", "-H", "-o", "value", "mountpoint", dataset)
+	if err != nil {
+		return "", nil, err
+	}
+	mount := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(mount) {
+		//"legacy" or "none"
+		return "", nil, fmt.Errorf("dataset %s has no mountpoint of its own (%s)", dataset, mount)
+	}
+	rel, err := s.dirWithin(mount, "dataset "+dataset)
+	if err != nil {
+		return "", nil, err
+	}
+
+	snapshot := s.stagingSnapshotName()
+	if _, err := runCommand(ctx, "zfs", "snapshot", dataset+"@"+snapshot); err != nil {
+		return "", nil, err
+	}
+	s.log().Debug("Took ZFS snapshot", "phase", "snapshot", "snapshot", dataset+"@"+snapshot)
+	release := func() {
+		//Also after a cancelled backup, or snapshots would pile up
+		_, err := runCommand(context.WithoutCancel(ctx), "zfs", "destroy", dataset+"@"+snapshot)
+		if err != nil {
+			s.log().Error("Error destroying ZFS snapshot", "phase", "snapshot", "snapshot", dataset+"@"+snapshot, "error", err)
+		}
+	}
+	//Every snapshot is reachable here, even with snapdir=hidden
+	return filepath.Join(mount, ".zfs", "snapshot", snapshot, rel), release, nil
+}